@@ -5,76 +5,165 @@
 package main
 
 import (
-	"encoding/json"
-	"github.com/nats-io/nats.go"
-	log "github.com/sirupsen/logrus"
-	"github.com/theotw/natssync/pkg"
-	"github.com/theotw/natssync/pkg/bridgemodel"
-	"github.com/theotw/natssync/pkg/natsmodel"
+	"flag"
+	"fmt"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/authserver"
+	"github.com/theotw/natssync/pkg/natsmodel"
 )
 
-// the main for an example of a simple auth server.  Authorizes a request if the user ID and secret matches what is set in the env
+// the reference auth server.  Answers the natssync.auth requests from a file of tokens, each with its own scopes,
+// expiry, single use and allowed registration metadata.
+//
+// usage:
+//
+//	simple_auth [serve]                  answer auth requests
+//	simple_auth mint -scopes register,natspost [-ttl 24h] [-single-use] [-metadata region=east,region=west] [-description text]
+//	simple_auth revoke <token ID>
+//	simple_auth list
+//
 // env vars to set are:
-// USER_ID= the valid user ID defaults to natssync
-// SECRET = the valid user secret. defaults to changeit
+// AUTH_TOKEN_FILE = the token file, defaults to tokens.json
+// AUTH_TOKEN = a token with every scope, like the old single token server.  Defaults to 42 when AUTH_TOKEN_FILE is not set
+// AUTH_AUDIT_FILE = a file for the JSON audit log, defaults to the server log
 func main() {
+	tokenFile := pkg.GetEnvWithDefaults("AUTH_TOKEN_FILE", "tokens.json")
+	store, err := authserver.NewTokenStore(tokenFile)
+	if err != nil {
+		log.Fatalf("Unable to open the token file %s: %s", tokenFile, err.Error())
+	}
+
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		serve(store)
+	case "mint":
+		mint(store, args)
+	case "revoke":
+		if len(args) != 1 {
+			log.Fatal("usage: revoke <token ID>")
+		}
+		if err = store.Revoke(args[0]); err != nil {
+			log.Fatalf("Unable to revoke token %s: %s", args[0], err.Error())
+		}
+		fmt.Printf("Revoked token %s\n", args[0])
+	case "list":
+		list(store)
+	default:
+		log.Fatalf("Unknown command %s, expected serve, mint, revoke or list", command)
+	}
+}
+
+func serve(store *authserver.TokenStore) {
 	log.Infof("Version %s", pkg.VERSION)
+	legacyToken := os.Getenv("AUTH_TOKEN")
+	if len(legacyToken) == 0 && len(os.Getenv("AUTH_TOKEN_FILE")) == 0 {
+		legacyToken = "42"
+	}
+	if len(legacyToken) > 0 {
+		log.Warn("AUTH_TOKEN is set, it has every scope and never expires")
+	}
+
+	audit := log.New()
+	audit.SetFormatter(&log.JSONFormatter{})
+	if auditFile := os.Getenv("AUTH_AUDIT_FILE"); len(auditFile) > 0 {
+		f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Unable to open the audit file %s: %s", auditFile, err.Error())
+		}
+		audit.SetOutput(f)
+	} else {
+		audit.SetOutput(os.Stdout)
+	}
+
 	natsURL := pkg.Config.NatsServerUrl
 	log.Infof("Connecting to NATS server %s", natsURL)
-
 	err := natsmodel.InitNats(natsURL, "simple auth server", 5*time.Minute)
 	if err != nil {
 		log.Errorf("Unable to connect to NATS, exiting %s", err.Error())
 		os.Exit(2)
-
 	}
-	nc := natsmodel.GetNatsConnection()
+	server := authserver.NewServer(store, legacyToken, audit)
+	if _, err = server.Subscribe(natsmodel.GetNatsConnection()); err != nil {
+		log.Errorf("Unable to subscribe to auth requests, exiting %s", err.Error())
+		os.Exit(2)
+	}
+	runtime.Goexit()
+}
 
-	expectedAuthToken := pkg.GetEnvWithDefaults("AUTH_TOKEN", "42")
-	subj := bridgemodel.REGISTRATION_AUTH_WILDCARD
-	nc.Subscribe(subj, func(msg *nats.Msg) {
-		log.Infof("Got message %s : %s", msg.Subject, msg.Reply)
-		var respBits []byte
-		if msg.Subject == bridgemodel.REGISTRATION_AUTH_SUBJECT {
-			var regReq bridgemodel.RegistrationRequest
-			var regResp bridgemodel.RegistrationResponse
-			err := json.Unmarshal(msg.Data, &regReq)
-			if err == nil {
-				regResp.Success = expectedAuthToken == regReq.AuthToken
-			} else {
-				regResp.Success = false
-			}
-			respBits, _ = json.Marshal(&regResp)
-			log.Infof("Reg Request %s from %s success=%t", regReq.AuthToken, regReq.LocationID, regResp.Success)
-		} else if msg.Subject == bridgemodel.UNREGISTRATION_AUTH_SUBJECT {
-			var unregReq bridgemodel.UnRegistrationRequest
-			var unregResp bridgemodel.UnRegistrationResponse
-			err := json.Unmarshal(msg.Data, &unregReq)
-			if err == nil {
-				unregResp.Success = expectedAuthToken == unregReq.AuthToken
-			} else {
-				unregResp.Success = false
-			}
-			respBits, _ = json.Marshal(&unregResp)
-			log.Infof("UnReg Request %s from %s success=%t", unregReq.AuthToken, unregReq.LocationID, unregResp.Success)
-		} else {
-			var regReq bridgemodel.GenericAuthRequest
-			var regResp bridgemodel.GenericAuthResponse
-			err := json.Unmarshal(msg.Data, &regReq)
-			if err == nil {
-				regResp.Success = expectedAuthToken == regReq.AuthToken
-			} else {
-				regResp.Success = false
+func mint(store *authserver.TokenStore, args []string) {
+	flags := flag.NewFlagSet("mint", flag.ExitOnError)
+	scopes := flags.String("scopes", "", "comma separated scopes: register, unregister, queryreg, natspost, admin or admin.<action>")
+	ttl := flags.Duration("ttl", 0, "how long the token is good for, forever if 0")
+	singleUse := flags.Bool("single-use", false, "the token is used up by the first request it is allowed")
+	metadata := flags.String("metadata", "", "comma separated key=value registration metadata the token is bound to, repeat a key to allow several values")
+	description := flags.String("description", "", "what the token is for")
+	flags.Parse(args)
+
+	opts := &authserver.MintOptions{
+		Description: *description,
+		TTL:         *ttl,
+		SingleUse:   *singleUse,
+	}
+	if len(*scopes) > 0 {
+		opts.Scopes = strings.Split(*scopes, ",")
+	}
+	if len(*metadata) > 0 {
+		opts.Metadata = make(map[string][]string)
+		for _, pair := range strings.Split(*metadata, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || len(kv[0]) == 0 {
+				log.Fatalf("Invalid metadata %s, expected key=value", pair)
 			}
-			respBits, _ = json.Marshal(&regResp)
-			log.Infof("Generic AuthRequest %s success=%t", regReq.AuthToken, regResp.Success)
+			opts.Metadata[kv[0]] = append(opts.Metadata[kv[0]], kv[1])
+		}
+	}
+	secret, token, err := store.Mint(opts)
+	if err != nil {
+		log.Fatalf("Unable to mint token: %s", err.Error())
+	}
+	fmt.Printf("Token ID: %s\n", token.ID)
+	fmt.Printf("Token:    %s\n", secret)
+	fmt.Println("The token is not stored and can not be shown again")
+}
 
+func list(store *authserver.TokenStore) {
+	tokens, err := store.List()
+	if err != nil {
+		log.Fatalf("Unable to list tokens: %s", err.Error())
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSCOPES\tCREATED\tEXPIRES\tSINGLE USE\tUSED\tMETADATA\tDESCRIPTION")
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
 		}
-		nc.Publish(msg.Reply, respBits)
-		nc.Flush()
-	})
-	runtime.Goexit()
+		return t.Format(time.RFC3339)
+	}
+	for _, token := range tokens {
+		var metadata []string
+		for key, values := range token.Metadata {
+			for _, val := range values {
+				metadata = append(metadata, key+"="+val)
+			}
+		}
+		sort.Strings(metadata)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n", token.ID, strings.Join(token.Scopes, ","),
+			formatTime(&token.Created), formatTime(token.Expires), token.SingleUse, formatTime(token.Used),
+			strings.Join(metadata, ","), token.Description)
+	}
+	w.Flush()
 }
@@ -5,9 +5,12 @@ go 1.14
 require (
 	github.com/gin-contrib/static v0.0.0-20191128031702-f81c604d8ac2
 	github.com/gin-gonic/gin v1.9.0
-	github.com/google/uuid v1.1.2
+	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.4.2
-	github.com/nats-io/nats-server/v2 v2.9.16 // indirect
+	github.com/klauspost/compress v1.16.4
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16 // indirect
+	github.com/nats-io/nats-server/v2 v2.9.16
 	github.com/nats-io/nats.go v1.24.0
 	github.com/nats-io/nkeys v0.4.4
 	github.com/prometheus/client_golang v1.11.1
@@ -15,9 +18,12 @@ require (
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.8.1
 	go.mongodb.org/mongo-driver v1.5.1
+	golang.org/x/crypto v0.8.0
 	google.golang.org/grpc v1.36.1
 	google.golang.org/protobuf v1.28.1
 	gopkg.in/yaml.v3 v3.0.1
+	k8s.io/api v0.23.0
 	k8s.io/apimachinery v0.23.0
 	k8s.io/client-go v0.23.0
+	modernc.org/sqlite v1.20.4
 )
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+)
+
+// scopes a request can need
+const (
+	SCOPE_REGISTER   = "register"
+	SCOPE_UNREGISTER = "unregister"
+	SCOPE_QUERYREG   = "queryreg"
+	SCOPE_NATSPOST   = "natspost"
+	SCOPE_ADMIN      = "admin"
+)
+
+// what an admin request does
+const (
+	ADMIN_ACTION_READ    = "read"
+	ADMIN_ACTION_UPDATE  = "update"
+	ADMIN_ACTION_ROTATE  = "rotate"
+	ADMIN_ACTION_SUSPEND = "suspend"
+	ADMIN_ACTION_DELETE  = "delete"
+)
+
+// AUTH_MODE values
+const (
+	AUTH_MODE_NATS   = "nats"
+	AUTH_MODE_JWT    = "jwt"
+	AUTH_MODE_STATIC = "static"
+)
+
+const defaultAuthCacheTTL = 30 * time.Second
+
+// Request what a token is being used for
+type Request struct {
+	Scope string
+	// Action for SCOPE_ADMIN, one of the ADMIN_ACTION values
+	Action string
+	Token  string
+	// LocationID the location the request is about, if there is one
+	LocationID string
+	// Metadata the metadata a location is registering with
+	Metadata map[string]string
+}
+
+// Authorizer decides if a token may be used for a request.  An error means no decision could be made
+type Authorizer interface {
+	Authorize(req *Request) (bool, error)
+}
+
+// NewAuthorizer the Authorizer picked by AUTH_MODE, with its decisions cached for AUTH_CACHE_TTL
+func NewAuthorizer() (Authorizer, error) {
+	var ret Authorizer
+	var err error
+	switch pkg.Config.AuthMode {
+	case "", AUTH_MODE_NATS:
+		ret = NewNatsAuthorizer()
+	case AUTH_MODE_JWT:
+		ret, err = NewJWTAuthorizer(&JWTOptions{
+			Jwks:          pkg.Config.AuthJwks,
+			Issuer:        pkg.Config.AuthJwtIssuer,
+			Audience:      pkg.Config.AuthJwtAudience,
+			ScopeClaim:    pkg.Config.AuthJwtScopeClaim,
+			ScopePrefix:   pkg.Config.AuthJwtScopePrefix,
+			LocationClaim: pkg.Config.AuthJwtLocationClaim,
+		})
+	case AUTH_MODE_STATIC:
+		log.Warn("AUTH_MODE is static, the static token file is meant for development only")
+		ret, err = NewStaticAuthorizer(pkg.Config.AuthStaticTokenFile)
+	default:
+		err = fmt.Errorf("unsupported AUTH_MODE %s", pkg.Config.AuthMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := defaultAuthCacheTTL
+	if len(pkg.Config.AuthCacheTTL) > 0 {
+		if ttl, err = time.ParseDuration(pkg.Config.AuthCacheTTL); err != nil {
+			log.WithError(err).Errorf("failed to parse auth cache ttl, using %v", defaultAuthCacheTTL)
+			ttl = defaultAuthCacheTTL
+		}
+	}
+	if ttl <= 0 {
+		return ret, nil
+	}
+	log.Infof("using %s authorizer, caching decisions for %v", pkg.Config.AuthMode, ttl)
+	return NewCachingAuthorizer(ret, ttl), nil
+}
+
+// HasScope true if the granted scopes cover the request, admin covers every admin action and admin.<action> just
+// that one
+func HasScope(granted []string, req *Request) bool {
+	for _, scope := range granted {
+		if scope == req.Scope {
+			return true
+		}
+		if req.Scope == SCOPE_ADMIN && len(req.Action) > 0 && scope == SCOPE_ADMIN+"."+req.Action {
+			return true
+		}
+	}
+	return false
+}
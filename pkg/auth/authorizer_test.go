@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/bridgemodel"
+)
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, HasScope([]string{"register"}, &Request{Scope: SCOPE_REGISTER}))
+	assert.False(t, HasScope([]string{"unregister"}, &Request{Scope: SCOPE_REGISTER}))
+	assert.True(t, HasScope([]string{"admin"}, &Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_DELETE}))
+	assert.True(t, HasScope([]string{"admin.read"}, &Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ}))
+	assert.False(t, HasScope([]string{"admin.read"}, &Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_UPDATE}))
+	assert.False(t, HasScope([]string{"admin.read"}, &Request{Scope: SCOPE_REGISTER, Action: ADMIN_ACTION_READ}))
+	assert.False(t, HasScope(nil, &Request{Scope: SCOPE_REGISTER}))
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+tokens:
+  - token: dev
+    scopes: [register, unregister, queryreg, natspost, admin]
+  - token: reader
+    scopes: [admin.read]
+    locationIDs: [loc1]
+`), 0600))
+	authorizer, err := NewStaticAuthorizer(path)
+	assert.Nil(t, err)
+
+	check := func(req *Request) bool {
+		ok, err := authorizer.Authorize(req)
+		assert.Nil(t, err)
+		return ok
+	}
+	assert.True(t, check(&Request{Scope: SCOPE_NATSPOST, Token: "dev"}))
+	assert.True(t, check(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_DELETE, Token: "dev", LocationID: "loc2"}))
+	assert.True(t, check(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: "reader", LocationID: "loc1"}))
+	assert.False(t, check(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: "reader", LocationID: "loc2"}))
+	assert.False(t, check(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_UPDATE, Token: "reader", LocationID: "loc1"}))
+	assert.False(t, check(&Request{Scope: SCOPE_REGISTER, Token: "unknown"}))
+	assert.False(t, check(&Request{Scope: SCOPE_REGISTER, Token: ""}))
+
+	_, err = NewStaticAuthorizer("")
+	assert.Error(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("tokens:\n  - scopes: [register]\n"), 0600))
+	_, err = NewStaticAuthorizer(path)
+	assert.Error(t, err)
+}
+
+type countingAuthorizer struct {
+	calls int
+	err   error
+}
+
+func (a *countingAuthorizer) Authorize(req *Request) (bool, error) {
+	a.calls++
+	return req.Token == "good", a.err
+}
+
+func TestCachingAuthorizer(t *testing.T) {
+	inner := new(countingAuthorizer)
+	authorizer := NewCachingAuthorizer(inner, time.Minute).(*cachingAuthorizer)
+	now := time.Now()
+	authorizer.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: "good"})
+		assert.True(t, ok)
+		ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: "bad"})
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 2, inner.calls)
+
+	// a different scope or location is a different decision
+	authorizer.Authorize(&Request{Scope: SCOPE_QUERYREG, Token: "good"})
+	authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: "good", LocationID: "loc1"})
+	assert.Equal(t, 4, inner.calls)
+
+	now = now.Add(2 * time.Minute)
+	authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: "good"})
+	assert.Equal(t, 5, inner.calls)
+
+	// errors are not cached
+	inner.err = errors.New("auth server is down")
+	_, err := authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: "good"})
+	assert.Error(t, err)
+	inner.err = nil
+	ok, err := authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: "good"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 7, inner.calls)
+
+	// registration tokens may be single use, so registrations always go to the inner authorizer
+	authorizer.Authorize(&Request{Scope: SCOPE_REGISTER, Token: "good"})
+	authorizer.Authorize(&Request{Scope: SCOPE_REGISTER, Token: "good"})
+	assert.Equal(t, 9, inner.calls)
+}
+
+func TestCachingAuthorizerSingleUse(t *testing.T) {
+	used := false
+	inner := &natsAuthorizer{
+		request: func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+			resp, _ := json.Marshal(&bridgemodel.GenericAuthResponse{Success: !used, NoCache: true})
+			used = true
+			return &nats.Msg{Data: resp}, nil
+		},
+	}
+	authorizer := NewCachingAuthorizer(inner, time.Minute)
+
+	// the auth server said the decision is only good once, the second use has to be refused by the auth server
+	ok, err := authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: "once"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: "once"})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestNatsAuthorizer(t *testing.T) {
+	var subjects []string
+	authorizer := &natsAuthorizer{
+		request: func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+			subjects = append(subjects, subject)
+			var req bridgemodel.AdminAuthRequest
+			json.Unmarshal(data, &req)
+			resp, _ := json.Marshal(&bridgemodel.GenericAuthResponse{Success: req.AuthToken == "42"})
+			return &nats.Msg{Data: resp}, nil
+		},
+	}
+	ok, err := authorizer.Authorize(&Request{Scope: SCOPE_REGISTER, Token: "42"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_SUSPEND, Token: "41"})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []string{bridgemodel.REGISTRATION_AUTH_SUBJECT, bridgemodel.ADMIN_LOCATION_SUSPEND_AUTH_SUBJECT}, subjects)
+
+	_, err = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: "explode", Token: "42"})
+	assert.Error(t, err)
+}
+
+func TestNewRequestFromSubject(t *testing.T) {
+	for _, req := range []*Request{
+		{Scope: SCOPE_REGISTER, Token: "42", LocationID: "loc1", Metadata: map[string]string{"region": "east"}},
+		{Scope: SCOPE_UNREGISTER, Token: "42", LocationID: "loc1"},
+		{Scope: SCOPE_QUERYREG, Token: "42"},
+		{Scope: SCOPE_NATSPOST, Token: "42"},
+		{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_ROTATE, Token: "42", LocationID: "loc1"},
+	} {
+		subject, authReq, err := authSubject(req)
+		assert.Nil(t, err)
+		bits, _ := json.Marshal(authReq)
+		req2, err := NewRequestFromSubject(subject, bits)
+		assert.Nil(t, err)
+		assert.Equal(t, req, req2, subject)
+	}
+	_, err := NewRequestFromSubject("natssync.auth.unknown", []byte("{}"))
+	assert.Error(t, err)
+	_, err = NewRequestFromSubject(bridgemodel.NATSPOST_AUTH_SUBJECT, []byte("not json"))
+	assert.Error(t, err)
+}
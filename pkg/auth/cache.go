@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// maxCachedDecisions bounds the cache, expired decisions are swept out when it fills
+const maxCachedDecisions = 10000
+
+type cachedDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// cacheableAuthorizer an Authorizer that can say a decision must not be reused
+type cacheableAuthorizer interface {
+	authorizeCacheable(req *Request) (allowed bool, cacheable bool, err error)
+}
+
+// cachingAuthorizer remembers the decisions of another Authorizer for a short time, so a busy location is not sent
+// to the auth server or JWT verifier on every request.  Errors are not cached, and neither are registrations, they
+// are rare.  Nor are decisions the inner Authorizer marks as not cacheable, a single use token is used up by its
+// first request whatever the scope, so a cached decision would let it be used again.  A token that is revoked, or signed by a key the JWKS dropped,
+// keeps working until its decision expires, up to AUTH_CACHE_TTL later.  Set AUTH_CACHE_TTL to 0 where revocation
+// has to take effect at once
+type cachingAuthorizer struct {
+	inner Authorizer
+	ttl   time.Duration
+	now   func() time.Time
+
+	lock      sync.Mutex
+	decisions map[[sha256.Size]byte]cachedDecision
+}
+
+func NewCachingAuthorizer(inner Authorizer, ttl time.Duration) Authorizer {
+	return &cachingAuthorizer{
+		inner:     inner,
+		ttl:       ttl,
+		now:       time.Now,
+		decisions: make(map[[sha256.Size]byte]cachedDecision),
+	}
+}
+
+// cacheKey a hash of the request, so tokens are not kept in memory any longer than needed
+func cacheKey(req *Request) [sha256.Size]byte {
+	return sha256.Sum256([]byte(req.Scope + "\x00" + req.Action + "\x00" + req.LocationID + "\x00" + req.Token))
+}
+
+func (a *cachingAuthorizer) Authorize(req *Request) (bool, error) {
+	if req.Scope == SCOPE_REGISTER || req.Scope == SCOPE_UNREGISTER {
+		return a.inner.Authorize(req)
+	}
+	key := cacheKey(req)
+	now := a.now()
+	a.lock.Lock()
+	decision, ok := a.decisions[key]
+	a.lock.Unlock()
+	if ok && now.Before(decision.expires) {
+		return decision.allowed, nil
+	}
+
+	allowed, cacheable, err := a.authorizeInner(req)
+	if err != nil {
+		return false, err
+	}
+	if !cacheable {
+		return allowed, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.decisions) >= maxCachedDecisions {
+		for k, v := range a.decisions {
+			if !now.Before(v.expires) {
+				delete(a.decisions, k)
+			}
+		}
+		if len(a.decisions) >= maxCachedDecisions {
+			a.decisions = make(map[[sha256.Size]byte]cachedDecision)
+		}
+	}
+	a.decisions[key] = cachedDecision{allowed: allowed, expires: now.Add(a.ttl)}
+	return allowed, nil
+}
+
+func (a *cachingAuthorizer) authorizeInner(req *Request) (bool, bool, error) {
+	if inner, ok := a.inner.(cacheableAuthorizer); ok {
+		return inner.authorizeCacheable(req)
+	}
+	allowed, err := a.inner.Authorize(req)
+	return allowed, true, err
+}
@@ -3,3 +3,430 @@
  */
 
 package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwtLeeway allowed clock difference when checking exp and nbf
+	jwtLeeway = time.Minute
+	// jwksRefresh how often keys from a URL are fetched again
+	jwksRefresh = time.Hour
+	// jwksMinRefresh an unknown kid fetches the keys again, but not more often than this
+	jwksMinRefresh   = time.Minute
+	jwksFetchTimeout = 10 * time.Second
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// JWTOptions how tokens are checked
+type JWTOptions struct {
+	// Jwks a JWKS file path or an http(s) URL
+	Jwks string
+	// Issuer required iss, not checked if empty
+	Issuer string
+	// Audience required in aud, not checked if empty
+	Audience string
+	// ScopeClaim the claim with the scopes, a space separated string or an array.  scp is also read
+	ScopeClaim string
+	// ScopePrefix only scopes with this prefix count, with the prefix removed
+	ScopePrefix string
+	// LocationClaim the claim with the location IDs a token is bound to, a string or an array.  A token with the claim
+	// is only good for requests about one of its locations, not checked if empty
+	LocationClaim string
+}
+
+// jwtAuthorizer verifies signed JWTs, from an OIDC provider for example, and grants the scopes in them
+type jwtAuthorizer struct {
+	options *JWTOptions
+	keys    *jwks
+	now     func() time.Time
+}
+
+func NewJWTAuthorizer(options *JWTOptions) (Authorizer, error) {
+	if len(options.Jwks) == 0 {
+		return nil, errors.New("AUTH_JWKS is required for jwt auth")
+	}
+	keys := &jwks{source: options.Jwks, now: time.Now}
+	if err := keys.load(); err != nil {
+		return nil, err
+	}
+	return &jwtAuthorizer{options: options, keys: keys, now: time.Now}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *jwtAuthorizer) Authorize(req *Request) (bool, error) {
+	claims, err := a.verify(req.Token)
+	if err != nil {
+		// a bad token is a decision, not a failure to make one
+		log.WithError(err).Debug("Rejected JWT")
+		return false, nil
+	}
+	if !a.allowsLocation(claims, req) {
+		log.WithField("locationID", req.LocationID).Debug("Rejected JWT bound to other locations")
+		return false, nil
+	}
+	return HasScope(a.scopes(claims), req), nil
+}
+
+// allowsLocation true unless the token is bound to locations and the request is not about one of them
+func (a *jwtAuthorizer) allowsLocation(claims map[string]interface{}, req *Request) bool {
+	if len(a.options.LocationClaim) == 0 {
+		return true
+	}
+	claim, ok := claims[a.options.LocationClaim]
+	if !ok {
+		return true
+	}
+	return len(req.LocationID) > 0 && hasString(claim, req.LocationID)
+}
+
+// verify checks the signature, time and issuer claims and returns the claims
+func (a *jwtAuthorizer) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key, err := a.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err = key.verify(header.Alg, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token is expired or has no exp")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if len(a.options.Issuer) > 0 && claims["iss"] != a.options.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if len(a.options.Audience) > 0 && !hasString(claims["aud"], a.options.Audience) {
+		return nil, fmt.Errorf("token is not for audience %s", a.options.Audience)
+	}
+	return claims, nil
+}
+
+// scopes the granted scopes in the claims
+func (a *jwtAuthorizer) scopes(claims map[string]interface{}) []string {
+	var ret []string
+	for _, claim := range []string{a.options.ScopeClaim, "scp"} {
+		for _, scope := range stringList(claims[claim]) {
+			if strings.HasPrefix(scope, a.options.ScopePrefix) {
+				ret = append(ret, strings.TrimPrefix(scope, a.options.ScopePrefix))
+			}
+		}
+	}
+	return ret
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bits, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err = json.Unmarshal(bits, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// stringList a claim that is a space separated string or an array of strings
+func stringList(claim interface{}) []string {
+	switch val := claim.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		ret := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+func hasString(claim interface{}, want string) bool {
+	if s, ok := claim.(string); ok {
+		return s == want
+	}
+	for _, s := range stringList(claim) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// jwk a verification key from a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	publicKey crypto.PublicKey
+}
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return err
+		}
+		k.publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return errors.New("EC key is not on its curve")
+		}
+		k.publicKey = pub
+	default:
+		return fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	return nil
+}
+
+// verify checks the signature with the key.  Only asymmetric algorithms are accepted, so none and HMAC tokens are
+// always rejected
+func (k *jwk) verify(alg string, signed []byte, sig []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	if len(k.Alg) > 0 && k.Alg != alg {
+		return fmt.Errorf("key %s is for %s not %s", k.Kid, k.Alg, alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch pub := k.publicKey.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if alg[0] != 'R' {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// jwks the verification keys, loaded from a file or fetched from a URL and refreshed
+type jwks struct {
+	source string
+	now    func() time.Time
+
+	lock    sync.Mutex
+	keys    map[string]*jwk
+	fetched time.Time
+	// attempted when the keys were last loaded, whether that worked or not, a failing URL is not fetched on every token
+	attempted time.Time
+	// refreshing closed when the fetch in flight is done, nil when there is none
+	refreshing chan struct{}
+}
+
+func (s *jwks) isURL() bool {
+	return strings.HasPrefix(s.source, "https://") || strings.HasPrefix(s.source, "http://")
+}
+
+func (s *jwks) load() error {
+	s.lock.Lock()
+	s.attempted = s.now()
+	s.lock.Unlock()
+
+	var bits []byte
+	var err error
+	if s.isURL() {
+		bits, err = fetchJwks(s.source)
+	} else {
+		bits, err = ioutil.ReadFile(s.source)
+	}
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(bits, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]*jwk)
+	for _, key := range set.Keys {
+		if len(key.Use) > 0 && key.Use != "sig" {
+			continue
+		}
+		if err = key.parse(); err != nil {
+			log.WithError(err).WithField("kid", key.Kid).Warn("Skipping JWKS key")
+			continue
+		}
+		keys[key.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no usable keys in %s", s.source)
+	}
+	s.lock.Lock()
+	s.keys = keys
+	s.fetched = s.now()
+	s.lock.Unlock()
+	return nil
+}
+
+func fetchJwks(url string) ([]byte, error) {
+	client := &http.Client{Timeout: jwksFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned status code %d", url, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// key the key with the kid, a token without a kid can use the only key.  Keys from a URL are fetched again when they
+// are old or the kid is unknown, a provider may have rotated its keys
+func (s *jwks) key(kid string) (*jwk, error) {
+	s.lock.Lock()
+	key := s.find(kid)
+	s.lock.Unlock()
+
+	if s.isURL() {
+		s.refresh(key == nil)
+		s.lock.Lock()
+		key = s.find(kid)
+		s.lock.Unlock()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key ID %s", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the keys again if they are older than jwksRefresh, or jwksMinRefresh when a kid was unknown.  No
+// attempt is made within jwksMinRefresh of the last one, and callers that come in while a fetch is in flight wait for
+// it rather than starting their own
+func (s *jwks) refresh(unknownKid bool) {
+	s.lock.Lock()
+	if wait := s.refreshing; wait != nil {
+		s.lock.Unlock()
+		<-wait
+		return
+	}
+	now := s.now()
+	due := now.Sub(s.fetched) > jwksRefresh || (unknownKid && now.Sub(s.fetched) > jwksMinRefresh)
+	if !due || now.Sub(s.attempted) <= jwksMinRefresh {
+		s.lock.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	s.refreshing = done
+	s.lock.Unlock()
+
+	if err := s.load(); err != nil {
+		log.WithError(err).WithField("jwks", s.source).Error("Unable to refresh JWKS, using the keys already loaded")
+	}
+	s.lock.Lock()
+	s.refreshing = nil
+	s.lock.Unlock()
+	close(done)
+}
+
+func (s *jwks) find(kid string) *jwk {
+	if len(kid) == 0 && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key
+		}
+	}
+	return s.keys[kid]
+}
@@ -3,3 +3,297 @@
  */
 
 package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testKeys struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	return &testKeys{rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func b64(bits []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bits)
+}
+
+func (k *testKeys) jwks() []byte {
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(k.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(k.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(k.ecKey.X.Bytes()), "y": b64(k.ecKey.Y.Bytes())},
+	}}
+	bits, _ := json.Marshal(set)
+	return bits
+}
+
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsaKey, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ecKey, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	assert.Nil(t, err)
+	return signed + "." + b64(sig)
+}
+
+func newTestJWTAuthorizer(t *testing.T, keys *testKeys) Authorizer {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.Nil(t, ioutil.WriteFile(path, keys.jwks(), 0600))
+	authorizer, err := NewJWTAuthorizer(&JWTOptions{
+		Jwks:          path,
+		Issuer:        "https://issuer.example.com",
+		Audience:      "natssync",
+		ScopeClaim:    "scope",
+		ScopePrefix:   "natssync:",
+		LocationClaim: "natssync_location",
+	})
+	assert.Nil(t, err)
+	return authorizer
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://issuer.example.com",
+		"aud":   []string{"other", "natssync"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "openid natssync:register natssync:admin.read",
+	}
+}
+
+func TestJWTAuthorizer(t *testing.T) {
+	keys := newTestKeys(t)
+	authorizer := newTestJWTAuthorizer(t, keys)
+
+	for _, alg := range []string{"RS256", "PS256", "ES256"} {
+		kid := "rsa1"
+		if alg == "ES256" {
+			kid = "ec1"
+		}
+		token := keys.sign(t, alg, kid, validClaims())
+		ok, err := authorizer.Authorize(&Request{Scope: SCOPE_REGISTER, Token: token})
+		assert.Nil(t, err)
+		assert.True(t, ok, alg)
+
+		ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token})
+		assert.True(t, ok, alg)
+		ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_DELETE, Token: token})
+		assert.False(t, ok, alg)
+		ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: token})
+		assert.False(t, ok, alg)
+	}
+
+	// an array scope claim and scp
+	claims := validClaims()
+	delete(claims, "scope")
+	claims["scp"] = []string{"natssync:natspost", "natspost2"}
+	ok, err := authorizer.Authorize(&Request{Scope: SCOPE_NATSPOST, Token: keys.sign(t, "RS256", "rsa1", claims)})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestJWTAuthorizerRejects(t *testing.T) {
+	keys := newTestKeys(t)
+	authorizer := newTestJWTAuthorizer(t, keys)
+	req := func(token string) bool {
+		ok, err := authorizer.Authorize(&Request{Scope: SCOPE_REGISTER, Token: token})
+		assert.Nil(t, err)
+		return ok
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	assert.False(t, req(keys.sign(t, "RS256", "rsa1", expired)), "expired")
+
+	noExp := validClaims()
+	delete(noExp, "exp")
+	assert.False(t, req(keys.sign(t, "RS256", "rsa1", noExp)), "no exp")
+
+	notYet := validClaims()
+	notYet["nbf"] = time.Now().Add(time.Hour).Unix()
+	assert.False(t, req(keys.sign(t, "RS256", "rsa1", notYet)), "nbf")
+
+	wrongAud := validClaims()
+	wrongAud["aud"] = "other"
+	assert.False(t, req(keys.sign(t, "RS256", "rsa1", wrongAud)), "aud")
+
+	wrongIss := validClaims()
+	wrongIss["iss"] = "https://evil.example.com"
+	assert.False(t, req(keys.sign(t, "RS256", "rsa1", wrongIss)), "iss")
+
+	// the signature has to match the key and the algorithm
+	assert.False(t, req(keys.sign(t, "RS256", "ec1", validClaims())), "wrong key")
+	assert.False(t, req(keys.sign(t, "RS256", "unknown", validClaims())), "unknown kid")
+
+	token := keys.sign(t, "RS256", "rsa1", validClaims())
+	tampered := validClaims()
+	tampered["scope"] = "natssync:admin"
+	payload, _ := json.Marshal(tampered)
+	parts := strings.Split(token, ".")
+	assert.False(t, req(parts[0]+"."+b64(payload)+"."+parts[2]), "tampered")
+
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa1"})
+	assert.False(t, req(b64(header)+"."+parts[1]+"."), "alg none")
+	header, _ = json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa1"})
+	assert.False(t, req(b64(header)+"."+parts[1]+"."+parts[2]), "alg HS256")
+
+	assert.False(t, req("not a token"))
+	assert.False(t, req(""))
+}
+
+func TestJWTAuthorizerJwksURL(t *testing.T) {
+	keys := newTestKeys(t)
+	fetches := 0
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(keys.jwks())
+	}))
+	defer server.Close()
+
+	authorizer, err := NewJWTAuthorizer(&JWTOptions{Jwks: server.URL, ScopeClaim: "scope"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fetches)
+	ok, err := authorizer.Authorize(&Request{Scope: SCOPE_QUERYREG, Token: keys.sign(t, "ES256", "ec1", map[string]interface{}{
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"scope": "queryreg",
+	})})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// an unknown kid only fetches the keys again once they are a minute old
+	jwtAuth := authorizer.(*jwtAuthorizer)
+	_, err = jwtAuth.keys.key("rotated")
+	assert.Error(t, err)
+	assert.Equal(t, 1, fetches)
+	jwtAuth.keys.now = func() time.Time { return time.Now().Add(2 * jwksMinRefresh) }
+	_, err = jwtAuth.keys.key("rotated")
+	assert.Error(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// a failed fetch is not tried again for a minute either
+	failing = true
+	jwtAuth.keys.now = func() time.Time { return time.Now().Add(4 * jwksMinRefresh) }
+	_, err = jwtAuth.keys.key("rotated")
+	assert.Error(t, err)
+	assert.Equal(t, 3, fetches)
+	_, err = jwtAuth.keys.key("rotated")
+	assert.Error(t, err)
+	assert.Equal(t, 3, fetches)
+	_, err = jwtAuth.keys.key("ec1")
+	assert.Nil(t, err)
+
+	_, err = NewJWTAuthorizer(&JWTOptions{})
+	assert.Error(t, err)
+	_, err = NewJWTAuthorizer(&JWTOptions{Jwks: filepath.Join(t.TempDir(), "missing.json")})
+	assert.Error(t, err)
+}
+
+func TestJWTAuthorizerJwksSingleFetch(t *testing.T) {
+	keys := newTestKeys(t)
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		w.Write(keys.jwks())
+	}))
+	defer server.Close()
+
+	authorizer, err := NewJWTAuthorizer(&JWTOptions{Jwks: server.URL, ScopeClaim: "scope"})
+	assert.Nil(t, err)
+	jwtAuth := authorizer.(*jwtAuthorizer)
+	jwtAuth.keys.now = func() time.Time { return time.Now().Add(2 * jwksMinRefresh) }
+
+	// tokens with an unknown kid arriving together share one fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwtAuth.keys.key("rotated")
+			assert.Error(t, err)
+		}()
+	}
+	for atomic.LoadInt32(&fetches) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestJWTAuthorizerLocationClaim(t *testing.T) {
+	keys := newTestKeys(t)
+	authorizer := newTestJWTAuthorizer(t, keys)
+
+	claims := validClaims()
+	claims["natssync_location"] = "loc1"
+	token := keys.sign(t, "RS256", "rsa1", claims)
+	ok, err := authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token, LocationID: "loc1"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token, LocationID: "loc2"})
+	assert.False(t, ok)
+	// a bound token is not good for requests about no location
+	ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token})
+	assert.False(t, ok)
+
+	claims["natssync_location"] = []string{"loc1", "loc2"}
+	token = keys.sign(t, "RS256", "rsa1", claims)
+	ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token, LocationID: "loc2"})
+	assert.True(t, ok)
+	ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token, LocationID: "loc3"})
+	assert.False(t, ok)
+
+	// tokens without the claim are not bound
+	token = keys.sign(t, "RS256", "rsa1", validClaims())
+	ok, _ = authorizer.Authorize(&Request{Scope: SCOPE_ADMIN, Action: ADMIN_ACTION_READ, Token: token, LocationID: "loc3"})
+	assert.True(t, ok)
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/natsmodel"
+)
+
+const natsAuthTimeout = 30 * time.Second
+
+var adminAuthSubjects = map[string]string{
+	ADMIN_ACTION_READ:    bridgemodel.ADMIN_LOCATION_READ_AUTH_SUBJECT,
+	ADMIN_ACTION_UPDATE:  bridgemodel.ADMIN_LOCATION_UPDATE_AUTH_SUBJECT,
+	ADMIN_ACTION_ROTATE:  bridgemodel.ADMIN_LOCATION_ROTATE_AUTH_SUBJECT,
+	ADMIN_ACTION_SUSPEND: bridgemodel.ADMIN_LOCATION_SUSPEND_AUTH_SUBJECT,
+	ADMIN_ACTION_DELETE:  bridgemodel.ADMIN_LOCATION_DELETE_AUTH_SUBJECT,
+}
+
+// natsAuthorizer delegates decisions to an auth server listening on the natssync.auth subjects
+type natsAuthorizer struct {
+	request func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error)
+	timeout time.Duration
+}
+
+func NewNatsAuthorizer() Authorizer {
+	return &natsAuthorizer{
+		request: func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+			return natsmodel.GetNatsConnection().Request(subject, data, timeout)
+		},
+		timeout: natsAuthTimeout,
+	}
+}
+
+// authSubject the subject and message an auth server expects for the request
+func authSubject(req *Request) (string, interface{}, error) {
+	switch req.Scope {
+	case SCOPE_REGISTER:
+		return bridgemodel.REGISTRATION_AUTH_SUBJECT, &bridgemodel.RegistrationRequest{AuthToken: req.Token, LocationID: req.LocationID, MetaData: req.Metadata}, nil
+	case SCOPE_UNREGISTER:
+		return bridgemodel.UNREGISTRATION_AUTH_SUBJECT, &bridgemodel.UnRegistrationRequest{AuthToken: req.Token, LocationID: req.LocationID}, nil
+	case SCOPE_QUERYREG:
+		return bridgemodel.REGISTRATION_QUERY_AUTH_SUBJECT, &bridgemodel.GenericAuthRequest{AuthToken: req.Token}, nil
+	case SCOPE_NATSPOST:
+		return bridgemodel.NATSPOST_AUTH_SUBJECT, &bridgemodel.GenericAuthRequest{AuthToken: req.Token}, nil
+	case SCOPE_ADMIN:
+		if subject, ok := adminAuthSubjects[req.Action]; ok {
+			return subject, &bridgemodel.AdminAuthRequest{AuthToken: req.Token, LocationID: req.LocationID}, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no auth subject for scope %s action %s", req.Scope, req.Action)
+}
+
+// NewRequestFromSubject the request an auth server received on one of the natssync.auth subjects
+func NewRequestFromSubject(subject string, data []byte) (*Request, error) {
+	switch subject {
+	case bridgemodel.REGISTRATION_AUTH_SUBJECT:
+		var authReq bridgemodel.RegistrationRequest
+		if err := json.Unmarshal(data, &authReq); err != nil {
+			return nil, err
+		}
+		return &Request{Scope: SCOPE_REGISTER, Token: authReq.AuthToken, LocationID: authReq.LocationID, Metadata: authReq.MetaData}, nil
+	case bridgemodel.UNREGISTRATION_AUTH_SUBJECT:
+		var authReq bridgemodel.UnRegistrationRequest
+		if err := json.Unmarshal(data, &authReq); err != nil {
+			return nil, err
+		}
+		return &Request{Scope: SCOPE_UNREGISTER, Token: authReq.AuthToken, LocationID: authReq.LocationID}, nil
+	case bridgemodel.REGISTRATION_QUERY_AUTH_SUBJECT, bridgemodel.NATSPOST_AUTH_SUBJECT:
+		var authReq bridgemodel.GenericAuthRequest
+		if err := json.Unmarshal(data, &authReq); err != nil {
+			return nil, err
+		}
+		scope := SCOPE_QUERYREG
+		if subject == bridgemodel.NATSPOST_AUTH_SUBJECT {
+			scope = SCOPE_NATSPOST
+		}
+		return &Request{Scope: scope, Token: authReq.AuthToken}, nil
+	}
+	for action, adminSubject := range adminAuthSubjects {
+		if subject == adminSubject {
+			var authReq bridgemodel.AdminAuthRequest
+			if err := json.Unmarshal(data, &authReq); err != nil {
+				return nil, err
+			}
+			return &Request{Scope: SCOPE_ADMIN, Action: action, Token: authReq.AuthToken, LocationID: authReq.LocationID}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown auth subject %s", subject)
+}
+
+func (a *natsAuthorizer) Authorize(req *Request) (bool, error) {
+	allowed, _, err := a.authorizeCacheable(req)
+	return allowed, err
+}
+
+// authorizeCacheable the decision, and false if the auth server said it is only good for this request
+func (a *natsAuthorizer) authorizeCacheable(req *Request) (bool, bool, error) {
+	subject, authReq, err := authSubject(req)
+	if err != nil {
+		return false, false, err
+	}
+	reqBits, _ := json.Marshal(authReq)
+	log.Tracef("Posting auth message to nats on %s", subject)
+	respMsg, err := a.request(subject, reqBits, a.timeout)
+	if err != nil {
+		log.WithError(err).WithField("subject", subject).Error("Error sending auth request to NATS")
+		return false, false, err
+	}
+	// every auth response is a success flag
+	var resp bridgemodel.GenericAuthResponse
+	if err = json.Unmarshal(respMsg.Data, &resp); err != nil {
+		log.WithError(err).WithField("subject", subject).Error("Error decoding auth nats response")
+		return false, false, err
+	}
+	return resp.Success, !resp.NoCache, nil
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StaticToken a token in the static token file and the scopes it has
+type StaticToken struct {
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+	// LocationIDs if set the token is only good for these locations
+	LocationIDs []string `yaml:"locationIDs"`
+}
+
+type staticTokenFile struct {
+	Tokens []StaticToken `yaml:"tokens"`
+}
+
+// staticAuthorizer grants the scopes listed for each token in a file, for development and testing
+type staticAuthorizer struct {
+	tokens []StaticToken
+}
+
+// NewStaticAuthorizer reads a yaml file of tokens, e.g.
+//
+//	tokens:
+//	  - token: dev-token
+//	    scopes: [register, unregister, queryreg, natspost, admin]
+func NewStaticAuthorizer(path string) (Authorizer, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("AUTH_STATIC_TOKEN_FILE is required for static auth")
+	}
+	bits, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file staticTokenFile
+	if err = yaml.Unmarshal(bits, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse static token file %s: %v", path, err)
+	}
+	for i, token := range file.Tokens {
+		if len(token.Token) == 0 {
+			return nil, fmt.Errorf("token %d in %s is empty", i, path)
+		}
+	}
+	return &staticAuthorizer{tokens: file.Tokens}, nil
+}
+
+func (a *staticAuthorizer) Authorize(req *Request) (bool, error) {
+	for _, token := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Token), []byte(req.Token)) != 1 {
+			continue
+		}
+		if len(token.LocationIDs) > 0 && !containsString(token.LocationIDs, req.LocationID) {
+			return false, nil
+		}
+		return HasScope(token.Scopes, req), nil
+	}
+	return false, nil
+}
+
+func containsString(list []string, val string) bool {
+	for _, s := range list {
+		if s == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package authserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg/auth"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+)
+
+// LEGACY_TOKEN_ID the token ID audited for the AUTH_TOKEN token
+const LEGACY_TOKEN_ID = "legacy"
+
+// Server answers the cloud server's auth requests on the natssync.auth subjects from a TokenStore
+type Server struct {
+	store *TokenStore
+	// legacyToken a token with every scope, like the old single AUTH_TOKEN server.  Off if empty
+	legacyToken string
+	audit       log.FieldLogger
+}
+
+func NewServer(store *TokenStore, legacyToken string, audit log.FieldLogger) *Server {
+	if audit == nil {
+		audit = log.StandardLogger()
+	}
+	return &Server{store: store, legacyToken: legacyToken, audit: audit}
+}
+
+// Subscribe answers requests on all the auth subjects
+func (s *Server) Subscribe(nc *nats.Conn) (*nats.Subscription, error) {
+	return nc.Subscribe(bridgemodel.REGISTRATION_AUTH_WILDCARD, func(msg *nats.Msg) {
+		if len(msg.Reply) == 0 {
+			return
+		}
+		if err := nc.Publish(msg.Reply, s.Handle(msg.Subject, msg.Data)); err != nil {
+			log.WithError(err).WithField("subject", msg.Subject).Error("Unable to send auth response")
+		}
+	})
+}
+
+// Handle the response to an auth request.  Every auth response has the same success flag, so one type serves for all
+func (s *Server) Handle(subject string, data []byte) []byte {
+	var decision Decision
+	req, err := auth.NewRequestFromSubject(subject, data)
+	if err != nil {
+		log.WithError(err).WithField("subject", subject).Warn("Unable to read auth request")
+		decision.Reason = REASON_INVALID_REQUEST
+		req = new(auth.Request)
+	} else {
+		decision = s.decide(req)
+	}
+	s.auditDecision(subject, req, &decision)
+	respBits, _ := json.Marshal(&bridgemodel.GenericAuthResponse{Success: decision.Allowed, NoCache: decision.NoCache})
+	return respBits
+}
+
+func (s *Server) decide(req *auth.Request) Decision {
+	if len(s.legacyToken) > 0 && subtle.ConstantTimeCompare([]byte(s.legacyToken), []byte(req.Token)) == 1 {
+		return Decision{Allowed: true, TokenID: LEGACY_TOKEN_ID, Reason: REASON_ALLOWED}
+	}
+	return s.store.Authorize(req)
+}
+
+// auditDecision logs every decision, never with the token itself
+func (s *Server) auditDecision(subject string, req *auth.Request, decision *Decision) {
+	fields := log.Fields{
+		"audit":   true,
+		"subject": subject,
+		"scope":   req.Scope,
+		"tokenID": decision.TokenID,
+		"allowed": decision.Allowed,
+		"reason":  decision.Reason,
+	}
+	if len(req.Action) > 0 {
+		fields["action"] = req.Action
+	}
+	if len(req.LocationID) > 0 {
+		fields["locationID"] = req.LocationID
+	}
+	if len(req.Metadata) > 0 {
+		fields["metadata"] = req.Metadata
+	}
+	s.audit.WithFields(fields).Info("Auth decision")
+}
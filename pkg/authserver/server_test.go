@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package authserver
+
+import (
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/auth"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+)
+
+func TestServerHandle(t *testing.T) {
+	store := newTestStore(t)
+	secret, token, err := store.Mint(&MintOptions{Scopes: []string{auth.SCOPE_REGISTER, auth.SCOPE_ADMIN}})
+	assert.Nil(t, err)
+	audit, hook := test.NewNullLogger()
+	server := NewServer(store, "42", audit)
+
+	handle := func(subject string, req interface{}) bool {
+		bits, _ := json.Marshal(req)
+		var resp bridgemodel.GenericAuthResponse
+		assert.Nil(t, json.Unmarshal(server.Handle(subject, bits), &resp))
+		return resp.Success
+	}
+	assert.True(t, handle(bridgemodel.REGISTRATION_AUTH_SUBJECT, &bridgemodel.RegistrationRequest{AuthToken: secret, LocationID: "loc1"}))
+	assert.True(t, handle(bridgemodel.ADMIN_LOCATION_DELETE_AUTH_SUBJECT, &bridgemodel.AdminAuthRequest{AuthToken: secret, LocationID: "loc1"}))
+	assert.False(t, handle(bridgemodel.NATSPOST_AUTH_SUBJECT, &bridgemodel.GenericAuthRequest{AuthToken: secret}))
+	assert.True(t, handle(bridgemodel.NATSPOST_AUTH_SUBJECT, &bridgemodel.GenericAuthRequest{AuthToken: "42"}))
+	assert.False(t, handle("natssync.auth.unknown", &bridgemodel.GenericAuthRequest{AuthToken: "42"}))
+
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 5)
+	assert.Equal(t, log.Fields{
+		"audit":      true,
+		"subject":    bridgemodel.REGISTRATION_AUTH_SUBJECT,
+		"scope":      auth.SCOPE_REGISTER,
+		"tokenID":    token.ID,
+		"allowed":    true,
+		"reason":     REASON_ALLOWED,
+		"locationID": "loc1",
+	}, entries[0].Data)
+	assert.Equal(t, LEGACY_TOKEN_ID, entries[3].Data["tokenID"])
+	assert.Equal(t, REASON_INVALID_REQUEST, entries[4].Data["reason"])
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Data, secret)
+	}
+}
+
+func TestServerHandleSingleUse(t *testing.T) {
+	store := newTestStore(t)
+	secret, _, err := store.Mint(&MintOptions{Scopes: []string{auth.SCOPE_NATSPOST}, SingleUse: true})
+	assert.Nil(t, err)
+	audit, _ := test.NewNullLogger()
+	server := NewServer(store, "", audit)
+
+	// the decision is marked so the cloud server does not cache it
+	bits, _ := json.Marshal(&bridgemodel.GenericAuthRequest{AuthToken: secret})
+	for _, allowed := range []bool{true, false} {
+		var resp bridgemodel.GenericAuthResponse
+		assert.Nil(t, json.Unmarshal(server.Handle(bridgemodel.NATSPOST_AUTH_SUBJECT, bits), &resp))
+		assert.Equal(t, allowed, resp.Success)
+		assert.True(t, resp.NoCache)
+	}
+}
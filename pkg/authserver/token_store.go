@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package authserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/theotw/natssync/pkg/auth"
+)
+
+// TOKEN_PREFIX starts every minted token, so they are easy to spot in config and logs
+const TOKEN_PREFIX = "nst_"
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// reasons given for a decision in the audit log
+const (
+	REASON_ALLOWED           = "allowed"
+	REASON_UNKNOWN_TOKEN     = "unknown token"
+	REASON_EXPIRED           = "expired"
+	REASON_USED              = "single use token already used"
+	REASON_SCOPE             = "scope not granted"
+	REASON_METADATA          = "metadata not allowed"
+	REASON_INVALID_REQUEST   = "invalid request"
+	REASON_STORE_UNAVAILABLE = "token store unavailable"
+)
+
+// Token a token the auth server knows.  Only a hash of the secret is kept
+type Token struct {
+	ID          string    `json:"id"`
+	Hash        string    `json:"hash"`
+	Description string    `json:"description,omitempty"`
+	Scopes      []string  `json:"scopes"`
+	Created     time.Time `json:"created"`
+	// Expires the token is no good after this, never if nil
+	Expires *time.Time `json:"expires,omitempty"`
+	// SingleUse the token is used up by its first allowed request, for bootstrapping a location
+	SingleUse bool       `json:"singleUse,omitempty"`
+	Used      *time.Time `json:"used,omitempty"`
+	// Metadata if set, a registration must have one of the listed values for each key
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// MintOptions what a new token may do
+type MintOptions struct {
+	Description string
+	Scopes      []string
+	TTL         time.Duration
+	SingleUse   bool
+	Metadata    map[string][]string
+}
+
+// Decision the answer to a request and why, for the audit log
+type Decision struct {
+	Allowed bool
+	TokenID string
+	Reason  string
+	// NoCache the decision must not be reused, set for single use tokens
+	NoCache bool
+}
+
+type tokenFile struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// TokenStore tokens kept in a JSON file.  The file is read again when it changes, so tokens minted or revoked by the
+// CLI are seen by a running server.  Changes hold a lock on the file's .lock file, so two processes sharing the file
+// can not both use a single use token or lose each other's changes
+type TokenStore struct {
+	path string
+	now  func() time.Time
+
+	lock   sync.Mutex
+	tokens map[string]*Token // by hash
+	// info the file when it was last read or written, saves go through a rename so the file changes with each one
+	info os.FileInfo
+}
+
+// NewTokenStore opens the token file, it is created when the first token is minted
+func NewTokenStore(path string) (*TokenStore, error) {
+	ret := &TokenStore{path: path, now: time.Now, tokens: make(map[string]*Token)}
+	ret.lock.Lock()
+	defer ret.lock.Unlock()
+	if err := ret.reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	bits := make([]byte, n)
+	if _, err := rand.Read(bits); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bits), nil
+}
+
+// reload reads the file if it changed since it was last read, the lock must be held
+func (s *TokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.tokens = make(map[string]*Token)
+		s.info = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.info != nil && os.SameFile(info, s.info) && info.ModTime().Equal(s.info.ModTime()) && info.Size() == s.info.Size() {
+		return nil
+	}
+	bits, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file tokenFile
+	if err = json.Unmarshal(bits, &file); err != nil {
+		return fmt.Errorf("unable to parse token file %s: %v", s.path, err)
+	}
+	tokens := make(map[string]*Token, len(file.Tokens))
+	for _, token := range file.Tokens {
+		tokens[token.Hash] = token
+	}
+	s.tokens = tokens
+	s.info = info
+	return nil
+}
+
+// save writes the file through a temp file so a reader never sees half of it, the lock must be held
+func (s *TokenStore) save() error {
+	file := tokenFile{Tokens: s.sortedTokens()}
+	bits, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(bits); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.info = info
+	}
+	return nil
+}
+
+func (s *TokenStore) sortedTokens() []*Token {
+	ret := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		ret = append(ret, token)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Created.Equal(ret[j].Created) {
+			return ret[i].ID < ret[j].ID
+		}
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return ret
+}
+
+// Mint adds a new token and returns its secret, which is not stored and can not be shown again
+func (s *TokenStore) Mint(opts *MintOptions) (string, *Token, error) {
+	if len(opts.Scopes) == 0 {
+		return "", nil, errors.New("a token needs at least one scope")
+	}
+	for _, scope := range opts.Scopes {
+		if !validScope(scope) {
+			return "", nil, fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+	id, err := randomString(6)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = TOKEN_PREFIX + secret
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := s.lockFile()
+	if err != nil {
+		return "", nil, err
+	}
+	defer unlock()
+	if err = s.reload(); err != nil {
+		return "", nil, err
+	}
+	token := &Token{
+		ID:          id,
+		Hash:        hashToken(secret),
+		Description: opts.Description,
+		Scopes:      opts.Scopes,
+		Created:     s.now().UTC(),
+		SingleUse:   opts.SingleUse,
+		Metadata:    opts.Metadata,
+	}
+	if opts.TTL > 0 {
+		expires := token.Created.Add(opts.TTL)
+		token.Expires = &expires
+	}
+	s.tokens[token.Hash] = token
+	if err = s.save(); err != nil {
+		delete(s.tokens, token.Hash)
+		return "", nil, err
+	}
+	return secret, token, nil
+}
+
+// Revoke removes the token with the ID
+func (s *TokenStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := s.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err = s.reload(); err != nil {
+		return err
+	}
+	for hash, token := range s.tokens {
+		if token.ID == id {
+			delete(s.tokens, hash)
+			return s.save()
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// List the tokens, oldest first
+func (s *TokenStore) List() ([]*Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s.sortedTokens(), nil
+}
+
+// Authorize decides the request.  An allowed request of any scope uses up a single use token, it is marked used in
+// the file before the decision is returned
+func (s *TokenStore) Authorize(req *auth.Request) Decision {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := s.lockFile()
+	if err != nil {
+		return Decision{Reason: REASON_STORE_UNAVAILABLE}
+	}
+	defer unlock()
+	if err = s.reload(); err != nil {
+		return Decision{Reason: REASON_STORE_UNAVAILABLE}
+	}
+	token, ok := s.tokens[hashToken(req.Token)]
+	if !ok || len(req.Token) == 0 {
+		return Decision{Reason: REASON_UNKNOWN_TOKEN}
+	}
+	ret := Decision{TokenID: token.ID, NoCache: token.SingleUse}
+	now := s.now()
+	switch {
+	case token.Expires != nil && now.After(*token.Expires):
+		ret.Reason = REASON_EXPIRED
+	case token.SingleUse && token.Used != nil:
+		ret.Reason = REASON_USED
+	case !auth.HasScope(token.Scopes, req):
+		ret.Reason = REASON_SCOPE
+	case req.Scope == auth.SCOPE_REGISTER && !metadataAllowed(token.Metadata, req.Metadata):
+		ret.Reason = REASON_METADATA
+	default:
+		ret.Allowed = true
+		ret.Reason = REASON_ALLOWED
+	}
+	if ret.Allowed && token.SingleUse {
+		used := now.UTC()
+		token.Used = &used
+		if err = s.save(); err != nil {
+			// if it can not be marked used it could be used again, so do not allow it
+			token.Used = nil
+			return Decision{TokenID: token.ID, Reason: REASON_STORE_UNAVAILABLE}
+		}
+	}
+	return ret
+}
+
+var validScopes = []string{auth.SCOPE_REGISTER, auth.SCOPE_UNREGISTER, auth.SCOPE_QUERYREG, auth.SCOPE_NATSPOST, auth.SCOPE_ADMIN}
+var validAdminActions = []string{auth.ADMIN_ACTION_READ, auth.ADMIN_ACTION_UPDATE, auth.ADMIN_ACTION_ROTATE, auth.ADMIN_ACTION_SUSPEND, auth.ADMIN_ACTION_DELETE}
+
+// validScope true for the scopes and admin.<action> scopes the cloud server asks for
+func validScope(scope string) bool {
+	for _, valid := range validScopes {
+		if scope == valid {
+			return true
+		}
+	}
+	for _, action := range validAdminActions {
+		if scope == auth.SCOPE_ADMIN+"."+action {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataAllowed true if the metadata has an allowed value for every bound key
+func metadataAllowed(allowed map[string][]string, metadata map[string]string) bool {
+	for key, values := range allowed {
+		val, ok := metadata[key]
+		if !ok {
+			return false
+		}
+		found := false
+		for _, allowedVal := range values {
+			if val == allowedVal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package authserver
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	lockFileRetry = 10 * time.Millisecond
+	// lockFileStale a lock held this long was left behind by a process that died holding it
+	lockFileStale = 30 * time.Second
+	lockFileWait  = 2 * lockFileStale
+)
+
+// lockFile takes the lock other processes using the file take to change it, the returned func releases it.  Without
+// flock the lock is the .lock file itself, created exclusively and removed on release
+func (s *TokenStore) lockFile() (func(), error) {
+	path := s.path + ".lock"
+	deadline := time.Now().Add(lockFileWait)
+	for {
+		lock, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			lock.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > lockFileStale {
+			_ = os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the token file lock %s", path)
+		}
+		time.Sleep(lockFileRetry)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package authserver
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/auth"
+)
+
+func newTestStore(t *testing.T) *TokenStore {
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	assert.Nil(t, err)
+	return store
+}
+
+func TestMintAndRevoke(t *testing.T) {
+	store := newTestStore(t)
+	secret, token, err := store.Mint(&MintOptions{Scopes: []string{auth.SCOPE_NATSPOST, "admin.read"}, Description: "test"})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(secret, TOKEN_PREFIX))
+	assert.NotContains(t, token.Hash, secret)
+
+	// another store on the same file sees the token
+	store2, err := NewTokenStore(store.path)
+	assert.Nil(t, err)
+	tokens, err := store2.List()
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, token.ID, tokens[0].ID)
+	assert.True(t, store2.Authorize(&auth.Request{Scope: auth.SCOPE_NATSPOST, Token: secret}).Allowed)
+
+	assert.Nil(t, store2.Revoke(token.ID))
+	assert.Equal(t, ErrTokenNotFound, store2.Revoke(token.ID))
+	decision := store.Authorize(&auth.Request{Scope: auth.SCOPE_NATSPOST, Token: secret})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, REASON_UNKNOWN_TOKEN, decision.Reason)
+
+	_, _, err = store.Mint(&MintOptions{})
+	assert.Error(t, err)
+	_, _, err = store.Mint(&MintOptions{Scopes: []string{"admin.everything"}})
+	assert.Error(t, err)
+}
+
+func TestAuthorizeToken(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	secret, token, err := store.Mint(&MintOptions{Scopes: []string{auth.SCOPE_QUERYREG, "admin.read"}, TTL: time.Hour})
+	assert.Nil(t, err)
+	check := func(req *auth.Request, reason string) {
+		decision := store.Authorize(req)
+		assert.Equal(t, reason, decision.Reason, req.Scope)
+		assert.Equal(t, reason == REASON_ALLOWED, decision.Allowed)
+	}
+	check(&auth.Request{Scope: auth.SCOPE_QUERYREG, Token: secret}, REASON_ALLOWED)
+	check(&auth.Request{Scope: auth.SCOPE_ADMIN, Action: auth.ADMIN_ACTION_READ, Token: secret}, REASON_ALLOWED)
+	check(&auth.Request{Scope: auth.SCOPE_ADMIN, Action: auth.ADMIN_ACTION_DELETE, Token: secret}, REASON_SCOPE)
+	check(&auth.Request{Scope: auth.SCOPE_REGISTER, Token: secret}, REASON_SCOPE)
+	check(&auth.Request{Scope: auth.SCOPE_QUERYREG, Token: secret + "x"}, REASON_UNKNOWN_TOKEN)
+	check(&auth.Request{Scope: auth.SCOPE_QUERYREG}, REASON_UNKNOWN_TOKEN)
+
+	assert.Equal(t, token.ID, store.Authorize(&auth.Request{Scope: auth.SCOPE_QUERYREG, Token: secret}).TokenID)
+	now = now.Add(2 * time.Hour)
+	check(&auth.Request{Scope: auth.SCOPE_QUERYREG, Token: secret}, REASON_EXPIRED)
+}
+
+func TestSingleUseToken(t *testing.T) {
+	store := newTestStore(t)
+	secret, _, err := store.Mint(&MintOptions{
+		Scopes:    []string{auth.SCOPE_REGISTER},
+		SingleUse: true,
+		Metadata:  map[string][]string{"region": {"east", "west"}},
+	})
+	assert.Nil(t, err)
+
+	// metadata that is not allowed does not use the token up
+	decision := store.Authorize(&auth.Request{Scope: auth.SCOPE_REGISTER, Token: secret, Metadata: map[string]string{"region": "north"}})
+	assert.Equal(t, REASON_METADATA, decision.Reason)
+	decision = store.Authorize(&auth.Request{Scope: auth.SCOPE_REGISTER, Token: secret})
+	assert.Equal(t, REASON_METADATA, decision.Reason)
+
+	decision = store.Authorize(&auth.Request{Scope: auth.SCOPE_REGISTER, Token: secret, Metadata: map[string]string{"region": "west", "team": "a"}})
+	assert.True(t, decision.Allowed)
+	decision = store.Authorize(&auth.Request{Scope: auth.SCOPE_REGISTER, Token: secret, Metadata: map[string]string{"region": "west"}})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, REASON_USED, decision.Reason)
+
+	// used is saved to the file
+	store2, err := NewTokenStore(store.path)
+	assert.Nil(t, err)
+	tokens, _ := store2.List()
+	assert.NotNil(t, tokens[0].Used)
+}
+
+func TestSingleUseTokenEveryScope(t *testing.T) {
+	store := newTestStore(t)
+	secret, _, err := store.Mint(&MintOptions{Scopes: []string{auth.SCOPE_NATSPOST, "admin.read"}, SingleUse: true})
+	assert.Nil(t, err)
+
+	// a scope the token does not have does not use it up
+	decision := store.Authorize(&auth.Request{Scope: auth.SCOPE_QUERYREG, Token: secret})
+	assert.Equal(t, REASON_SCOPE, decision.Reason)
+	decision = store.Authorize(&auth.Request{Scope: auth.SCOPE_NATSPOST, Token: secret})
+	assert.True(t, decision.Allowed)
+
+	// another server on the same file sees it used
+	store2, err := NewTokenStore(store.path)
+	assert.Nil(t, err)
+	decision = store2.Authorize(&auth.Request{Scope: auth.SCOPE_ADMIN, Action: auth.ADMIN_ACTION_READ, Token: secret})
+	assert.Equal(t, REASON_USED, decision.Reason)
+}
+
+func TestSingleUseTokenConcurrent(t *testing.T) {
+	store := newTestStore(t)
+	secret, _, err := store.Mint(&MintOptions{Scopes: []string{auth.SCOPE_NATSPOST}, SingleUse: true})
+	assert.Nil(t, err)
+
+	// stores on the same file stand in for separate auth servers, only one of them may use the token
+	var allowed int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		other, err := NewTokenStore(store.path)
+		assert.Nil(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if other.Authorize(&auth.Request{Scope: auth.SCOPE_NATSPOST, Token: secret}).Allowed {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, int32(1), allowed)
+}
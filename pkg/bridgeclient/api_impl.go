@@ -140,7 +140,7 @@ func handlePostRegister(c *gin.Context) {
 
 	req.PublicKey = base64.StdEncoding.EncodeToString(buf.Bytes())
 	req.AuthToken = in.AuthToken
-	req.MetaData = in.MetaData
+	req.MetaData = msgs.AdvertiseCompression(in.MetaData)
 	req.KeyID = selfLocationData.GetKeyID()
 	jsonBits, _ := json.Marshal(&req)
 	url := fmt.Sprintf("%s/bridge-server/1/register/", pkg.Config.CloudBridgeUrl)
@@ -188,8 +188,15 @@ func handlePostRegister(c *gin.Context) {
 		return
 	}
 
-	// the servers key is always the current key. Must be explicitly unset
+	// messages to the cloud name its key, servers that do not send the key ID leave it unset
 	locationData.UnsetKeyID()
+	if len(regResp.CloudKeyID) > 0 {
+		if err = locationData.SetKeyID(regResp.CloudKeyID); err != nil {
+			code, response := bridgemodel.HandleError(c, err)
+			c.JSON(code, response)
+			return
+		}
+	}
 
 	err = persistence.GetKeyStore().WriteLocation(*locationData)
 	if err != nil {
@@ -200,6 +207,9 @@ func handlePostRegister(c *gin.Context) {
 
 	//this step must be last, other parts of the code watch for this key
 	selfLocationData.SetLocationID(regResp.PremID)
+	if len(regResp.ClientCertificate) > 0 {
+		selfLocationData.SetCertificate([]byte(regResp.ClientCertificate))
+	}
 	err = persistence.GetKeyStore().WriteKeyPair(selfLocationData)
 	if err != nil {
 		code, response := bridgemodel.HandleError(c, err)
@@ -5,6 +5,8 @@
 package cloudclient
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/theotw/natssync/pkg/natsmodel"
@@ -75,6 +77,9 @@ func RunClient(test bool) {
 		log.Warn("SKIP_TLS_VALIDATION was set to true! Don't use this in production!")
 		bridgemodel.ConfigureDefaultTransportToSkipTlsValidation()
 	}
+	if err := configureClientTLS(store); err != nil {
+		log.Fatalf("Error configuring TLS: %s", err)
+	}
 
 	if err := RunBridgeClientRestAPI(); err != nil {
 		log.Errorf("Error starting API server %s", err.Error())
@@ -124,6 +129,8 @@ func RunClient(test bool) {
 			//announce the cloud ID/location ID at startup and changes
 			connection.Publish(bridgemodel.ResponseForLocationID, []byte(clientID))
 			connection.Flush()
+			negotiateWithServer(serverURL)
+			startCloudKeyRefresher(store, serverURL)
 			currentMessageHandler = NewBidiMessageHandler(serverURL)
 			log.Infof("Starting Message Handler of type %s ", currentMessageHandler.GetHandlerType())
 			currentMessageHandler.StartMessageHandler(clientID)
@@ -139,15 +146,37 @@ func RunClient(test bool) {
 func isInvalidCertificateError(err error) bool {
 	return strings.Contains(err.Error(), fmt.Sprintf("status code %v", pkg.StatusCertificateError))
 }
-func getMessagesFromCloud(serverURL, clientID string) ([]v1.BridgeMessage, error) {
-	url := fmt.Sprintf("%s/bridge-server/1/message-queue/%s", serverURL, clientID)
+
+// getMessagesFromCloud polls for messages, acking the delivery IDs of the messages handled since the last poll
+func getMessagesFromCloud(serverURL, clientID string, acks []string) ([]msgs.BatchMessage, error) {
+	path := msgs.MakeMessageQueuePath(clientID)
+	url := fmt.Sprintf("%s%s", serverURL, path)
 
 	httpclient := bridgemodel.NewHttpClient()
-	var msglist []v1.BridgeMessage
+	accept := msgs.CONTENT_TYPE_JSON
+	if msgs.UseBinaryBatches() {
+		accept = fmt.Sprintf("%s, %s", msgs.CONTENT_TYPE_BINARY_BATCH, msgs.CONTENT_TYPE_JSON)
+	}
+	var contentType string
+	var respBits []byte
 
 	for true {
-		ac := msgs.NewAuthChallenge("")
-		err := httpclient.SendAuthorizedRequestWithBodyAndResp(http.MethodGet, url, ac, &msglist)
+		ac := msgs.NewAuthChallengeForRequest("", clientID, http.MethodGet, path)
+		if ac == nil {
+			return nil, errors.New("unable to create auth challenge")
+		}
+		req := v1.BridgeMessageGetReq{
+			Version:        ac.Version,
+			AuthChallengeA: ac.AuthChallengeA,
+			AuthChellengeB: ac.AuthChellengeB,
+			ExplicitAcks:   true,
+			Acks:           acks,
+		}
+		reqBits, err := json.Marshal(&req)
+		if err != nil {
+			return nil, err
+		}
+		contentType, respBits, err = httpclient.SendAuthorizedRequestWithContentType(http.MethodGet, url, msgs.CONTENT_TYPE_JSON, accept, reqBits)
 		if err != nil {
 			if isInvalidCertificateError(err) {
 				if certRotationErr := NewCertRotationHandler(serverURL, clientID).HandleCertRotation(); certRotationErr != nil {
@@ -161,7 +190,86 @@ func getMessagesFromCloud(serverURL, clientID string) ([]v1.BridgeMessage, error
 		break
 	}
 
-	return msglist, nil
+	// older servers always answer in JSON
+	if strings.HasPrefix(contentType, msgs.CONTENT_TYPE_BINARY_BATCH) {
+		batch, err := msgs.DecodeBatch(respBits)
+		if err != nil {
+			return nil, err
+		}
+		return batch.Messages, nil
+	}
+	var msglist []v1.BridgeMessage
+	if err := json.Unmarshal(respBits, &msglist); err != nil {
+		return nil, err
+	}
+	batchMsgs, msgErrs := msgs.NewBatchMessages(msglist)
+	for _, err := range msgErrs {
+		log.Errorf("Error unmarshalling envelope %s", err.Error())
+	}
+	return batchMsgs, nil
+}
+
+// negotiateWithServer asks the server what it accepts and picks the send envelope version and compression to match
+func negotiateWithServer(serverURL string) {
+	url := fmt.Sprintf("%s%s/about", serverURL, msgs.BRIDGE_SERVER_API_PATH)
+	var about v1.AboutResponse
+	if err := bridgemodel.NewHttpClient().SendAuthorizedRequestWithBodyAndResp(http.MethodGet, url, nil, &about); err != nil {
+		log.WithError(err).Errorf("Unable to get the server envelope policy, using the configured envelope version")
+		msgs.SetSendEnvelopeVersion(0)
+		msgs.SetSendCompression(msgs.COMPRESSION_DISABLED)
+		msgs.SetUseBinaryBatches(false)
+		return
+	}
+	negotiateEnvelopeVersion(&about)
+	negotiateCompression(&about)
+	negotiateBatchFormat(&about)
+}
+
+// negotiateEnvelopeVersion picks a send envelope version the server's policy accepts.  If the server is too old
+// to publish a policy, the configured version is used
+func negotiateEnvelopeVersion(about *v1.AboutResponse) {
+	if about.EnvelopePolicy == nil || len(about.EnvelopePolicy.AcceptedVersions) == 0 {
+		msgs.SetSendEnvelopeVersion(0)
+		return
+	}
+
+	accepted := make([]int, 0, len(about.EnvelopePolicy.AcceptedVersions))
+	for _, version := range about.EnvelopePolicy.AcceptedVersions {
+		accepted = append(accepted, int(version))
+	}
+	msgs.SetSendEnvelopeVersion(0)
+	version := msgs.ChooseEnvelopeVersion(msgs.GetSendEnvelopeVersion(), accepted)
+	log.Infof("Using envelope version %d, server accepts %v", version, accepted)
+	msgs.SetSendEnvelopeVersion(version)
+}
+
+// negotiateCompression only compresses with the configured algorithm if the server says it can read it.  Servers
+// too old to list any get uncompressed messages
+func negotiateCompression(about *v1.AboutResponse) {
+	compression := msgs.GetConfiguredCompression(pkg.CLOUD_ID)
+	if compression == msgs.COMPRESSION_NONE {
+		msgs.SetSendCompression(msgs.COMPRESSION_DISABLED)
+		return
+	}
+	for _, supported := range about.SupportedCompression {
+		if supported == compression {
+			log.Infof("Using %s compression", compression)
+			msgs.SetSendCompression(compression)
+			return
+		}
+	}
+	log.Warnf("Server does not support %s compression, sending uncompressed messages", compression)
+	msgs.SetSendCompression(msgs.COMPRESSION_DISABLED)
+}
+
+// negotiateBatchFormat sends binary batches if the server lists them, otherwise JSON
+func negotiateBatchFormat(about *v1.AboutResponse) {
+	supported := false
+	for _, contentType := range about.BatchContentTypes {
+		supported = supported || contentType == msgs.CONTENT_TYPE_BINARY_BATCH
+	}
+	msgs.SetUseBinaryBatches(supported)
+	log.Infof("Using binary batches %v, server accepts %v", msgs.UseBinaryBatches(), about.BatchContentTypes)
 }
 
 func timeToQuit(quitChannel chan os.Signal) bool {
@@ -12,12 +12,13 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
 	"github.com/theotw/natssync/pkg/msgs"
 	"github.com/theotw/natssync/pkg/persistence"
 )
 
 const (
-	certRotationUrlFormat = "%v/bridge-server/1/register-certificate"
+	certRotationUrlFormat = "%v" + msgs.CERT_ROTATION_PATH
 	connectionTimeout     = 30 * time.Second
 )
 
@@ -77,7 +78,7 @@ func (crh *certRotationHandler) HandleCertRotation() error {
 		return err
 	}
 
-	envelope, enverr := msgs.PutMessageInEnvelopeV3(buf.Bytes(), crh.clientID, pkg.CLOUD_ID)
+	envelope, enverr := msgs.PutMessageInEnvelope(buf.Bytes(), crh.clientID, pkg.CLOUD_ID)
 	if enverr != nil {
 		return err
 	}
@@ -92,8 +93,9 @@ func (crh *certRotationHandler) HandleCertRotation() error {
 
 	payload.PremID = locationID
 	payload.PublicKeyPackage = *envelope
-	payload.AuthChallenge = *msgs.NewAuthChallenge("")
+	payload.AuthChallenge = *msgs.NewAuthChallengeForRequest("", locationID, http.MethodPost, msgs.CERT_ROTATION_PATH)
 	payload.KeyID = selfLocationData.GetKeyID()
+	payload.ClientCertificate = true
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
@@ -101,7 +103,7 @@ func (crh *certRotationHandler) HandleCertRotation() error {
 	}
 
 	response, err := crh.client.Post(crh.certRotationUrl, "application/json", bytes.NewReader(payloadBytes))
-	if err != nil || response.StatusCode != http.StatusNoContent {
+	if err != nil || (response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK) {
 		statusCode := 0
 		if response != nil {
 			statusCode = response.StatusCode
@@ -112,12 +114,27 @@ func (crh *certRotationHandler) HandleCertRotation() error {
 			Errorf("Failed to rotate certificates")
 		return fmt.Errorf("failed to rotate certificates")
 	}
+	defer response.Body.Close()
+
+	// servers with a client CA send a certificate for the new key pair
+	if response.StatusCode == http.StatusOK {
+		var rotationResp msgs.CertRotationResponse
+		if err = json.NewDecoder(response.Body).Decode(&rotationResp); err != nil {
+			log.WithError(err).Errorf("Failed to decode cert rotation response")
+			return err
+		}
+		if len(rotationResp.ClientCertificate) > 0 {
+			selfLocationData.SetCertificate([]byte(rotationResp.ClientCertificate))
+		}
+	}
 
 	err = crh.store.WriteKeyPair(selfLocationData)
 	if err != nil {
 		log.WithError(err).WithField("PremID", payload.PremID).Errorf("failed to save keypair")
 		return err
 	}
+	// connections still open were made with the old certificate
+	bridgemodel.CloseIdleConnections()
 
 	return nil
 }
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+// clientCertificateSource presents the client certificate stored with the location's current key pair, it is read
+// from the keystore on each handshake so a rotated certificate is used without a restart
+type clientCertificateSource struct {
+	store persistence.LocationKeyStore
+
+	lock  sync.Mutex
+	keyID string
+	cert  *tls.Certificate
+}
+
+func (s *clientCertificateSource) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	locationData, err := s.store.ReadKeyPair("")
+	if err != nil || locationData == nil || len(locationData.GetCertificate()) == 0 {
+		// no certificate, the server will ask for a key pair rotation which issues one
+		return &tls.Certificate{}, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cert != nil && s.keyID == locationData.GetKeyID() {
+		return s.cert, nil
+	}
+	cert, err := tls.X509KeyPair(locationData.GetCertificate(), locationData.GetPrivateKey())
+	if err != nil {
+		log.WithError(err).WithField("keyID", locationData.GetKeyID()).Error("Invalid client certificate in the keystore")
+		return &tls.Certificate{}, nil
+	}
+	s.keyID = locationData.GetKeyID()
+	s.cert = &cert
+	return s.cert, nil
+}
+
+// configureClientTLS presents the location's client certificate to the cloud server, and trusts the server's CA from
+// CLOUD_BRIDGE_CA_FILE if it is set
+func configureClientTLS(store persistence.LocationKeyStore) error {
+	var rootCAs *x509.CertPool
+	if len(pkg.Config.CloudBridgeCAFile) > 0 {
+		caPEM, err := ioutil.ReadFile(pkg.Config.CloudBridgeCAFile)
+		if err != nil {
+			return err
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in %s", pkg.Config.CloudBridgeCAFile)
+		}
+	}
+	source := &clientCertificateSource{store: store}
+	bridgemodel.ConfigureDefaultTransportTLS(rootCAs, source.getClientCertificate)
+	return nil
+}
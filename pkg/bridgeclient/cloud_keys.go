@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudclient
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+// cloudKeyRefreshPeriod how often the cloud keys are fetched when nothing asked for them sooner
+const cloudKeyRefreshPeriod = time.Hour
+
+// cloudKeyMinFetchInterval stops a flood of messages with bad signatures from hammering the server
+const cloudKeyMinFetchInterval = time.Minute
+
+// cloudKeyRefresher keeps the stored cloud master public keys in step with the server's rotations.  A new set is
+// only stored if a key the location already trusts signed it
+type cloudKeyRefresher struct {
+	store persistence.LocationKeyStore
+	fetch func() (*msgs.CloudKeySet, error)
+	now   func() time.Time
+
+	lock      sync.Mutex
+	lastFetch time.Time
+}
+
+func newCloudKeyRefresher(store persistence.LocationKeyStore, serverURL string) *cloudKeyRefresher {
+	return &cloudKeyRefresher{
+		store: store,
+		fetch: func() (*msgs.CloudKeySet, error) {
+			keySet := new(msgs.CloudKeySet)
+			url := fmt.Sprintf("%s%s", serverURL, msgs.CLOUD_KEYS_PATH)
+			if err := bridgemodel.NewHttpClient().SendAuthorizedRequestWithBodyAndResp(http.MethodGet, url, nil, keySet); err != nil {
+				return nil, err
+			}
+			return keySet, nil
+		},
+		now: time.Now,
+	}
+}
+
+var cloudKeysLock sync.Mutex
+var cloudKeys *cloudKeyRefresher
+
+// startCloudKeyRefresher refreshes the cloud keys now and then every cloudKeyRefreshPeriod, and when a message from
+// the cloud does not verify with the keys the location has
+func startCloudKeyRefresher(store persistence.LocationKeyStore, serverURL string) {
+	refresher := newCloudKeyRefresher(store, serverURL)
+	cloudKeysLock.Lock()
+	first := cloudKeys == nil
+	cloudKeys = refresher
+	cloudKeysLock.Unlock()
+
+	msgs.SetSenderKeyRefresher(func(senderID string) bool {
+		if senderID != pkg.CLOUD_ID {
+			return false
+		}
+		changed, _ := getCloudKeyRefresher().refresh(false)
+		return changed
+	})
+	refresher.refresh(true)
+	if !first {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cloudKeyRefreshPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			getCloudKeyRefresher().refresh(true)
+		}
+	}()
+}
+
+func getCloudKeyRefresher() *cloudKeyRefresher {
+	cloudKeysLock.Lock()
+	defer cloudKeysLock.Unlock()
+	return cloudKeys
+}
+
+// refreshCloudKeys fetches the cloud keys, if the refresher is running
+func refreshCloudKeys() {
+	if refresher := getCloudKeyRefresher(); refresher != nil {
+		refresher.refresh(true)
+	}
+}
+
+// refresh fetches and stores the cloud keys, returns true if they changed.  Unless forced it does nothing if they
+// were fetched in the last cloudKeyMinFetchInterval
+func (r *cloudKeyRefresher) refresh(force bool) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	if !force && now.Sub(r.lastFetch) < cloudKeyMinFetchInterval {
+		return false, nil
+	}
+	r.lastFetch = now
+
+	keySet, err := r.fetch()
+	if err != nil {
+		// servers that do not rotate their key do not serve it either
+		log.WithError(err).Warn("Unable to fetch the cloud keys")
+		return false, err
+	}
+	changed, err := r.storeKeySet(keySet)
+	if err != nil {
+		log.WithError(err).Error("Unable to update the cloud keys")
+	}
+	return changed, err
+}
+
+// storeKeySet replaces the cloud location's keys with the set, the first key becomes its public key and key ID and the
+// rest its previous keys
+func (r *cloudKeyRefresher) storeKeySet(keySet *msgs.CloudKeySet) (bool, error) {
+	locationData, err := r.store.ReadLocation(pkg.CLOUD_ID)
+	if err != nil {
+		return false, err
+	}
+	trusted := make([]*rsa.PublicKey, 0, 1+len(locationData.GetPreviousPublicKeys()))
+	for _, pemKey := range append([][]byte{locationData.GetPublicKey()}, locationData.GetPreviousPublicKeys()...) {
+		publicKey, err := msgs.ParsePublicKey(pemKey)
+		if err != nil {
+			return false, err
+		}
+		trusted = append(trusted, publicKey)
+	}
+	// a location offline for longer than the key overlap has to register again
+	if err = keySet.Verify(trusted); err != nil {
+		return false, err
+	}
+
+	current := []byte(keySet.Current().PublicKey)
+	previous := make([][]byte, 0, len(keySet.Keys)-1)
+	for _, key := range keySet.Keys[1:] {
+		previous = append(previous, []byte(key.PublicKey))
+	}
+	currentKeyID := keySet.Current().KeyID
+	if bytes.Equal(current, locationData.GetPublicKey()) && samePublicKeys(previous, locationData.GetPreviousPublicKeys()) &&
+		currentKeyID == locationData.GetKeyID() {
+		return false, nil
+	}
+
+	locationData.PublicKey = current
+	locationData.KeyID = currentKeyID
+	locationData.SetPreviousPublicKeys(previous)
+	// a refresh racing this one fails with a conflict, the next refresh reads what it stored
+	if err = r.store.UpdateLocation(locationData); err != nil {
+		return false, err
+	}
+	log.WithField("keyID", currentKeyID).Info("Updated the cloud keys")
+	return true, nil
+}
+
+func samePublicKeys(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
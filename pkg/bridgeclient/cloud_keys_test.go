@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudclient
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// cloudLocationStore just the cloud location
+type cloudLocationStore struct {
+	cloud *types.LocationData
+}
+
+func (s *cloudLocationStore) ReadKeyPair(string) (*types.LocationData, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (s *cloudLocationStore) WriteKeyPair(*types.LocationData) error {
+	return fmt.Errorf("unsupported")
+}
+func (s *cloudLocationStore) RemoveKeyPair(string) error          { return fmt.Errorf("unsupported") }
+func (s *cloudLocationStore) LoadLocationID(string) string        { return "" }
+func (s *cloudLocationStore) RemoveLocation(string) error         { return fmt.Errorf("unsupported") }
+func (s *cloudLocationStore) ListKnownClients() ([]string, error) { return nil, nil }
+
+func (s *cloudLocationStore) WriteLocation(locationData types.LocationData) error {
+	if s.cloud != nil {
+		return fmt.Errorf("cloud location already exists")
+	}
+	s.cloud = &locationData
+	return nil
+}
+
+func (s *cloudLocationStore) UpdateLocation(locationData *types.LocationData) error {
+	if locationData.LocationID != pkg.CLOUD_ID || s.cloud == nil || s.cloud.Revision != locationData.Revision {
+		return types.ErrRevisionConflict
+	}
+	updated := *locationData
+	updated.Revision++
+	s.cloud = &updated
+	locationData.Revision = updated.Revision
+	return nil
+}
+
+func (s *cloudLocationStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	if locationID != pkg.CLOUD_ID || s.cloud == nil {
+		return nil, fmt.Errorf("no location %s", locationID)
+	}
+	ret := *s.cloud
+	return &ret, nil
+}
+
+func (s *cloudLocationStore) RemoveCloudMasterData() error {
+	s.cloud = nil
+	return nil
+}
+
+func newTestCloudKeyPair(t *testing.T) *types.LocationData {
+	pair, err := msgs.GenerateNewKeyPair()
+	assert.Nil(t, err)
+	ret, err := msgs.GetKeyPairLocationData(pkg.CLOUD_ID, pair)
+	assert.Nil(t, err)
+	return ret
+}
+
+func TestCloudKeyRefresher(t *testing.T) {
+	oldKey := newTestCloudKeyPair(t)
+	newKey := newTestCloudKeyPair(t)
+	otherKey := newTestCloudKeyPair(t)
+	store := &cloudLocationStore{cloud: &types.LocationData{LocationID: pkg.CLOUD_ID, PublicKey: oldKey.GetPublicKey()}}
+
+	keySet, err := msgs.SignCloudKeys([]*types.LocationData{newKey, oldKey})
+	assert.Nil(t, err)
+	fetches := 0
+	now := time.Now()
+	refresher := newCloudKeyRefresher(store, "")
+	refresher.now = func() time.Time { return now }
+	refresher.fetch = func() (*msgs.CloudKeySet, error) {
+		fetches++
+		return keySet, nil
+	}
+
+	changed, err := refresher.refresh(false)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, newKey.GetPublicKey(), store.cloud.GetPublicKey())
+	assert.Equal(t, [][]byte{oldKey.GetPublicKey()}, store.cloud.GetPreviousPublicKeys())
+	// messages to the cloud name the key they are encrypted to
+	assert.Equal(t, newKey.GetKeyID(), store.cloud.GetKeyID())
+
+	// fetched too recently
+	changed, err = refresher.refresh(false)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, fetches)
+
+	// nothing new
+	now = now.Add(cloudKeyMinFetchInterval)
+	changed, err = refresher.refresh(false)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 2, fetches)
+
+	// a set none of the trusted keys signed is not stored
+	keySet, err = msgs.SignCloudKeys([]*types.LocationData{otherKey})
+	assert.Nil(t, err)
+	changed, err = refresher.refresh(true)
+	assert.Equal(t, msgs.ErrCloudKeySetUntrusted, err)
+	assert.False(t, changed)
+	assert.Equal(t, newKey.GetPublicKey(), store.cloud.GetPublicKey())
+
+	// the retired key drops out
+	keySet, err = msgs.SignCloudKeys([]*types.LocationData{newKey})
+	assert.Nil(t, err)
+	changed, err = refresher.refresh(true)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, newKey.GetPublicKey(), store.cloud.GetPublicKey())
+	assert.Empty(t, store.cloud.GetPreviousPublicKeys())
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudclient
+
+import (
+	"container/list"
+	"sync"
+)
+
+// number of delivery IDs remembered for dropping redelivered messages
+const defaultDedupeSize = 4096
+
+// deliveryDeduper remembers the most recent delivery IDs so redelivered messages are only published once
+type deliveryDeduper struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+func newDeliveryDeduper(size int) *deliveryDeduper {
+	return &deliveryDeduper{
+		size:  size,
+		order: list.New(),
+		seen:  make(map[string]*list.Element),
+	}
+}
+
+// firstDelivery records the delivery ID, returns false if it was already seen.  Messages without an ID always
+// count as a first delivery
+func (d *deliveryDeduper) firstDelivery(deliveryID string) bool {
+	if len(deliveryID) == 0 {
+		return true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if e, exists := d.seen[deliveryID]; exists {
+		d.order.MoveToFront(e)
+		return false
+	}
+	d.seen[deliveryID] = d.order.PushFront(deliveryID)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.seen, oldest.Value.(string))
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryDeduper(t *testing.T) {
+	d := newDeliveryDeduper(2)
+
+	assert.True(t, d.firstDelivery("a"))
+	assert.False(t, d.firstDelivery("a"))
+	assert.True(t, d.firstDelivery(""))
+	assert.True(t, d.firstDelivery(""), "messages without an ID are never duplicates")
+
+	assert.True(t, d.firstDelivery("b"))
+	// a was used more recently than b was added, so b is the oldest when c pushes one out
+	assert.False(t, d.firstDelivery("a"))
+	assert.True(t, d.firstDelivery("c"))
+	assert.True(t, d.firstDelivery("b"))
+	assert.False(t, d.firstDelivery("c"))
+}
@@ -11,7 +11,6 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/theotw/natssync/pkg"
 	"github.com/theotw/natssync/pkg/bridgemodel"
-	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
 	"github.com/theotw/natssync/pkg/metrics"
 	"github.com/theotw/natssync/pkg/msgs"
 	"github.com/theotw/natssync/pkg/natsmodel"
@@ -27,12 +26,16 @@ type RestMessageHandler struct {
 	serverURL           string
 	stopFlag            bool
 	currentSubscription *nats.Subscription
+	deduper             *deliveryDeduper
+	// delivery IDs to ack on the next poll
+	pendingAcks []string
 }
 
 func NewRestMessageHandler(serverURL string) *RestMessageHandler {
 	ret := new(RestMessageHandler)
 	ret.serverURL = serverURL
 	ret.stopFlag = false
+	ret.deduper = newDeliveryDeduper(defaultDedupeSize)
 	return ret
 }
 func (t *RestMessageHandler) GetHandlerType() string {
@@ -53,29 +56,34 @@ func (t *RestMessageHandler) StopMessageHandler() {
 }
 func (t *RestMessageHandler) pullMessageFromCloud(clientID string) {
 	for !t.stopFlag {
-		msglist, err := getMessagesFromCloud(t.serverURL, clientID)
+		msglist, err := getMessagesFromCloud(t.serverURL, clientID, t.pendingAcks)
 		if err != nil {
 			log.Errorf("Error fetching messages %s", err.Error())
 			time.Sleep(2 * time.Second)
 			continue
 		}
+		t.pendingAcks = nil
 		log.Infof("Received %d messages from server", len(msglist))
 
 		for _, m := range msglist {
-			nc := natsmodel.GetNatsConnection()
-			var env msgs.MessageEnvelope
-			err = json.Unmarshal([]byte(m.MessageData), &env)
-			if err != nil {
-				log.Errorf("Error unmarshalling envelope %s", err.Error())
+			// messages that can not be handled are acked too, a redelivery would fail the same way
+			if len(m.DeliveryID) > 0 {
+				t.pendingAcks = append(t.pendingAcks, m.DeliveryID)
+			}
+			if !t.deduper.firstDelivery(m.DeliveryID) {
+				log.Debugf("Dropping redelivered message %s", m.DeliveryID)
 				continue
 			}
-
+			nc := natsmodel.GetNatsConnection()
 			var natmsg bridgemodel.NatsMessage
-			err := msgs.PullObjectFromEnvelope(&natmsg, &env)
+			err := msgs.PullObjectFromEnvelope(&natmsg, m.Envelope)
 			if err != nil {
 				log.Errorf("Error decoding envelope %s", err.Error())
 				continue
 			}
+			if msgs.DropIfExpired(natmsg.Expires, natmsg.Subject, clientID, msgs.EXPIRED_STAGE_CLIENT_INBOUND) {
+				continue
+			}
 			msgFormat := msgs.GetMsgFormat()
 			status, err := msgFormat.ValidateMsgFormat(natmsg.Data, pkg.Config.CloudEvents)
 			if err != nil {
@@ -108,14 +116,11 @@ func (t *RestMessageHandler) pullMessageFromCloud(clientID string) {
 				}
 
 				log.Infof("PublishRequest data to sub=%s with reply=%s", natmsg.Subject, natmsg.Reply)
-				if err := nc.PublishRequest(natmsg.Subject, natmsg.Reply, natmsg.Data); err != nil {
-					log.Errorf("Error publishing request: %s", err)
-				}
 			} else {
 				log.Infof("Publishing data to sub=%s", natmsg.Subject)
-				if err := nc.Publish(natmsg.Subject, natmsg.Data); err != nil {
-					log.Errorf("Error publishing request: %s", err)
-				}
+			}
+			if err := nc.PublishMsg(natmsg.NewNatsMsg()); err != nil {
+				log.Errorf("Error publishing request: %s", err)
 			}
 			nc.Flush()
 		}
@@ -179,8 +184,19 @@ func handleOutboundMessages(subscription *nats.Subscription, serverURL, clientID
 	}
 	log.Infof("Leaving Handle Outbound Messages ")
 }
+
+// newNatsMessageForCloud wraps the message to send to the cloud, returns nil if the message has already expired
+func newNatsMessageForCloud(msg *nats.Msg, clientID string, defaultTTL time.Duration) *bridgemodel.NatsMessage {
+	expires := msgs.GetMessageExpiry(msg.Header, time.Now(), defaultTTL)
+	if msgs.DropIfExpired(expires, msg.Subject, clientID, msgs.EXPIRED_STAGE_CLIENT_OUTBOUND) {
+		return nil
+	}
+	return &bridgemodel.NatsMessage{Reply: msg.Reply, Subject: msg.Subject, Data: msg.Data, Expires: expires, Header: msg.Header}
+}
+
 func sendMessageToCloud(serverURL string, clientID string, ceEnabled bool, msgsList ...*nats.Msg) {
-	messagesToSend := make([]v1.BridgeMessage, 0)
+	batch := new(msgs.Batch)
+	defaultTTL := msgs.GetDefaultTTL(pkg.CLOUD_ID)
 	for _, msg := range msgsList {
 		msgFormat := msgs.GetMsgFormat()
 		status, err := msgFormat.ValidateMsgFormat(msg.Data, ceEnabled)
@@ -193,32 +209,32 @@ func sendMessageToCloud(serverURL string, clientID string, ceEnabled bool, msgsL
 			continue
 		}
 
-		natmsg := bridgemodel.NatsMessage{Reply: msg.Reply, Subject: msg.Subject, Data: msg.Data}
-		envelope, enverr := msgs.PutObjectInEnvelope(natmsg, clientID, pkg.CLOUD_ID)
-		if enverr != nil {
-			log.Errorf("Error putting msg in envelope %s", enverr.Error())
+		natmsg := newNatsMessageForCloud(msg, clientID, defaultTTL)
+		if natmsg == nil {
 			continue
 		}
-		jsonbits, jsonerr := json.Marshal(&envelope)
-		if jsonerr != nil {
-			log.Errorf("Error encoding envelope to json bits, wkipping message %s", jsonerr.Error())
+		envelope, enverr := msgs.PutObjectInEnvelope(*natmsg, clientID, pkg.CLOUD_ID)
+		if enverr != nil {
+			log.Errorf("Error putting msg in envelope %s", enverr.Error())
 			continue
 		}
-		bmsg := v1.BridgeMessage{ClientID: clientID, MessageData: string(jsonbits), FormatVersion: "1"}
-		messagesToSend = append(messagesToSend, bmsg)
+		batch.Messages = append(batch.Messages, msgs.BatchMessage{ClientID: clientID, Envelope: envelope})
 
 	}
-	url := fmt.Sprintf("%s/bridge-server/1/message-queue/%s", serverURL, clientID)
+	path := msgs.MakeMessageQueuePath(clientID)
+	url := fmt.Sprintf("%s%s", serverURL, path)
 
 	for true {
-		fullPostReq := v1.BridgeMessagePostReq{
-			AuthChallenge: *msgs.NewAuthChallengeFromStoredKey(),
-			Messages:      messagesToSend,
+		batch.AuthChallenge = *msgs.NewAuthChallengeForRequest("", clientID, http.MethodPost, path)
+		contentType, body, encodeErr := encodeBatch(batch)
+		if encodeErr != nil {
+			log.WithError(encodeErr).Errorf("Error encoding messages.  Dropping the messages ")
+			return
 		}
 
 		httpclient := bridgemodel.NewHttpClient()
 		startpost := time.Now()
-		postErr := httpclient.SendAuthorizedRequestWithBodyAndResp(http.MethodPost, url, fullPostReq, nil)
+		_, _, postErr := httpclient.SendAuthorizedRequestWithContentType(http.MethodPost, url, contentType, msgs.CONTENT_TYPE_JSON, body)
 		//resp, postErr := http.DefaultClient.Post(url, "application/json", r)
 		if postErr != nil {
 			log.WithError(postErr).Errorf("Error sending message to server.  Dropping the messages ")
@@ -240,3 +256,17 @@ func sendMessageToCloud(serverURL string, clientID string, ceEnabled bool, msgsL
 	}
 
 }
+
+// encodeBatch the binary batch if the server reads them, otherwise the JSON BridgeMessagePostReq
+func encodeBatch(batch *msgs.Batch) (string, []byte, error) {
+	if msgs.UseBinaryBatches() {
+		bits, err := msgs.EncodeBatch(batch)
+		return msgs.CONTENT_TYPE_BINARY_BATCH, bits, err
+	}
+	req, err := batch.PostReq()
+	if err != nil {
+		return "", nil, err
+	}
+	bits, err := json.Marshal(req)
+	return msgs.CONTENT_TYPE_JSON, bits, err
+}
@@ -6,6 +6,7 @@ package cloudclient
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/nats-io/nats.go"
@@ -15,49 +16,196 @@ import (
 	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
 	"github.com/theotw/natssync/pkg/msgs"
 	"github.com/theotw/natssync/pkg/natsmodel"
+	"math/rand"
+	"net/http"
 	"net/url"
-	"strings"
+	"sync"
+	"time"
+)
+
+// reconnect backoff of the websocket transport
+const (
+	wsMinReconnectDelay = 1 * time.Second
+	wsMaxReconnectDelay = 60 * time.Second
+	// a connection that stayed up this long resets the backoff
+	wsHealthyConnection = 2 * msgs.WEBSOCKET_PING_PERIOD
 )
 
 // WebSocketMessageHandler A web socket based implementation of the BiDiMessageHanadler
 type WebSocketMessageHandler struct {
 	serverURL string
+	deduper   *deliveryDeduper
+	// websocket connections only support one concurrent writer
+	writeLock sync.Mutex
+	stop      chan struct{}
+	stopOnce  sync.Once
+	connLock  sync.Mutex
+	conn      *websocket.Conn
 }
 
 func NewWebSocketMessageHandler(serverURL string) *WebSocketMessageHandler {
 	ret := new(WebSocketMessageHandler)
 	ret.serverURL = serverURL
+	ret.deduper = newDeliveryDeduper(defaultDedupeSize)
+	ret.stop = make(chan struct{})
 	return ret
 }
 func (t *WebSocketMessageHandler) GetHandlerType() string {
 	return "web-socket"
 }
+
+// StartMessageHandler connects to the server and keeps reconnecting, with backoff, until the handler is stopped
 func (t *WebSocketMessageHandler) StartMessageHandler(clientID string) error {
-	urlSplit := strings.SplitAfterN(t.serverURL, "://", 2)
-	urlObject := url.URL{
-		Scheme: "ws",
-		Host:   urlSplit[1],
-		Path:   fmt.Sprintf("/bridge-server/1/message-queue/%s/ws", clientID),
+	if _, err := t.makeWebSocketURL(clientID); err != nil {
+		return err
+	}
+	go t.run(clientID)
+	return nil
+}
+
+func (t *WebSocketMessageHandler) StopMessageHandler() {
+	t.stopOnce.Do(func() { close(t.stop) })
+	t.connLock.Lock()
+	conn := t.conn
+	t.connLock.Unlock()
+	if conn != nil {
+		t.closeConn(conn, websocket.CloseNormalClosure)
+	}
+}
+
+func (t *WebSocketMessageHandler) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *WebSocketMessageHandler) run(clientID string) {
+	delay := wsMinReconnectDelay
+	for !t.stopped() {
+		started := time.Now()
+		if err := t.connectAndServe(clientID); err != nil {
+			log.WithError(err).Error("Websocket connection to the server failed")
+		}
+		if time.Since(started) > wsHealthyConnection {
+			delay = wsMinReconnectDelay
+		}
+		// jitter keeps locations from all reconnecting at once after a server restart
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.WithField("delay", wait).Info("Reconnecting websocket")
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > wsMaxReconnectDelay {
+			delay = wsMaxReconnectDelay
+		}
+	}
+}
+
+func (t *WebSocketMessageHandler) makeWebSocketURL(clientID string) (string, error) {
+	urlObject, err := url.Parse(t.serverURL)
+	if err != nil {
+		return "", err
+	}
+	switch urlObject.Scheme {
+	case "https", "wss":
+		urlObject.Scheme = "wss"
+	case "http", "ws":
+		urlObject.Scheme = "ws"
+	default:
+		return "", fmt.Errorf("unsupported server URL scheme %s", urlObject.Scheme)
+	}
+	// ask the server to wait for our acks before forgetting messages
+	query := url.Values{msgs.WEBSOCKET_ACKS_PARAM: []string{msgs.WEBSOCKET_ACKS_EXPLICIT}}
+	if msgs.UseBinaryBatches() {
+		query.Set(msgs.WEBSOCKET_FORMAT_PARAM, msgs.BATCH_FORMAT_BINARY)
+	}
+	urlObject.Path = msgs.MakeWebSocketPath(clientID)
+	urlObject.RawQuery = query.Encode()
+	return urlObject.String(), nil
+}
+
+// connectAndServe dials the server and moves messages until the connection ends
+func (t *WebSocketMessageHandler) connectAndServe(clientID string) error {
+	websocketURL, err := t.makeWebSocketURL(clientID)
+	if err != nil {
+		return err
 	}
-	websocketURL := urlObject.String()
 	log.WithField("websocketURL", websocketURL).Info("Using websocket transport")
 
-	conn, _, err := websocket.DefaultDialer.Dial(websocketURL, nil)
+	challenge := msgs.NewAuthChallengeForRequest("", clientID, http.MethodGet, msgs.MakeWebSocketPath(clientID))
+	if challenge == nil {
+		return errors.New("unable to create auth challenge")
+	}
+	headerVal, err := msgs.EncodeAuthChallengeHeader(challenge)
 	if err != nil {
-		log.WithError(err).WithField("url", websocketURL).Error("Failed to connect to websocket")
 		return err
 	}
-	go t.subscribeAndSendMessageToCloud(conn, clientID)
-	go t.ReadWSFromCloud(conn)
-	return nil
+	header := http.Header{}
+	header.Set(msgs.HEADER_AUTH_CHALLENGE, headerVal)
+
+	// same TLS settings, and client certificate, as the REST calls
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = bridgemodel.DefaultTransportTLSConfig()
+	conn, resp, err := dialer.Dial(websocketURL, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == pkg.StatusCertificateError {
+			log.Info("Server requires a certificate rotation before connecting")
+			t.rotateCert(clientID)
+		}
+		return err
+	}
+	t.connLock.Lock()
+	t.conn = conn
+	t.connLock.Unlock()
+	defer func() {
+		t.connLock.Lock()
+		t.conn = nil
+		t.connLock.Unlock()
+	}()
+	if t.stopped() {
+		t.closeConn(conn, websocket.CloseNormalClosure)
+		return nil
+	}
+
+	sub, err := t.subscribeAndSendMessageToCloud(conn, clientID)
+	if err != nil {
+		t.closeConn(conn, websocket.CloseGoingAway)
+		return err
+	}
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil {
+			log.WithError(err).Warning("Failed to unsubscribe from NATS")
+		}
+	}()
+	return t.ReadWSFromCloud(conn, clientID)
 }
-func (t *WebSocketMessageHandler) StopMessageHandler() {
-	//TODO Should probably do something here
+
+func (t *WebSocketMessageHandler) rotateCert(clientID string) {
+	if err := NewCertRotationHandler(t.serverURL, clientID).HandleCertRotation(); err != nil {
+		log.WithError(err).Error("Failed to rotate certificate")
+	}
 }
-func (t *WebSocketMessageHandler) subscribeAndSendMessageToCloud(conn *websocket.Conn, clientID string) {
+
+func (t *WebSocketMessageHandler) closeConn(conn *websocket.Conn, code int) {
+	t.writeLock.Lock()
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(msgs.WEBSOCKET_WRITE_WAIT))
+	t.writeLock.Unlock()
+	if err != nil && err != websocket.ErrCloseSent {
+		log.WithError(err).Debug("Unable to send websocket close message")
+	}
+	conn.Close()
+}
+
+func (t *WebSocketMessageHandler) subscribeAndSendMessageToCloud(conn *websocket.Conn, clientID string) (*nats.Subscription, error) {
 	nc := natsmodel.GetNatsConnection()
 	subject := fmt.Sprintf("%s.>", msgs.NATSSYNC_MESSAGE_PREFIX)
-	_, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
 		log.Info("Received NATS message to send to cloud via websocket")
 		parsedSubject, err := msgs.ParseSubject(msg.Subject)
 		if err != nil {
@@ -79,31 +227,21 @@ func (t *WebSocketMessageHandler) subscribeAndSendMessageToCloud(conn *websocket
 			return
 		}
 
-		natmsg := bridgemodel.NatsMessage{Reply: msg.Reply, Subject: msg.Subject, Data: msg.Data}
-		envelope, enverr := msgs.PutObjectInEnvelope(natmsg, clientID, pkg.CLOUD_ID)
-		if enverr != nil {
-			log.Errorf("Error putting msg in envelope %s", enverr.Error())
+		natmsg := newNatsMessageForCloud(msg, clientID, msgs.GetDefaultTTL(pkg.CLOUD_ID))
+		if natmsg == nil {
 			return
 		}
-		jsonbits, jsonerr := json.Marshal(&envelope)
-		if jsonerr != nil {
-			log.Errorf("Error encoding envelope to json bits, wkipping message %s", jsonerr.Error())
+		envelope, enverr := msgs.PutObjectInEnvelope(*natmsg, clientID, pkg.CLOUD_ID)
+		if enverr != nil {
+			log.Errorf("Error putting msg in envelope %s", enverr.Error())
 			return
 		}
-		var bmsgs []v1.BridgeMessage
-		bmsg := v1.BridgeMessage{ClientID: clientID, MessageData: string(jsonbits), FormatVersion: "1"}
-
-		request := v1.BridgeMessagePostReq{
-			AuthChallenge: *msgs.NewAuthChallengeFromStoredKey(),
-			Messages:      append(bmsgs, bmsg),
+		request := &msgs.Batch{
+			AuthChallenge: *msgs.NewAuthChallengeForRequest("", clientID, http.MethodPost, msgs.MakeWebSocketPath(clientID)),
+			Messages:      []msgs.BatchMessage{{ClientID: clientID, Envelope: envelope}},
 		}
 
-		msgJSON, err := json.Marshal(request)
-		if err != nil {
-			log.WithError(err).Error("Failed to marshal msg to JSON")
-			return
-		}
-		if err = conn.WriteMessage(websocket.TextMessage, msgJSON); err != nil {
+		if err = t.writeRequest(conn, request); err != nil {
 			log.WithError(err).Error("Failed to send message to websocket")
 			return
 		}
@@ -111,44 +249,167 @@ func (t *WebSocketMessageHandler) subscribeAndSendMessageToCloud(conn *websocket
 	})
 	if err != nil {
 		log.WithError(err).Error("Failed to subscribe to subject")
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (t *WebSocketMessageHandler) writeRequest(conn *websocket.Conn, request *msgs.Batch) error {
+	contentType, bits, err := encodeBatch(request)
+	if err != nil {
+		return err
+	}
+	frameType := websocket.TextMessage
+	if contentType == msgs.CONTENT_TYPE_BINARY_BATCH {
+		frameType = websocket.BinaryMessage
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	if err = conn.SetWriteDeadline(time.Now().Add(msgs.WEBSOCKET_WRITE_WAIT)); err != nil {
+		return err
+	}
+	return conn.WriteMessage(frameType, bits)
+}
+
+// sendAcks tells the server the messages were handled so they are not redelivered.  The acks of a frame go back in
+// one request, so there is one auth challenge to sign per frame rather than per message
+func (t *WebSocketMessageHandler) sendAcks(conn *websocket.Conn, clientID string, deliveryIDs []string) {
+	if len(deliveryIDs) == 0 {
 		return
 	}
+	request := &msgs.Batch{
+		AuthChallenge: *msgs.NewAuthChallengeForRequest("", clientID, http.MethodPost, msgs.MakeWebSocketPath(clientID)),
+		Acks:          deliveryIDs,
+	}
+	if err := t.writeRequest(conn, request); err != nil {
+		log.WithError(err).WithField("acks", len(deliveryIDs)).Error("Failed to ack messages, they will be redelivered")
+	}
 }
 
-func (t *WebSocketMessageHandler) ReadWSFromCloud(conn *websocket.Conn) {
-	nc := natsmodel.GetNatsConnection()
+// ReadWSFromCloud publishes the messages from the server until the connection ends.  The server pings every
+// WEBSOCKET_PING_PERIOD, not hearing from it for WEBSOCKET_PONG_WAIT means the connection is gone
+func (t *WebSocketMessageHandler) ReadWSFromCloud(conn *websocket.Conn, clientID string) error {
 	defer func() { conn.Close() }()
+	conn.SetReadDeadline(time.Now().Add(msgs.WEBSOCKET_PONG_WAIT))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(msgs.WEBSOCKET_PONG_WAIT))
+		t.writeLock.Lock()
+		defer t.writeLock.Unlock()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(msgs.WEBSOCKET_WRITE_WAIT))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
 	for {
-		_, msgBytes, err := conn.ReadMessage()
-		log.Info("Received message from the cloud via websocket")
-
+		msgType, msgBytes, err := conn.ReadMessage()
 		if err != nil {
+			if websocket.IsCloseError(err, msgs.WEBSOCKET_CLOSE_CERT_ROTATION) {
+				log.Info("Server closed the websocket for a certificate rotation")
+				t.rotateCert(clientID)
+				return nil
+			}
+			if t.stopped() || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
 			log.WithError(err).Error("Failed to read websocket message")
-			continue
+			return err
 		}
+		conn.SetReadDeadline(time.Now().Add(msgs.WEBSOCKET_PONG_WAIT))
+		log.Info("Received message from the cloud via websocket")
 
-		var bridgeMsg v1.BridgeMessage
-		if err = json.Unmarshal(msgBytes, &bridgeMsg); err != nil {
+		batchMsgs, control, err := readBridgeMsgFrame(msgType, msgBytes)
+		if err != nil {
 			log.WithError(err).Error("Failed to unmarshal message")
 			continue
 		}
-
-		var env msgs.MessageEnvelope
-		if err = json.Unmarshal([]byte(bridgeMsg.MessageData), &env); err != nil {
-			log.Errorf("Error unmarshalling envelope %s", err.Error())
-			continue
+		if control == msgs.WEBSOCKET_CONTROL_CERT_ROTATION {
+			// the server closes the connection after this, reconnecting needs the new key pair
+			log.Info("Server requested a certificate rotation")
+			t.rotateCert(clientID)
+			t.closeConn(conn, websocket.CloseNormalClosure)
+			return nil
 		}
-
-		var natmsg bridgemodel.NatsMessage
-		if err = msgs.PullObjectFromEnvelope(&natmsg, &env); err != nil {
-			log.WithError(err).Error("Failure pulling object from envelope")
+		if control == msgs.WEBSOCKET_CONTROL_CLOUD_KEYS {
+			log.Info("Server rotated its key")
+			refreshCloudKeys()
 			continue
 		}
+		acks := make([]string, 0, len(batchMsgs))
+		for i := range batchMsgs {
+			bridgeMsg := &batchMsgs[i]
+			if t.deduper.firstDelivery(bridgeMsg.DeliveryID) {
+				t.publishFromCloud(bridgeMsg)
+			} else {
+				log.Debugf("Dropping redelivered message %s", bridgeMsg.DeliveryID)
+			}
+			// messages that can not be handled are acked too, a redelivery would fail the same way
+			if len(bridgeMsg.DeliveryID) > 0 {
+				acks = append(acks, bridgeMsg.DeliveryID)
+			}
+		}
+		t.sendAcks(conn, clientID, acks)
+	}
+}
 
-		err = nc.PublishRequest(natmsg.Subject, natmsg.Reply, natmsg.Data)
+// readBridgeMsgFrame binary frames carry a binary batch, text frames a JSON bridge message, error or control frame.
+// Returns the control of a control frame
+func readBridgeMsgFrame(msgType int, msgBytes []byte) ([]msgs.BatchMessage, string, error) {
+	if msgType == websocket.BinaryMessage {
+		batch, err := msgs.DecodeBatch(msgBytes)
 		if err != nil {
-			log.WithError(err).WithField("message", natmsg).Error("Error attempting to publish message")
+			return nil, "", err
 		}
-		log.Info("Published message from websocket to NATS")
+		return batch.Messages, "", nil
+	}
+	// text frames are a bridge message, a WebSocketErrorFrame or a WebSocketControlFrame
+	var frame struct {
+		v1.BridgeMessage
+		v1.WebSocketErrorFrame
+		v1.WebSocketControlFrame
+	}
+	if err := json.Unmarshal(msgBytes, &frame); err != nil {
+		return nil, "", err
+	}
+	if len(frame.Control) > 0 {
+		return nil, frame.Control, nil
+	}
+	if frame.Error != nil {
+		log.WithFields(log.Fields{
+			"code":       frame.Error.Code,
+			"parameters": frame.Error.Parameters,
+			"retryAfter": frame.RetryAfter,
+		}).Error("Server rejected a websocket request, messages in it were dropped")
+		return nil, "", nil
+	}
+	bridgeMsg := frame.BridgeMessage
+	batchMsg, err := msgs.NewBatchMessage(&bridgeMsg)
+	if err != nil {
+		// the delivery is still acked, a redelivery would fail the same way
+		log.Errorf("Error unmarshalling envelope %s", err.Error())
+		return []msgs.BatchMessage{{ClientID: bridgeMsg.ClientID, DeliveryID: bridgeMsg.DeliveryID}}, "", nil
+	}
+	return []msgs.BatchMessage{*batchMsg}, "", nil
+}
+
+func (t *WebSocketMessageHandler) publishFromCloud(bridgeMsg *msgs.BatchMessage) {
+	if bridgeMsg.Envelope == nil {
+		return
+	}
+	var natmsg bridgemodel.NatsMessage
+	if err := msgs.PullObjectFromEnvelope(&natmsg, bridgeMsg.Envelope); err != nil {
+		log.WithError(err).Error("Failure pulling object from envelope")
+		return
+	}
+	if msgs.DropIfExpired(natmsg.Expires, natmsg.Subject, bridgeMsg.ClientID, msgs.EXPIRED_STAGE_CLIENT_INBOUND) {
+		return
+	}
+
+	nc := natsmodel.GetNatsConnection()
+	err := nc.PublishMsg(natmsg.NewNatsMsg())
+	if err != nil {
+		log.WithError(err).WithField("message", natmsg).Error("Error attempting to publish message")
+		return
 	}
+	log.Info("Published message from websocket to NATS")
 }
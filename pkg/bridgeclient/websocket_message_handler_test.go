@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+	"github.com/theotw/natssync/pkg/msgs"
+)
+
+func TestMakeWebSocketURL(t *testing.T) {
+	for serverURL, expected := range map[string]string{
+		"http://localhost:8080":  "ws://localhost:8080" + msgs.MakeWebSocketPath("client1"),
+		"https://bridge.example": "wss://bridge.example" + msgs.MakeWebSocketPath("client1"),
+	} {
+		wsURL, err := NewWebSocketMessageHandler(serverURL).makeWebSocketURL("client1")
+		assert.Nil(t, err)
+		assert.Contains(t, wsURL, expected+"?")
+		assert.Contains(t, wsURL, msgs.WEBSOCKET_ACKS_PARAM+"="+msgs.WEBSOCKET_ACKS_EXPLICIT)
+	}
+	_, err := NewWebSocketMessageHandler("ftp://bridge.example").makeWebSocketURL("client1")
+	assert.Error(t, err)
+}
+
+func TestReadBridgeMsgFrameControl(t *testing.T) {
+	bits, err := json.Marshal(&v1.WebSocketControlFrame{Control: msgs.WEBSOCKET_CONTROL_CERT_ROTATION})
+	assert.Nil(t, err)
+	batchMsgs, control, err := readBridgeMsgFrame(websocket.TextMessage, bits)
+	assert.Nil(t, err)
+	assert.Empty(t, batchMsgs)
+	assert.Equal(t, msgs.WEBSOCKET_CONTROL_CERT_ROTATION, control)
+
+	bits, err = json.Marshal(&v1.WebSocketErrorFrame{Error: &v1.ErrorResponse{Code: "rate.limited"}, RetryAfter: 2})
+	assert.Nil(t, err)
+	batchMsgs, control, err = readBridgeMsgFrame(websocket.TextMessage, bits)
+	assert.Nil(t, err)
+	assert.Empty(t, batchMsgs)
+	assert.Empty(t, control)
+}
+
+func TestReadWSFromCloudBatchesAcks(t *testing.T) {
+	saved := pkg.Config
+	defer func() { pkg.Config = saved }()
+	pkg.Config.KeystoreUrl = "file://" + t.TempDir()
+	if err := msgs.InitCloudKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the envelopes do not open, the messages are acked anyway
+	batch := &msgs.Batch{}
+	for _, deliveryID := range []string{"d1", "d2", "d3"} {
+		batch.Messages = append(batch.Messages, msgs.BatchMessage{
+			ClientID:   "client1",
+			DeliveryID: deliveryID,
+			Envelope:   &msgs.MessageEnvelope{EnvelopeVersion: msgs.ENVELOPE_VERSION_5, RecipientID: "client1"},
+		})
+	}
+	frame, err := msgs.EncodeBatch(batch)
+	assert.Nil(t, err)
+
+	acks := make(chan []string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err = conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msgType, bits, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType == websocket.BinaryMessage {
+			request, err := msgs.DecodeBatch(bits)
+			if assert.Nil(t, err) {
+				acks <- request.Acks
+			}
+		} else {
+			var request v1.BridgeMessagePostReq
+			if assert.Nil(t, json.Unmarshal(bits, &request)) {
+				acks <- request.Acks
+			}
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	handler := NewWebSocketMessageHandler(server.URL)
+	assert.Nil(t, handler.ReadWSFromCloud(conn, "client1"))
+
+	// one ack request for the whole frame
+	close(acks)
+	var received [][]string
+	for ack := range acks {
+		received = append(received, ack)
+	}
+	assert.Equal(t, [][]string{{"d1", "d2", "d3"}}, received)
+}
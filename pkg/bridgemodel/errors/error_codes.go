@@ -18,6 +18,12 @@ const (
 	INVALID_REGISTRATION_REQ       = "invalid.reg.request"
 	INVALID_PUB_KEY                = "invalid.pub.key"
 	INVALID_LOCATION_ID            = "invalid.location.id"
+	RATE_LIMITED                   = "rate.limited"
+	LOCATION_NOT_FOUND             = "location.not.found"
+	LOCATION_SUSPENDED             = "location.suspended"
+	RESERVED_METADATA              = "reserved.metadata"
+	INVALID_QUERY                  = "invalid.query"
+	LOCATION_CHANGED               = "location.changed"
 )
 
 const (
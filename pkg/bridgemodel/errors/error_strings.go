@@ -29,6 +29,12 @@ func mkUSMap() map[string]string {
 	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, ERROR_CODE_UNKNOWN)] = "An unknown error occurred.  "
 	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, INVALID_REGISTRATION_REQ)] = "The registration request was rejected by the registration auth system "
 	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, INVALID_PUB_KEY)] = "The given public key was not valid. "
+	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, RATE_LIMITED)] = "The location is over its rate limit. "
+	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, LOCATION_NOT_FOUND)] = "The location is not registered. "
+	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, LOCATION_SUSPENDED)] = "The location is suspended. "
+	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, RESERVED_METADATA)] = "The metadata key can not be set directly. "
+	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, INVALID_QUERY)] = "The query parameters are not valid. "
+	ret[fmt.Sprintf("%s.%s", BRIDGE_ERROR, LOCATION_CHANGED)] = "The location was changed by another request, try again. "
 
 	return ret
 }
@@ -14,4 +14,12 @@ type AboutResponse struct {
 	AppVersion string `json:"appVersion,omitempty"`
 
 	ApiVersions []string `json:"apiVersions,omitempty"`
+
+	EnvelopePolicy *EnvelopePolicy `json:"envelopePolicy,omitempty"`
+
+	// The payload compression algorithms the server can read
+	SupportedCompression []string `json:"supportedCompression,omitempty"`
+
+	// The content types the server accepts for message batches
+	BatchContentTypes []string `json:"batchContentTypes,omitempty"`
 }
@@ -11,9 +11,12 @@ package v1
 
 type AuthChallenge struct {
 
+	// 2 for a challenge bound to a location and request.  Version 1 challenges are rejected unless AUTH_CHALLENGE_ALLOW_LEGACY is set
 	Version float32 `json:"version,omitempty"`
 
+	// For version 2 a JSON object with timestamp (unix ms), nonce, locationID, method and path.  Each nonce is only accepted once
 	AuthChallengeA string `json:"authChallengeA,omitempty"`
 
+	// base64 RSA signature of authChallengeA made with the location private key
 	AuthChellengeB string `json:"authChellengeB,omitempty"`
 }
@@ -18,4 +18,7 @@ type BridgeMessage struct {
 
 	// Encrypted message data.
 	MessageData string `json:"messageData,omitempty"`
+
+	// Identifies the delivery for acks.  A redelivered message keeps its delivery ID so the client can drop duplicates
+	DeliveryID string `json:"deliveryID,omitempty"`
 }
@@ -0,0 +1,28 @@
+/*
+ * On Prem cloud side REST APIBridge REST API
+ *
+ * Cloud side service to move messages between on prem and cloud
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package v1
+
+type BridgeMessageGetReq struct {
+
+	// 2 for a challenge bound to a location and request.  Version 1 challenges are rejected unless AUTH_CHALLENGE_ALLOW_LEGACY is set
+	Version float32 `json:"version,omitempty"`
+
+	// For version 2 a JSON object with timestamp (unix ms), nonce, locationID, method and path.  Each nonce is only accepted once
+	AuthChallengeA string `json:"authChallengeA,omitempty"`
+
+	// base64 RSA signature of authChallengeA made with the location private key
+	AuthChellengeB string `json:"authChellengeB,omitempty"`
+
+	// True when the client acks messages by delivery ID.  Unacked messages are redelivered after a timeout
+	ExplicitAcks bool `json:"explicitAcks,omitempty"`
+
+	// Delivery IDs of messages the client has handled
+	Acks []string `json:"acks,omitempty"`
+}
@@ -14,4 +14,7 @@ type BridgeMessagePostReq struct {
 	AuthChallenge AuthChallenge `json:"authChallenge,omitempty"`
 
 	Messages []BridgeMessage `json:"messages,omitempty"`
+
+	// Delivery IDs of messages the client has handled.  Only used over the websocket
+	Acks []string `json:"acks,omitempty"`
 }
@@ -0,0 +1,23 @@
+/*
+ * On Prem cloud side REST APIBridge REST API
+ *
+ * Cloud side service to move messages between on prem and cloud
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package v1
+
+// EnvelopePolicy - The global message envelope policy of the server.  Locations may have a stricter policy
+type EnvelopePolicy struct {
+
+	// The lowest encrypted envelope version the server accepts
+	MinVersion int32 `json:"minVersion,omitempty"`
+
+	// If signed but unencrypted (version 4) envelopes are accepted
+	AllowPlaintext bool `json:"allowPlaintext,omitempty"`
+
+	// All envelope versions the server accepts
+	AcceptedVersions []int32 `json:"acceptedVersions,omitempty"`
+}
@@ -0,0 +1,40 @@
+/*
+ * On Prem cloud side REST APIBridge REST API
+ *
+ * Cloud side service to move messages between on prem and cloud
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package v1
+
+import (
+	"time"
+)
+
+type LocationDetails struct {
+
+	// The location ID
+	LocationID string `json:"locationID,omitempty"`
+
+	// ID of the location's current key pair
+	KeyID string `json:"keyID,omitempty"`
+
+	MetaData map[string]string `json:"metaData,omitempty"`
+
+	Created time.Time `json:"created,omitempty"`
+
+	LastModified time.Time `json:"lastModified,omitempty"`
+
+	LastKeypairRotation time.Time `json:"lastKeypairRotation,omitempty"`
+
+	// When the location last made an authenticated bridge request, updated every few minutes
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+
+	// True if the location has to rotate its key pair before it can move messages again
+	ForceKeypairRotation bool `json:"forceKeypairRotation,omitempty"`
+
+	// True if the location's bridge requests are rejected
+	Suspended bool `json:"suspended,omitempty"`
+}
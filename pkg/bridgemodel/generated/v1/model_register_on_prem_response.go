@@ -13,6 +13,12 @@ type RegisterOnPremResponse struct {
 
 	CloudPublicKey string `json:"cloudPublicKey,omitempty"`
 
+	// The key ID of cloudPublicKey, messages encrypted to the cloud name it
+	CloudKeyID string `json:"cloudKeyID,omitempty"`
+
+	// PEM client certificate for mutual TLS, issued when the server runs a client CA
+	ClientCertificate string `json:"clientCertificate,omitempty"`
+
 	MetaData map[string]string `json:"metaData,omitempty"`
 
 	// An ID to use for all other calls of post and get messages
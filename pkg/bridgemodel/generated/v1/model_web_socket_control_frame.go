@@ -0,0 +1,17 @@
+/*
+ * On Prem cloud side REST APIBridge REST API
+ *
+ * Cloud side service to move messages between on prem and cloud
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package v1
+
+// WebSocketControlFrame - Sent by the server as a text frame to tell the client to do something
+type WebSocketControlFrame struct {
+
+	// What to do.  cert-rotation means the location has to rotate its key pair, the server closes the connection after sending it
+	Control string `json:"control"`
+}
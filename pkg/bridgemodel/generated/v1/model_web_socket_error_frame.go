@@ -0,0 +1,18 @@
+/*
+ * On Prem cloud side REST APIBridge REST API
+ *
+ * Cloud side service to move messages between on prem and cloud
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package v1
+
+// WebSocketErrorFrame - Sent by the server as a text frame when it rejects a websocket request
+type WebSocketErrorFrame struct {
+	Error *ErrorResponse `json:"error"`
+
+	// Seconds to wait before sending again, when the request was rate limited
+	RetryAfter int32 `json:"retryAfter,omitempty"`
+}
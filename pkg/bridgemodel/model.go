@@ -4,6 +4,8 @@
 
 package bridgemodel
 
+import "github.com/nats-io/nats.go"
+
 const REGISTRATION_AUTH_SUBJECT = "natssync.auth.registration"
 const NATSPOST_AUTH_SUBJECT = "natssync.auth.natspost"
 const REGISTRATION_QUERY_AUTH_SUBJECT = "natssync.auth.queryreg"
@@ -11,14 +13,43 @@ const REGISTRATION_AUTH_WILDCARD = "natssync.auth.*"
 const UNREGISTRATION_AUTH_SUBJECT = "natssync.auth.unregister"
 const REGISTRATION_LIFECYCLE_ADDED = "natssync.registration.lifecyle.added"
 const REGISTRATION_LIFECYCLE_REMOVED = "natssync.registration.lifecyle.removed"
+
+// REGISTRATION_LIFECYCLE_KEY_ROTATED the data is the ID of the location whose key pair changed, CLOUD_ID for the
+// cloud master key
+const REGISTRATION_LIFECYCLE_KEY_ROTATED = "natssync.registration.lifecyle.keyrotated"
+
+// REGISTRATION_LIFECYCLE_UPDATED the data is the ID of the location whose record was changed, e.g. its metadata
+const REGISTRATION_LIFECYCLE_UPDATED = "natssync.registration.lifecyle.updated"
 const ACCOUNT_LIFECYCLE_REMOVED = "account.lifecycle.removed" // TODO: This should probably be configurable
 
+// auth subjects of the location admin API, the request is an AdminAuthRequest and the response a GenericAuthResponse
+const ADMIN_LOCATION_READ_AUTH_SUBJECT = "natssync.auth.adminread"
+const ADMIN_LOCATION_UPDATE_AUTH_SUBJECT = "natssync.auth.adminupdate"
+const ADMIN_LOCATION_ROTATE_AUTH_SUBJECT = "natssync.auth.adminrotate"
+const ADMIN_LOCATION_SUSPEND_AUTH_SUBJECT = "natssync.auth.adminsuspend"
+const ADMIN_LOCATION_DELETE_AUTH_SUBJECT = "natssync.auth.admindelete"
+
 //this is a generic message that will be encrypted and decrypted on the bridge.
 //Its basicly the NATS data
 type NatsMessage struct {
 	Subject string
 	Reply   string
 	Data    []byte
+	// Expires unix time in milliseconds after which the message is dropped, 0 means it never expires
+	Expires int64 `json:",omitempty"`
+	// Header the NATS headers of the message, nil for messages from bridges that did not carry headers
+	Header nats.Header `json:",omitempty"`
+}
+
+// NewNatsMsg the message to publish on this side of the bridge, with its headers
+func (m *NatsMessage) NewNatsMsg() *nats.Msg {
+	ret := nats.NewMsg(m.Subject)
+	ret.Reply = m.Reply
+	ret.Data = m.Data
+	for key, values := range m.Header {
+		ret.Header[key] = values
+	}
+	return ret
 }
 
 type HttpReqHeader struct {
@@ -44,6 +75,8 @@ type RegistrationRequest struct {
 	AuthToken string `json:"authToken"`
 	//for reference, this is generated by the bridge server
 	LocationID string `json:"locationID"`
+	//the metadata the location asked to register with
+	MetaData map[string]string `json:"metaData,omitempty"`
 }
 
 type UnRegistrationRequest struct {
@@ -61,6 +94,15 @@ type GenericAuthRequest struct {
 }
 type GenericAuthResponse struct {
 	Success bool `json:"success"`
+	// NoCache the decision is only good for this request, a single use token is used up by it
+	NoCache bool `json:"noCache,omitempty"`
+}
+
+// AdminAuthRequest asks the auth server if the token may act on the location, auth servers that only read
+// GenericAuthRequest can still answer it
+type AdminAuthRequest struct {
+	AuthToken  string `json:"authToken"`
+	LocationID string `json:"locationID"`
 }
 type UnRegistrationResponse struct {
 	Success bool `json:"success"`
@@ -7,6 +7,7 @@ package bridgemodel
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -56,13 +57,38 @@ func (t *HttpClient) SendAuthorizedRequestWithBodyAndResp(method string, url str
 	return e
 }
 
+// SendAuthorizedRequestWithContentType sends the body as is with the content type, and asks for the accept content
+// types in the response.  Returns the response content type and body
+func (t *HttpClient) SendAuthorizedRequestWithContentType(method string, url string, contentType string, accept string, body []byte) (string, []byte, error) {
+	resp, err := t.sendAuthorizedRequestWithHeaders(method, url, contentType, accept, body)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", nil, errors.New(fmt.Sprintf("status code %s", resp.Status))
+	}
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Header.Get("Content-Type"), bits, nil
+}
+
 func (t *HttpClient) sendAuthorizedRequest(method string, url string, body []byte) (response *http.Response, err error) {
+	return t.sendAuthorizedRequestWithHeaders(method, url, "", "application/json", body)
+}
+
+func (t *HttpClient) sendAuthorizedRequestWithHeaders(method string, url string, contentType string, accept string, body []byte) (response *http.Response, err error) {
 	log.Tracef("Sending Auth Req")
 	request, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
 		return
 	}
-	request.Header.Add("Accept", "application/json")
+	request.Header.Add("Accept", accept)
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
 	// Send the request
 	response, err = http.DefaultClient.Do(request)
 	return
@@ -79,3 +105,35 @@ func ConfigureDefaultTransportToSkipTlsValidation() {
 		dt.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
 	}
 }
+
+// DefaultTransportTLSConfig the TLS config of the default transport, for connections that do not go through it like
+// websockets.  Nil if it has none
+func DefaultTransportTLSConfig() *tls.Config {
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		return dt.TLSClientConfig
+	}
+	return nil
+}
+
+// ConfigureDefaultTransportTLS trusts rootCAs, if set, instead of the system roots and presents the client certificate
+// getClientCertificate returns when a server asks for one
+func ConfigureDefaultTransportTLS(rootCAs *x509.CertPool, getClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) {
+	dt, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return
+	}
+	if dt.TLSClientConfig == nil {
+		dt.TLSClientConfig = &tls.Config{}
+	}
+	if rootCAs != nil {
+		dt.TLSClientConfig.RootCAs = rootCAs
+	}
+	dt.TLSClientConfig.GetClientCertificate = getClientCertificate
+}
+
+// CloseIdleConnections drops the default transport's idle connections, so the next request makes a new TLS handshake
+func CloseIdleConnections() {
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		dt.CloseIdleConnections()
+	}
+}
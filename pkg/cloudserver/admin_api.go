@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/auth"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/bridgemodel/errors"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/natsmodel"
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// METADATA_SUSPENDED location metadata set to "true" while the location is suspended
+const METADATA_SUSPENDED = msgs.NATSSYNC_METADATA_PREFIX + "suspended"
+
+const adminLocationIDParam = "locationID"
+
+// adminSettableMetadata the NATSSYNC_METADATA_PREFIX keys the admin API can change.  The others are kept by natssync,
+// e.g. suspended is set by suspend and resume, and the supported compression by the location when it registers
+var adminSettableMetadata = map[string]bool{
+	msgs.METADATA_COMPRESSION:             true,
+	msgs.METADATA_ENVELOPE_MIN_VERSION:    true,
+	msgs.METADATA_ENVELOPE_DENY_PLAINTEXT: true,
+	msgs.METADATA_MESSAGE_DEFAULT_TTL:     true,
+	METADATA_RATE_LIMIT_MESSAGES_PER_SEC:  true,
+	METADATA_RATE_LIMIT_BYTES_PER_SEC:     true,
+	METADATA_RATE_LIMIT_MAX_BATCH_SIZE:    true,
+}
+
+// adminAPI the location administration endpoints.  Every call needs the admin scope for its action
+type adminAPI struct {
+	store     persistence.LocationKeyStore
+	authorize func(req *auth.Request) (bool, error)
+	publish   func(subject string, data []byte) error
+	// rotateCloudKey makes a new cloud master key and returns its key ID
+	rotateCloudKey func() (string, error)
+	cloudKeySet    func() (*msgs.CloudKeySet, error)
+}
+
+func newAdminAPI(store persistence.LocationKeyStore) *adminAPI {
+	return &adminAPI{
+		store:     store,
+		authorize: authorize,
+		publish: func(subject string, data []byte) error {
+			return natsmodel.GetNatsConnection().Publish(subject, data)
+		},
+		rotateCloudKey: func() (string, error) {
+			return serverCloudKeys.rotateKey()
+		},
+		cloudKeySet: msgs.NewCloudKeySet,
+	}
+}
+
+func (a *adminAPI) addRoutes(group *gin.RouterGroup) {
+	locations := group.Group("/admin/locations")
+	locations.Handle(http.MethodGet, "/:locationID", a.handleGetLocation)
+	locations.Handle(http.MethodPatch, "/:locationID/metadata", a.handlePatchMetadata)
+	locations.Handle(http.MethodPost, "/:locationID/rotate-keypair", a.handlePostRotateKeypair)
+	locations.Handle(http.MethodPost, "/:locationID/suspend", a.handlePostSuspend)
+	locations.Handle(http.MethodPost, "/:locationID/resume", a.handlePostResume)
+	locations.Handle(http.MethodDelete, "/:locationID", a.handleDeleteLocation)
+	group.Handle(http.MethodPost, "/admin/cloud-keys/rotate", a.handlePostRotateCloudKey)
+}
+
+// authorized checks the caller may take the action on the location.  Writes the error response and returns false
+// if not
+func (a *adminAPI) authorized(c *gin.Context, action string, locationID string) bool {
+	req := &auth.Request{Scope: auth.SCOPE_ADMIN, Action: action, Token: c.Request.Header.Get("x-Authorization"), LocationID: locationID}
+	ok, err := a.authorize(req)
+	if err != nil {
+		c.JSON(bridgemodel.HandleError(c, err))
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, "")
+		return false
+	}
+	return true
+}
+
+// authorizedLocation checks the caller may act on the location and reads it.  Writes the error response and
+// returns nil if not
+func (a *adminAPI) authorizedLocation(c *gin.Context, action string, update bool) *types.LocationData {
+	locationID := c.Param(adminLocationIDParam)
+	if !a.authorized(c, action, locationID) {
+		return nil
+	}
+	if update && locationID == pkg.CLOUD_ID {
+		ierr := errors.NewInternalErrorWithDataParam(errors.BRIDGE_ERROR, errors.INVALID_LOCATION_ID, locationID)
+		c.JSON(bridgemodel.HandleError(c, ierr))
+		return nil
+	}
+	locationData, err := a.store.ReadLocation(locationID)
+	if err != nil || locationData == nil {
+		log.WithError(err).WithField("locationID", locationID).Error("Unable to read location")
+		_, resp := bridgemodel.HandleError(c, errors.NewInternalErrorWithDataParam(errors.BRIDGE_ERROR, errors.LOCATION_NOT_FOUND, locationID))
+		c.JSON(http.StatusNotFound, resp)
+		return nil
+	}
+	return locationData
+}
+
+// writeLocation updates the location read by authorizedLocation, if it was changed since then the update is
+// refused with a 409
+func (a *adminAPI) writeLocation(c *gin.Context, action string, locationData *types.LocationData) bool {
+	locationData.UpdateLastModified()
+	if err := a.store.UpdateLocation(locationData); err != nil {
+		handleLocationUpdateError(c, locationData.GetLocationID(), err)
+		return false
+	}
+	log.WithField("locationID", locationData.GetLocationID()).WithField("action", action).Info("Location updated by admin")
+	// the other servers drop the location they cached, so a suspension or new metadata takes effect everywhere
+	if err := a.publish(bridgemodel.REGISTRATION_LIFECYCLE_UPDATED, []byte(locationData.GetLocationID())); err != nil {
+		log.WithError(err).WithField("locationID", locationData.GetLocationID()).Error("Unable to publish location update")
+	}
+	return true
+}
+
+// handleLocationUpdateError writes the response for a failed UpdateLocation, a revision conflict is a 409
+func handleLocationUpdateError(c *gin.Context, locationID string, err error) {
+	if err == types.ErrRevisionConflict {
+		log.WithField("locationID", locationID).Warn("Location was changed by another request while it was updated")
+		_, resp := bridgemodel.HandleError(c, errors.NewInternalErrorWithDataParam(errors.BRIDGE_ERROR, errors.LOCATION_CHANGED, locationID))
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	c.JSON(bridgemodel.HandleError(c, err))
+}
+
+func newLocationDetails(locationData *types.LocationData) *v1.LocationDetails {
+	return &v1.LocationDetails{
+		LocationID:           locationData.GetLocationID(),
+		KeyID:                locationData.GetKeyID(),
+		MetaData:             locationData.GetMetadata(),
+		Created:              locationData.GetCreated(),
+		LastModified:         locationData.GetLastModified(),
+		LastKeypairRotation:  locationData.GetLastKeyPairRotation(),
+		LastSeen:             locationData.GetLastSeen(),
+		ForceKeypairRotation: locationData.GetForceKeypairRotation(),
+		Suspended:            isSuspended(locationData),
+	}
+}
+
+func isSuspended(locationData *types.LocationData) bool {
+	return locationData.GetMetadata()[METADATA_SUSPENDED] == "true"
+}
+
+func (a *adminAPI) handleGetLocation(c *gin.Context) {
+	locationData := a.authorizedLocation(c, auth.ADMIN_ACTION_READ, false)
+	if locationData == nil {
+		return
+	}
+	c.JSON(http.StatusOK, newLocationDetails(locationData))
+}
+
+// handlePatchMetadata merges the body into the metadata, a null value removes the key.  Reserved keys are refused
+// with a 400
+func (a *adminAPI) handlePatchMetadata(c *gin.Context) {
+	locationData := a.authorizedLocation(c, auth.ADMIN_ACTION_UPDATE, true)
+	if locationData == nil {
+		return
+	}
+	var patch map[string]*string
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		code, ret := bridgemodel.HandleErrors(c, err)
+		c.JSON(code, &ret)
+		return
+	}
+	metadata := make(map[string]string)
+	for key, val := range locationData.GetMetadata() {
+		metadata[key] = val
+	}
+	for key, val := range patch {
+		if strings.HasPrefix(key, msgs.NATSSYNC_METADATA_PREFIX) && !adminSettableMetadata[key] {
+			ierr := errors.NewInternalErrorWithDataParam(errors.BRIDGE_ERROR, errors.RESERVED_METADATA, key)
+			c.JSON(bridgemodel.HandleError(c, ierr))
+			return
+		}
+		if val == nil {
+			delete(metadata, key)
+		} else {
+			metadata[key] = *val
+		}
+	}
+	locationData.SetMetadata(metadata)
+	if a.writeLocation(c, "patch-metadata", locationData) {
+		c.JSON(http.StatusOK, newLocationDetails(locationData))
+	}
+}
+
+// handlePostRotateKeypair the location's bridge requests get a 495 until it has registered a new key pair
+func (a *adminAPI) handlePostRotateKeypair(c *gin.Context) {
+	locationData := a.authorizedLocation(c, auth.ADMIN_ACTION_ROTATE, true)
+	if locationData == nil {
+		return
+	}
+	locationData.SetForcedKeypairRotation()
+	if a.writeLocation(c, "rotate-keypair", locationData) {
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+// handlePostRotateCloudKey makes a new cloud master key.  The old one stays valid until the reaper retires it
+// KEY_OVERLAP after the rotation, which gives the locations time to pick up the new one
+func (a *adminAPI) handlePostRotateCloudKey(c *gin.Context) {
+	if !a.authorized(c, auth.ADMIN_ACTION_ROTATE, pkg.CLOUD_ID) {
+		return
+	}
+	keyID, err := a.rotateCloudKey()
+	if err != nil {
+		c.JSON(bridgemodel.HandleError(c, err))
+		return
+	}
+	log.WithField("keyID", keyID).Info("Cloud master key rotated by admin")
+	keySet, err := a.cloudKeySet()
+	if err != nil {
+		c.JSON(bridgemodel.HandleError(c, err))
+		return
+	}
+	c.JSON(http.StatusOK, keySet)
+}
+
+func (a *adminAPI) handlePostSuspend(c *gin.Context) {
+	a.setSuspended(c, true)
+}
+
+func (a *adminAPI) handlePostResume(c *gin.Context) {
+	a.setSuspended(c, false)
+}
+
+func (a *adminAPI) setSuspended(c *gin.Context, suspended bool) {
+	locationData := a.authorizedLocation(c, auth.ADMIN_ACTION_SUSPEND, true)
+	if locationData == nil {
+		return
+	}
+	metadata := make(map[string]string)
+	for key, val := range locationData.GetMetadata() {
+		metadata[key] = val
+	}
+	action := "resume"
+	if suspended {
+		action = "suspend"
+		metadata[METADATA_SUSPENDED] = "true"
+	} else {
+		delete(metadata, METADATA_SUSPENDED)
+	}
+	locationData.SetMetadata(metadata)
+	if a.writeLocation(c, action, locationData) {
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+// handleDeleteLocation removes the location and tells the servers to drop its message queue
+func (a *adminAPI) handleDeleteLocation(c *gin.Context) {
+	locationData := a.authorizedLocation(c, auth.ADMIN_ACTION_DELETE, true)
+	if locationData == nil {
+		return
+	}
+	locationID := locationData.GetLocationID()
+	if err := a.store.RemoveLocation(locationID); err != nil {
+		c.JSON(bridgemodel.HandleError(c, err))
+		return
+	}
+	log.Tracef("Publishing subscription remove msg for clientID %s", locationID)
+	if err := a.publish(bridgemodel.REGISTRATION_LIFECYCLE_REMOVED, []byte(locationID)); err != nil {
+		log.WithError(err).WithField("locationID", locationID).Error("Unable to publish location removal")
+		c.JSON(bridgemodel.HandleError(c, err))
+		return
+	}
+	log.WithField("locationID", locationID).WithField("action", "delete").Info("Location deleted by admin")
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// locationSuspended true if the location is known and suspended
+func locationSuspended(store persistence.LocationKeyStore, locationID string) bool {
+	locationData, err := persistence.LoadLocation(store, locationID)
+	return err == nil && locationData != nil && isSuspended(locationData)
+}
+
+// enforceNotSuspended rejects the bridge requests of suspended locations with a 403
+func enforceNotSuspended(store persistence.LocationKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID := c.Param("premid")
+		if locationSuspended(store, clientID) {
+			log.WithField("clientID", clientID).Info("Rejected request from suspended location")
+			_, resp := bridgemodel.HandleError(c, errors.NewInternalErrorWithDataParam(errors.BRIDGE_ERROR, errors.LOCATION_SUSPENDED, clientID))
+			c.AbortWithStatusJSON(http.StatusForbidden, resp)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/auth"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// memoryKeyStore just the location calls the admin API makes
+type memoryKeyStore struct {
+	locations map[string]types.LocationData
+	// beforeUpdate is called at the start of UpdateLocation, to make changes that race it
+	beforeUpdate func()
+}
+
+func (m *memoryKeyStore) ReadKeyPair(string) (*types.LocationData, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *memoryKeyStore) WriteKeyPair(*types.LocationData) error { return fmt.Errorf("unsupported") }
+func (m *memoryKeyStore) RemoveKeyPair(string) error             { return fmt.Errorf("unsupported") }
+func (m *memoryKeyStore) LoadLocationID(string) string           { return "" }
+func (m *memoryKeyStore) RemoveCloudMasterData() error           { return fmt.Errorf("unsupported") }
+
+func (m *memoryKeyStore) WriteLocation(locationData types.LocationData) error {
+	m.locations[locationData.LocationID] = locationData
+	return nil
+}
+
+func (m *memoryKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	if m.beforeUpdate != nil {
+		m.beforeUpdate()
+	}
+	stored, ok := m.locations[locationData.LocationID]
+	if !ok || stored.Revision != locationData.Revision {
+		return types.ErrRevisionConflict
+	}
+	locationData.Revision++
+	m.locations[locationData.LocationID] = *locationData
+	return nil
+}
+
+func (m *memoryKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	locationData, ok := m.locations[locationID]
+	if !ok {
+		return nil, fmt.Errorf("no location %s", locationID)
+	}
+	return &locationData, nil
+}
+
+func (m *memoryKeyStore) RemoveLocation(locationID string) error {
+	delete(m.locations, locationID)
+	return nil
+}
+
+func (m *memoryKeyStore) ListKnownClients() ([]string, error) {
+	ret := make([]string, 0, len(m.locations))
+	for locationID := range m.locations {
+		ret = append(ret, locationID)
+	}
+	return ret, nil
+}
+
+func newTestAdminAPI() (*gin.Engine, *memoryKeyStore, *[]string) {
+	gin.SetMode(gin.TestMode)
+	store := &memoryKeyStore{locations: map[string]types.LocationData{
+		"loc1": {LocationID: "loc1", Metadata: map[string]string{"region": "east", "team": "a"}},
+	}}
+	var published []string
+	api := newAdminAPI(store)
+	api.authorize = func(req *auth.Request) (bool, error) {
+		return req.Token == "42", nil
+	}
+	api.publish = func(subject string, data []byte) error {
+		published = append(published, fmt.Sprintf("%s %s", subject, data))
+		return nil
+	}
+	router := gin.New()
+	api.addRoutes(router.Group("/bridge-server/1"))
+	router.Handle(http.MethodGet, "/message-queue/:premid", enforceNotSuspended(store), func(c *gin.Context) {
+		c.JSON(http.StatusOK, "")
+	})
+	return router, store, &published
+}
+
+func doAdminRequest(router *gin.Engine, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var bits []byte
+	if body != nil {
+		bits, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, "/bridge-server/1/admin/locations/"+path, bytes.NewReader(bits))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-Authorization", token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminGetLocation(t *testing.T) {
+	router, _, _ := newTestAdminAPI()
+
+	w := doAdminRequest(router, http.MethodGet, "loc1", "wrong", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doAdminRequest(router, http.MethodGet, "nope", "42", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doAdminRequest(router, http.MethodGet, "loc1", "42", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var details v1.LocationDetails
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &details))
+	assert.Equal(t, "loc1", details.LocationID)
+	assert.Equal(t, "east", details.MetaData["region"])
+	assert.False(t, details.Suspended)
+}
+
+func TestAdminPatchMetadata(t *testing.T) {
+	router, store, _ := newTestAdminAPI()
+	west := "west"
+	w := doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{"region": &west, "team": nil})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{"region": "west"}, store.locations["loc1"].Metadata)
+
+	yes := "true"
+	w = doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{METADATA_SUSPENDED: &yes})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	// removing one is refused as well, and nothing in the patch is applied
+	w = doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{"region": &yes, METADATA_SUSPENDED: nil})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	for _, key := range []string{msgs.METADATA_SUPPORTED_COMPRESSION, msgs.NATSSYNC_METADATA_PREFIX + "unknown"} {
+		w = doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{key: &yes})
+		assert.Equal(t, http.StatusBadRequest, w.Code, key)
+	}
+	assert.Equal(t, map[string]string{"region": "west"}, store.locations["loc1"].Metadata)
+
+	// the settings an operator keeps per location can be changed
+	limit := "10"
+	w = doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{METADATA_RATE_LIMIT_MESSAGES_PER_SEC: &limit})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", store.locations["loc1"].Metadata[METADATA_RATE_LIMIT_MESSAGES_PER_SEC])
+
+	w = doAdminRequest(router, http.MethodPatch, pkg.CLOUD_ID+"/metadata", "42", map[string]*string{"region": &west})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAdminRotateSuspendDelete(t *testing.T) {
+	router, store, published := newTestAdminAPI()
+
+	w := doAdminRequest(router, http.MethodPost, "loc1/rotate-keypair", "42", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.True(t, store.locations["loc1"].ForceKeypairRotation)
+
+	queueReq := httptest.NewRequest(http.MethodGet, "/message-queue/loc1", nil)
+	w = doAdminRequest(router, http.MethodPost, "loc1/suspend", "42", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, queueReq)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doAdminRequest(router, http.MethodPost, "loc1/resume", "42", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, queueReq)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{"region": "east", "team": "a"}, store.locations["loc1"].Metadata)
+
+	w = doAdminRequest(router, http.MethodDelete, "loc1", "42", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, store.locations)
+	// every change tells the other servers to drop the location they cached
+	assert.Equal(t, []string{
+		bridgemodel.REGISTRATION_LIFECYCLE_UPDATED + " loc1",
+		bridgemodel.REGISTRATION_LIFECYCLE_UPDATED + " loc1",
+		bridgemodel.REGISTRATION_LIFECYCLE_UPDATED + " loc1",
+		bridgemodel.REGISTRATION_LIFECYCLE_REMOVED + " loc1",
+	}, *published)
+}
+
+func TestAdminUpdateConflict(t *testing.T) {
+	router, store, _ := newTestAdminAPI()
+	west := "west"
+	w := doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{"region": &west})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), store.locations["loc1"].Revision)
+
+	// another replica changes the location between the read and the update
+	store.beforeUpdate = func() {
+		locationData := store.locations["loc1"]
+		locationData.Revision++
+		store.locations["loc1"] = locationData
+	}
+	w = doAdminRequest(router, http.MethodPost, "loc1/rotate-keypair", "42", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.False(t, store.locations["loc1"].ForceKeypairRotation)
+
+	east := "east"
+	w = doAdminRequest(router, http.MethodPatch, "loc1/metadata", "42", map[string]*string{"region": &east})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "west", store.locations["loc1"].Metadata["region"])
+}
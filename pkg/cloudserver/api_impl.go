@@ -27,6 +27,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/auth"
 	"github.com/theotw/natssync/pkg/bridgemodel"
 	"github.com/theotw/natssync/pkg/bridgemodel/errors"
 	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
@@ -50,27 +51,41 @@ func handleGetMessages(c *gin.Context) {
 
 	clientID := c.Param("premid")
 	log.Tracef("Handling get message request for clientID %s", clientID)
-	var in v1.AuthChallenge
+	// older clients send a plain AuthChallenge, which reads as a BridgeMessageGetReq without acks
+	var in v1.BridgeMessageGetReq
 	e := c.ShouldBindJSON(&in)
 	if e != nil {
 		_, ret := bridgemodel.HandleErrors(c, e)
 		c.JSON(http.StatusBadRequest, ret)
 		return
 	}
-	if !msgs.ValidateAuthChallenge(clientID, &in) {
+	challenge := v1.AuthChallenge{
+		Version:        in.Version,
+		AuthChallengeA: in.AuthChallengeA,
+		AuthChellengeB: in.AuthChellengeB,
+	}
+	if !validateAuthChallenge(clientID, c.Request.Method, c.Request.URL.Path, &challenge) {
 		c.JSON(http.StatusUnauthorized, "")
 		return
 	}
+	locationLastSeen.seen(clientID)
 
-	ret := make([]v1.BridgeMessage, 0)
+	ret := new(msgs.Batch)
 	metrics.IncrementTotalQueries(1)
-	sub := GetSubscriptionForClient(clientID)
+	queue := GetMessageQueueForClient(clientID)
 	start := time.Now()
-	if sub != nil {
+	if queue != nil {
+		if in.ExplicitAcks {
+			queue.Ack(in.Acks)
+		} else {
+			// the client only polls again once it has handled the previous batch
+			queue.AckDelivered()
+		}
 		keepWaiting := true
 		for keepWaiting {
-			m, e := sub.NextMsg(time.Duration(waitTimeout) * time.Millisecond)
+			qm, e := nextLiveMsg(queue, time.Duration(waitTimeout)*time.Millisecond, clientID)
 			if e == nil {
+				m := qm.Msg
 				if strings.HasSuffix(m.Subject, msgs.ECHO_SUBJECT_BASE) {
 					if len(m.Reply) == 0 {
 						log.Errorf("Got an echo message with no reply")
@@ -88,74 +103,112 @@ func handleGetMessages(c *gin.Context) {
 				plainMsg.Data = m.Data
 				plainMsg.Reply = m.Reply
 				plainMsg.Subject = m.Subject
+				plainMsg.Header = m.Header
+				plainMsg.Expires = qm.Expires
 
 				var envelopErr error
 				var envelope *msgs.MessageEnvelope
 				envelope, envelopErr = msgs.PutObjectInEnvelope(plainMsg, pkg.CLOUD_ID, clientID)
 
 				if envelopErr == nil {
-					jsonData, marshelError := json.Marshal(&envelope)
-					if marshelError == nil {
-						var bridgeMsg v1.BridgeMessage
-						bridgeMsg.MessageData = string(jsonData)
-						bridgeMsg.FormatVersion = "1"
-						bridgeMsg.ClientID = clientID
-						ret = append(ret, bridgeMsg)
-					} else {
-						log.Errorf("Error marshelling message in envelope %s \n", marshelError.Error())
-					}
+					ret.Messages = append(ret.Messages, msgs.BatchMessage{ClientID: clientID, DeliveryID: qm.DeliveryID, Envelope: envelope})
+					queue.Delivered(qm)
 				} else {
 					log.Errorf("Error putting message in envelope %s \n", envelopErr.Error())
 				}
-				keepWaiting = len(ret) < int(maxQueueSize)
+				keepWaiting = len(ret.Messages) < int(maxQueueSize)
 			} else {
 				keepWaiting = false
 				t := time.Now()
-				keepWaiting = t.Sub(start) < 30*time.Second && len(ret) == 0
+				keepWaiting = t.Sub(start) < 30*time.Second && len(ret.Messages) == 0
 			}
 		}
 	} else {
 		log.Errorf("Got a request for messages for a client ID that has no subscription %s \n", clientID)
 	}
 
+	writeBatch(c, ret)
+}
+
+// writeBatch responds with the binary batch if the client asks for it by name, otherwise the JSON list of bridge
+// messages.  Wildcard accepts get JSON, older clients and tools expect it
+func writeBatch(c *gin.Context, batch *msgs.Batch) {
+	if strings.Contains(c.GetHeader("Accept"), msgs.CONTENT_TYPE_BINARY_BATCH) {
+		bits, err := msgs.EncodeBatch(batch)
+		if err != nil {
+			log.WithError(err).Errorf("Error encoding binary batch")
+			c.JSON(http.StatusInternalServerError, "")
+			return
+		}
+		c.Data(http.StatusOK, msgs.CONTENT_TYPE_BINARY_BATCH, bits)
+		return
+	}
+	ret, err := batch.BridgeMessages()
+	if err != nil {
+		log.WithError(err).Errorf("Error marshelling messages in envelope")
+		c.JSON(http.StatusInternalServerError, "")
+		return
+	}
 	c.JSON(http.StatusOK, ret)
 }
 
+// readPostBatch reads a binary batch or a JSON BridgeMessagePostReq, based on the content type.  Messages that can
+// not be read are left out and their errors returned
+func readPostBatch(c *gin.Context) (*msgs.Batch, []error, error) {
+	if c.ContentType() == msgs.CONTENT_TYPE_BINARY_BATCH {
+		bits, err := c.GetRawData()
+		if err != nil {
+			return nil, nil, err
+		}
+		batch, err := msgs.DecodeBatch(bits)
+		return batch, nil, err
+	}
+	var in v1.BridgeMessagePostReq
+	if err := c.ShouldBindJSON(&in); err != nil {
+		return nil, nil, err
+	}
+	batch, msgErrs := msgs.NewBatchFromPostReq(&in)
+	return batch, msgErrs, nil
+}
+
 func handlePostMessage(c *gin.Context) {
 	clientID := c.Param("premid")
 	log.Debug(clientID)
-	var in v1.BridgeMessagePostReq
-	e := c.ShouldBindJSON(&in)
+	in, msgErrs, e := readPostBatch(c)
 
 	if e != nil {
 		_, ret := bridgemodel.HandleErrors(c, e)
 		c.JSON(http.StatusBadRequest, ret)
 		return
 	}
-	if !msgs.ValidateAuthChallenge(clientID, &in.AuthChallenge) {
+	if !validateAuthChallenge(clientID, c.Request.Method, c.Request.URL.Path, &in.AuthChallenge) {
 		log.Errorf("Got invalid message auth request in post messages %s", clientID)
 		c.JSON(http.StatusUnauthorized, "")
 		return
 	}
+	locationLastSeen.seen(clientID)
+	if limitErr := locationRateLimiter.allow(clientID, len(in.Messages), in.MessageBytes()); limitErr != nil {
+		respondRateLimited(c, limitErr)
+		return
+	}
 	nc := natsmodel.GetNatsConnection()
 	errors := make([]*v1.ErrorResponse, 0)
+	for _, err := range msgErrs {
+		log.Errorf("Error unmarshalling envelope %s", err.Error())
+		_, resp := bridgemodel.HandleError(c, err)
+		errors = append(errors, resp)
+	}
 	for _, msg := range in.Messages {
-		var envl msgs.MessageEnvelope
-		err := json.Unmarshal([]byte(msg.MessageData), &envl)
-		if err != nil {
-			log.Errorf("Error unmarshalling envelope %s", err.Error())
-			_, resp := bridgemodel.HandleError(c, err)
-			errors = append(errors, resp)
-			continue
-		}
-
 		var natmsg bridgemodel.NatsMessage
-		err = msgs.PullObjectFromEnvelope(&natmsg, &envl)
+		err := msgs.PullObjectFromEnvelope(&natmsg, msg.Envelope)
 		if err != nil {
 			log.Errorf("Error decoding envelope %s", err.Error())
 			_, resp := bridgemodel.HandleError(c, err)
 			errors = append(errors, resp)
 		}
+		if msgs.DropIfExpired(natmsg.Expires, natmsg.Subject, clientID, msgs.EXPIRED_STAGE_SERVER_INBOUND) {
+			continue
+		}
 		log.Tracef("Posting message to nats sub=%s, repl=%s", natmsg.Subject, natmsg.Reply)
 		if strings.HasSuffix(natmsg.Subject, msgs.ECHO_SUBJECT_BASE) {
 			if len(natmsg.Reply) == 0 {
@@ -170,12 +223,8 @@ func handlePostMessage(c *gin.Context) {
 				nc.Publish(echomsg.Subject, echomsg.Data)
 			}
 		}
-		m := nats.NewMsg(natmsg.Subject)
-		m.Header.Set("x-connection-id", clientID)
-		m.Data = natmsg.Data
-		if len(natmsg.Reply) > 0 {
-			m.Reply = natmsg.Reply
-		}
+		m := natmsg.NewNatsMsg()
+		m.Header.Set(HEADER_CONNECTION_ID, clientID)
 		nc.PublishMsg(m)
 		nc.Flush()
 	}
@@ -281,66 +330,74 @@ func handleMultipartFormRegistration(c *gin.Context) (ret *v1.RegisterOnPremReq,
 	return
 }
 
+// HEADER_NEXT_CURSOR set on a page of registered locations when there is a next page, pass it as the cursor parameter
+const HEADER_NEXT_CURSOR = "X-Next-Cursor"
+
 func handleGetRegisteredLocations(c *gin.Context) {
 	authHeader := c.Request.Header.Get("x-Authorization")
-	response, e := sendGenericAuthRequest(bridgemodel.REGISTRATION_QUERY_AUTH_SUBJECT, authHeader)
+	allowed, e := authorize(&auth.Request{Scope: auth.SCOPE_QUERYREG, Token: authHeader})
 	if e != nil {
 		code, ret := bridgemodel.HandleErrors(c, e)
 		c.JSON(code, &ret)
 		return
 	}
-	if !response.Success {
+	if !allowed {
 		c.JSON(http.StatusUnauthorized, "")
 		return
 	}
-	type filterKV struct {
-		k string
-		v string
-	}
-	filterKeys := make([]*filterKV, 0)
-	value, _ := c.GetQuery("filter")
-	filterElements := strings.Split(value, ",")
-	for _, x := range filterElements {
-		parts := strings.Split(x, "=")
-		if len(parts) == 2 {
-			kv := new(filterKV)
-			kv.k = parts[0]
-			kv.v = parts[1]
-			filterKeys = append(filterKeys, kv)
-		}
+	query, e := newLocationQuery(c)
+	if e != nil {
+		ierr := errors.NewInternalErrorWithDataParam(errors.BRIDGE_ERROR, errors.INVALID_QUERY, e.Error())
+		c.JSON(bridgemodel.HandleError(c, ierr))
+		return
 	}
-	store := persistence.GetKeyStore()
-	clients, e := store.ListKnownClients()
+	page, e := persistence.ListLocations(persistence.GetKeyStore(), query)
 	if e != nil {
 		code, ret := bridgemodel.HandleErrors(c, e)
 		c.JSON(code, &ret)
 		return
 	}
-	ret := make([]v1.RegisteredClientLocation, 0)
-	for _, client := range clients {
+	ret := make([]v1.RegisteredClientLocation, 0, len(page.Locations))
+	for _, locationData := range page.Locations {
 		var x v1.RegisteredClientLocation
-		locationData, e := store.ReadLocation(client)
-		if e == nil {
-			keymatch := false
-			for _, kv := range filterKeys {
-				actualValue := locationData.Metadata[kv.k]
-				keymatch = (actualValue == value)
-				if !keymatch {
-					break
-				}
-			}
-			if keymatch {
-				x.PremID = client
-				x.MetaData = locationData.Metadata
-				ret = append(ret, x)
-			}
-		} else {
-			log.Errorf("Unable to read location info for location ID %s", client)
-		}
+		x.PremID = locationData.GetLocationID()
+		x.MetaData = locationData.GetMetadata()
+		ret = append(ret, x)
+	}
+	if len(page.NextCursor) > 0 {
+		c.Header(HEADER_NEXT_CURSOR, page.NextCursor)
 	}
 	c.JSON(http.StatusOK, ret)
 }
 
+// newLocationQuery the location query from the request parameters.  selector is a Kubernetes style selector over
+// the metadata, filter is the older name for it
+func newLocationQuery(c *gin.Context) (*types.LocationQuery, error) {
+	selectorStr := c.Query("selector")
+	if len(selectorStr) == 0 {
+		selectorStr = c.Query("filter")
+	}
+	selector, err := types.ParseSelector(selectorStr)
+	if err != nil {
+		return nil, err
+	}
+	var descending bool
+	switch c.Query("order") {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	var limit int
+	if limitStr := c.Query("limit"); len(limitStr) > 0 {
+		if limit, err = strconv.Atoi(limitStr); err != nil {
+			return nil, fmt.Errorf("invalid limit %s", limitStr)
+		}
+	}
+	return types.NewLocationQuery(selector, c.Query("sortBy"), descending, limit, c.Query("cursor"))
+}
+
 func handlePostUnRegister(c *gin.Context) {
 	var in *v1.UnRegisterOnPremReq
 	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data") {
@@ -361,7 +418,7 @@ func handlePostUnRegister(c *gin.Context) {
 		}
 	}
 
-	response, e := sendUnRegRequestToAuthServer(in)
+	allowed, e := authorize(&auth.Request{Scope: auth.SCOPE_UNREGISTER, Token: in.AuthToken, LocationID: in.MetaData})
 	if e != nil {
 		metrics.IncrementClientUnRegistrationFailure(1)
 		code, ret := bridgemodel.HandleErrors(c, e)
@@ -370,7 +427,7 @@ func handlePostUnRegister(c *gin.Context) {
 	} else {
 		metrics.IncrementClientUnRegistrationSuccess(1)
 	}
-	if !response.Success {
+	if !allowed {
 		ierr := errors.NewInternalError(errors.BRIDGE_ERROR, errors.INVALID_REGISTRATION_REQ, nil)
 		c.JSON(bridgemodel.HandleError(c, ierr))
 		return
@@ -432,7 +489,7 @@ func handlePostRegister(c *gin.Context) {
 		c.JSON(bridgemodel.HandleError(c, ierr))
 		return
 	}
-	response, e := sendRegRequestToAuthServer(in)
+	allowed, e := authorize(&auth.Request{Scope: auth.SCOPE_REGISTER, Token: in.AuthToken, Metadata: in.MetaData})
 	if e != nil {
 		metrics.IncrementClientRegistrationFailure(1)
 		code, ret := bridgemodel.HandleErrors(c, e)
@@ -442,7 +499,7 @@ func handlePostRegister(c *gin.Context) {
 		metrics.IncrementClientRegistrationSuccess(1)
 	}
 
-	if !response.Success {
+	if !allowed {
 		ierr := errors.NewInternalError(errors.BRIDGE_ERROR, errors.INVALID_REGISTRATION_REQ, nil)
 		c.JSON(bridgemodel.HandleError(c, ierr))
 		return
@@ -458,7 +515,7 @@ func handlePostRegister(c *gin.Context) {
 		return
 	}
 
-	writeLocationData, err := types.NewLocationData(locationID, pubKeyBits, nil, in.MetaData)
+	writeLocationData, err := types.NewLocationData(locationID, pubKeyBits, nil, msgs.RemoveReservedMetadata(locationID, in.MetaData))
 	if err != nil {
 		code, ret := bridgemodel.HandleErrors(c, err)
 		c.JSON(code, &ret)
@@ -471,6 +528,14 @@ func handlePostRegister(c *gin.Context) {
 		return
 	}
 
+	clientCert, err := issueClientCertificate(locationID, pubKeyBits)
+	if err != nil {
+		log.WithError(err).WithField("locationID", locationID).Error("Unable to issue client certificate")
+		code, ret := bridgemodel.HandleErrors(c, err)
+		c.JSON(code, &ret)
+		return
+	}
+
 	err = store.WriteLocation(*writeLocationData)
 
 	if err != nil {
@@ -479,7 +544,9 @@ func handlePostRegister(c *gin.Context) {
 		return
 	}
 	resp.CloudPublicKey = string(locationData.PublicKey)
+	resp.CloudKeyID = locationData.GetKeyID()
 	resp.PremID = locationID
+	resp.ClientCertificate = string(clientCert)
 	nc := natsmodel.GetNatsConnection()
 	nc.Publish(bridgemodel.REGISTRATION_LIFECYCLE_ADDED, []byte(locationID))
 	AddNewSubscription(locationID, nc)
@@ -496,7 +563,7 @@ func handlePostCertRotation(c *gin.Context) {
 		return
 	}
 
-	if !msgs.ValidateAuthChallenge(in.PremID, &in.AuthChallenge) {
+	if !validateAuthChallenge(in.PremID, c.Request.Method, c.Request.URL.Path, &in.AuthChallenge) {
 		c.JSON(http.StatusUnauthorized, "")
 		return
 	}
@@ -528,97 +595,60 @@ func handlePostCertRotation(c *gin.Context) {
 		return
 	}
 
-	existingLocationData.SetKeyPair(pubKeyBits, nil).UpdateLastKeyPairRotation()
+	// a client that asks for one gets a certificate for its new key pair
+	var clientCert []byte
+	if in.ClientCertificate {
+		if clientCert, err = issueClientCertificate(in.PremID, pubKeyBits); err != nil {
+			log.WithError(err).WithField("locationID", in.PremID).Error("Unable to issue client certificate")
+			c.JSON(bridgemodel.HandleError(c, err))
+			return
+		}
+	}
+
+	// a new key pair satisfies a rotation forced by an admin
+	existingLocationData.SetKeyPair(pubKeyBits, nil).UpdateLastKeyPairRotation().UnsetForcedKeyPairRotation()
 	if err = existingLocationData.SetKeyID(in.KeyID); err != nil {
 		code, ret := bridgemodel.HandleErrors(c, err)
 		c.JSON(code, &ret)
 		return
 	}
 
-	err = store.RemoveLocation(existingLocationData.GetLocationID())
-	if err != nil {
-		code, ret := bridgemodel.HandleErrors(c, err)
-		c.JSON(code, &ret)
+	// a rotation racing another, from a retry or on another replica, gets a 409 rather than overwriting it
+	if err = store.UpdateLocation(existingLocationData); err != nil {
+		handleLocationUpdateError(c, in.PremID, err)
 		return
 	}
-
-	err = store.WriteLocation(*existingLocationData)
-	if err != nil {
-		code, ret := bridgemodel.HandleErrors(c, err)
-		c.JSON(code, &ret)
+	publishKeyRotated(in.PremID)
+	if len(clientCert) > 0 {
+		c.JSON(http.StatusOK, &msgs.CertRotationResponse{ClientCertificate: string(clientCert)})
 		return
 	}
 	c.JSON(http.StatusNoContent, "")
 }
 
-func sendRegRequestToAuthServer(in *v1.RegisterOnPremReq) (*bridgemodel.RegistrationResponse, error) {
-	timeout := time.Second * 30
-	nc := natsmodel.GetNatsConnection()
-	ret := new(bridgemodel.RegistrationResponse)
-	log.Tracef("Posting registration message to nats ")
-	regReq := bridgemodel.RegistrationRequest{AuthToken: in.AuthToken}
-	reqBits, _ := json.Marshal(&regReq)
-	respMsg, err := nc.Request(bridgemodel.REGISTRATION_AUTH_SUBJECT, reqBits, timeout)
-	if err != nil {
-		log.Errorf("Error sending to NATS %s", err.Error())
-		return nil, err
-	}
-	err = json.Unmarshal(respMsg.Data, ret)
-	if err != nil {
-		log.Errorf("Error decoding nats response %s", err.Error())
-		return nil, err
-	}
-	return ret, nil
-}
-
-func sendGenericAuthRequest(subject string, authToken string) (*bridgemodel.GenericAuthResponse, error) {
-	timeout := time.Second * 30
-	nc := natsmodel.GetNatsConnection()
-	ret := new(bridgemodel.GenericAuthResponse)
-	log.Tracef("Posting generic auth message to nats ")
-	regReq := bridgemodel.GenericAuthRequest{AuthToken: authToken}
-	reqBits, _ := json.Marshal(&regReq)
-	respMsg, err := nc.Request(subject, reqBits, timeout)
-	if err != nil {
-		log.Errorf("Error sending to NATS %s", err.Error())
-	}
-	err = json.Unmarshal(respMsg.Data, ret)
-	if err != nil {
-		log.Errorf("Error decoding unregister nats response %s", err.Error())
-		return nil, err
-	}
-	return ret, nil
-}
-
-func sendUnRegRequestToAuthServer(in *v1.UnRegisterOnPremReq) (*bridgemodel.UnRegistrationResponse, error) {
-	timeout := time.Second * 30
-	nc := natsmodel.GetNatsConnection()
-	ret := new(bridgemodel.UnRegistrationResponse)
-	log.Infof("Posting Unregistration message to nats with %s", in.AuthToken)
-	unregReq := bridgemodel.UnRegistrationRequest{AuthToken: in.AuthToken}
-	reqBits, _ := json.Marshal(&unregReq)
-	respMsg, err := nc.Request(bridgemodel.UNREGISTRATION_AUTH_SUBJECT, reqBits, timeout)
-	if err != nil {
-		log.Errorf("Error sending unregister message to NATS %s", err.Error())
-		return nil, err
-	}
-	err = json.Unmarshal(respMsg.Data, ret)
-	if err != nil {
-		log.Errorf("Error decoding unregister nats response %s", err.Error())
-		return nil, err
-	}
-	return ret, nil
-}
-
 func aboutGetUnversioned(c *gin.Context) {
 	var resp v1.AboutResponse
 	resp.AppVersion = pkg.VERSION // Run `make generate` to create version
 	resp.ApiVersions = make([]string, 0)
 	resp.ApiVersions = append(resp.ApiVersions, "1")
+	resp.EnvelopePolicy = getEnvelopePolicyResponse()
+	resp.SupportedCompression = msgs.SupportedCompression
+	resp.BatchContentTypes = msgs.SupportedBatchContentTypes
 	log.Tracef("About call %s", resp.ApiVersions)
 	c.JSON(http.StatusOK, resp)
 }
 
+func getEnvelopePolicyResponse() *v1.EnvelopePolicy {
+	policy := msgs.GetGlobalEnvelopePolicy()
+	ret := new(v1.EnvelopePolicy)
+	ret.MinVersion = int32(policy.MinVersion)
+	ret.AllowPlaintext = policy.AllowPlaintext
+	for _, version := range policy.AcceptedVersions() {
+		ret.AcceptedVersions = append(ret.AcceptedVersions, int32(version))
+	}
+	return ret
+}
+
 func healthCheckGetUnversioned(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{})
 }
@@ -640,13 +670,13 @@ func natsMsgPostHandler(c *gin.Context) {
 		return
 	}
 
-	response, e := sendGenericAuthRequest(bridgemodel.NATSPOST_AUTH_SUBJECT, msg.AuthToken)
+	allowed, e := authorize(&auth.Request{Scope: auth.SCOPE_NATSPOST, Token: msg.AuthToken})
 	if e != nil {
 		code, ret := bridgemodel.HandleErrors(c, e)
 		c.JSON(code, &ret)
 		return
 	}
-	if !response.Success {
+	if !allowed {
 		c.JSON(http.StatusUnauthorized, "")
 		return
 	}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+	"github.com/theotw/natssync/pkg/msgs"
+)
+
+func newTestBatch() *msgs.Batch {
+	return &msgs.Batch{
+		AuthChallenge: v1.AuthChallenge{Version: 2, AuthChallengeA: "a", AuthChellengeB: "b"},
+		Messages: []msgs.BatchMessage{{
+			ClientID:   "client1",
+			DeliveryID: "delivery1",
+			Envelope:   &msgs.MessageEnvelope{EnvelopeVersion: 5, RecipientID: "client1", Message: "aGVsbG8=", Signature: "c2ln"},
+		}},
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	batch := newTestBatch()
+	for accept, expected := range map[string]string{
+		"":                                       msgs.CONTENT_TYPE_JSON,
+		"*/*":                                    msgs.CONTENT_TYPE_JSON,
+		msgs.CONTENT_TYPE_JSON:                   msgs.CONTENT_TYPE_JSON,
+		msgs.CONTENT_TYPE_BINARY_BATCH + ", */*": msgs.CONTENT_TYPE_BINARY_BATCH,
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.Header.Set("Accept", accept)
+		writeBatch(c, batch)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), expected, accept)
+		if expected == msgs.CONTENT_TYPE_BINARY_BATCH {
+			batch2, err := msgs.DecodeBatch(w.Body.Bytes())
+			assert.Nil(t, err)
+			assert.Equal(t, batch.Messages, batch2.Messages)
+		} else {
+			var bridgeMsgs []v1.BridgeMessage
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &bridgeMsgs))
+			assert.Len(t, bridgeMsgs, 1)
+		}
+	}
+}
+
+func TestReadPostBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	batch := newTestBatch()
+	binaryBits, err := msgs.EncodeBatch(batch)
+	assert.Nil(t, err)
+	req, err := batch.PostReq()
+	assert.Nil(t, err)
+	jsonBits, err := json.Marshal(req)
+	assert.Nil(t, err)
+
+	for contentType, body := range map[string][]byte{msgs.CONTENT_TYPE_BINARY_BATCH: binaryBits, msgs.CONTENT_TYPE_JSON: jsonBits} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		c.Request.Header.Set("Content-Type", contentType)
+
+		batch2, msgErrs, err := readPostBatch(c)
+		assert.Nil(t, err, contentType)
+		assert.Empty(t, msgErrs)
+		assert.Equal(t, batch, batch2, contentType)
+	}
+}
@@ -43,6 +43,17 @@ func RunBridgeServerApp(test bool) {
 	if keyError := msgs.InitCloudKey(); keyError != nil {
 		log.Fatalf("Unable to initialize the key manager. Ending the app %s", keyError.Error())
 	}
+	InitCloudKeyRotation()
+	InitAuthChallengeValidator()
+	if authError := InitAuthorizer(); authError != nil {
+		log.Fatalf("Unable to initialize the authorizer. Ending the app %s", authError.Error())
+	}
+	if caError := InitClientCA(); caError != nil {
+		log.Fatalf("Unable to initialize the client CA. Ending the app %s", caError.Error())
+	}
+	if pkg.Config.MTLSRequired && len(pkg.Config.TLSCertFile) == 0 {
+		log.Fatalf("MTLS_REQUIRED needs the server to terminate TLS, set TLS_CERT_FILE and TLS_KEY_FILE")
+	}
 	if subError := InitSubscriptionMgr(); subError != nil {
 		log.Fatalf("Unable to initialize the subscription manager. Ending the app %s", subError.Error())
 	}
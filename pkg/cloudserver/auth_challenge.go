@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+	"github.com/theotw/natssync/pkg/msgs"
+)
+
+const defaultAuthChallengeMaxSkew = 2 * time.Minute
+
+var authChallengeValidator *msgs.AuthChallengeValidator
+
+// InitAuthChallengeValidator sets up the validator used for all location auth challenges
+func InitAuthChallengeValidator() {
+	maxSkew := defaultAuthChallengeMaxSkew
+	if skew, err := time.ParseDuration(pkg.Config.AuthChallengeMaxSkew); err != nil {
+		log.WithError(err).Errorf("failed to parse auth challenge max skew, using %v", maxSkew)
+	} else {
+		maxSkew = skew
+	}
+	if pkg.Config.AuthChallengeAllowLegacy {
+		log.Warn("AUTH_CHALLENGE_ALLOW_LEGACY was set to true! Legacy auth challenges can be replayed")
+	}
+
+	log.Infof("setting auth challenge max skew to %v", maxSkew.String())
+	authChallengeValidator = msgs.NewAuthChallengeValidator(maxSkew, msgs.NewMemoryNonceCache(), pkg.Config.AuthChallengeAllowLegacy)
+}
+
+// validateAuthChallenge checks the challenge against the location and the request it came in on
+func validateAuthChallenge(locationID, method, path string, challenge *v1.AuthChallenge) bool {
+	if err := authChallengeValidator.Validate(locationID, method, path, challenge); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"locationID": locationID,
+			"method":     method,
+			"path":       path,
+		}).Errorf("Rejected auth challenge")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg/auth"
+)
+
+var serverAuthorizer auth.Authorizer
+
+// InitAuthorizer sets up the authorizer picked by AUTH_MODE for registration, query, post and admin requests
+func InitAuthorizer() error {
+	authorizer, err := auth.NewAuthorizer()
+	if err != nil {
+		return err
+	}
+	serverAuthorizer = authorizer
+	return nil
+}
+
+// authorize asks the server authorizer if the token may be used for the scope
+func authorize(req *auth.Request) (bool, error) {
+	if serverAuthorizer == nil {
+		return false, errors.New("authorizer is not initialized")
+	}
+	ok, err := serverAuthorizer.Authorize(req)
+	if err != nil {
+		log.WithError(err).WithField("scope", req.Scope).Error("Unable to authorize request")
+		return false, err
+	}
+	if !ok {
+		log.WithField("scope", req.Scope).WithField("action", req.Action).WithField("locationID", req.LocationID).Debug("Request not authorized")
+	}
+	return ok, nil
+}
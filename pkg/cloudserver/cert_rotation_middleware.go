@@ -1,6 +1,7 @@
 package cloudserver
 
 import (
+	"crypto/tls"
 	"os"
 	"time"
 
@@ -22,17 +23,22 @@ type certMiddleware struct {
 }
 
 func NewCertMiddleware(persistence persistence.LocationKeyStore) *certMiddleware {
-	certRotationTimeout := defaultCertRotationTimeout
+	certRotationTimeout := getCertRotationTimeout()
+	log.Infof("setting cert rotation timeout to %v", certRotationTimeout.String())
+	return NewCertMiddlewareDetailed(certRotationTimeout, persistence)
+}
 
+// getCertRotationTimeout how long a location keeps its key pair before it is sent to rotate it
+func getCertRotationTimeout() time.Duration {
 	if timeoutString, exists := os.LookupEnv(certRotationTimeoutEnvKey); exists {
-		if timeout, err := time.ParseDuration(timeoutString); err != nil {
+		timeout, err := time.ParseDuration(timeoutString)
+		if err != nil {
 			log.WithError(err).Errorf("failed to parse timeout from environment")
-		} else {
-			certRotationTimeout = timeout
+			return defaultCertRotationTimeout
 		}
+		return timeout
 	}
-	log.Infof("setting cert rotation timeout to %v", certRotationTimeout.String())
-	return NewCertMiddlewareDetailed(certRotationTimeout, persistence)
+	return defaultCertRotationTimeout
 }
 
 func NewCertMiddlewareDetailed(timeout time.Duration, persistence persistence.LocationKeyStore) *certMiddleware {
@@ -46,19 +52,32 @@ func (c *certMiddleware) Enforce(ginContext *gin.Context) {
 
 	clientID := ginContext.Param("premid")
 
-	data, err := c.persistence.ReadLocation(clientID)
+	if c.NeedsRotation(clientID) || c.CertificateExpiring(ginContext.Request.TLS) {
+		log.WithField("clientID", clientID).Infof("sending out cert rotation request")
+		ginContext.AbortWithStatusJSON(pkg.StatusCertificateError, "")
+		return
+	}
+
+	ginContext.Next()
+}
+
+// NeedsRotation true if the location's key pair is too old or a rotation was forced
+func (c *certMiddleware) NeedsRotation(clientID string) bool {
+	data, err := persistence.LoadLocation(c.persistence, clientID)
 	if err != nil {
 		log.Warning("failed to read location data from persistence")
-	} else {
+		return false
+	}
 
-		timePeriodSinceLastCertRotation := time.Now().Sub(data.GetLastKeyPairRotation())
+	timePeriodSinceLastCertRotation := time.Now().Sub(data.GetLastKeyPairRotation())
+	return timePeriodSinceLastCertRotation >= c.timeout || data.GetForceKeypairRotation()
+}
 
-		if timePeriodSinceLastCertRotation >= c.timeout || data.GetForceKeypairRotation() {
-			log.WithField("clientID", clientID).Infof("sending out cert rotation request")
-			ginContext.AbortWithStatusJSON(pkg.StatusCertificateError, "")
-			return
-		}
+// CertificateExpiring true if the client certificate runs out within the rotation timeout, the rotation renews it
+// while it still works
+func (c *certMiddleware) CertificateExpiring(state *tls.ConnectionState) bool {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return false
 	}
-
-	ginContext.Next()
+	return time.Now().Add(c.timeout).After(state.VerifiedChains[0][0].NotAfter)
 }
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+const (
+	defaultClientCertValidity = 30 * 24 * time.Hour
+	clientCAValidity          = 10 * 365 * 24 * time.Hour
+	// clientCertBackdate allows for clocks that are a little behind the server's
+	clientCertBackdate = 5 * time.Minute
+)
+
+// clientCA the internal CA that issues location client certificates for mutual TLS
+type clientCA struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	validity time.Duration
+	now      func() time.Time
+}
+
+// serverClientCA set by InitClientCA when CLIENT_CA_ENABLED is true
+var serverClientCA *clientCA
+
+// InitClientCA loads the client CA from CLIENT_CA_CERT_FILE and CLIENT_CA_KEY_FILE, creating it the first time
+func InitClientCA() error {
+	if !pkg.Config.ClientCAEnabled {
+		if pkg.Config.MTLSRequired {
+			return errors.New("MTLS_REQUIRED needs CLIENT_CA_ENABLED")
+		}
+		return nil
+	}
+	validity := defaultClientCertValidity
+	if len(pkg.Config.ClientCertValidity) > 0 {
+		if v, err := time.ParseDuration(pkg.Config.ClientCertValidity); err != nil || v <= 0 {
+			log.WithError(err).Errorf("failed to parse client cert validity, using %v", defaultClientCertValidity)
+		} else {
+			validity = v
+		}
+	}
+	// a certificate has to outlast the rotation that renews it
+	if rotation := getCertRotationTimeout(); validity <= rotation {
+		return fmt.Errorf("CLIENT_CERT_VALIDITY %v must be longer than CERT_ROTATION_TIMEOUT %v", validity, rotation)
+	}
+	ca, err := loadOrCreateClientCA(pkg.Config.ClientCACertFile, pkg.Config.ClientCAKeyFile)
+	if err != nil {
+		return err
+	}
+	ca.validity = validity
+	serverClientCA = ca
+	log.Infof("client CA %s is issuing client certificates valid for %v", ca.cert.Subject.CommonName, validity)
+	return nil
+}
+
+func loadOrCreateClientCA(certFile, keyFile string) (*clientCA, error) {
+	certPEM, certErr := ioutil.ReadFile(certFile)
+	keyPEM, keyErr := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Infof("No client CA found at %s, creating one", certFile)
+		return createClientCA(certFile, keyFile)
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	return parseClientCA(certPEM, keyPEM)
+}
+
+func parseClientCA(certPEM, keyPEM []byte) (*clientCA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("the client CA certificate is not a CA")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported client CA key")
+	}
+	return &clientCA{cert: cert, key: key, validity: defaultClientCertValidity, now: time.Now}, nil
+}
+
+// newClientCA a new self signed CA
+func newClientCA() (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "natssync client CA " + pkg.CLOUD_ID, Organization: []string{"natssync"}},
+		NotBefore:             now.Add(-clientCertBackdate),
+		NotAfter:              now.Add(clientCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func createClientCA(certFile, keyFile string) (*clientCA, error) {
+	certPEM, keyPEM, err := newClientCA()
+	if err != nil {
+		return nil, err
+	}
+	// a CA that is not saved would orphan every certificate it issues when the server restarts
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("unable to save the client CA key: %v", err)
+	}
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("unable to save the client CA certificate: %v", err)
+	}
+	return parseClientCA(certPEM, keyPEM)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// issue a client certificate for the location's public key, the location ID is the common name
+func (ca *clientCA) issue(locationID string, publicKeyPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := ca.now()
+	notAfter := now.Add(ca.validity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: locationID, Organization: []string{"natssync"}},
+		NotBefore:    now.Add(-clientCertBackdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, publicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("locationID", locationID).WithField("notAfter", notAfter).Info("Issued client certificate")
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// issueClientCertificate a certificate for the location if the client CA is running, nil if not
+func issueClientCertificate(locationID string, publicKeyPEM []byte) ([]byte, error) {
+	if serverClientCA == nil {
+		return nil, nil
+	}
+	return serverClientCA.issue(locationID, publicKeyPEM)
+}
+
+func (ca *clientCA) certPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// newServerTLSConfig asks for client certificates from the client CA, they are only required on the message queue
+// routes so registration still works without one
+func newServerTLSConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if serverClientCA != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = serverClientCA.certPool()
+	}
+	return config
+}
+
+// enforceClientCertificate requires a verified client certificate for the premid and the location's current key.  A
+// location without one is sent to rotate its key pair, which issues it a certificate
+func enforceClientCertificate(store persistence.LocationKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID := c.Param("premid")
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			log.WithField("clientID", clientID).Info("No client certificate, sending out cert rotation request")
+			c.AbortWithStatusJSON(pkg.StatusCertificateError, "")
+			return
+		}
+		cert := c.Request.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName != clientID {
+			log.WithField("clientID", clientID).WithField("subject", cert.Subject.CommonName).Warn("Client certificate is for another location")
+			c.AbortWithStatusJSON(http.StatusForbidden, "")
+			return
+		}
+		locationData, err := persistence.LoadLocation(store, clientID)
+		if err != nil || locationData == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "")
+			return
+		}
+		// a certificate for a key the location has rotated away from is no longer good
+		if !certificateMatchesKey(cert, locationData.GetPublicKey()) {
+			log.WithField("clientID", clientID).Info("Client certificate is for an old key pair, sending out cert rotation request")
+			c.AbortWithStatusJSON(pkg.StatusCertificateError, "")
+			return
+		}
+		c.Next()
+	}
+}
+
+func certificateMatchesKey(cert *x509.Certificate, publicKeyPEM []byte) bool {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return false
+	}
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(certKey, block.Bytes)
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// newTestLocationKey a location key pair in the keystore's PEM formats
+func newTestLocationKey(t *testing.T, locationID string) *types.LocationData {
+	pair, err := msgs.GenerateNewKeyPair()
+	assert.Nil(t, err)
+	locationData, err := msgs.GetKeyPairLocationData(locationID, pair)
+	assert.Nil(t, err)
+	return locationData
+}
+
+func TestClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	ca, err := loadOrCreateClientCA(certFile, keyFile)
+	assert.Nil(t, err)
+
+	// the second load reads the CA that was saved
+	ca2, err := loadOrCreateClientCA(certFile, keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, ca.cert.Raw, ca2.cert.Raw)
+
+	location := newTestLocationKey(t, "loc1")
+	certPEM, err := ca2.issue("loc1", location.GetPublicKey())
+	assert.Nil(t, err)
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	assert.Equal(t, "loc1", cert.Subject.CommonName)
+	assert.True(t, certificateMatchesKey(cert, location.GetPublicKey()))
+	assert.False(t, certificateMatchesKey(cert, newTestLocationKey(t, "loc1").GetPublicKey()))
+
+	_, err = cert.Verify(x509.VerifyOptions{Roots: ca.certPool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.Nil(t, err)
+
+	// the certificate goes with the private key the location already has
+	_, err = tls.X509KeyPair(certPEM, location.GetPrivateKey())
+	assert.Nil(t, err)
+
+	_, err = ca.issue("loc1", []byte("not a key"))
+	assert.Error(t, err)
+
+	// a cert without its key is an error, not a new CA
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("junk"), 0600))
+	_, err = loadOrCreateClientCA(certFile, keyFile)
+	assert.Error(t, err)
+}
+
+func TestEnforceClientCertificate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ca, err := loadOrCreateClientCA(filepath.Join(t.TempDir(), "ca.crt"), filepath.Join(t.TempDir(), "ca.key"))
+	assert.Nil(t, err)
+	location := newTestLocationKey(t, "loc1")
+	store := &memoryKeyStore{locations: map[string]types.LocationData{"loc1": *location}}
+
+	certFor := func(locationID string, locationData *types.LocationData) *x509.Certificate {
+		certPEM, err := ca.issue(locationID, locationData.GetPublicKey())
+		assert.Nil(t, err)
+		block, _ := pem.Decode(certPEM)
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		return cert
+	}
+	router := gin.New()
+	router.Handle(http.MethodGet, "/message-queue/:premid", enforceClientCertificate(store), func(c *gin.Context) {
+		c.JSON(http.StatusOK, "")
+	})
+	doRequest := func(premID string, cert *x509.Certificate) int {
+		req := httptest.NewRequest(http.MethodGet, "/message-queue/"+premID, nil)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, doRequest("loc1", certFor("loc1", location)))
+	assert.Equal(t, pkg.StatusCertificateError, doRequest("loc1", nil))
+	assert.Equal(t, http.StatusForbidden, doRequest("loc1", certFor("loc2", location)))
+	// a certificate for a key the location rotated away from
+	assert.Equal(t, pkg.StatusCertificateError, doRequest("loc1", certFor("loc1", newTestLocationKey(t, "loc1"))))
+	assert.Equal(t, http.StatusUnauthorized, doRequest("loc2", certFor("loc2", location)))
+}
+
+func TestInitClientCAValidity(t *testing.T) {
+	saved := pkg.Config
+	savedCA := serverClientCA
+	defer func() {
+		pkg.Config = saved
+		serverClientCA = savedCA
+	}()
+	dir := t.TempDir()
+	pkg.Config.ClientCAEnabled = true
+	pkg.Config.ClientCACertFile, pkg.Config.ClientCAKeyFile = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	// certificates that run out before the rotation that renews them are refused
+	pkg.Config.ClientCertValidity = "24h"
+	assert.Error(t, InitClientCA())
+	defer os.Unsetenv(certRotationTimeoutEnvKey)
+	os.Setenv(certRotationTimeoutEnvKey, "48h")
+	pkg.Config.ClientCertValidity = "36h"
+	assert.Error(t, InitClientCA())
+
+	pkg.Config.ClientCertValidity = "72h"
+	assert.Nil(t, InitClientCA())
+	assert.Equal(t, 72*time.Hour, serverClientCA.validity)
+}
+
+func TestCertMiddlewareCertificateExpiring(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ca, err := loadOrCreateClientCA(filepath.Join(t.TempDir(), "ca.crt"), filepath.Join(t.TempDir(), "ca.key"))
+	assert.Nil(t, err)
+	location := newTestLocationKey(t, "loc1")
+	location.LastKeypairRotation = time.Now()
+	store := &memoryKeyStore{locations: map[string]types.LocationData{"loc1": *location}}
+	middleware := NewCertMiddlewareDetailed(24*time.Hour, store)
+
+	router := gin.New()
+	router.Handle(http.MethodGet, "/message-queue/:premid", middleware.Enforce, func(c *gin.Context) {
+		c.JSON(http.StatusOK, "")
+	})
+	doRequest := func(validity time.Duration) int {
+		ca.validity = validity
+		certPEM, err := ca.issue("loc1", location.GetPublicKey())
+		assert.Nil(t, err)
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/message-queue/loc1", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, doRequest(48*time.Hour))
+	// the key pair is new, but the certificate would run out before the next rotation
+	assert.Equal(t, pkg.StatusCertificateError, doRequest(12*time.Hour))
+}
+
+func TestClientCAHandshake(t *testing.T) {
+	ca, err := loadOrCreateClientCA(filepath.Join(t.TempDir(), "ca.crt"), filepath.Join(t.TempDir(), "ca.key"))
+	assert.Nil(t, err)
+	ca.validity = time.Hour
+	saved := serverClientCA
+	serverClientCA = ca
+	defer func() { serverClientCA = saved }()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	server.TLS = newServerTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	location := newTestLocationKey(t, "loc1")
+	certPEM, err := issueClientCertificate("loc1", location.GetPublicKey())
+	assert.Nil(t, err)
+	clientCert, err := tls.X509KeyPair(certPEM, location.GetPrivateKey())
+	assert.Nil(t, err)
+
+	get := func(certs []tls.Certificate) string {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		bits, _ := ioutil.ReadAll(resp.Body)
+		return string(bits)
+	}
+	assert.Equal(t, "loc1", get([]tls.Certificate{clientCert}))
+	// the certificate is optional at the TLS layer, registration does not have one yet
+	assert.Equal(t, "", get(nil))
+}
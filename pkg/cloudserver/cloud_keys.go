@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/natsmodel"
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// cloudKeyCheckPeriod how often the latest cloud key is checked, so a rotation on another server instance is seen
+const cloudKeyCheckPeriod = time.Minute
+
+// cloudKeyRotator rotates the cloud master key once it is older than the interval, and remembers the current key ID
+// so websocket connections can tell their location when it changes
+type cloudKeyRotator struct {
+	lock         sync.Mutex
+	currentKeyID string
+	// interval 0 turns scheduled rotation off
+	interval time.Duration
+	latest   func() (*types.LocationData, error)
+	rotate   func() (string, error)
+	now      func() time.Time
+}
+
+func newCloudKeyRotator(interval time.Duration) *cloudKeyRotator {
+	return &cloudKeyRotator{
+		interval: interval,
+		latest: func() (*types.LocationData, error) {
+			return persistence.GetKeyStore().ReadKeyPair("")
+		},
+		rotate: msgs.RotateCloudKey,
+		now:    time.Now,
+	}
+}
+
+var serverCloudKeys = newCloudKeyRotator(0)
+
+// InitCloudKeyRotation reads CLOUD_KEY_ROTATION_INTERVAL and starts watching the cloud key
+func InitCloudKeyRotation() {
+	var interval time.Duration
+	if len(pkg.Config.CloudKeyRotationInterval) > 0 {
+		var err error
+		interval, err = time.ParseDuration(pkg.Config.CloudKeyRotationInterval)
+		if err != nil || interval < 0 {
+			log.WithError(err).Errorf("Invalid cloud key rotation interval %s, scheduled rotation is off", pkg.Config.CloudKeyRotationInterval)
+			interval = 0
+		}
+	}
+	serverCloudKeys = newCloudKeyRotator(interval)
+	serverCloudKeys.check()
+	go func() {
+		ticker := time.NewTicker(cloudKeyCheckPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			serverCloudKeys.check()
+		}
+	}()
+}
+
+// check rotates the key if it is due and refreshes the current key ID
+func (r *cloudKeyRotator) check() {
+	latest, err := r.latest()
+	if err != nil {
+		log.WithError(err).Error("Unable to read the cloud master key")
+		return
+	}
+	keyID := latest.GetKeyID()
+	if r.interval > 0 && r.now().Sub(latest.GetCreated()) >= r.interval {
+		if keyID, err = r.rotateKey(); err != nil {
+			return
+		}
+	}
+	r.setCurrentKeyID(keyID)
+}
+
+func (r *cloudKeyRotator) rotateKey() (string, error) {
+	keyID, err := r.rotate()
+	if err != nil {
+		log.WithError(err).Error("Unable to rotate the cloud master key")
+		return "", err
+	}
+	r.setCurrentKeyID(keyID)
+	publishKeyRotated(pkg.CLOUD_ID)
+	return keyID, nil
+}
+
+// publishKeyRotated tells the other servers to drop the keys they cached for the location
+func publishKeyRotated(locationID string) {
+	nc := natsmodel.GetNatsConnection()
+	if nc == nil {
+		return
+	}
+	if err := nc.Publish(bridgemodel.REGISTRATION_LIFECYCLE_KEY_ROTATED, []byte(locationID)); err != nil {
+		log.WithError(err).WithField("locationID", locationID).Error("Unable to publish key rotation")
+	}
+}
+
+func (r *cloudKeyRotator) setCurrentKeyID(keyID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.currentKeyID = keyID
+}
+
+// CurrentKeyID the key the cloud signs with, as of the last check
+func (r *cloudKeyRotator) CurrentKeyID() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.currentKeyID
+}
+
+// handleGetCloudKeys the signed cloud key set, it needs no auth since every key in it vouches for the others
+func handleGetCloudKeys(c *gin.Context) {
+	keySet, err := msgs.NewCloudKeySet()
+	if err != nil {
+		log.WithError(err).Error("Unable to make the cloud key set")
+		c.JSON(bridgemodel.HandleError(c, err))
+		return
+	}
+	c.JSON(http.StatusOK, keySet)
+}
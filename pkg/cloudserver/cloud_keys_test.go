@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/auth"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+func newTestCloudKeyRotator(interval time.Duration, created time.Time) (*cloudKeyRotator, *[]string) {
+	var rotated []string
+	r := newCloudKeyRotator(interval)
+	r.latest = func() (*types.LocationData, error) {
+		return &types.LocationData{KeyID: "key1", Created: created}, nil
+	}
+	r.rotate = func() (string, error) {
+		rotated = append(rotated, "key2")
+		return "key2", nil
+	}
+	return r, &rotated
+}
+
+func TestCloudKeyRotatorCheck(t *testing.T) {
+	now := time.Now()
+
+	// scheduled rotation is off
+	r, rotated := newTestCloudKeyRotator(0, now.Add(-1000*time.Hour))
+	r.check()
+	assert.Empty(t, *rotated)
+	assert.Equal(t, "key1", r.CurrentKeyID())
+
+	// not due yet
+	r, rotated = newTestCloudKeyRotator(24*time.Hour, now.Add(-time.Hour))
+	r.check()
+	assert.Empty(t, *rotated)
+	assert.Equal(t, "key1", r.CurrentKeyID())
+
+	r, rotated = newTestCloudKeyRotator(24*time.Hour, now.Add(-25*time.Hour))
+	r.check()
+	assert.Equal(t, []string{"key2"}, *rotated)
+	assert.Equal(t, "key2", r.CurrentKeyID())
+}
+
+func TestAdminRotateCloudKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var authorized []*auth.Request
+	rotated := 0
+	api := newAdminAPI(&memoryKeyStore{locations: map[string]types.LocationData{}})
+	api.authorize = func(req *auth.Request) (bool, error) {
+		authorized = append(authorized, req)
+		return req.Token == "42", nil
+	}
+	api.rotateCloudKey = func() (string, error) {
+		rotated++
+		return "key2", nil
+	}
+	api.cloudKeySet = func() (*msgs.CloudKeySet, error) {
+		return &msgs.CloudKeySet{Keys: []msgs.CloudKey{{KeyID: "key2"}, {KeyID: "key1"}}}, nil
+	}
+	router := gin.New()
+	api.addRoutes(router.Group("/bridge-server/1"))
+
+	for token, expected := range map[string]int{"wrong": http.StatusUnauthorized, "42": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "/bridge-server/1/admin/cloud-keys/rotate", nil)
+		req.Header.Set("x-Authorization", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Code, token)
+		if expected == http.StatusOK {
+			var keySet msgs.CloudKeySet
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &keySet))
+			assert.Equal(t, "key2", keySet.Current().KeyID)
+		}
+	}
+	assert.Equal(t, 1, rotated)
+	for _, req := range authorized {
+		assert.Equal(t, auth.SCOPE_ADMIN, req.Scope)
+		assert.Equal(t, auth.ADMIN_ACTION_ROTATE, req.Action)
+		assert.Equal(t, pkg.CLOUD_ID, req.LocationID)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+)
+
+const defaultDeliveryAckWait = 1 * time.Minute
+
+// maxPendingDeliveries caps the unacked messages held per location, past this messages are sent at most once
+const maxPendingDeliveries = 10000
+
+// getDeliveryAckWait how long a delivered message waits for the client's ack before it is redelivered
+func getDeliveryAckWait() time.Duration {
+	ackWait, err := time.ParseDuration(pkg.Config.DeliveryAckWait)
+	if err != nil {
+		log.WithError(err).Errorf("failed to parse delivery ack wait, using %v", defaultDeliveryAckWait)
+		return defaultDeliveryAckWait
+	}
+	return ackWait
+}
+
+type pendingDelivery struct {
+	msg      *QueuedMessage
+	deadline time.Time
+}
+
+// deliveryTracker holds the messages handed to a client until the client acks them.  When redeliver is set, messages
+// not acked within ackWait are handed out again, otherwise redelivery is left to the queue (JetStream does its own)
+type deliveryTracker struct {
+	lock      sync.Mutex
+	ackWait   time.Duration
+	redeliver bool
+	pending   map[string]*pendingDelivery
+	now       func() time.Time
+}
+
+func newDeliveryTracker(ackWait time.Duration, redeliver bool) *deliveryTracker {
+	return &deliveryTracker{
+		ackWait:   ackWait,
+		redeliver: redeliver,
+		pending:   make(map[string]*pendingDelivery),
+		now:       time.Now,
+	}
+}
+
+func (d *deliveryTracker) delivered(msg *QueuedMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, exists := d.pending[msg.DeliveryID]; !exists && len(d.pending) >= maxPendingDeliveries {
+		log.WithField("deliveryID", msg.DeliveryID).Warn("Too many unacked messages, message will not be redelivered")
+		return
+	}
+	d.pending[msg.DeliveryID] = &pendingDelivery{msg: msg, deadline: d.now().Add(d.ackWait)}
+}
+
+func (d *deliveryTracker) ack(deliveryIDs []string) {
+	d.lock.Lock()
+	acked := make([]*QueuedMessage, 0, len(deliveryIDs))
+	for _, id := range deliveryIDs {
+		if p, exists := d.pending[id]; exists {
+			acked = append(acked, p.msg)
+			delete(d.pending, id)
+		}
+	}
+	d.lock.Unlock()
+
+	ackMessages(acked)
+}
+
+func (d *deliveryTracker) ackAll() {
+	d.lock.Lock()
+	acked := make([]*QueuedMessage, 0, len(d.pending))
+	for id, p := range d.pending {
+		acked = append(acked, p.msg)
+		delete(d.pending, id)
+	}
+	d.lock.Unlock()
+
+	ackMessages(acked)
+}
+
+// nextRedelivery the oldest message whose ack wait has passed, or nil
+func (d *deliveryTracker) nextRedelivery() *QueuedMessage {
+	if !d.redeliver {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	var oldest *pendingDelivery
+	for _, p := range d.pending {
+		if p.deadline.Before(now) && (oldest == nil || p.deadline.Before(oldest.deadline)) {
+			oldest = p
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	delete(d.pending, oldest.msg.DeliveryID)
+	return oldest.msg
+}
+
+func ackMessages(acked []*QueuedMessage) {
+	for _, msg := range acked {
+		if err := msg.Ack(); err != nil {
+			log.WithError(err).WithField("deliveryID", msg.DeliveryID).Errorf("Unable to ack message, it will be redelivered")
+		}
+	}
+}
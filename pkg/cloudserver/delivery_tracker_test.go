@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newDeliveryTracker(time.Minute, true)
+	tracker.now = func() time.Time { return now }
+
+	acked := make(map[string]bool)
+	newMsg := func(id string) *QueuedMessage {
+		return &QueuedMessage{DeliveryID: id, ack: func() error { acked[id] = true; return nil }}
+	}
+
+	tracker.delivered(newMsg("1"))
+	tracker.delivered(newMsg("2"))
+	tracker.delivered(newMsg("3"))
+	assert.Nil(t, tracker.nextRedelivery(), "nothing is due before the ack wait")
+
+	tracker.ack([]string{"2", "unknown"})
+	assert.True(t, acked["2"])
+	assert.False(t, acked["1"])
+
+	now = now.Add(2 * time.Minute)
+	redelivered := []string{tracker.nextRedelivery().DeliveryID, tracker.nextRedelivery().DeliveryID}
+	assert.ElementsMatch(t, []string{"1", "3"}, redelivered)
+	assert.Nil(t, tracker.nextRedelivery())
+
+	tracker.delivered(newMsg("4"))
+	tracker.ackAll()
+	assert.True(t, acked["4"])
+	assert.Empty(t, tracker.pending)
+}
+
+func TestDeliveryTrackerNoRedeliver(t *testing.T) {
+	now := time.Now()
+	tracker := newDeliveryTracker(time.Minute, false)
+	tracker.now = func() time.Time { return now }
+
+	tracker.delivered(&QueuedMessage{DeliveryID: "1"})
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, tracker.nextRedelivery(), "redelivery is left to the queue")
+	tracker.ack([]string{"1"})
+	assert.Empty(t, tracker.pending)
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/msgs"
+)
+
+const JETSTREAM_QUEUE_PREFIX = "natssync.queue"
+const JETSTREAM_INGEST_QUEUE_GROUP = "natssync-jetstream"
+
+// RESERVED_HEADER_PREFIX headers the server owns, publishers can not set them on a queued message
+const RESERVED_HEADER_PREFIX = "Natssync-"
+
+// headers used to carry the original subject and reply of a message while it sits in the stream
+const HEADER_ORIGINAL_SUBJECT = "Natssync-Subject"
+const HEADER_ORIGINAL_REPLY = "Natssync-Reply"
+const HEADER_DELIVERY_ID = "Natssync-Delivery-Id"
+
+const defaultJetStreamMaxAge = 24 * time.Hour
+const defaultJetStreamMaxMsgsPerLocation = 10000
+
+// minimum time a fetch waits on the server, stops short client timeouts from hammering JetStream with pull requests
+const jetStreamMinFetchWait = 100 * time.Millisecond
+
+type jetStreamSettings struct {
+	stream             string
+	maxAge             time.Duration
+	maxMsgsPerLocation int64
+	ackWait            time.Duration
+}
+
+var jetStream nats.JetStreamContext
+var jetStreamConfig jetStreamSettings
+
+func loadJetStreamSettings() jetStreamSettings {
+	ret := jetStreamSettings{
+		stream:             pkg.Config.JetStreamStream,
+		maxAge:             defaultJetStreamMaxAge,
+		maxMsgsPerLocation: defaultJetStreamMaxMsgsPerLocation,
+		ackWait:            getDeliveryAckWait(),
+	}
+	if maxAge, err := time.ParseDuration(pkg.Config.JetStreamMaxAge); err != nil {
+		log.WithError(err).Errorf("failed to parse JetStream max age, using %v", ret.maxAge)
+	} else {
+		ret.maxAge = maxAge
+	}
+	if maxMsgs, err := strconv.ParseInt(pkg.Config.JetStreamMaxMsgsPerLocation, 10, 64); err != nil {
+		log.WithError(err).Errorf("failed to parse JetStream max messages per location, using %d", ret.maxMsgsPerLocation)
+	} else {
+		ret.maxMsgsPerLocation = maxMsgs
+	}
+	return ret
+}
+
+// InitJetStream creates or updates the stream that holds the messages for all the locations
+func InitJetStream(nc *nats.Conn) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	settings := loadJetStreamSettings()
+
+	streamConfig := &nats.StreamConfig{
+		Name:              settings.stream,
+		Subjects:          []string{fmt.Sprintf("%s.*", JETSTREAM_QUEUE_PREFIX)},
+		Retention:         nats.WorkQueuePolicy,
+		MaxAge:            settings.maxAge,
+		MaxMsgsPerSubject: settings.maxMsgsPerLocation,
+		Discard:           nats.DiscardOld,
+		Storage:           nats.FileStorage,
+	}
+	if _, err = js.StreamInfo(settings.stream); err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(streamConfig)
+	} else if err == nil {
+		_, err = js.UpdateStream(streamConfig)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Unable to set up JetStream stream %s", settings.stream)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"stream":             settings.stream,
+		"maxAge":             settings.maxAge.String(),
+		"maxMsgsPerLocation": settings.maxMsgsPerLocation,
+	}).Info("Using JetStream for location message queues")
+	jetStream = js
+	jetStreamConfig = settings
+	return nil
+}
+
+func makeJetStreamQueueSubject(locationID string) string {
+	return fmt.Sprintf("%s.%s", JETSTREAM_QUEUE_PREFIX, locationID)
+}
+
+func makeJetStreamDurableName(locationID string) string {
+	return fmt.Sprintf("natssync-%s", locationID)
+}
+
+// jetStreamMessageQueue keeps a location's messages in a stream so they survive restarts and the client being offline.
+// Messages published to the location are republished into the stream rather than captured by it directly, so the
+// reply subject is kept (JetStream would answer it with a publish ack)
+type jetStreamMessageQueue struct {
+	locationID string
+	js         nats.JetStreamContext
+	settings   jetStreamSettings
+	ingest     *nats.Subscription
+	pull       *nats.Subscription
+	deliveries *deliveryTracker
+}
+
+func newJetStreamMessageQueue(nc *nats.Conn, js nats.JetStreamContext, settings jetStreamSettings, locationID string) (*jetStreamMessageQueue, error) {
+	q := &jetStreamMessageQueue{
+		locationID: locationID,
+		js:         js,
+		settings:   settings,
+		deliveries: newDeliveryTracker(settings.ackWait, false),
+	}
+
+	durable := makeJetStreamDurableName(locationID)
+	queueSubject := makeJetStreamQueueSubject(locationID)
+	if _, err := js.ConsumerInfo(settings.stream, durable); err == nats.ErrConsumerNotFound {
+		_, err = js.AddConsumer(settings.stream, &nats.ConsumerConfig{
+			Durable:       durable,
+			FilterSubject: queueSubject,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       settings.ackWait,
+			DeliverPolicy: nats.DeliverAllPolicy,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	pull, err := js.PullSubscribe(queueSubject, durable, nats.Bind(settings.stream, durable))
+	if err != nil {
+		return nil, err
+	}
+	q.pull = pull
+
+	subject := fmt.Sprintf("%s.%s.>", msgs.NATSSYNC_MESSAGE_PREFIX, locationID)
+	ingest, err := nc.QueueSubscribe(subject, JETSTREAM_INGEST_QUEUE_GROUP, q.ingestMsg)
+	if err != nil {
+		_ = pull.Unsubscribe()
+		return nil, err
+	}
+	q.ingest = ingest
+	return q, nil
+}
+
+func (q *jetStreamMessageQueue) ingestMsg(m *nats.Msg) {
+	queued := nats.NewMsg(makeJetStreamQueueSubject(q.locationID))
+	queued.Data = m.Data
+	for key, values := range m.Header {
+		if !isReservedHeader(key) {
+			queued.Header[key] = values
+		}
+	}
+	// fix the deadline now, the message may sit in the stream for a while before it is fetched
+	if expires := msgs.GetMessageExpiry(m.Header, time.Now(), msgs.GetDefaultTTL(q.locationID)); expires > 0 {
+		queued.Header.Set(msgs.HEADER_EXPIRES, strconv.FormatInt(expires, 10))
+	}
+	queued.Header.Set(HEADER_ORIGINAL_SUBJECT, m.Subject)
+	queued.Header.Set(HEADER_DELIVERY_ID, bridgemodel.GenerateUUID())
+	if len(m.Reply) > 0 {
+		queued.Header.Set(HEADER_ORIGINAL_REPLY, m.Reply)
+	}
+	if _, err := q.js.PublishMsg(queued); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"locationID": q.locationID,
+			"subject":    m.Subject,
+		}).Errorf("Unable to queue message in JetStream")
+	}
+}
+
+// isReservedHeader true for the headers the server sets, whatever case the publisher used
+func isReservedHeader(key string) bool {
+	return len(key) >= len(RESERVED_HEADER_PREFIX) && strings.EqualFold(key[:len(RESERVED_HEADER_PREFIX)], RESERVED_HEADER_PREFIX)
+}
+
+func (q *jetStreamMessageQueue) NextMsg(timeout time.Duration) (*QueuedMessage, error) {
+	if timeout < jetStreamMinFetchWait {
+		timeout = jetStreamMinFetchWait
+	}
+	fetched, err := q.pull.Fetch(1, nats.MaxWait(timeout))
+	if err == context.DeadlineExceeded {
+		err = nats.ErrTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(fetched) == 0 {
+		return nil, nats.ErrTimeout
+	}
+
+	m := fetched[0]
+	original := nats.NewMsg(m.Header.Get(HEADER_ORIGINAL_SUBJECT))
+	original.Reply = m.Header.Get(HEADER_ORIGINAL_REPLY)
+	original.Data = m.Data
+	for key, values := range m.Header {
+		if key != HEADER_ORIGINAL_SUBJECT && key != HEADER_ORIGINAL_REPLY && key != HEADER_DELIVERY_ID {
+			original.Header[key] = values
+		}
+	}
+	deliveryID := m.Header.Get(HEADER_DELIVERY_ID)
+	if len(deliveryID) == 0 {
+		deliveryID = bridgemodel.GenerateUUID()
+	}
+	// the deadline was stamped when the message was queued
+	expires := msgs.GetMessageExpiry(m.Header, time.Now(), 0)
+	return &QueuedMessage{Msg: original, DeliveryID: deliveryID, Expires: expires, ack: func() error { return m.Ack() }}, nil
+}
+
+// Delivered tracks the message for acking, JetStream redelivers it if no ack arrives within the ack wait
+func (q *jetStreamMessageQueue) Delivered(msg *QueuedMessage) {
+	q.deliveries.delivered(msg)
+}
+
+func (q *jetStreamMessageQueue) Ack(deliveryIDs []string) {
+	q.deliveries.ack(deliveryIDs)
+}
+
+func (q *jetStreamMessageQueue) AckDelivered() {
+	q.deliveries.ackAll()
+}
+
+// Unsubscribe stops queueing messages and removes the location's consumer and any messages left in the stream
+func (q *jetStreamMessageQueue) Unsubscribe() error {
+	if err := q.ingest.Unsubscribe(); err != nil {
+		return err
+	}
+	if err := q.pull.Unsubscribe(); err != nil {
+		return err
+	}
+	if err := q.js.DeleteConsumer(q.settings.stream, makeJetStreamDurableName(q.locationID)); err != nil && err != nats.ErrConsumerNotFound {
+		return err
+	}
+	return q.js.PurgeStream(q.settings.stream, &nats.StreamPurgeRequest{Subject: makeJetStreamQueueSubject(q.locationID)})
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/msgs"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	return ns
+}
+
+func TestJetStreamMessageQueue(t *testing.T) {
+	ns := runJetStreamServer(t)
+	defer ns.Shutdown()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := jetStreamSettings{
+		stream:             "NATSSYNC_TEST",
+		maxAge:             time.Hour,
+		maxMsgsPerLocation: 100,
+		ackWait:            500 * time.Millisecond,
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:              settings.stream,
+		Subjects:          []string{JETSTREAM_QUEUE_PREFIX + ".*"},
+		Retention:         nats.WorkQueuePolicy,
+		MaxMsgsPerSubject: settings.maxMsgsPerLocation,
+		Storage:           nats.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := newJetStreamMessageQueue(nc, js, settings, "loc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := msgs.MakeMessageSubject("loc1", "foo")
+	m := nats.NewMsg(subject)
+	m.Reply = "reply.to.me"
+	m.Data = []byte("hello")
+	m.Header.Set("Trace-Id", "abc")
+	assert.Nil(t, nc.PublishMsg(m))
+	assert.Nil(t, nc.Flush())
+
+	qm, err := queue.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, subject, qm.Msg.Subject)
+	assert.Equal(t, "reply.to.me", qm.Msg.Reply)
+	assert.Equal(t, "hello", string(qm.Msg.Data))
+	assert.Equal(t, "abc", qm.Msg.Header.Get("Trace-Id"))
+	assert.Empty(t, qm.Msg.Header.Get(HEADER_ORIGINAL_SUBJECT))
+
+	assert.NotEmpty(t, qm.DeliveryID)
+	assert.Empty(t, qm.Msg.Header.Get(HEADER_DELIVERY_ID))
+	deliveryID := qm.DeliveryID
+
+	// delivered but never confirmed, so it comes back after the ack wait with the same delivery ID
+	queue.Delivered(qm)
+	qm, err = queue.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", string(qm.Msg.Data))
+	assert.Equal(t, deliveryID, qm.DeliveryID)
+
+	// survives a server restart of the queue as the consumer is durable
+	assert.Nil(t, queue.pull.Unsubscribe())
+	assert.Nil(t, queue.ingest.Unsubscribe())
+	queue, err = newJetStreamMessageQueue(nc, js, settings, "loc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qm, err = queue.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Delivered(qm)
+	queue.Ack([]string{qm.DeliveryID})
+
+	_, err = queue.NextMsg(time.Second)
+	assert.Equal(t, nats.ErrTimeout, err)
+
+	// the server's own headers can not be forged by the publisher
+	m = nats.NewMsg(subject)
+	m.Data = []byte("forged")
+	m.Header.Set(HEADER_ORIGINAL_SUBJECT, msgs.MakeMessageSubject("loc2", "foo"))
+	m.Header.Set(HEADER_ORIGINAL_REPLY, "forged.reply")
+	m.Header.Set(HEADER_DELIVERY_ID, deliveryID)
+	m.Header.Set(msgs.HEADER_EXPIRES, "not a deadline")
+	m.Header["natssync-subject"] = []string{"natssync.lower"}
+	assert.Nil(t, nc.PublishMsg(m))
+	assert.Nil(t, nc.Flush())
+	qm, err = queue.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "forged", string(qm.Msg.Data))
+	assert.Equal(t, subject, qm.Msg.Subject)
+	assert.Empty(t, qm.Msg.Reply)
+	assert.NotEqual(t, deliveryID, qm.DeliveryID)
+	assert.Empty(t, qm.Msg.Header.Get(msgs.HEADER_EXPIRES))
+	assert.Empty(t, qm.Msg.Header["natssync-subject"])
+	assert.Equal(t, int64(0), qm.Expires)
+	assert.Nil(t, qm.Ack())
+
+	assert.Nil(t, queue.Unsubscribe())
+	_, err = js.ConsumerInfo(settings.stream, makeJetStreamDurableName("loc1"))
+	assert.Equal(t, nats.ErrConsumerNotFound, err)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// lastSeenResolution how stale a location's LastSeen may get, locations poll far more often than this and writing
+// the keystore on every request would be too much
+const lastSeenResolution = 5 * time.Minute
+
+// lastSeenUpdateAttempts how many times the last seen update is tried when the location changes under it
+const lastSeenUpdateAttempts = 3
+
+// lastSeenTracker records when locations last made an authenticated request
+type lastSeenTracker struct {
+	lock    sync.Mutex
+	written map[string]time.Time
+	store   func() persistence.LocationKeyStore
+	now     func() time.Time
+}
+
+func newLastSeenTracker(store func() persistence.LocationKeyStore) *lastSeenTracker {
+	return &lastSeenTracker{
+		written: make(map[string]time.Time),
+		store:   store,
+		now:     time.Now,
+	}
+}
+
+var locationLastSeen = newLastSeenTracker(persistence.GetKeyStore)
+
+// seen updates the location's LastSeen in the background if it was last written more than lastSeenResolution ago
+func (t *lastSeenTracker) seen(locationID string) {
+	now := t.now()
+	t.lock.Lock()
+	if last, ok := t.written[locationID]; ok && now.Sub(last) < lastSeenResolution {
+		t.lock.Unlock()
+		return
+	}
+	t.written[locationID] = now
+	t.lock.Unlock()
+
+	go t.write(locationID)
+}
+
+func (t *lastSeenTracker) write(locationID string) {
+	store := t.store()
+	if store == nil {
+		return
+	}
+	// another update in between, like a cert rotation, is read again rather than overwritten
+	for attempt := 0; attempt < lastSeenUpdateAttempts; attempt++ {
+		locationData, err := store.ReadLocation(locationID)
+		if err != nil || locationData == nil {
+			log.WithError(err).WithField("locationID", locationID).Warning("Unable to read location to update last seen")
+			return
+		}
+		locationData.UpdateLastSeen()
+		err = store.UpdateLocation(locationData)
+		if err != types.ErrRevisionConflict {
+			if err != nil {
+				log.WithError(err).WithField("locationID", locationID).Error("Unable to update location last seen")
+			}
+			return
+		}
+	}
+	log.WithField("locationID", locationID).Warning("Location kept changing, last seen not updated")
+}
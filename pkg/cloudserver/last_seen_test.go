@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+func TestLastSeenTracker(t *testing.T) {
+	store := &memoryKeyStore{locations: map[string]types.LocationData{
+		"loc1": {LocationID: "loc1", Metadata: map[string]string{"region": "east"}},
+	}}
+	now := time.Now()
+	tracker := newLastSeenTracker(func() persistence.LocationKeyStore { return store })
+	tracker.now = func() time.Time { return now }
+
+	tracker.write("loc1")
+	seen := store.locations["loc1"].LastSeen
+	assert.False(t, seen.IsZero())
+	assert.Equal(t, "east", store.locations["loc1"].Metadata["region"])
+
+	// a change made between the read and the update is read again, not overwritten
+	store.beforeUpdate = func() {
+		store.beforeUpdate = nil
+		locationData := store.locations["loc1"]
+		locationData.Metadata = map[string]string{"region": "west"}
+		locationData.Revision++
+		store.locations["loc1"] = locationData
+	}
+	now = now.Add(time.Minute)
+	tracker.write("loc1")
+	assert.Equal(t, "west", store.locations["loc1"].Metadata["region"])
+	assert.True(t, store.locations["loc1"].LastSeen.After(seen))
+
+	// unknown locations are ignored
+	tracker.write("nope")
+	assert.Len(t, store.locations, 1)
+
+	// seen writes in the background, only the throttling is checked from here on
+	tracker.store = func() persistence.LocationKeyStore { return nil }
+	tracker.written["loc1"] = now
+	now = now.Add(lastSeenResolution / 2)
+	tracker.seen("loc1")
+	assert.Equal(t, now.Add(-lastSeenResolution/2), tracker.written["loc1"], "written recently, so not written again")
+
+	now = now.Add(lastSeenResolution)
+	tracker.seen("loc1")
+	assert.Equal(t, now, tracker.written["loc1"])
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/msgs"
+)
+
+// MessageQueue holds the messages waiting to be picked up by a location
+type MessageQueue interface {
+	// NextMsg waits up to the timeout for the next message, returns nats.ErrTimeout if there was none
+	NextMsg(timeout time.Duration) (*QueuedMessage, error)
+
+	// Delivered records that the message was handed to the client.  It is acked once the client confirms it
+	Delivered(msg *QueuedMessage)
+
+	// Ack acks the delivered messages with the given delivery IDs
+	Ack(deliveryIDs []string)
+
+	// AckDelivered acks all delivered messages, for clients that do not ack by delivery ID
+	AckDelivered()
+
+	// Unsubscribe stops queueing messages for the location
+	Unsubscribe() error
+}
+
+// QueuedMessage a message taken from a MessageQueue
+type QueuedMessage struct {
+	// Msg the message with the subject and reply it was originally published with
+	Msg *nats.Msg
+	// DeliveryID stays the same when the message is redelivered
+	DeliveryID string
+	// Expires the unix millisecond deadline fixed when the message was queued, 0 if it does not expire
+	Expires int64
+	ack     func() error
+}
+
+// Ack tells the queue the message does not need to be delivered again
+func (m *QueuedMessage) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack()
+}
+
+// maxCoreQueuedMessages caps the messages held per location by a coreMessageQueue, past this the oldest are dropped
+const maxCoreQueuedMessages = 65536
+
+// coreMessageQueue a plain NATS subscription.  Messages and unacked deliveries are only kept in memory
+type coreMessageQueue struct {
+	locationID string
+	sub        *nats.Subscription
+	deliveries *deliveryTracker
+
+	lock    sync.Mutex
+	queued  []*QueuedMessage
+	arrived chan struct{}
+	done    chan struct{}
+}
+
+// newCoreMessageQueue subscribes to the subject, in the queue group if one is given
+func newCoreMessageQueue(nc *nats.Conn, subject string, queueGroup string, locationID string) (*coreMessageQueue, error) {
+	q := &coreMessageQueue{
+		locationID: locationID,
+		deliveries: newDeliveryTracker(getDeliveryAckWait(), true),
+		arrived:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	var err error
+	if len(queueGroup) > 0 {
+		q.sub, err = nc.QueueSubscribe(subject, queueGroup, q.ingestMsg)
+	} else {
+		q.sub, err = nc.Subscribe(subject, q.ingestMsg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// ingestMsg fixes the message's deadline as it arrives, it may wait a while for the client to pick it up
+func (q *coreMessageQueue) ingestMsg(m *nats.Msg) {
+	qm := &QueuedMessage{
+		Msg:        m,
+		DeliveryID: bridgemodel.GenerateUUID(),
+		Expires:    msgs.GetMessageExpiry(m.Header, time.Now(), msgs.GetDefaultTTL(q.locationID)),
+	}
+	q.lock.Lock()
+	if len(q.queued) >= maxCoreQueuedMessages {
+		log.WithField("locationID", q.locationID).WithField("subject", q.queued[0].Msg.Subject).Warn("Too many queued messages, dropping the oldest")
+		q.queued[0] = nil
+		q.queued = q.queued[1:]
+	}
+	q.queued = append(q.queued, qm)
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *coreMessageQueue) signal() {
+	select {
+	case q.arrived <- struct{}{}:
+	default:
+	}
+}
+
+func (q *coreMessageQueue) pop() *QueuedMessage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.queued) == 0 {
+		return nil
+	}
+	ret := q.queued[0]
+	q.queued[0] = nil
+	q.queued = q.queued[1:]
+	if len(q.queued) > 0 {
+		// another waiter may have missed the signal for the messages still queued
+		q.signal()
+	}
+	return ret
+}
+
+func (q *coreMessageQueue) NextMsg(timeout time.Duration) (*QueuedMessage, error) {
+	if redelivery := q.deliveries.nextRedelivery(); redelivery != nil {
+		return redelivery, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if qm := q.pop(); qm != nil {
+			return qm, nil
+		}
+		select {
+		case <-q.arrived:
+		case <-q.done:
+			return nil, nats.ErrBadSubscription
+		case <-timer.C:
+			return nil, nats.ErrTimeout
+		}
+	}
+}
+
+func (q *coreMessageQueue) Delivered(msg *QueuedMessage) {
+	q.deliveries.delivered(msg)
+}
+
+func (q *coreMessageQueue) Ack(deliveryIDs []string) {
+	q.deliveries.ack(deliveryIDs)
+}
+
+func (q *coreMessageQueue) AckDelivered() {
+	q.deliveries.ackAll()
+}
+
+func (q *coreMessageQueue) Unsubscribe() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
+	return q.sub.Unsubscribe()
+}
+
+// nextLiveMsg the next message from the queue that has not expired, expired messages are acked and dropped
+func nextLiveMsg(queue MessageQueue, timeout time.Duration, locationID string) (*QueuedMessage, error) {
+	for {
+		qm, err := queue.NextMsg(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if !msgs.DropIfExpired(qm.Expires, qm.Msg.Subject, locationID, msgs.EXPIRED_STAGE_SERVER_OUTBOUND) {
+			return qm, nil
+		}
+		if err = qm.Ack(); err != nil {
+			log.WithError(err).Error("Unable to ack expired message")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/msgs"
+)
+
+func TestCoreMessageQueueExpiry(t *testing.T) {
+	ns := runJetStreamServer(t)
+	defer ns.Shutdown()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	queue, err := newCoreMessageQueue(nc, msgs.MakeMessageSubject("loc1", ">"), "", "loc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Unsubscribe()
+
+	before := time.Now()
+	shortLived := nats.NewMsg(msgs.MakeMessageSubject("loc1", "short"))
+	shortLived.Header.Set(msgs.HEADER_TTL, "100ms")
+	assert.Nil(t, nc.PublishMsg(shortLived))
+	longLived := nats.NewMsg(msgs.MakeMessageSubject("loc1", "long"))
+	longLived.Header.Set(msgs.HEADER_TTL, "1h")
+	assert.Nil(t, nc.PublishMsg(longLived))
+	assert.Nil(t, nc.Flush())
+
+	// buffered past its TTL, the deadline was fixed when it was queued so it is dropped rather than sent
+	time.Sleep(200 * time.Millisecond)
+	qm, err := nextLiveMsg(queue, time.Second, "loc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, longLived.Subject, qm.Msg.Subject)
+	assert.GreaterOrEqual(t, qm.Expires, before.Add(time.Hour).UnixNano()/int64(time.Millisecond))
+	assert.Less(t, qm.Expires, time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond))
+
+	// a redelivery keeps its deadline
+	expires := qm.Expires
+	queue.deliveries.ackWait = 0
+	queue.Delivered(qm)
+	time.Sleep(10 * time.Millisecond)
+	qm, err = queue.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expires, qm.Expires)
+
+	_, err = nextLiveMsg(queue, 100*time.Millisecond, "loc1")
+	assert.Equal(t, nats.ErrTimeout, err)
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/bridgemodel/errors"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+	"github.com/theotw/natssync/pkg/metrics"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+// location metadata keys that override the global rate limits for the location, 0 is unlimited
+const (
+	METADATA_RATE_LIMIT_MESSAGES_PER_SEC = msgs.NATSSYNC_METADATA_PREFIX + "rateLimit.messagesPerSec"
+	METADATA_RATE_LIMIT_BYTES_PER_SEC    = msgs.NATSSYNC_METADATA_PREFIX + "rateLimit.bytesPerSec"
+	METADATA_RATE_LIMIT_MAX_BATCH_SIZE   = msgs.NATSSYNC_METADATA_PREFIX + "rateLimit.maxBatchSize"
+)
+
+// reasons reported in the throttled metric
+const (
+	THROTTLE_REASON_MESSAGES   = "messages"
+	THROTTLE_REASON_BYTES      = "bytes"
+	THROTTLE_REASON_BATCH_SIZE = "batch-size"
+)
+
+// RateLimits what a location may send, 0 is unlimited
+type RateLimits struct {
+	MessagesPerSec float64
+	BytesPerSec    float64
+	MaxBatchSize   int
+}
+
+// getRateLimits the RATE_LIMIT_* settings, overridden by the location metadata
+func getRateLimits(locationID string) RateLimits {
+	values := map[string]string{
+		METADATA_RATE_LIMIT_MESSAGES_PER_SEC: pkg.Config.RateLimitMessagesPerSec,
+		METADATA_RATE_LIMIT_BYTES_PER_SEC:    pkg.Config.RateLimitBytesPerSec,
+		METADATA_RATE_LIMIT_MAX_BATCH_SIZE:   pkg.Config.RateLimitMaxBatchSize,
+	}
+	if store := persistence.GetKeyStore(); store != nil {
+		if locationData, err := persistence.LoadLocation(store, locationID); err == nil && locationData != nil {
+			metadata := locationData.GetMetadata()
+			for key := range values {
+				if val, ok := metadata[key]; ok {
+					values[key] = val
+				}
+			}
+		}
+	}
+
+	parse := func(key string) float64 {
+		if len(values[key]) == 0 {
+			return 0
+		}
+		val, err := strconv.ParseFloat(values[key], 64)
+		if err != nil || val < 0 {
+			log.WithField("locationID", locationID).WithField(key, values[key]).Errorf("Invalid rate limit, it will not be enforced")
+			return 0
+		}
+		return val
+	}
+	return RateLimits{
+		MessagesPerSec: parse(METADATA_RATE_LIMIT_MESSAGES_PER_SEC),
+		BytesPerSec:    parse(METADATA_RATE_LIMIT_BYTES_PER_SEC),
+		MaxBatchSize:   int(parse(METADATA_RATE_LIMIT_MAX_BATCH_SIZE)),
+	}
+}
+
+// tokenBucket refills at rate tokens a second and holds up to one second's worth
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// wait how long until n tokens can be taken, 0 if they can be taken now.  Takes bigger than the bucket go through
+// when it is full and leave it in debt, so they slow the location down rather than being stuck forever
+func (b *tokenBucket) wait(n float64) time.Duration {
+	needed := math.Min(n, b.rate)
+	if b.tokens >= needed {
+		return 0
+	}
+	return time.Duration((needed - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= n
+}
+
+// RateLimitError a location went over one of its limits
+type RateLimitError struct {
+	LocationID string
+	Reason     string
+	// RetryAfter when the same request would be allowed, 0 if it never will be
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("location %s is over its %s limit", e.LocationID, e.Reason)
+}
+
+// RetryAfterSeconds RetryAfter rounded up to whole seconds, for the Retry-After header
+func (e *RateLimitError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+func (e *RateLimitError) internalError() *errors.InternalError {
+	return errors.NewInternalError(errors.BRIDGE_ERROR, errors.RATE_LIMITED, map[string]string{
+		"locationID": e.LocationID,
+		"reason":     e.Reason,
+		"retryAfter": strconv.Itoa(e.RetryAfterSeconds()),
+	})
+}
+
+// respondRateLimited 429 with Retry-After, or 413 for a batch that will never fit
+func respondRateLimited(c *gin.Context, limitErr *RateLimitError) {
+	_, resp := bridgemodel.HandleError(c, limitErr.internalError())
+	if limitErr.RetryAfter == 0 {
+		c.JSON(http.StatusRequestEntityTooLarge, resp)
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(limitErr.RetryAfterSeconds()))
+	c.JSON(http.StatusTooManyRequests, resp)
+}
+
+// newRateLimitedFrame the websocket error frame for a rejected request
+func newRateLimitedFrame(limitErr *RateLimitError) *v1.WebSocketErrorFrame {
+	_, resp := bridgemodel.HandleErrorWithLocale("", limitErr.internalError())
+	return &v1.WebSocketErrorFrame{Error: resp, RetryAfter: int32(limitErr.RetryAfterSeconds())}
+}
+
+type locationLimiter struct {
+	limits   RateLimits
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// rateLimiter per location token buckets for messages and bytes
+type rateLimiter struct {
+	lock      sync.Mutex
+	locations map[string]*locationLimiter
+	limitsFor func(locationID string) RateLimits
+	now       func() time.Time
+}
+
+func newRateLimiter(limitsFor func(locationID string) RateLimits) *rateLimiter {
+	return &rateLimiter{
+		locations: make(map[string]*locationLimiter),
+		limitsFor: limitsFor,
+		now:       time.Now,
+	}
+}
+
+var locationRateLimiter = newRateLimiter(getRateLimits)
+
+// allow takes the messages and bytes from the location's buckets, or returns a RateLimitError and takes nothing
+func (r *rateLimiter) allow(locationID string, msgCount int, byteCount int) *RateLimitError {
+	if msgCount == 0 {
+		return nil
+	}
+	limits := r.limitsFor(locationID)
+	if limits.MaxBatchSize > 0 && msgCount > limits.MaxBatchSize {
+		return r.throttled(locationID, THROTTLE_REASON_BATCH_SIZE, 0)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	limiter, ok := r.locations[locationID]
+	if !ok || limiter.limits != limits {
+		// new location or its limits changed, start it with full buckets
+		limiter = &locationLimiter{limits: limits}
+		if limits.MessagesPerSec > 0 {
+			limiter.messages = newTokenBucket(limits.MessagesPerSec, now)
+		}
+		if limits.BytesPerSec > 0 {
+			limiter.bytes = newTokenBucket(limits.BytesPerSec, now)
+		}
+		r.locations[locationID] = limiter
+	}
+
+	if limiter.messages != nil {
+		limiter.messages.refill(now)
+		if wait := limiter.messages.wait(float64(msgCount)); wait > 0 {
+			return r.throttled(locationID, THROTTLE_REASON_MESSAGES, wait)
+		}
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.refill(now)
+		if wait := limiter.bytes.wait(float64(byteCount)); wait > 0 {
+			return r.throttled(locationID, THROTTLE_REASON_BYTES, wait)
+		}
+	}
+	if limiter.messages != nil {
+		limiter.messages.take(float64(msgCount))
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.take(float64(byteCount))
+	}
+	return nil
+}
+
+func (r *rateLimiter) throttled(locationID string, reason string, retryAfter time.Duration) *RateLimitError {
+	metrics.IncrementLocationThrottled(locationID, reason)
+	log.WithFields(log.Fields{
+		"locationID": locationID,
+		"reason":     reason,
+		"retryAfter": retryAfter,
+	}).Warn("Location is over its rate limit")
+	return &RateLimitError{LocationID: locationID, Reason: reason, RetryAfter: retryAfter}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limits := map[string]RateLimits{
+		"loc1": {MessagesPerSec: 10, BytesPerSec: 1000, MaxBatchSize: 5},
+	}
+	limiter := newRateLimiter(func(locationID string) RateLimits { return limits[locationID] })
+	limiter.now = func() time.Time { return now }
+
+	assert.Nil(t, limiter.allow("unlimited", 1000, 1000000))
+
+	limitErr := limiter.allow("loc1", 6, 10)
+	if assert.NotNil(t, limitErr) {
+		assert.Equal(t, THROTTLE_REASON_BATCH_SIZE, limitErr.Reason)
+		assert.Equal(t, time.Duration(0), limitErr.RetryAfter, "a batch that is too big never fits")
+	}
+
+	assert.Nil(t, limiter.allow("loc1", 5, 100))
+	assert.Nil(t, limiter.allow("loc1", 5, 100))
+	limitErr = limiter.allow("loc1", 5, 100)
+	if assert.NotNil(t, limitErr) {
+		assert.Equal(t, THROTTLE_REASON_MESSAGES, limitErr.Reason)
+		assert.Equal(t, 500*time.Millisecond, limitErr.RetryAfter)
+		assert.Equal(t, 1, limitErr.RetryAfterSeconds())
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, limiter.allow("loc1", 5, 100), "the bucket refills over time")
+
+	// more bytes than the bucket holds go through on a full bucket, then the location has to wait
+	now = now.Add(time.Second)
+	assert.Nil(t, limiter.allow("loc1", 1, 3000))
+	limitErr = limiter.allow("loc1", 1, 10)
+	if assert.NotNil(t, limitErr) {
+		assert.Equal(t, THROTTLE_REASON_BYTES, limitErr.Reason)
+		assert.True(t, limitErr.RetryAfter > 2*time.Second)
+	}
+
+	// changed limits start over
+	limits["loc1"] = RateLimits{MessagesPerSec: 100}
+	assert.Nil(t, limiter.allow("loc1", 1, 10))
+}
+
+func TestRespondRateLimited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	respondRateLimited(c, &RateLimitError{LocationID: "loc1", Reason: THROTTLE_REASON_MESSAGES, RetryAfter: 1500 * time.Millisecond})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	respondRateLimited(c, &RateLimitError{LocationID: "loc1", Reason: THROTTLE_REASON_BATCH_SIZE})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+}
@@ -40,8 +40,9 @@ func RunBridgeServer(test bool) {
 
 	r := newRouter()
 	srv := &http.Server{
-		Addr:    pkg.Config.ListenString,
-		Handler: r,
+		Addr:      pkg.Config.ListenString,
+		Handler:   r,
+		TLSConfig: newServerTLSConfig(),
 	}
 	connection := natsmodel.GetNatsConnection()
 	connection.Subscribe(bridgemodel.RequestForLocationID, func(msg *nats.Msg) {
@@ -53,7 +54,13 @@ func RunBridgeServer(test bool) {
 	go func() {
 		// service connections
 		log.Info("In goroutine list and server")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if len(pkg.Config.TLSCertFile) > 0 {
+			err = srv.ListenAndServeTLS(pkg.Config.TLSCertFile, pkg.Config.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 		log.Info("Post In goroutine list and server")
@@ -83,6 +90,16 @@ func newRouter() *gin.Engine {
 	root.Handle(http.MethodGet, "/metrics", metricGetHandlers)
 
 	certMiddleware := NewCertMiddleware(persistence.GetKeyStore())
+	notSuspended := enforceNotSuspended(persistence.GetKeyStore())
+	clientCertificate := enforceClientCertificate(persistence.GetKeyStore())
+	// the message queue routes are for locations only, with MTLS_REQUIRED they need the client certificate as well
+	locationOnly := func(handler gin.HandlerFunc) []gin.HandlerFunc {
+		handlers := []gin.HandlerFunc{notSuspended, certMiddleware.Enforce}
+		if pkg.Config.MTLSRequired {
+			handlers = append(handlers, clientCertificate)
+		}
+		return append(handlers, handler)
+	}
 
 	v1 := router.Group("/bridge-server/1", routeMiddleware)
 	v1.Handle(http.MethodGet, "/about", aboutGetUnversioned)
@@ -90,11 +107,13 @@ func newRouter() *gin.Engine {
 	v1.Handle(http.MethodPost, "/register", handlePostRegister)
 	v1.Handle(http.MethodGet, "/register", handleGetRegisteredLocations)
 	v1.Handle(http.MethodPost, "/register-certificate", handlePostCertRotation)
+	v1.Handle(http.MethodGet, "/cloud-keys", handleGetCloudKeys)
 	v1.Handle(http.MethodPost, "/unregister", handlePostUnRegister)
-	v1.Handle(http.MethodPost, "/message-queue/:premid", certMiddleware.Enforce, handlePostMessage)
-	v1.Handle(http.MethodGet, "/message-queue/:premid", certMiddleware.Enforce, handleGetMessages)
+	v1.Handle(http.MethodPost, "/message-queue/:premid", locationOnly(handlePostMessage)...)
+	v1.Handle(http.MethodGet, "/message-queue/:premid", locationOnly(handleGetMessages)...)
 	v1.Handle(http.MethodPost, "/messages", natsMsgPostHandler)
-	v1.Handle(http.MethodGet, "/message-queue/:premid/ws", HandleConnectionRequest)
+	v1.Handle(http.MethodGet, "/message-queue/:premid/ws", locationOnly(newWebSocketHandler(certMiddleware, persistence.GetKeyStore()).HandleConnectionRequest)...)
+	newAdminAPI(persistence.GetKeyStore()).addRoutes(v1)
 
 	addUnversionedRoutes(router)
 	addOpenApiDefRoutes(router)
@@ -13,24 +13,30 @@ import (
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/theotw/natssync/pkg"
 	"github.com/theotw/natssync/pkg/bridgemodel"
 	"github.com/theotw/natssync/pkg/msgs"
 	"github.com/theotw/natssync/pkg/persistence"
 )
 
 var mapSync sync.RWMutex
-var natsSubscriptions map[string]*nats.Subscription
+var natsSubscriptions map[string]MessageQueue
 
 func InitSubscriptionMgr() error {
 	mapSync.Lock()
 	defer mapSync.Unlock()
-	natsSubscriptions = make(map[string]*nats.Subscription)
+	natsSubscriptions = make(map[string]MessageQueue)
 	var err error
 
 	nc := natsmodel.GetNatsConnection()
 	if nc == nil {
 		return errors.New("uninitialized nats connection")
 	}
+	if pkg.Config.JetStreamEnabled {
+		if err = InitJetStream(nc); err != nil {
+			return err
+		}
+	}
 	_, err = nc.Subscribe(bridgemodel.REGISTRATION_LIFECYCLE_ADDED, handleNewSubscription)
 	if err != nil {
 		log.Errorf("Error registering for lifecycle add events %s", err)
@@ -53,13 +59,21 @@ func InitSubscriptionMgr() error {
 		return err
 	}
 	for _, clientID := range knownClients {
+		if jetStream != nil {
+			queue, err := newJetStreamMessageQueue(nc, jetStream, jetStreamConfig, clientID)
+			if err != nil {
+				log.WithError(err).Errorf("Unable to set up JetStream queue for %s", clientID)
+			} else {
+				natsSubscriptions[clientID] = queue
+			}
+			continue
+		}
 		subject := fmt.Sprintf("%s.%s.>", msgs.NATSSYNC_MESSAGE_PREFIX, clientID)
-		//sub, err := nc.SubscribeSync(subject)
-		sub, err := nc.QueueSubscribeSync(subject, "natssync-get")
+		queue, err := newCoreMessageQueue(nc, subject, "natssync-get", clientID)
 		if err != nil {
 			log.Errorf("Unable to subscribe to %s because of %s \n", subject, err.Error())
 		} else {
-			natsSubscriptions[clientID] = sub
+			natsSubscriptions[clientID] = queue
 		}
 	}
 	return nil
@@ -80,14 +94,29 @@ func handleNewSubscription(msg *nats.Msg) {
 
 func AddNewSubscription(clientID string, nc *nats.Conn) {
 	log.Tracef("In handle New Subscription %s", clientID)
-	subject := fmt.Sprintf("%s.%s.>", msgs.NATSSYNC_MESSAGE_PREFIX, clientID)
-	sub, err := nc.SubscribeSync(subject)
-	if err != nil {
-		log.Errorf("Error subscribing to subject: %s error: %s \n", subject, err.Error())
+	if GetMessageQueueForClient(clientID) != nil {
+		log.Debugf("Already have a message queue for %s", clientID)
 		return
 	}
+	var queue MessageQueue
+	if jetStream != nil {
+		jsQueue, err := newJetStreamMessageQueue(nc, jetStream, jetStreamConfig, clientID)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to set up JetStream queue for %s", clientID)
+			return
+		}
+		queue = jsQueue
+	} else {
+		subject := fmt.Sprintf("%s.%s.>", msgs.NATSSYNC_MESSAGE_PREFIX, clientID)
+		coreQueue, err := newCoreMessageQueue(nc, subject, "", clientID)
+		if err != nil {
+			log.Errorf("Error subscribing to subject: %s error: %s \n", subject, err.Error())
+			return
+		}
+		queue = coreQueue
+	}
 	mapSync.Lock()
-	natsSubscriptions[clientID] = sub
+	natsSubscriptions[clientID] = queue
 	mapSync.Unlock()
 }
 
@@ -133,9 +162,9 @@ func handleRemoveAccount(msg *nats.Msg) {
 	}
 }
 
-// gets the subscription for the client ID or returns nil
-func GetSubscriptionForClient(clientID string) *nats.Subscription {
-	var ret *nats.Subscription
+// gets the message queue for the client ID or returns nil
+func GetMessageQueueForClient(clientID string) MessageQueue {
+	var ret MessageQueue
 	log.Tracef("Start Get Subscript for client  %s", clientID)
 	mapSync.RLock()
 	ret = natsSubscriptions[clientID]
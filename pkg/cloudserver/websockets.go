@@ -5,13 +5,14 @@
 package cloudserver
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/theotw/natssync/pkg/natsmodel"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,12 +23,16 @@ import (
 	"github.com/theotw/natssync/pkg/bridgemodel"
 	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
 	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/persistence"
 )
 
 const (
 	hostAddress = "server"
 )
 
+// HEADER_CONNECTION_ID set by the server on messages from a location, to the location ID
+const HEADER_CONNECTION_ID = "x-connection-id"
+
 func client() error {
 	hostUrl := url.URL{
 		Scheme: "https",
@@ -54,89 +59,240 @@ func client() error {
 	return nil
 }
 
+// wsPingPeriod how often the sender pings the client, and checks the location was not suspended while connected
+var wsPingPeriod = msgs.WEBSOCKET_PING_PERIOD
+
+// wsNextMsgTimeout how long the sender waits on the queue before checking if the connection is still up
+const wsNextMsgTimeout = 1 * time.Second
+
+// wsMaxFrameSize the largest frame a client may send
+const wsMaxFrameSize = 32 * 1024 * 1024
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin bridge clients do not send an Origin, browsers do and are only allowed from WEBSOCKET_ALLOWED_ORIGINS
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	for _, allowed := range strings.Split(pkg.Config.WebSocketAllowedOrigins, ",") {
+		if strings.TrimSpace(allowed) == origin {
+			return true
+		}
+	}
+	log.WithField("origin", origin).Warn("Rejected websocket connection from origin")
+	return false
 }
 
-func init() {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+// wsConn serializes writes, the sender and receiver both write to the connection and websocket connections only
+// support one concurrent writer.  done is closed once the connection stops reading
+type wsConn struct {
+	*websocket.Conn
+	writeLock sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func HandleConnectionRequest(ctx *gin.Context) {
-	log.Info("Handling websocket connection request")
+func newWSConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{Conn: conn, done: make(chan struct{})}
+}
 
-	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+func (w *wsConn) WriteMessage(messageType int, data []byte) error {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+	if err := w.Conn.SetWriteDeadline(time.Now().Add(msgs.WEBSOCKET_WRITE_WAIT)); err != nil {
+		return err
+	}
+	return w.Conn.WriteMessage(messageType, data)
+}
+
+func (w *wsConn) writeJSONFrame(frame interface{}) error {
+	bits, err := json.Marshal(frame)
 	if err != nil {
-		log.WithError(err).Error("WebSocket connection upgrade failed")
-		return
+		return err
 	}
-	log.Info("WebSocket connection started")
+	return w.WriteMessage(websocket.TextMessage, bits)
+}
+
+// writeErrorFrame sends the error as a JSON text frame
+func (w *wsConn) writeErrorFrame(frame *v1.WebSocketErrorFrame) error {
+	return w.writeJSONFrame(frame)
+}
+
+// writeControlFrame sends the control as a JSON text frame
+func (w *wsConn) writeControlFrame(control string) error {
+	return w.writeJSONFrame(&v1.WebSocketControlFrame{Control: control})
+}
+
+func (w *wsConn) ping() error {
+	return w.WriteControl(websocket.PingMessage, nil, time.Now().Add(msgs.WEBSOCKET_WRITE_WAIT))
+}
+
+// closeWithCode tells the client why the connection is closing, then closes it
+func (w *wsConn) closeWithCode(code int, text string) {
+	err := w.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(msgs.WEBSOCKET_WRITE_WAIT))
+	if err != nil && err != websocket.ErrCloseSent {
+		log.WithError(err).Debug("Unable to send websocket close message")
+	}
+	if err = w.Close(); err != nil {
+		log.WithError(err).Warning("Error attempting to close websocket connection")
+	}
+}
+
+func (w *wsConn) stopped() {
+	w.closeOnce.Do(func() { close(w.done) })
+}
+
+// webSocketHandler the websocket transport, a location's messages in both directions over one connection
+type webSocketHandler struct {
+	certs *certMiddleware
+	store persistence.LocationKeyStore
+}
+
+func newWebSocketHandler(certs *certMiddleware, store persistence.LocationKeyStore) *webSocketHandler {
+	return &webSocketHandler{certs: certs, store: store}
+}
+
+// HandleConnectionRequest checks the auth challenge in the handshake and upgrades the connection
+func (h *webSocketHandler) HandleConnectionRequest(ctx *gin.Context) {
+	log.Info("Handling websocket connection request")
 
 	clientID := ctx.Param("premid")
-	sub := GetSubscriptionForClient(clientID)
-	subObject, exists := ctx.Get("subscription")
-	sub, ok := subObject.(*nats.Subscription)
-	if !exists || !ok || sub == nil {
+	challenge, err := msgs.DecodeAuthChallengeHeader(ctx.GetHeader(msgs.HEADER_AUTH_CHALLENGE))
+	if err != nil {
+		log.WithError(err).WithField("clientID", clientID).Error("Missing or invalid websocket auth challenge")
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, "")
+		return
+	}
+	if !validateAuthChallenge(clientID, http.MethodGet, ctx.Request.URL.Path, challenge) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, "")
+		return
+	}
+	locationLastSeen.seen(clientID)
+	queue := GetMessageQueueForClient(clientID)
+	if queue == nil {
 		log.WithField("clientID", clientID).Error("No subscription for client")
+		ctx.AbortWithStatusJSON(http.StatusNotFound, "")
 		return
 	}
+	// clients that ack by delivery ID say so when they connect
+	explicitAcks := ctx.Query(msgs.WEBSOCKET_ACKS_PARAM) == msgs.WEBSOCKET_ACKS_EXPLICIT
+	// and the ones that read binary batches
+	binaryFrames := ctx.Query(msgs.WEBSOCKET_FORMAT_PARAM) == msgs.BATCH_FORMAT_BINARY
+
+	upgraded, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		log.WithError(err).Error("WebSocket connection upgrade failed")
+		return
+	}
+	conn := newWSConn(upgraded)
+	log.WithField("clientID", clientID).Info("WebSocket connection started")
+
 	//get messages from web sockets
-	go messageReceiver(conn, clientID)
+	go messageReceiver(conn, clientID, queue)
 
 	//push messages to the socket
-	go messageSender(conn, clientID, sub)
+	go h.messageSender(conn, clientID, ctx.Request.TLS, queue, explicitAcks, binaryFrames)
 }
 
-func messageReceiver(conn *websocket.Conn, clientID string) {
+func messageReceiver(conn *wsConn, clientID string, queue MessageQueue) {
+	defer conn.stopped()
+	conn.SetReadLimit(wsMaxFrameSize)
+	// the client answers the sender's pings, hearing nothing for too long means the connection is gone
+	conn.SetReadDeadline(time.Now().Add(msgs.WEBSOCKET_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(msgs.WEBSOCKET_PONG_WAIT))
+	})
 	for {
 		messageType, messageBytes, err := conn.ReadMessage()
 		if err != nil {
-			log.WithError(err).Error("WebSocket read message failure")
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.WithField("clientID", clientID).Info("WebSocket connection closed by client")
+			} else {
+				log.WithError(err).WithField("clientID", clientID).Error("WebSocket read message failure")
+			}
 			return
 		}
+		conn.SetReadDeadline(time.Now().Add(msgs.WEBSOCKET_PONG_WAIT))
 
-		log.WithField("type", messageType).WithField("data", string(messageBytes)).Info("Received message via websocket")
+		log.WithField("type", messageType).WithField("size", len(messageBytes)).Info("Received message via websocket")
 
-		handleReadMessage(messageBytes, clientID)
+		if limitErr := handleReadMessage(messageType, messageBytes, clientID, queue); limitErr != nil {
+			if err = conn.writeErrorFrame(newRateLimitedFrame(limitErr)); err != nil {
+				log.WithError(err).WithField("clientID", clientID).Error("Failed to send error frame to client")
+			}
+		}
 	}
 }
 
-func messageSender(conn *websocket.Conn, clientID string, sub *nats.Subscription) {
-	handleGetMessagesWS(conn, clientID, sub)
+// messageSender pushes the location's messages to the socket as they arrive, pings the client and tells it when it
+// has to rotate its key pair.  It closes the connection when the receiver stops or the location is suspended
+func (h *webSocketHandler) messageSender(conn *wsConn, clientID string, tlsState *tls.ConnectionState, queue MessageQueue, explicitAcks bool, binaryFrames bool) {
+	needsRotation := func(clientID string) bool {
+		return h.certs.NeedsRotation(clientID) || h.certs.CertificateExpiring(tlsState)
+	}
+	suspended := func(clientID string) bool {
+		return locationSuspended(h.store, clientID)
+	}
+	closeCode, closeText := handleGetMessagesWS(conn, clientID, queue, explicitAcks, binaryFrames, needsRotation, suspended, serverCloudKeys.CurrentKeyID)
+	conn.closeWithCode(closeCode, closeText)
 }
 
-func handleReadMessage(messageBytes []byte, clientID string) {
+// readWSBatch binary frames carry a binary batch, text frames a JSON BridgeMessagePostReq
+func readWSBatch(messageType int, messageBytes []byte) (*msgs.Batch, error) {
+	if messageType == websocket.BinaryMessage {
+		return msgs.DecodeBatch(messageBytes)
+	}
 	var request v1.BridgeMessagePostReq
-	err := json.Unmarshal(messageBytes, &request)
+	if err := json.Unmarshal(messageBytes, &request); err != nil {
+		return nil, err
+	}
+	batch, msgErrs := msgs.NewBatchFromPostReq(&request)
+	for _, err := range msgErrs {
+		log.Errorf("Error unmarshalling envelope %s", err.Error())
+	}
+	return batch, nil
+}
+
+// handleReadMessage publishes the messages in the request, returns an error if the location is over its rate limit
+func handleReadMessage(messageType int, messageBytes []byte, clientID string, queue MessageQueue) *RateLimitError {
+	request, err := readWSBatch(messageType, messageBytes)
 	if err != nil {
 		log.WithError(err).
 			WithField("clientID", clientID).
 			WithField("request", messageBytes).
 			Error("Failure to unmarshal request")
-		return
+		return nil
 	}
 
-	if !msgs.ValidateAuthChallenge(clientID, &request.AuthChallenge) {
-		log.WithError(err).WithField("clientID", clientID).Error("Got invalid message auth request")
-		return
+	if !validateAuthChallenge(clientID, http.MethodPost, msgs.MakeWebSocketPath(clientID), &request.AuthChallenge) {
+		log.WithField("clientID", clientID).Error("Got invalid message auth request")
+		return nil
+	}
+	locationLastSeen.seen(clientID)
+	if len(request.Acks) > 0 {
+		queue.Ack(request.Acks)
+	}
+	if limitErr := locationRateLimiter.allow(clientID, len(request.Messages), request.MessageBytes()); limitErr != nil {
+		return limitErr
 	}
 
 	nc := natsmodel.GetNatsConnection()
 	for _, msg := range request.Messages {
-		var envl msgs.MessageEnvelope
-		err = json.Unmarshal([]byte(msg.MessageData), &envl)
-		if err != nil {
-			log.Errorf("Error unmarshalling envelope %s", err.Error())
-			continue
-		}
-
 		var natmsg bridgemodel.NatsMessage
-		err = msgs.PullObjectFromEnvelope(&natmsg, &envl)
+		err = msgs.PullObjectFromEnvelope(&natmsg, msg.Envelope)
 		if err != nil {
 			log.Errorf("Error decoding envelope %s", err.Error())
 			continue
 		}
+		if msgs.DropIfExpired(natmsg.Expires, natmsg.Subject, clientID, msgs.EXPIRED_STAGE_SERVER_INBOUND) {
+			continue
+		}
 
 		log.Tracef("Posting message to nats sub=%s, repl=%s", natmsg.Subject, natmsg.Reply)
 
@@ -153,43 +309,63 @@ func handleReadMessage(messageBytes []byte, clientID string) {
 				nc.Publish(echomsg.Subject, echomsg.Data)
 			}
 		}
-		if len(natmsg.Reply) > 0 {
-			nc.PublishRequest(natmsg.Subject, natmsg.Reply, natmsg.Data)
-		} else {
-			nc.Publish(natmsg.Subject, natmsg.Data)
+		m := natmsg.NewNatsMsg()
+		m.Header.Set(HEADER_CONNECTION_ID, clientID)
+		if err = nc.PublishMsg(m); err != nil {
+			log.WithError(err).WithField("subject", natmsg.Subject).Error("Error publishing message")
 		}
 		nc.Flush()
 	}
+	return nil
 }
 
-func handleGetMessagesWS(conn *websocket.Conn, clientID string, sub *nats.Subscription) {
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.WithError(err).Warning("Error attempting to close websocket connection")
-		}
-	}()
-
-	timeoutStr := pkg.GetEnvWithDefaults("NATSSYNC_MSG_WAIT_TIMEOUT", "5")
-	waitTimeout, numErr := strconv.ParseInt(timeoutStr, 10, 16)
-	if numErr != nil {
-		waitTimeout = 5
-	}
-
-	if sub == nil {
-		//make this trace because its really just a timeout
-		log.Errorf("Got a request for messages for a client ID that has no subscription %s \n", clientID)
-		return
-	}
+// handleGetMessagesWS sends messages until the connection stops or has to close, returns the close code and reason
+func handleGetMessagesWS(conn *wsConn, clientID string, queue MessageQueue, explicitAcks bool, binaryFrames bool, needsRotation func(clientID string) bool, suspended func(clientID string) bool, cloudKeyID func() string) (int, string) {
+	pingTicker := time.NewTicker(wsPingPeriod)
+	defer pingTicker.Stop()
+	lastCloudKeyID := cloudKeyID()
 
 	for {
-		msg, err := sub.NextMsg(time.Duration(waitTimeout) * time.Millisecond)
+		select {
+		case <-conn.done:
+			return websocket.CloseNormalClosure, ""
+		case <-pingTicker.C:
+			// the handshake was checked, a location suspended since then is cut off here
+			if suspended(clientID) {
+				log.WithField("clientID", clientID).Info("Closing websocket of suspended location")
+				return websocket.ClosePolicyViolation, "location suspended"
+			}
+			if needsRotation(clientID) {
+				log.WithField("clientID", clientID).Infof("sending out cert rotation request")
+				if err := conn.writeControlFrame(msgs.WEBSOCKET_CONTROL_CERT_ROTATION); err != nil {
+					log.WithError(err).WithField("clientID", clientID).Error("Failed to send cert rotation request")
+				}
+				return msgs.WEBSOCKET_CLOSE_CERT_ROTATION, "cert rotation required"
+			}
+			if keyID := cloudKeyID(); keyID != lastCloudKeyID {
+				log.WithField("clientID", clientID).WithField("keyID", keyID).Info("Telling the client about the new cloud key")
+				if err := conn.writeControlFrame(msgs.WEBSOCKET_CONTROL_CLOUD_KEYS); err != nil {
+					log.WithError(err).WithField("clientID", clientID).Error("Failed to send the cloud key change")
+				}
+				lastCloudKeyID = keyID
+			}
+			if err := conn.ping(); err != nil {
+				log.WithError(err).WithField("clientID", clientID).Error("Failed to ping client")
+				return websocket.CloseGoingAway, ""
+			}
+		default:
+		}
+
+		// blocks until a message arrives, the timeout only bounds how long a closed connection goes unnoticed
+		qm, err := nextLiveMsg(queue, wsNextMsgTimeout, clientID)
 		if err != nil {
 			if err == nats.ErrTimeout {
 				continue
 			}
 			log.WithError(err).Error("Failure to get message from NATS")
-			return
+			return websocket.CloseInternalServerErr, "message queue failure"
 		}
+		msg := qm.Msg
 
 		if strings.HasSuffix(msg.Subject, msgs.ECHO_SUBJECT_BASE) {
 			if len(msg.Reply) == 0 {
@@ -206,25 +382,28 @@ func handleGetMessagesWS(conn *websocket.Conn, clientID string, sub *nats.Subscr
 		}
 
 		plainMsg := newMsgFromNatsMsg(msg)
+		plainMsg.Expires = qm.Expires
 		envelope, err := msgs.PutObjectInEnvelope(plainMsg, pkg.CLOUD_ID, clientID)
 		if err != nil {
 			log.WithError(err).Error("Failed to create envelope with message")
 			continue
 		}
 
-		jsonData, err := json.Marshal(envelope)
-		if err != nil {
-			log.WithError(err).Error("Failed to marshal message in envelope")
-		}
-
-		bridgeMsg, err := newBridgeMsg(jsonData, 1, clientID)
+		frameType, frame, err := newBridgeMsgFrame(&msgs.BatchMessage{ClientID: clientID, DeliveryID: qm.DeliveryID, Envelope: envelope}, binaryFrames)
 		if err != nil {
 			log.WithError(err).Error("Failed to create bridge message")
 			continue
 		}
 
-		if err = conn.WriteMessage(websocket.TextMessage, bridgeMsg); err != nil {
+		// tracked before the write, a failed write leaves it unacked so it is redelivered once the ack wait passes
+		queue.Delivered(qm)
+		if err = conn.WriteMessage(frameType, frame); err != nil {
 			log.WithError(err).WithField("clientID", clientID).Error("Failed to send message to client")
+			return websocket.CloseGoingAway, ""
+		}
+		if !explicitAcks {
+			// older clients do not ack, a successful write is as good as it gets
+			queue.AckDelivered()
 		}
 	}
 }
@@ -234,14 +413,20 @@ func newMsgFromNatsMsg(msg *nats.Msg) *bridgemodel.NatsMessage {
 		Data:    msg.Data,
 		Reply:   msg.Reply,
 		Subject: msg.Subject,
+		Header:  msg.Header,
 	}
 }
 
-func newBridgeMsg(data []byte, version int, clientID string) ([]byte, error) {
-	msg := v1.BridgeMessage{
-		MessageData:   string(data),
-		FormatVersion: string(rune(version)),
-		ClientID:      clientID,
+// newBridgeMsgFrame a binary frame with a one message batch, or a text frame with the JSON bridge message
+func newBridgeMsgFrame(msg *msgs.BatchMessage, binaryFrames bool) (int, []byte, error) {
+	if binaryFrames {
+		bits, err := msgs.EncodeBatch(&msgs.Batch{Messages: []msgs.BatchMessage{*msg}})
+		return websocket.BinaryMessage, bits, err
+	}
+	bridgeMsg, err := msgs.NewBridgeMessage(msg)
+	if err != nil {
+		return 0, nil, err
 	}
-	return json.Marshal(msg)
+	bits, err := json.Marshal(bridgeMsg)
+	return websocket.TextMessage, bits, err
 }
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package cloudserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/msgs"
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	saved := pkg.Config.WebSocketAllowedOrigins
+	defer func() { pkg.Config.WebSocketAllowedOrigins = saved }()
+	pkg.Config.WebSocketAllowedOrigins = "https://a.example.com, https://b.example.com"
+
+	for origin, expected := range map[string]bool{
+		"":                      true,
+		"https://a.example.com": true,
+		"https://b.example.com": true,
+		"https://c.example.com": false,
+		"http://a.example.com":  false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(origin) > 0 {
+			r.Header.Set("Origin", origin)
+		}
+		assert.Equal(t, expected, checkOrigin(r), origin)
+	}
+
+	pkg.Config.WebSocketAllowedOrigins = ""
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://a.example.com")
+	assert.False(t, checkOrigin(r))
+}
+
+func TestHandleConnectionRequestUnauthorized(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newWebSocketHandler(nil, nil)
+	for _, header := range []string{"", "not base64!", "bm90IGpzb24="} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "premid", Value: "client1"}}
+		c.Request = httptest.NewRequest(http.MethodGet, msgs.MakeWebSocketPath("client1"), nil)
+		if len(header) > 0 {
+			c.Request.Header.Set(msgs.HEADER_AUTH_CHALLENGE, header)
+		}
+		handler.HandleConnectionRequest(c)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+	}
+}
+
+// dialTestWebSocket returns both ends of a websocket connection
+func dialTestWebSocket(t *testing.T) (*wsConn, *websocket.Conn, func()) {
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	conn := newWSConn(<-accepted)
+	return conn, client, func() {
+		client.Close()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestHandleGetMessagesWSFailedWrite(t *testing.T) {
+	saved := pkg.Config
+	defer func() { pkg.Config = saved }()
+	pkg.Config.KeystoreUrl = "file://" + t.TempDir()
+	if err := msgs.InitCloudKey(); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := msgs.GenerateNewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := msgs.GetKeyPairLocationData("client1", pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = persistence.GetKeyStore().WriteLocation(*location); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := runJetStreamServer(t)
+	defer ns.Shutdown()
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	queue, err := newCoreMessageQueue(nc, msgs.MakeMessageSubject("client1", ">"), "", "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Unsubscribe()
+	queue.deliveries.ackWait = 0
+	assert.Nil(t, nc.Publish(msgs.MakeMessageSubject("client1", "test"), []byte("hello")))
+	assert.Nil(t, nc.Flush())
+
+	noRotation := func(string) bool { return false }
+	notSuspended := func(string) bool { return false }
+	cloudKeyID := func() string { return "" }
+
+	// the write fails, the message must not be lost with the connection
+	broken, _, closeBroken := dialTestWebSocket(t)
+	defer closeBroken()
+	broken.Conn.UnderlyingConn().Close()
+	code, _ := handleGetMessagesWS(broken, "client1", queue, false, true, noRotation, notSuspended, cloudKeyID)
+	assert.Equal(t, websocket.CloseGoingAway, code)
+
+	// and goes out on the next connection
+	conn, client, closeConn := dialTestWebSocket(t)
+	defer closeConn()
+	codes := make(chan int, 1)
+	go func() {
+		code, _ := handleGetMessagesWS(conn, "client1", queue, false, true, noRotation, notSuspended, cloudKeyID)
+		codes <- code
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, frame, err := client.ReadMessage()
+	conn.stopped()
+	if assert.Nil(t, err) {
+		batch, err := msgs.DecodeBatch(frame)
+		if assert.Nil(t, err) && assert.Len(t, batch.Messages, 1) {
+			assert.Equal(t, "client1", batch.Messages[0].ClientID)
+		}
+	}
+	assert.Equal(t, websocket.CloseNormalClosure, <-codes)
+}
+
+// idleMessageQueue never has a message
+type idleMessageQueue struct{}
+
+func (idleMessageQueue) NextMsg(timeout time.Duration) (*QueuedMessage, error) {
+	time.Sleep(timeout)
+	return nil, nats.ErrTimeout
+}
+func (idleMessageQueue) Delivered(*QueuedMessage) {}
+func (idleMessageQueue) Ack([]string)             {}
+func (idleMessageQueue) AckDelivered()            {}
+func (idleMessageQueue) Unsubscribe() error       { return nil }
+
+func TestHandleGetMessagesWSSuspended(t *testing.T) {
+	saved := wsPingPeriod
+	defer func() { wsPingPeriod = saved }()
+	wsPingPeriod = 10 * time.Millisecond
+
+	location, err := types.NewLocationData("client1", nil, nil, map[string]string{METADATA_SUSPENDED: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryKeyStore{locations: map[string]types.LocationData{"client1": *location}}
+	suspended := func(clientID string) bool { return locationSuspended(store, clientID) }
+
+	// suspended after the handshake was checked, the open connection is closed at the next ping
+	conn, _, closeConn := dialTestWebSocket(t)
+	defer closeConn()
+	code, text := handleGetMessagesWS(conn, "client1", idleMessageQueue{}, true, true, func(string) bool { return false }, suspended, func() string { return "" })
+	assert.Equal(t, websocket.ClosePolicyViolation, code)
+	assert.Equal(t, "location suspended", text)
+	assert.False(t, locationSuspended(store, "client2"))
+}
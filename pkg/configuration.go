@@ -26,6 +26,7 @@ type Configuration struct {
 	CloudBridgeUrl    string
 	LogLevel          string
 	KeystoreUrl       string
+	KeystoreCacheTTL  string
 	MongodbServer     string
 	MongodbPort       string
 	MongodbUsername   string
@@ -35,6 +36,57 @@ type Configuration struct {
 	PodNamespace      string
 	CloudEvents       bool
 	SkipTlsValidation bool
+
+	AuthChallengeMaxSkew          string
+	AuthChallengeAllowLegacy      bool
+	EnvelopeVersion               string
+	EnvelopeMinVersion            string
+	EnvelopeDenyPlaintext         bool
+	EnvelopeSessionKeyTTL         string
+	EnvelopeSessionKeyMaxMessages string
+
+	JetStreamEnabled            bool
+	JetStreamStream             string
+	JetStreamMaxAge             string
+	JetStreamMaxMsgsPerLocation string
+	DeliveryAckWait             string
+	MessageDefaultTTL           string
+	MessageCompression          string
+	MessageCompressionThreshold string
+	BridgeBatchFormat           string
+	RateLimitMessagesPerSec     string
+	RateLimitBytesPerSec        string
+	RateLimitMaxBatchSize       string
+	WebSocketAllowedOrigins     string
+
+	AuthMode             string
+	AuthCacheTTL         string
+	AuthJwks             string
+	AuthJwtIssuer        string
+	AuthJwtAudience      string
+	AuthJwtScopeClaim    string
+	AuthJwtScopePrefix   string
+	AuthJwtLocationClaim string
+	AuthStaticTokenFile  string
+
+	TLSCertFile        string
+	TLSKeyFile         string
+	ClientCAEnabled    bool
+	ClientCACertFile   string
+	ClientCAKeyFile    string
+	ClientCertValidity string
+	MTLSRequired       bool
+	CloudBridgeCAFile  string
+
+	KeyOverlap               string
+	CloudKeyRotationInterval string
+
+	KeystoreKEKFile               string
+	KeystoreKEKPassphrase         string
+	KeystoreKEKKMS                string
+	KeystoreKEKPreviousFile       string
+	KeystoreKEKPreviousPassphrase string
+	KeystoreKEKMigrate            bool
 }
 
 type configOption struct {
@@ -49,6 +101,7 @@ func (c *Configuration) LoadValues() {
 		{&c.CloudBridgeUrl, "CLOUD_BRIDGE_URL", "http://localhost:8081"},
 		{&c.LogLevel, "LOG_LEVEL", "debug"},
 		{&c.KeystoreUrl, "KEYSTORE_URL", "file:///tmp"},
+		{&c.KeystoreCacheTTL, "KEYSTORE_CACHE_TTL", "5m"},
 		{&c.MongodbServer, "MONGODB_SERVER", ""},
 		{&c.MongodbPort, "MONGODB_PORT", "27017"},
 		{&c.MongodbUsername, "MONGODB_USERNAME", ""},
@@ -57,6 +110,51 @@ func (c *Configuration) LoadValues() {
 		{&c.ConfigmapName, "CONFIGMAP_NAME", ""},
 		{&c.CloudEvents, "CLOUDEVENTS_ENABLED", false},
 		{&c.SkipTlsValidation, "SKIP_TLS_VALIDATION", false},
+		{&c.AuthChallengeMaxSkew, "AUTH_CHALLENGE_MAX_SKEW", "2m"},
+		{&c.AuthChallengeAllowLegacy, "AUTH_CHALLENGE_ALLOW_LEGACY", false},
+		{&c.EnvelopeVersion, "ENVELOPE_VERSION", "3"},
+		{&c.EnvelopeMinVersion, "ENVELOPE_MIN_VERSION", "1"},
+		{&c.EnvelopeDenyPlaintext, "ENVELOPE_DENY_PLAINTEXT", false},
+		{&c.EnvelopeSessionKeyTTL, "ENVELOPE_SESSION_KEY_TTL", "1h"},
+		{&c.EnvelopeSessionKeyMaxMessages, "ENVELOPE_SESSION_KEY_MAX_MESSAGES", "100000"},
+		{&c.JetStreamEnabled, "JETSTREAM_ENABLED", false},
+		{&c.JetStreamStream, "JETSTREAM_STREAM", "NATSSYNC"},
+		{&c.JetStreamMaxAge, "JETSTREAM_MAX_AGE", "24h"},
+		{&c.JetStreamMaxMsgsPerLocation, "JETSTREAM_MAX_MSGS_PER_LOCATION", "10000"},
+		{&c.DeliveryAckWait, "DELIVERY_ACK_WAIT", "1m"},
+		{&c.MessageDefaultTTL, "MESSAGE_DEFAULT_TTL", ""},
+		{&c.MessageCompression, "MESSAGE_COMPRESSION", ""},
+		{&c.MessageCompressionThreshold, "MESSAGE_COMPRESSION_THRESHOLD", "1024"},
+		{&c.BridgeBatchFormat, "BRIDGE_BATCH_FORMAT", "binary"},
+		{&c.RateLimitMessagesPerSec, "RATE_LIMIT_MESSAGES_PER_SEC", "0"},
+		{&c.RateLimitBytesPerSec, "RATE_LIMIT_BYTES_PER_SEC", "0"},
+		{&c.RateLimitMaxBatchSize, "RATE_LIMIT_MAX_BATCH_SIZE", "0"},
+		{&c.WebSocketAllowedOrigins, "WEBSOCKET_ALLOWED_ORIGINS", ""},
+		{&c.AuthMode, "AUTH_MODE", "nats"},
+		{&c.AuthCacheTTL, "AUTH_CACHE_TTL", "30s"},
+		{&c.AuthJwks, "AUTH_JWKS", ""},
+		{&c.AuthJwtIssuer, "AUTH_JWT_ISSUER", ""},
+		{&c.AuthJwtAudience, "AUTH_JWT_AUDIENCE", ""},
+		{&c.AuthJwtScopeClaim, "AUTH_JWT_SCOPE_CLAIM", "scope"},
+		{&c.AuthJwtScopePrefix, "AUTH_JWT_SCOPE_PREFIX", "natssync:"},
+		{&c.AuthJwtLocationClaim, "AUTH_JWT_LOCATION_CLAIM", "natssync_location"},
+		{&c.AuthStaticTokenFile, "AUTH_STATIC_TOKEN_FILE", ""},
+		{&c.TLSCertFile, "TLS_CERT_FILE", ""},
+		{&c.TLSKeyFile, "TLS_KEY_FILE", ""},
+		{&c.ClientCAEnabled, "CLIENT_CA_ENABLED", false},
+		{&c.ClientCACertFile, "CLIENT_CA_CERT_FILE", "/tmp/natssync-client-ca.crt"},
+		{&c.ClientCAKeyFile, "CLIENT_CA_KEY_FILE", "/tmp/natssync-client-ca.key"},
+		{&c.ClientCertValidity, "CLIENT_CERT_VALIDITY", "720h"},
+		{&c.MTLSRequired, "MTLS_REQUIRED", false},
+		{&c.CloudBridgeCAFile, "CLOUD_BRIDGE_CA_FILE", ""},
+		{&c.KeyOverlap, "KEY_OVERLAP", "24h"},
+		{&c.CloudKeyRotationInterval, "CLOUD_KEY_ROTATION_INTERVAL", ""},
+		{&c.KeystoreKEKFile, "KEYSTORE_KEK_FILE", ""},
+		{&c.KeystoreKEKPassphrase, "KEYSTORE_KEK_PASSPHRASE", ""},
+		{&c.KeystoreKEKKMS, "KEYSTORE_KEK_KMS", ""},
+		{&c.KeystoreKEKPreviousFile, "KEYSTORE_KEK_PREVIOUS_FILE", ""},
+		{&c.KeystoreKEKPreviousPassphrase, "KEYSTORE_KEK_PREVIOUS_PASSPHRASE", ""},
+		{&c.KeystoreKEKMigrate, "KEYSTORE_KEK_MIGRATE", false},
 	}
 
 
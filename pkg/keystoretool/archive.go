@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package keystoretool
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/theotw/natssync/pkg/persistence/kek"
+)
+
+// ARCHIVE_VERSION the archive format Export writes
+const ARCHIVE_VERSION = 1
+
+// archiveAssociatedData binds the encrypted snapshot to being a keystore archive
+const archiveAssociatedData = "natssync-keystore-archive"
+
+var ErrArchiveSignature = errors.New("the archive signature does not verify")
+
+// Archive a snapshot encrypted with a KEK and signed with an RSA key.  The signature covers everything but itself and
+// is checked before anything is decrypted
+type Archive struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// KEK the ID of the KEK the payload is encrypted with
+	KEK string `json:"kek"`
+	// Payload the encrypted JSON snapshot
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// signedHash the hash of the archive without its signature
+func (a *Archive) signedHash() ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = nil
+	bits, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bits)
+	return hash[:], nil
+}
+
+// Export writes the snapshot as an archive
+func Export(snapshot *Snapshot, w io.Writer, encrypter kek.KeyEncrypter, signer *rsa.PrivateKey) error {
+	plain, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	payload, err := encrypter.Encrypt(plain, []byte(archiveAssociatedData))
+	if err != nil {
+		return err
+	}
+	archive := &Archive{
+		Version: ARCHIVE_VERSION,
+		Created: snapshot.Created,
+		KEK:     encrypter.ID(),
+		Payload: payload,
+	}
+	hash, err := archive.signedHash()
+	if err != nil {
+		return err
+	}
+	if archive.Signature, err = rsa.SignPSS(rand.Reader, signer, crypto.SHA256, hash, nil); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(archive)
+}
+
+// Import reads the snapshot from an archive, it is only decrypted if the signature verifies with the public key
+func Import(r io.Reader, encrypter kek.KeyEncrypter, verifier *rsa.PublicKey) (*Snapshot, error) {
+	archive := &Archive{}
+	if err := json.NewDecoder(r).Decode(archive); err != nil {
+		return nil, fmt.Errorf("invalid archive: %v", err)
+	}
+	if archive.Version != ARCHIVE_VERSION {
+		return nil, fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+	hash, err := archive.signedHash()
+	if err != nil {
+		return nil, err
+	}
+	if rsa.VerifyPSS(verifier, crypto.SHA256, hash, archive.Signature, nil) != nil {
+		return nil, ErrArchiveSignature
+	}
+	if archive.KEK != encrypter.ID() {
+		return nil, fmt.Errorf("the archive was encrypted with KEK %s, not %s", archive.KEK, encrypter.ID())
+	}
+	plain, err := encrypter.Decrypt(archive.Payload, []byte(archiveAssociatedData))
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err = json.Unmarshal(plain, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// LoadSigningKey a PEM RSA private key, PKCS#1 or PKCS#8
+func LoadSigningKey(fileName string) (*rsa.PrivateKey, error) {
+	bits, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bits)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", fileName)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the key in %s is not an RSA key", fileName)
+	}
+	return ret, nil
+}
+
+// LoadVerifyKey a PEM RSA public key, or the public half of a private key
+func LoadVerifyKey(fileName string) (*rsa.PublicKey, error) {
+	bits, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bits)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", fileName)
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if ret, ok := key.(*rsa.PublicKey); ok {
+			return ret, nil
+		}
+		return nil, fmt.Errorf("the key in %s is not an RSA key", fileName)
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	private, err := LoadSigningKey(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &private.PublicKey, nil
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package keystoretool copies, backs up and restores keystores for the natssync-keystore command
+package keystoretool
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// Snapshot every key pair and location in a keystore
+type Snapshot struct {
+	Created   time.Time            `json:"created"`
+	KeyPairs  []types.LocationData `json:"keyPairs"`
+	Locations []types.LocationData `json:"locations"`
+}
+
+// Counts of key pairs and locations
+type Counts struct {
+	KeyPairs  int `json:"keyPairs"`
+	Locations int `json:"locations"`
+}
+
+// Report what a restore did, or would do in a dry run
+type Report struct {
+	DryRun bool `json:"dryRun"`
+	// Read records in the snapshot
+	Read Counts `json:"read"`
+	// Written records that were missing from the destination, or replaced in it when overwriting
+	Written Counts `json:"written"`
+	// Unchanged records the destination already had as they are in the snapshot
+	Unchanged Counts `json:"unchanged"`
+	// Conflicts records the destination has with different contents, they are left alone unless overwriting
+	Conflicts []string `json:"conflicts,omitempty"`
+	// Mismatches records that did not read back the same after the restore
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// Options for a restore
+type Options struct {
+	// DryRun only reports what would be written
+	DryRun bool
+	// Overwrite replaces conflicting records rather than skipping them
+	Overwrite bool
+}
+
+// ReadSnapshot reads every key pair and location from the keystore.  Keystores that can not list their key pairs
+// only give their latest one
+func ReadSnapshot(store persistence.LocationKeyStore) (*Snapshot, error) {
+	ret := &Snapshot{
+		Created:   time.Now().UTC(),
+		KeyPairs:  make([]types.LocationData, 0),
+		Locations: make([]types.LocationData, 0),
+	}
+	if _, ok := store.(persistence.CleanupKeysInterface); !ok {
+		log.Warn("The keystore can not list its key pairs, only the latest is read")
+	}
+	keyPairs, err := persistence.ListKeyPairs(store)
+	if err != nil {
+		if _, ok := store.(persistence.CleanupKeysInterface); ok {
+			return nil, err
+		}
+		// nothing to read is not an error for a keystore without a key pair
+		log.WithError(err).Warn("Unable to read the latest key pair")
+	}
+	for _, keyPair := range keyPairs {
+		ret.KeyPairs = append(ret.KeyPairs, *keyPair)
+	}
+
+	locationIDs, err := store.ListKnownClients()
+	if err != nil {
+		return nil, err
+	}
+	for _, locationID := range locationIDs {
+		locationData, err := store.ReadLocation(locationID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read location %s: %v", locationID, err)
+		}
+		ret.Locations = append(ret.Locations, *locationData)
+	}
+	return ret, nil
+}
+
+// Copy every key pair and location from one keystore to another
+func Copy(from persistence.LocationKeyStore, to persistence.LocationKeyStore, opts Options) (*Report, error) {
+	snapshot, err := ReadSnapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	return Restore(snapshot, to, opts)
+}
+
+// Restore writes the snapshot to the keystore, then reads every record back to check it
+func Restore(snapshot *Snapshot, to persistence.LocationKeyStore, opts Options) (*Report, error) {
+	report := &Report{
+		DryRun: opts.DryRun,
+		Read:   Counts{KeyPairs: len(snapshot.KeyPairs), Locations: len(snapshot.Locations)},
+	}
+
+	for i := range snapshot.KeyPairs {
+		keyPair := &snapshot.KeyPairs[i]
+		existing, err := to.ReadKeyPair(keyPair.KeyID)
+		if err == nil && existing != nil {
+			if sameRecord(keyPair, existing) {
+				report.Unchanged.KeyPairs++
+				continue
+			}
+			report.Conflicts = append(report.Conflicts, "key pair "+keyPair.KeyID)
+			if !opts.Overwrite {
+				continue
+			}
+			if !opts.DryRun {
+				// some keystores only insert, so the old record goes first
+				if err = to.RemoveKeyPair(keyPair.KeyID); err != nil {
+					return report, err
+				}
+			}
+		}
+		if !opts.DryRun {
+			if err = to.WriteKeyPair(keyPair); err != nil {
+				return report, fmt.Errorf("unable to write key pair %s: %v", keyPair.KeyID, err)
+			}
+		}
+		report.Written.KeyPairs++
+	}
+
+	for i := range snapshot.Locations {
+		location := snapshot.Locations[i]
+		locationID := location.GetLocationID()
+		existing, err := to.ReadLocation(locationID)
+		if err == nil && existing != nil {
+			if sameRecord(&location, existing) {
+				report.Unchanged.Locations++
+				continue
+			}
+			report.Conflicts = append(report.Conflicts, "location "+locationID)
+			if !opts.Overwrite {
+				continue
+			}
+			if !opts.DryRun {
+				if locationID == pkg.CLOUD_ID {
+					err = to.RemoveCloudMasterData()
+				} else {
+					err = to.RemoveLocation(locationID)
+				}
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+		if !opts.DryRun {
+			if err = to.WriteLocation(location); err != nil {
+				return report, fmt.Errorf("unable to write location %s: %v", locationID, err)
+			}
+		}
+		report.Written.Locations++
+	}
+
+	if !opts.DryRun {
+		var skipped []string
+		if !opts.Overwrite {
+			skipped = report.Conflicts
+		}
+		report.Mismatches = Verify(snapshot, to, skipped)
+	}
+	return report, nil
+}
+
+// Verify reads every record of the snapshot back from the keystore, returns the ones that are missing or differ.
+// The skipped records, named as in Report.Conflicts, are not checked
+func Verify(snapshot *Snapshot, store persistence.LocationKeyStore, skipped []string) []string {
+	skip := make(map[string]bool)
+	for _, name := range skipped {
+		skip[name] = true
+	}
+	ret := make([]string, 0)
+	for i := range snapshot.KeyPairs {
+		name := "key pair " + snapshot.KeyPairs[i].KeyID
+		if skip[name] {
+			continue
+		}
+		stored, err := store.ReadKeyPair(snapshot.KeyPairs[i].KeyID)
+		if err != nil || !sameRecord(&snapshot.KeyPairs[i], stored) {
+			ret = append(ret, name)
+		}
+	}
+	for i := range snapshot.Locations {
+		name := "location " + snapshot.Locations[i].GetLocationID()
+		if skip[name] {
+			continue
+		}
+		stored, err := store.ReadLocation(snapshot.Locations[i].GetLocationID())
+		if err != nil || !sameRecord(&snapshot.Locations[i], stored) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// sameRecord compares what the records hold rather than how a keystore gave them back.  Empty and missing fields are
+// the same and times are compared to the millisecond mongo keeps
+func sameRecord(a *types.LocationData, b *types.LocationData) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	aBits, aErr := json.Marshal(normalize(*a))
+	bBits, bErr := json.Marshal(normalize(*b))
+	return aErr == nil && bErr == nil && string(aBits) == string(bBits)
+}
+
+func normalize(locationData types.LocationData) types.LocationData {
+	normalizeTime := func(t time.Time) time.Time {
+		return t.UTC().Truncate(time.Millisecond)
+	}
+	locationData.Created = normalizeTime(locationData.Created)
+	locationData.LastModified = normalizeTime(locationData.LastModified)
+	locationData.LastKeypairRotation = normalizeTime(locationData.LastKeypairRotation)
+	locationData.LastSeen = normalizeTime(locationData.LastSeen)
+	if len(locationData.Metadata) == 0 {
+		locationData.Metadata = nil
+	}
+	if len(locationData.PublicKey) == 0 {
+		locationData.PublicKey = nil
+	}
+	if len(locationData.PrivateKey) == 0 {
+		locationData.PrivateKey = nil
+	}
+	if len(locationData.Certificate) == 0 {
+		locationData.Certificate = nil
+	}
+	if len(locationData.PreviousPublicKeys) == 0 {
+		locationData.PreviousPublicKeys = nil
+	}
+	return locationData
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package keystoretool
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence/file"
+	"github.com/theotw/natssync/pkg/persistence/kek"
+	"github.com/theotw/natssync/pkg/types"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func newTestStore(t *testing.T) *file.FileKeyStore {
+	store, err := file.NewFileKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newSourceStore a keystore with two key pairs, the cloud master data and two clients, gives back the key pair IDs
+func newSourceStore(t *testing.T) (*file.FileKeyStore, []string) {
+	store := newTestStore(t)
+	keyIDs := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		keyPair, err := types.NewLocationData(pkg.CLOUD_ID, []byte(fmt.Sprintf("pub%d", i)), []byte(fmt.Sprintf("priv%d", i)), nil)
+		assert.Nil(t, err)
+		assert.Nil(t, store.WriteKeyPair(keyPair))
+		keyIDs = append(keyIDs, keyPair.KeyID)
+	}
+	assert.Nil(t, store.WriteLocation(types.LocationData{LocationID: pkg.CLOUD_ID, PublicKey: []byte("master")}))
+	for _, id := range []string{"client-a", "client-b"} {
+		assert.Nil(t, store.WriteLocation(types.LocationData{LocationID: id, PublicKey: []byte(id), Metadata: map[string]string{"site": id}}))
+	}
+	return store, keyIDs
+}
+
+func TestCopy(t *testing.T) {
+	from, keyIDs := newSourceStore(t)
+	to := newTestStore(t)
+
+	report, err := Copy(from, to, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, Counts{KeyPairs: 2, Locations: 3}, report.Read)
+	assert.Equal(t, Counts{KeyPairs: 2, Locations: 3}, report.Written)
+	assert.Empty(t, report.Conflicts)
+	assert.Empty(t, report.Mismatches)
+
+	clients, err := to.ListKnownClients()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{pkg.CLOUD_ID, "client-a", "client-b"}, clients)
+	keyPair, err := to.ReadKeyPair(keyIDs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "priv0", string(keyPair.GetPrivateKey()))
+
+	// copying again has nothing to do
+	report, err = Copy(from, to, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, Counts{}, report.Written)
+	assert.Equal(t, Counts{KeyPairs: 2, Locations: 3}, report.Unchanged)
+}
+
+func TestCopyConflicts(t *testing.T) {
+	from, _ := newSourceStore(t)
+	to := newTestStore(t)
+	assert.Nil(t, to.WriteLocation(types.LocationData{LocationID: "client-a", PublicKey: []byte("other")}))
+
+	report, err := Copy(from, to, Options{DryRun: true})
+	assert.Nil(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, Counts{KeyPairs: 2, Locations: 2}, report.Written)
+	assert.Equal(t, []string{"location client-a"}, report.Conflicts)
+	assert.Nil(t, report.Mismatches)
+	clients, err := to.ListKnownClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"client-a"}, clients, "a dry run writes nothing")
+
+	// without overwrite the conflict is left alone, and not reported as a mismatch
+	report, err = Copy(from, to, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"location client-a"}, report.Conflicts)
+	assert.Empty(t, report.Mismatches)
+	location, err := to.ReadLocation("client-a")
+	assert.Nil(t, err)
+	assert.Equal(t, "other", string(location.GetPublicKey()))
+
+	report, err = Copy(from, to, Options{Overwrite: true})
+	assert.Nil(t, err)
+	assert.Equal(t, Counts{Locations: 1}, report.Written)
+	assert.Empty(t, report.Mismatches)
+	location, err = to.ReadLocation("client-a")
+	assert.Nil(t, err)
+	assert.Equal(t, "client-a", string(location.GetPublicKey()))
+}
+
+func TestVerify(t *testing.T) {
+	from, keyIDs := newSourceStore(t)
+	snapshot, err := ReadSnapshot(from)
+	assert.Nil(t, err)
+	assert.Empty(t, Verify(snapshot, from, nil))
+
+	to := newTestStore(t)
+	assert.Len(t, Verify(snapshot, to, nil), 5)
+	assert.Nil(t, to.WriteLocation(types.LocationData{LocationID: "client-b", PublicKey: []byte("other")}))
+	mismatches := Verify(snapshot, to, []string{"key pair " + keyIDs[0], "key pair " + keyIDs[1], "location " + pkg.CLOUD_ID, "location client-a"})
+	assert.Equal(t, []string{"location client-b"}, mismatches)
+}
+
+func TestArchive(t *testing.T) {
+	from, _ := newSourceStore(t)
+	snapshot, err := ReadSnapshot(from)
+	assert.Nil(t, err)
+	encrypter, err := kek.NewPassphraseKeyEncrypter("correct horse battery staple")
+	assert.Nil(t, err)
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, Export(snapshot, buf, encrypter, signer))
+	assert.NotContains(t, buf.String(), "priv0", "the archive is encrypted")
+	archived := buf.Bytes()
+
+	imported, err := Import(bytes.NewReader(archived), encrypter, &signer.PublicKey)
+	assert.Nil(t, err)
+	to := newTestStore(t)
+	report, err := Restore(imported, to, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, Counts{KeyPairs: 2, Locations: 3}, report.Written)
+	assert.Empty(t, report.Mismatches)
+
+	// a different signer
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	_, err = Import(bytes.NewReader(archived), encrypter, &other.PublicKey)
+	assert.Equal(t, ErrArchiveSignature, err)
+
+	// a tampered archive
+	archive := &Archive{}
+	assert.Nil(t, json.Unmarshal(archived, archive))
+	archive.KEK = "someone-else"
+	tampered, err := json.Marshal(archive)
+	assert.Nil(t, err)
+	_, err = Import(bytes.NewReader(tampered), encrypter, &signer.PublicKey)
+	assert.Equal(t, ErrArchiveSignature, err)
+
+	// the wrong passphrase
+	wrong, err := kek.NewPassphraseKeyEncrypter("wrong")
+	assert.Nil(t, err)
+	_, err = Import(bytes.NewReader(archived), wrong, &signer.PublicKey)
+	assert.Error(t, err)
+}
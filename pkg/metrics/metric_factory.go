@@ -4,6 +4,7 @@
 
 package metrics
 
+import "strconv"
 import "github.com/prometheus/client_golang/prometheus/promauto"
 import "github.com/prometheus/client_golang/prometheus"
 
@@ -15,17 +16,28 @@ var totalClientRegistrationFailures prometheus.Counter
 var totalClientUnRegistrationSuccesses prometheus.Counter
 var totalClientUnRegistrationFailures prometheus.Counter
 var timeToPushMessage prometheus.Histogram
-//sum of all 200 level returns
+
+// sum of all 200 level returns
 var httpResp200s prometheus.Counter
-//sum of all 400s (including 401 and 404)
+
+// sum of all 400s (including 401 and 404)
 var httpResp400s prometheus.Counter
-//counter specific for 401 for security
+
+// counter specific for 401 for security
 var httpResp401 prometheus.Counter
-//counter specific for 404 for health
+
+// counter specific for 404 for health
 var httpResp404 prometheus.Counter
 var httpResp500 prometheus.Counter
+var envelopesRejected *prometheus.CounterVec
+var messagesExpired *prometheus.CounterVec
+var compressionBytesIn *prometheus.CounterVec
+var compressionBytesOut *prometheus.CounterVec
+var locationsThrottled *prometheus.CounterVec
+var keystoreCacheHits *prometheus.CounterVec
+var keystoreCacheMisses *prometheus.CounterVec
 
-//uses this page https://prometheus.io/docs/guides/go-application/
+// uses this page https://prometheus.io/docs/guides/go-application/
 func InitMetrics() {
 	totalQueryForMessages = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "natssync_message_query_total",
@@ -72,6 +84,34 @@ func InitMetrics() {
 		Name: "natssync_http_resp500s",
 		Help: "The total number 500 level responses.",
 	})
+	envelopesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_envelope_rejected_total",
+		Help: "The total number of envelopes rejected by the envelope version policy.",
+	}, []string{"location", "version"})
+	messagesExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_message_expired_total",
+		Help: "The total number of messages dropped because they expired before reaching the other side.",
+	}, []string{"location", "stage"})
+	compressionBytesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_compression_bytes_in_total",
+		Help: "The total number of message bytes before compression.",
+	}, []string{"algorithm"})
+	compressionBytesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_compression_bytes_out_total",
+		Help: "The total number of message bytes after compression.",
+	}, []string{"algorithm"})
+	locationsThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_location_throttled_total",
+		Help: "The total number of requests from a location rejected by its rate limits.",
+	}, []string{"location", "reason"})
+	keystoreCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_keystore_cache_hits_total",
+		Help: "The total number of locations, public or private keys found in the keystore cache.",
+	}, []string{"kind"})
+	keystoreCacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "natssync_keystore_cache_misses_total",
+		Help: "The total number of locations, public or private keys read from the keystore because they were not cached.",
+	}, []string{"kind"})
 
 }
 
@@ -114,22 +154,61 @@ func IncrementClientUnRegistrationFailure(count int) {
 	}
 }
 
+func IncrementEnvelopeRejected(locationID string, version int) {
+	if envelopesRejected != nil {
+		envelopesRejected.WithLabelValues(locationID, strconv.Itoa(version)).Inc()
+	}
+}
+
+// IncrementMessageExpired stage is where in the bridge the expired message was found
+func IncrementMessageExpired(locationID string, stage string) {
+	if messagesExpired != nil {
+		messagesExpired.WithLabelValues(locationID, stage).Inc()
+	}
+}
+
+func AddCompressionBytes(algorithm string, before int, after int) {
+	if compressionBytesIn != nil {
+		compressionBytesIn.WithLabelValues(algorithm).Add(float64(before))
+		compressionBytesOut.WithLabelValues(algorithm).Add(float64(after))
+	}
+}
+
+func IncrementLocationThrottled(locationID string, reason string) {
+	if locationsThrottled != nil {
+		locationsThrottled.WithLabelValues(locationID, reason).Inc()
+	}
+}
+
+// IncrementKeystoreCacheHit kind is public, private or location
+func IncrementKeystoreCacheHit(kind string) {
+	if keystoreCacheHits != nil {
+		keystoreCacheHits.WithLabelValues(kind).Inc()
+	}
+}
+
+func IncrementKeystoreCacheMiss(kind string) {
+	if keystoreCacheMisses != nil {
+		keystoreCacheMisses.WithLabelValues(kind).Inc()
+	}
+}
+
 func RecordTimeToPushMessage(count int) {
 	if timeToPushMessage != nil {
 		timeToPushMessage.Observe(float64(count))
 	}
 }
-func IncrementHttpResp(statusCode int){
-	if statusCode <300{
+func IncrementHttpResp(statusCode int) {
+	if statusCode < 300 {
 		httpResp200s.Inc()
-	}else if statusCode>399 && statusCode <500{
+	} else if statusCode > 399 && statusCode < 500 {
 		httpResp400s.Inc()
-		if statusCode ==401{
+		if statusCode == 401 {
 			httpResp401.Inc()
-		}else if statusCode==404{
+		} else if statusCode == 404 {
 			httpResp404.Inc()
 		}
-	}else if statusCode>500{
+	} else if statusCode > 500 {
 		httpResp500.Inc()
 	}
 }
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+)
+
+const AUTH_CHALLENGE_VERSION_1 = 1 // signed time string, no replay protection
+const AUTH_CHALLENGE_VERSION_2 = 2 // signed AuthChallengeData, bound to a location and request
+
+var (
+	ErrAuthChallengeInvalid         = errors.New("invalid auth challenge")
+	ErrAuthChallengeSignature       = errors.New("auth challenge signature verification failed")
+	ErrAuthChallengeLegacy          = errors.New("legacy auth challenges are not allowed")
+	ErrAuthChallengeExpired         = errors.New("auth challenge is outside the allowed clock skew")
+	ErrAuthChallengeReplayed        = errors.New("auth challenge has already been used")
+	ErrAuthChallengeBindingMismatch = errors.New("auth challenge does not match the request")
+)
+
+// AuthChallengeData the signed payload of a version 2 auth challenge, it is carried as JSON in AuthChallengeA
+type AuthChallengeData struct {
+	// Timestamp unix time in milliseconds of when the challenge was made
+	Timestamp  int64  `json:"timestamp"`
+	Nonce      string `json:"nonce"`
+	LocationID string `json:"locationID"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+}
+
+// NewAuthChallengeForRequest Makes a new auth challenge bound to the location and the request it will be sent with.
+// if KeyID is blank, it uses the current known key ID
+func NewAuthChallengeForRequest(keyID, locationID, method, path string) *v1.AuthChallenge {
+	key, err := LoadPrivateKey(keyID)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to load private Key")
+		return nil
+	}
+
+	data := AuthChallengeData{
+		Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
+		Nonce:      bridgemodel.GenerateUUID(),
+		LocationID: locationID,
+		Method:     method,
+		Path:       path,
+	}
+	dataBits, err := json.Marshal(&data)
+	if err != nil {
+		log.WithError(err).Errorf("Error encoding auth challenge data")
+		return nil
+	}
+	sig, err := SignData(dataBits, key)
+	if err != nil {
+		log.WithError(err).Errorf("Error signing data")
+		return nil
+	}
+
+	ret := new(v1.AuthChallenge)
+	ret.Version = AUTH_CHALLENGE_VERSION_2
+	ret.AuthChallengeA = string(dataBits)
+	ret.AuthChellengeB = base64.StdEncoding.EncodeToString(sig)
+	return ret
+}
+
+// AuthChallengeValidator checks auth challenges for a valid signature, freshness and replays
+type AuthChallengeValidator struct {
+	maxSkew     time.Duration
+	nonceCache  NonceCache
+	allowLegacy bool
+	now         func() time.Time
+}
+
+func NewAuthChallengeValidator(maxSkew time.Duration, nonceCache NonceCache, allowLegacy bool) *AuthChallengeValidator {
+	return &AuthChallengeValidator{
+		maxSkew:     maxSkew,
+		nonceCache:  nonceCache,
+		allowLegacy: allowLegacy,
+		now:         time.Now,
+	}
+}
+
+// Validate returns nil if the challenge was signed by the location, is bound to the given request, is within the
+// allowed clock skew and has not been seen before
+func (v *AuthChallengeValidator) Validate(locationID, method, path string, challenge *v1.AuthChallenge) error {
+	if challenge == nil || len(challenge.AuthChallengeA) == 0 {
+		return ErrAuthChallengeInvalid
+	}
+
+	if int(challenge.Version) != AUTH_CHALLENGE_VERSION_2 {
+		if !v.allowLegacy {
+			return ErrAuthChallengeLegacy
+		}
+		if !ValidateAuthChallenge(locationID, challenge) {
+			return ErrAuthChallengeSignature
+		}
+		log.WithField("locationID", locationID).Warn("Accepted a legacy auth challenge without replay protection")
+		return nil
+	}
+
+	var data AuthChallengeData
+	if err := json.Unmarshal([]byte(challenge.AuthChallengeA), &data); err != nil {
+		return ErrAuthChallengeInvalid
+	}
+	if data.LocationID != locationID || data.Method != method || data.Path != path {
+		return ErrAuthChallengeBindingMismatch
+	}
+	if len(data.Nonce) == 0 {
+		return ErrAuthChallengeInvalid
+	}
+
+	issued := time.Unix(0, data.Timestamp*int64(time.Millisecond))
+	now := v.now()
+	if issued.Before(now.Add(-v.maxSkew)) || issued.After(now.Add(v.maxSkew)) {
+		return ErrAuthChallengeExpired
+	}
+
+	// check the signature before touching the nonce cache so forged challenges cannot burn nonces
+	if !ValidateAuthChallenge(locationID, challenge) {
+		return ErrAuthChallengeSignature
+	}
+
+	// a nonce only needs remembering for as long as its timestamp would still be accepted
+	fresh, err := v.nonceCache.Add(fmt.Sprintf("%s:%s", locationID, data.Nonce), issued.Add(v.maxSkew))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrAuthChallengeReplayed
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/theotw/natssync/pkg"
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+)
+
+const CONTENT_TYPE_JSON = "application/json"
+
+// CONTENT_TYPE_BINARY_BATCH length prefixed binary batches, see EncodeBatch
+const CONTENT_TYPE_BINARY_BATCH = "application/x-natssync-batch"
+
+const BATCH_FORMAT_JSON = "json"
+const BATCH_FORMAT_BINARY = "binary"
+
+const WEBSOCKET_FORMAT_PARAM = "format" // query parameter a websocket client sets to BATCH_FORMAT_BINARY for binary frames
+
+// BRIDGE_MESSAGE_FORMAT_VERSION the FormatVersion of JSON bridge messages
+const BRIDGE_MESSAGE_FORMAT_VERSION = "1"
+
+const binaryBatchVersion = 1
+
+var binaryBatchMagic = []byte("NSB")
+
+var ErrInvalidBatch = errors.New("invalid binary batch")
+
+// useBinaryBatches set once the server says it can read binary batches
+var useBinaryBatches int32
+
+// SupportedBatchContentTypes the bridge batch content types this build can read
+var SupportedBatchContentTypes = []string{CONTENT_TYPE_JSON, CONTENT_TYPE_BINARY_BATCH}
+
+// BatchMessage a message in a bridge batch with its envelope
+type BatchMessage struct {
+	ClientID   string
+	DeliveryID string
+	Envelope   *MessageEnvelope
+}
+
+// Batch a set of messages and acks moving across the bridge in one request, response or websocket frame
+type Batch struct {
+	AuthChallenge v1.AuthChallenge
+	Acks          []string
+	Messages      []BatchMessage
+}
+
+// SetUseBinaryBatches turns binary batches on if BRIDGE_BATCH_FORMAT allows them
+func SetUseBinaryBatches(serverSupported bool) {
+	var val int32
+	if serverSupported && pkg.Config.BridgeBatchFormat == BATCH_FORMAT_BINARY {
+		val = 1
+	}
+	atomic.StoreInt32(&useBinaryBatches, val)
+}
+
+// UseBinaryBatches true if batches should be sent to the server in binary
+func UseBinaryBatches() bool {
+	return atomic.LoadInt32(&useBinaryBatches) == 1
+}
+
+// NewBridgeMessage the JSON form of a batch message, the envelope is carried as a JSON string
+func NewBridgeMessage(msg *BatchMessage) (v1.BridgeMessage, error) {
+	var ret v1.BridgeMessage
+	jsonData, err := json.Marshal(msg.Envelope)
+	if err != nil {
+		return ret, err
+	}
+	ret.MessageData = string(jsonData)
+	ret.FormatVersion = BRIDGE_MESSAGE_FORMAT_VERSION
+	ret.ClientID = msg.ClientID
+	ret.DeliveryID = msg.DeliveryID
+	return ret, nil
+}
+
+// NewBatchMessage reads the envelope out of a JSON bridge message
+func NewBatchMessage(msg *v1.BridgeMessage) (*BatchMessage, error) {
+	envelope := new(MessageEnvelope)
+	if err := json.Unmarshal([]byte(msg.MessageData), envelope); err != nil {
+		return nil, err
+	}
+	return &BatchMessage{ClientID: msg.ClientID, DeliveryID: msg.DeliveryID, Envelope: envelope}, nil
+}
+
+// NewBatchFromPostReq the batch in a JSON post request.  Messages that can not be read are left out and their
+// errors returned
+func NewBatchFromPostReq(req *v1.BridgeMessagePostReq) (*Batch, []error) {
+	batchMsgs, errs := NewBatchMessages(req.Messages)
+	return &Batch{AuthChallenge: req.AuthChallenge, Acks: req.Acks, Messages: batchMsgs}, errs
+}
+
+// NewBatchMessages the batch messages of JSON bridge messages.  Messages that can not be read are left out and their
+// errors returned
+func NewBatchMessages(bridgeMsgs []v1.BridgeMessage) ([]BatchMessage, []error) {
+	ret := make([]BatchMessage, 0, len(bridgeMsgs))
+	var errs []error
+	for i := range bridgeMsgs {
+		msg, err := NewBatchMessage(&bridgeMsgs[i])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ret = append(ret, *msg)
+	}
+	return ret, errs
+}
+
+// BridgeMessages the JSON form of the batch messages
+func (b *Batch) BridgeMessages() ([]v1.BridgeMessage, error) {
+	ret := make([]v1.BridgeMessage, 0, len(b.Messages))
+	for i := range b.Messages {
+		bridgeMsg, err := NewBridgeMessage(&b.Messages[i])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, bridgeMsg)
+	}
+	return ret, nil
+}
+
+// MessageBytes the size of the encrypted messages in the batch
+func (b *Batch) MessageBytes() int {
+	ret := 0
+	for i := range b.Messages {
+		if b.Messages[i].Envelope != nil {
+			ret += base64.StdEncoding.DecodedLen(len(b.Messages[i].Envelope.Message))
+		}
+	}
+	return ret
+}
+
+// PostReq the JSON form of the batch
+func (b *Batch) PostReq() (*v1.BridgeMessagePostReq, error) {
+	bridgeMsgs, err := b.BridgeMessages()
+	if err != nil {
+		return nil, err
+	}
+	return &v1.BridgeMessagePostReq{AuthChallenge: b.AuthChallenge, Acks: b.Acks, Messages: bridgeMsgs}, nil
+}
+
+// EncodeBatch the binary form of the batch.  It is the magic "NSB" and a format version byte, followed by the auth
+// challenge, acks and messages.  Numbers are uvarints, strings are uvarint length prefixed and the envelope message
+// and signature are carried as raw bytes rather than base64
+func EncodeBatch(batch *Batch) ([]byte, error) {
+	w := new(batchWriter)
+	w.buf.Write(binaryBatchMagic)
+	w.buf.WriteByte(binaryBatchVersion)
+
+	w.uvarint(uint64(batch.AuthChallenge.Version))
+	w.string(batch.AuthChallenge.AuthChallengeA)
+	w.string(batch.AuthChallenge.AuthChellengeB)
+
+	w.uvarint(uint64(len(batch.Acks)))
+	for _, ack := range batch.Acks {
+		w.string(ack)
+	}
+
+	w.uvarint(uint64(len(batch.Messages)))
+	for i := range batch.Messages {
+		msg := &batch.Messages[i]
+		if msg.Envelope == nil {
+			return nil, fmt.Errorf("message %d has no envelope", i)
+		}
+		w.string(msg.ClientID)
+		w.string(msg.DeliveryID)
+		if err := w.envelope(msg.Envelope); err != nil {
+			return nil, err
+		}
+	}
+	return w.buf.Bytes(), nil
+}
+
+// DecodeBatch reads a batch made by EncodeBatch
+func DecodeBatch(bits []byte) (*Batch, error) {
+	if len(bits) < len(binaryBatchMagic)+1 || !bytes.Equal(bits[:len(binaryBatchMagic)], binaryBatchMagic) {
+		return nil, ErrInvalidBatch
+	}
+	if bits[len(binaryBatchMagic)] != binaryBatchVersion {
+		return nil, fmt.Errorf("unsupported binary batch version %d", bits[len(binaryBatchMagic)])
+	}
+	r := &batchReader{bits: bits[len(binaryBatchMagic)+1:]}
+
+	ret := new(Batch)
+	ret.AuthChallenge.Version = float32(r.uvarint())
+	ret.AuthChallenge.AuthChallengeA = r.string()
+	ret.AuthChallenge.AuthChellengeB = r.string()
+
+	ackCount := r.count()
+	if ackCount > 0 {
+		ret.Acks = make([]string, 0, ackCount)
+	}
+	for i := 0; i < ackCount && r.err == nil; i++ {
+		ret.Acks = append(ret.Acks, r.string())
+	}
+
+	msgCount := r.count()
+	ret.Messages = make([]BatchMessage, 0, msgCount)
+	for i := 0; i < msgCount && r.err == nil; i++ {
+		var msg BatchMessage
+		msg.ClientID = r.internedString()
+		msg.DeliveryID = r.string()
+		msg.Envelope = r.envelope()
+		ret.Messages = append(ret.Messages, msg)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.bits) > 0 {
+		return nil, ErrInvalidBatch
+	}
+	return ret, nil
+}
+
+type batchWriter struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+	// reused for decoding base64 fields
+	decoded []byte
+}
+
+func (w *batchWriter) uvarint(val uint64) {
+	n := binary.PutUvarint(w.scratch[:], val)
+	w.buf.Write(w.scratch[:n])
+}
+
+func (w *batchWriter) string(val string) {
+	w.uvarint(uint64(len(val)))
+	w.buf.WriteString(val)
+}
+
+func (w *batchWriter) bytes(val []byte) {
+	w.uvarint(uint64(len(val)))
+	w.buf.Write(val)
+}
+
+// base64 writes the decoded bits of a base64 string
+func (w *batchWriter) base64(val string) error {
+	maxLen := base64.StdEncoding.DecodedLen(len(val))
+	if cap(w.decoded) < maxLen {
+		w.decoded = make([]byte, maxLen)
+	}
+	n, err := base64.StdEncoding.Decode(w.decoded[:maxLen], []byte(val))
+	if err != nil {
+		return err
+	}
+	w.bytes(w.decoded[:n])
+	return nil
+}
+
+func (w *batchWriter) envelope(envelope *MessageEnvelope) error {
+	w.uvarint(uint64(envelope.EnvelopeVersion))
+	w.string(envelope.RecipientID)
+	w.string(envelope.SenderID)
+	w.string(envelope.KeyID)
+	w.string(envelope.MsgKey)
+	w.string(envelope.Compression)
+	if err := w.base64(envelope.Signature); err != nil {
+		return fmt.Errorf("invalid envelope signature: %v", err)
+	}
+	if err := w.base64(envelope.Message); err != nil {
+		return fmt.Errorf("invalid envelope message: %v", err)
+	}
+	return nil
+}
+
+// batchReader reads batch fields, the first error sticks and all later reads return zero values
+type batchReader struct {
+	bits []byte
+	err  error
+	// location and key IDs repeat across a batch, so they are only allocated once
+	interned map[string]string
+}
+
+func (r *batchReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	val, n := binary.Uvarint(r.bits)
+	if n <= 0 {
+		r.err = ErrInvalidBatch
+		return 0
+	}
+	r.bits = r.bits[n:]
+	return val
+}
+
+// count reads a number of items, each item takes at least a byte so it can not be more than what is left
+func (r *batchReader) count() int {
+	val := r.uvarint()
+	if val > uint64(len(r.bits)) {
+		r.err = ErrInvalidBatch
+		return 0
+	}
+	return int(val)
+}
+
+func (r *batchReader) bytes() []byte {
+	n := r.count()
+	if r.err != nil {
+		return nil
+	}
+	ret := r.bits[:n:n]
+	r.bits = r.bits[n:]
+	return ret
+}
+
+func (r *batchReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *batchReader) internedString() string {
+	bits := r.bytes()
+	if ret, ok := r.interned[string(bits)]; ok {
+		return ret
+	}
+	if r.interned == nil {
+		r.interned = make(map[string]string)
+	}
+	ret := string(bits)
+	r.interned[ret] = ret
+	return ret
+}
+
+func (r *batchReader) envelope() *MessageEnvelope {
+	ret := new(MessageEnvelope)
+	ret.EnvelopeVersion = int(r.uvarint())
+	ret.RecipientID = r.internedString()
+	ret.SenderID = r.internedString()
+	ret.KeyID = r.internedString()
+	ret.MsgKey = r.string()
+	ret.Compression = r.internedString()
+	ret.Signature = base64.StdEncoding.EncodeToString(r.bytes())
+	ret.Message = base64.StdEncoding.EncodeToString(r.bytes())
+	return ret
+}
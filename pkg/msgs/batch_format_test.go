@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+)
+
+func newTestBatch(count int, size int) *Batch {
+	ret := &Batch{
+		AuthChallenge: v1.AuthChallenge{Version: AUTH_CHALLENGE_VERSION_2, AuthChallengeA: `{"nonce":"abc"}`, AuthChellengeB: "c2ln"},
+		Acks:          []string{"ack1", "ack2"},
+	}
+	for i := 0; i < count; i++ {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		sig := make([]byte, 256)
+		rand.Read(sig)
+		ret.Messages = append(ret.Messages, BatchMessage{
+			ClientID:   "client1",
+			DeliveryID: fmt.Sprintf("delivery-%d", i),
+			Envelope: &MessageEnvelope{
+				EnvelopeVersion: ENVELOPE_VERSION_5,
+				RecipientID:     "client1",
+				SenderID:        "cloud-master",
+				KeyID:           "key1",
+				MsgKey:          base64.StdEncoding.EncodeToString(sig),
+				Compression:     COMPRESSION_ZSTD,
+				Signature:       base64.StdEncoding.EncodeToString(sig),
+				Message:         base64.StdEncoding.EncodeToString(msg),
+			},
+		})
+	}
+	return ret
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	batch := newTestBatch(10, 1001)
+	bits, err := EncodeBatch(batch)
+	assert.Nil(t, err)
+
+	batch2, err := DecodeBatch(bits)
+	assert.Nil(t, err)
+	assert.Equal(t, batch, batch2)
+
+	jsonBits, err := json.Marshal(batch.Messages)
+	assert.Nil(t, err)
+	assert.Less(t, len(bits), len(jsonBits))
+
+	// JSON and binary carry the same messages
+	req, err := batch.PostReq()
+	assert.Nil(t, err)
+	batch3, errs := NewBatchFromPostReq(req)
+	assert.Empty(t, errs)
+	assert.Equal(t, batch, batch3)
+}
+
+func TestDecodeBatchInvalid(t *testing.T) {
+	bits, err := EncodeBatch(newTestBatch(2, 100))
+	assert.Nil(t, err)
+
+	_, err = DecodeBatch([]byte("[]"))
+	assert.Equal(t, ErrInvalidBatch, err)
+	for _, n := range []int{4, 10, len(bits) / 2, len(bits) - 1} {
+		_, err = DecodeBatch(bits[:n])
+		assert.Error(t, err, "truncated at %d", n)
+	}
+	_, err = DecodeBatch(append(bits, 0))
+	assert.Equal(t, ErrInvalidBatch, err)
+
+	_, err = EncodeBatch(&Batch{Messages: []BatchMessage{{Envelope: &MessageEnvelope{Message: "not base64!"}}}})
+	assert.Error(t, err)
+}
+
+func BenchmarkBatchJSON(b *testing.B) {
+	batch := newTestBatch(512, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bridgeMsgs, err := batch.BridgeMessages()
+		if err != nil {
+			b.Fatal(err)
+		}
+		bits, err := json.Marshal(bridgeMsgs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(bits)))
+
+		var bridgeMsgs2 []v1.BridgeMessage
+		if err = json.Unmarshal(bits, &bridgeMsgs2); err != nil {
+			b.Fatal(err)
+		}
+		if _, errs := NewBatchMessages(bridgeMsgs2); len(errs) > 0 {
+			b.Fatal(errs[0])
+		}
+	}
+}
+
+func BenchmarkBatchBinary(b *testing.B) {
+	batch := newTestBatch(512, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bits, err := EncodeBatch(batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(bits)))
+
+		if _, err = DecodeBatch(bits); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
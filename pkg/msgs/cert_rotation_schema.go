@@ -9,4 +9,11 @@ type CertRotationRequest struct {
 	PublicKeyPackage MessageEnvelope  `json:"publicKey,omitempty"`
 	PremID           string           `json:"premID,omitempty"`
 	AuthChallenge    v1.AuthChallenge `json:"authChallenge,omitempty"`
+	// ClientCertificate asks for a client certificate for the new key pair, older servers ignore it
+	ClientCertificate bool `json:"clientCertificate,omitempty"`
+}
+
+// CertRotationResponse sent with a 200 when the server issued a client certificate, otherwise the response is a 204
+type CertRotationResponse struct {
+	ClientCertificate string `json:"clientCertificate,omitempty"`
 }
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// CLOUD_KEYS_PATH serves the signed set of cloud master public keys
+const CLOUD_KEYS_PATH = BRIDGE_SERVER_API_PATH + "/cloud-keys"
+
+var ErrCloudKeySetUntrusted = errors.New("cloud key set is not signed by a trusted key")
+
+// CloudKey a cloud master public key
+type CloudKey struct {
+	KeyID string `json:"keyID"`
+	// PublicKey PEM encoded
+	PublicKey string    `json:"publicKey"`
+	Created   time.Time `json:"created"`
+}
+
+// CloudKeySignature a signature over the keys of a CloudKeySet made with the private half of one of them
+type CloudKeySignature struct {
+	KeyID     string `json:"keyID"`
+	Signature string `json:"signature"`
+}
+
+// CloudKeySet the cloud master public keys, newest first.  The first key is the one the cloud signs with, the others
+// are still valid until they are retired.  Every key signs the set, so a client that only knows an older key can
+// trust the newer ones
+type CloudKeySet struct {
+	Keys       []CloudKey          `json:"keys"`
+	Signatures []CloudKeySignature `json:"signatures"`
+}
+
+// RotateCloudKey makes a new cloud master key pair, the older key pairs stay until the reaper retires them
+func RotateCloudKey() (string, error) {
+	pair, err := GenerateNewKeyPair()
+	if err != nil {
+		return "", err
+	}
+	locationData, err := GetKeyPairLocationData(pkg.CLOUD_ID, pair)
+	if err != nil {
+		return "", err
+	}
+	if err = persistence.GetKeyStore().WriteKeyPair(locationData); err != nil {
+		return "", err
+	}
+	log.WithField("keyID", locationData.GetKeyID()).Info("Rotated the cloud master key")
+	return locationData.GetKeyID(), nil
+}
+
+// NewCloudKeySet the signed set of this side's key pairs
+func NewCloudKeySet() (*CloudKeySet, error) {
+	keyPairs, err := persistence.ListKeyPairs(persistence.GetKeyStore())
+	if err != nil {
+		return nil, err
+	}
+	return SignCloudKeys(keyPairs)
+}
+
+// SignCloudKeys the set of the key pairs' public keys, signed by each of them.  The first key pair is the current one
+func SignCloudKeys(keyPairs []*types.LocationData) (*CloudKeySet, error) {
+	if len(keyPairs) == 0 {
+		return nil, errors.New("no cloud keys")
+	}
+	ret := new(CloudKeySet)
+	for _, keyPair := range keyPairs {
+		ret.Keys = append(ret.Keys, CloudKey{
+			KeyID:     keyPair.GetKeyID(),
+			PublicKey: string(keyPair.GetPublicKey()),
+			Created:   keyPair.GetCreated(),
+		})
+	}
+	hash, err := ret.hash()
+	if err != nil {
+		return nil, err
+	}
+	for _, keyPair := range keyPairs {
+		privateKey, err := parsePrivateKey(keyPair.GetPrivateKey())
+		if err != nil {
+			return nil, err
+		}
+		sig, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret.Signatures = append(ret.Signatures, CloudKeySignature{
+			KeyID:     keyPair.GetKeyID(),
+			Signature: base64.StdEncoding.EncodeToString(sig),
+		})
+	}
+	return ret, nil
+}
+
+func (s *CloudKeySet) hash() ([]byte, error) {
+	bits, err := json.Marshal(s.Keys)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bits)
+	return hash[:], nil
+}
+
+// Current the key the cloud signs with
+func (s *CloudKeySet) Current() CloudKey {
+	return s.Keys[0]
+}
+
+// Verify returns nil if one of the trusted keys is in the set and signed it
+func (s *CloudKeySet) Verify(trusted []*rsa.PublicKey) error {
+	if len(s.Keys) == 0 {
+		return errors.New("cloud key set is empty")
+	}
+	hash, err := s.hash()
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]string, len(s.Keys))
+	for _, key := range s.Keys {
+		keys[key.KeyID] = key.PublicKey
+	}
+	for _, sig := range s.Signatures {
+		pemKey, ok := keys[sig.KeyID]
+		if !ok {
+			continue
+		}
+		publicKey, err := ParsePublicKey([]byte(pemKey))
+		if err != nil || !isTrusted(publicKey, trusted) {
+			continue
+		}
+		sigBits, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil {
+			continue
+		}
+		if rsa.VerifyPSS(publicKey, crypto.SHA256, hash, sigBits, nil) == nil {
+			return nil
+		}
+	}
+	return ErrCloudKeySetUntrusted
+}
+
+func isTrusted(publicKey *rsa.PublicKey, trusted []*rsa.PublicKey) bool {
+	for _, key := range trusted {
+		if publicKey.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
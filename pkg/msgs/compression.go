@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/metrics"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+const COMPRESSION_NONE = ""
+const COMPRESSION_GZIP = "gzip"
+const COMPRESSION_ZSTD = "zstd"
+
+// COMPRESSION_DISABLED turns compression off, even if the location metadata asks for it
+const COMPRESSION_DISABLED = "none"
+
+// METADATA_COMPRESSION location metadata key for the compression the location accepts, gzip or zstd
+const METADATA_COMPRESSION = NATSSYNC_METADATA_PREFIX + "compression"
+
+// METADATA_SUPPORTED_COMPRESSION location metadata key for the comma separated compression the location can read.
+// Locations list it when they register, messages to a location are only compressed with one it listed
+const METADATA_SUPPORTED_COMPRESSION = NATSSYNC_METADATA_PREFIX + "compression.supported"
+
+const defaultCompressionThreshold = 1024
+
+// zeroPaddingGuard is appended to compressed v3 messages.  The v3 AES-CBC zero padding is removed by trimming zeros,
+// which would also eat the end of compressed data that happens to end in zeros
+const zeroPaddingGuard = byte(0xff)
+
+// maxDecompressedSize guards against decompression bombs
+const maxDecompressedSize = 64 * 1024 * 1024
+
+// SupportedCompression the compression algorithms this build can read
+var SupportedCompression = []string{COMPRESSION_GZIP, COMPRESSION_ZSTD}
+
+var ErrDecompressedTooLarge = errors.New("decompressed message is too large")
+
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdOnce sync.Once
+
+// negotiatedCompression set when the compression was agreed with the other side
+var negotiatedCompression atomic.Value
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			log.WithError(err).Errorf("Unable to create zstd encoder")
+		}
+		if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize)); err != nil {
+			log.WithError(err).Errorf("Unable to create zstd decoder")
+		}
+	})
+}
+
+// IsSupportedCompression true if this build can read the compression algorithm
+func IsSupportedCompression(compression string) bool {
+	for _, c := range SupportedCompression {
+		if c == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSendCompression overrides the compression used when sending, COMPRESSION_NONE goes back to the configured one
+// and COMPRESSION_DISABLED stops compression
+func SetSendCompression(compression string) {
+	negotiatedCompression.Store(compression)
+}
+
+// AdvertiseCompression a copy of the registration metadata that lists the compression this build can read
+func AdvertiseCompression(metadata map[string]string) map[string]string {
+	ret := make(map[string]string, len(metadata)+1)
+	for key, val := range metadata {
+		ret[key] = val
+	}
+	ret[METADATA_SUPPORTED_COMPRESSION] = strings.Join(SupportedCompression, ",")
+	return ret
+}
+
+// GetCompression the compression to use for messages to the recipient.  An agreed compression wins, otherwise the
+// configured compression is used if the recipient listed it when it registered
+func GetCompression(recipientID string) string {
+	if negotiated, ok := negotiatedCompression.Load().(string); ok && len(negotiated) > 0 {
+		if negotiated == COMPRESSION_DISABLED {
+			return COMPRESSION_NONE
+		}
+		return negotiated
+	}
+	metadata := getRecipientMetadata(recipientID)
+	compression := configuredCompression(metadata)
+	if compression == COMPRESSION_NONE {
+		return COMPRESSION_NONE
+	}
+	for _, supported := range strings.Split(metadata[METADATA_SUPPORTED_COMPRESSION], ",") {
+		if strings.TrimSpace(supported) == compression {
+			return compression
+		}
+	}
+	return COMPRESSION_NONE
+}
+
+// GetConfiguredCompression the compression asked for by the recipient's metadata or MESSAGE_COMPRESSION, whether or
+// not the recipient can read it
+func GetConfiguredCompression(recipientID string) string {
+	return configuredCompression(getRecipientMetadata(recipientID))
+}
+
+func configuredCompression(metadata map[string]string) string {
+	compression := pkg.Config.MessageCompression
+	if val, ok := metadata[METADATA_COMPRESSION]; ok {
+		compression = val
+	}
+	if compression == COMPRESSION_DISABLED || (len(compression) > 0 && !IsSupportedCompression(compression)) {
+		return COMPRESSION_NONE
+	}
+	return compression
+}
+
+func getRecipientMetadata(recipientID string) map[string]string {
+	if store := persistence.GetKeyStore(); store != nil {
+		if locationData, err := persistence.LoadLocation(store, recipientID); err == nil && locationData != nil {
+			return locationData.GetMetadata()
+		}
+	}
+	return nil
+}
+
+func getCompressionThreshold() int {
+	threshold, err := strconv.Atoi(pkg.Config.MessageCompressionThreshold)
+	if err != nil {
+		log.WithError(err).Errorf("failed to parse message compression threshold, using %d", defaultCompressionThreshold)
+		return defaultCompressionThreshold
+	}
+	return threshold
+}
+
+// compressForRecipient compresses the message if the recipient accepts compression and the message is over the
+// threshold.  Returns the bits to encrypt and the compression used
+func compressForRecipient(msg []byte, recipientID string) ([]byte, string) {
+	compression := GetCompression(recipientID)
+	if compression == COMPRESSION_NONE || len(msg) < getCompressionThreshold() {
+		return msg, COMPRESSION_NONE
+	}
+	compressed, err := compress(msg, compression)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to compress message with %s, sending it uncompressed", compression)
+		return msg, COMPRESSION_NONE
+	}
+	// not worth it, e.g. already compressed or encrypted data
+	if len(compressed) >= len(msg) {
+		return msg, COMPRESSION_NONE
+	}
+	metrics.AddCompressionBytes(compression, len(msg), len(compressed))
+	return compressed, compression
+}
+
+func compress(msg []byte, compression string) ([]byte, error) {
+	switch compression {
+	case COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(msg); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case COMPRESSION_ZSTD:
+		initZstd()
+		if zstdEncoder == nil {
+			return nil, errors.New("zstd is not available")
+		}
+		return zstdEncoder.EncodeAll(msg, make([]byte, 0, len(msg))), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
+
+func decompress(msg []byte, compression string) ([]byte, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return msg, nil
+	case COMPRESSION_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(msg))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		ret, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(ret) > maxDecompressedSize {
+			return nil, ErrDecompressedTooLarge
+		}
+		return ret, nil
+	case COMPRESSION_ZSTD:
+		initZstd()
+		if zstdDecoder == nil {
+			return nil, errors.New("zstd is not available")
+		}
+		return zstdDecoder.DecodeAll(msg, nil)
+	}
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
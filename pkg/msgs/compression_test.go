@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	msg := bytes.Repeat([]byte("hello world "), 1000)
+	for _, compression := range SupportedCompression {
+		compressed, err := compress(msg, compression)
+		assert.Nil(t, err)
+		assert.Less(t, len(compressed), len(msg))
+
+		msg2, err := decompress(compressed, compression)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, msg2)
+	}
+
+	_, err := compress(msg, "bogus")
+	assert.Error(t, err)
+	_, err = decompress(msg, "bogus")
+	assert.Error(t, err)
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	bomb := make([]byte, maxDecompressedSize+1)
+	for _, compression := range SupportedCompression {
+		compressed, err := compress(bomb, compression)
+		assert.Nil(t, err)
+
+		_, err = decompress(compressed, compression)
+		assert.Error(t, err, compression)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"errors"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/metrics"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+// location metadata keys that tighten the global envelope policy for a single location
+const NATSSYNC_METADATA_PREFIX = "natssync."
+const METADATA_ENVELOPE_MIN_VERSION = NATSSYNC_METADATA_PREFIX + "envelope.minVersion"
+const METADATA_ENVELOPE_DENY_PLAINTEXT = NATSSYNC_METADATA_PREFIX + "envelope.denyPlaintext"
+
+var (
+	ErrEnvelopeVersionNotAllowed   = errors.New("envelope version is below the minimum allowed version")
+	ErrEnvelopePlaintextNotAllowed = errors.New("plaintext envelopes are not allowed")
+	ErrEnvelopeKeyIDRequired       = errors.New("envelope does not name the key pair it was encrypted to")
+)
+
+// SupportedEnvelopeVersions the envelope versions this build can read
+var SupportedEnvelopeVersions = []int{ENVELOPE_VERSION_1, ENVELOPE_VERSION_2, ENVELOPE_VERSION_3, ENVELOPE_VERSION_4, ENVELOPE_VERSION_5, ENVELOPE_VERSION_6}
+
+// isEncryptedSendVersion true for the encrypted envelope versions this build sends with
+func isEncryptedSendVersion(version int) bool {
+	return version == ENVELOPE_VERSION_3 || version == ENVELOPE_VERSION_5 || version == ENVELOPE_VERSION_6
+}
+
+// EnvelopePolicy which envelope versions are accepted.  The plaintext version (v4) is governed by AllowPlaintext
+// only, MinVersion applies to the encrypted versions
+type EnvelopePolicy struct {
+	MinVersion     int
+	AllowPlaintext bool
+}
+
+// GetGlobalEnvelopePolicy the policy set by ENVELOPE_MIN_VERSION and ENVELOPE_DENY_PLAINTEXT
+func GetGlobalEnvelopePolicy() EnvelopePolicy {
+	ret := EnvelopePolicy{
+		MinVersion:     ENVELOPE_VERSION_1,
+		AllowPlaintext: !pkg.Config.EnvelopeDenyPlaintext,
+	}
+	if version, err := strconv.Atoi(pkg.Config.EnvelopeMinVersion); err != nil {
+		log.WithError(err).Errorf("failed to parse envelope min version, using %d", ret.MinVersion)
+	} else {
+		ret.MinVersion = version
+	}
+	return ret
+}
+
+// GetEnvelopePolicy the global policy tightened by the location's metadata.  A location can only make the policy
+// stricter, never looser
+func GetEnvelopePolicy(locationID string) EnvelopePolicy {
+	ret := GetGlobalEnvelopePolicy()
+	store := persistence.GetKeyStore()
+	if store == nil {
+		return ret
+	}
+	locationData, err := persistence.LoadLocation(store, locationID)
+	if err != nil || locationData == nil {
+		return ret
+	}
+	metadata := locationData.GetMetadata()
+	if val, ok := metadata[METADATA_ENVELOPE_MIN_VERSION]; ok {
+		if version, err := strconv.Atoi(val); err != nil {
+			log.WithError(err).WithField("locationID", locationID).Errorf("Invalid %s metadata", METADATA_ENVELOPE_MIN_VERSION)
+		} else if version > ret.MinVersion {
+			ret.MinVersion = version
+		}
+	}
+	if val, ok := metadata[METADATA_ENVELOPE_DENY_PLAINTEXT]; ok {
+		if deny, _ := strconv.ParseBool(val); deny {
+			ret.AllowPlaintext = false
+		}
+	}
+	return ret
+}
+
+// Check returns nil if the envelope version is accepted by the policy
+func (p EnvelopePolicy) Check(version int) error {
+	if version == ENVELOPE_VERSION_4 {
+		if !p.AllowPlaintext {
+			return ErrEnvelopePlaintextNotAllowed
+		}
+		return nil
+	}
+	if version < p.MinVersion {
+		return ErrEnvelopeVersionNotAllowed
+	}
+	return nil
+}
+
+// AcceptedVersions the supported envelope versions this policy accepts
+func (p EnvelopePolicy) AcceptedVersions() []int {
+	ret := make([]int, 0, len(SupportedEnvelopeVersions))
+	for _, version := range SupportedEnvelopeVersions {
+		if p.Check(version) == nil {
+			ret = append(ret, version)
+		}
+	}
+	return ret
+}
+
+// ChooseEnvelopeVersion the version to send with given the preferred version and the versions the peer accepts.
+// Falls back to the newest encrypted version the peer accepts, or the preferred version if there is no overlap.
+// Session keys (v6) are never fallen back to, they are only used when configured
+func ChooseEnvelopeVersion(preferred int, accepted []int) int {
+	best := 0
+	for _, version := range accepted {
+		if version == preferred {
+			return preferred
+		}
+		if (version == ENVELOPE_VERSION_3 || version == ENVELOPE_VERSION_5) && version > best {
+			best = version
+		}
+	}
+	if best == 0 {
+		return preferred
+	}
+	return best
+}
+
+func checkEnvelopePolicy(envelope *MessageEnvelope) error {
+	err := GetEnvelopePolicy(envelope.SenderID).Check(envelope.EnvelopeVersion)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"locationID":      envelope.SenderID,
+			"envelopeVersion": envelope.EnvelopeVersion,
+		}).Errorf("Rejected envelope")
+		metrics.IncrementEnvelopeRejected(envelope.SenderID, envelope.EnvelopeVersion)
+	}
+	return err
+}
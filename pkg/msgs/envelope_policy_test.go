@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/msgs"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func TestChooseEnvelopeVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred int
+		accepted  []int
+		expected  int
+	}{
+		{"preferred accepted", msgs.ENVELOPE_VERSION_3, []int{1, 2, 3, 4, 5}, msgs.ENVELOPE_VERSION_3},
+		{"move up", msgs.ENVELOPE_VERSION_3, []int{4, 5}, msgs.ENVELOPE_VERSION_5},
+		{"session keys", msgs.ENVELOPE_VERSION_6, []int{3, 4, 5, 6}, msgs.ENVELOPE_VERSION_6},
+		{"no session keys", msgs.ENVELOPE_VERSION_6, []int{1, 2, 3, 4, 5}, msgs.ENVELOPE_VERSION_5},
+		{"session keys not chosen", msgs.ENVELOPE_VERSION_3, []int{4, 5, 6}, msgs.ENVELOPE_VERSION_5},
+		{"old server", msgs.ENVELOPE_VERSION_5, []int{1, 2, 3, 4}, msgs.ENVELOPE_VERSION_3},
+		{"no overlap", msgs.ENVELOPE_VERSION_5, []int{4}, msgs.ENVELOPE_VERSION_5},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, msgs.ChooseEnvelopeVersion(tc.preferred, tc.accepted))
+		})
+	}
+}
+
+func TestEnvelopePolicyCheck(t *testing.T) {
+	policy := msgs.EnvelopePolicy{MinVersion: msgs.ENVELOPE_VERSION_3, AllowPlaintext: false}
+	assert.Equal(t, msgs.ErrEnvelopeVersionNotAllowed, policy.Check(msgs.ENVELOPE_VERSION_1))
+	assert.Nil(t, policy.Check(msgs.ENVELOPE_VERSION_3))
+	assert.Equal(t, msgs.ErrEnvelopePlaintextNotAllowed, policy.Check(msgs.ENVELOPE_VERSION_4))
+	assert.Equal(t, []int{msgs.ENVELOPE_VERSION_3, msgs.ENVELOPE_VERSION_5, msgs.ENVELOPE_VERSION_6}, policy.AcceptedVersions())
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// locationSettableMetadata the NATSSYNC_METADATA_PREFIX keys a location may set for itself when it registers.  They
+// only change how messages to the location are sent, the rest (e.g. rate limits) are for the server operator
+var locationSettableMetadata = map[string]bool{
+	METADATA_COMPRESSION:             true,
+	METADATA_SUPPORTED_COMPRESSION:   true,
+	METADATA_ENVELOPE_MIN_VERSION:    true,
+	METADATA_ENVELOPE_DENY_PLAINTEXT: true,
+	METADATA_MESSAGE_DEFAULT_TTL:     true,
+}
+
+// RemoveReservedMetadata copies the metadata a location sent, leaving out NATSSYNC_METADATA_PREFIX keys the location
+// is not allowed to set for itself
+func RemoveReservedMetadata(locationID string, metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(metadata))
+	for key, val := range metadata {
+		if strings.HasPrefix(key, NATSSYNC_METADATA_PREFIX) && !locationSettableMetadata[key] {
+			log.WithField("locationID", locationID).WithField("key", key).Warn("Ignoring reserved metadata key")
+			continue
+		}
+		ret[key] = val
+	}
+	return ret
+}
@@ -0,0 +1,28 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveReservedMetadata(t *testing.T) {
+	metadata := map[string]string{
+		"cluster":                     "east",
+		METADATA_COMPRESSION:          COMPRESSION_ZSTD,
+		METADATA_ENVELOPE_MIN_VERSION: "5",
+		NATSSYNC_METADATA_PREFIX + "rateLimit.messagesPerSec": "0",
+	}
+	ret := RemoveReservedMetadata("loc1", metadata)
+	assert.Equal(t, map[string]string{
+		"cluster":                     "east",
+		METADATA_COMPRESSION:          COMPRESSION_ZSTD,
+		METADATA_ENVELOPE_MIN_VERSION: "5",
+	}, ret)
+	assert.Len(t, metadata, 4, "the metadata passed in is not changed")
+	assert.Nil(t, RemoveReservedMetadata("loc1", nil))
+}
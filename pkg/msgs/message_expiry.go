@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/metrics"
+	"github.com/theotw/natssync/pkg/persistence"
+)
+
+// HEADER_EXPIRES absolute deadline for a message, RFC3339 or unix time in milliseconds
+const HEADER_EXPIRES = "Natssync-Expires"
+
+// HEADER_TTL go duration (e.g. 30s), counted from when the bridge first sees the message
+const HEADER_TTL = "Natssync-TTL"
+
+// METADATA_MESSAGE_DEFAULT_TTL location metadata key for the TTL of messages to the location that have none
+const METADATA_MESSAGE_DEFAULT_TTL = NATSSYNC_METADATA_PREFIX + "message.defaultTTL"
+
+// stages reported in the expired message metric
+const (
+	EXPIRED_STAGE_SERVER_OUTBOUND = "server-outbound"
+	EXPIRED_STAGE_SERVER_INBOUND  = "server-inbound"
+	EXPIRED_STAGE_CLIENT_OUTBOUND = "client-outbound"
+	EXPIRED_STAGE_CLIENT_INBOUND  = "client-inbound"
+)
+
+// GetDefaultTTL the TTL for messages to the location without their own, from the location metadata or
+// MESSAGE_DEFAULT_TTL.  0 means messages do not expire
+func GetDefaultTTL(locationID string) time.Duration {
+	ttlStr := pkg.Config.MessageDefaultTTL
+	if store := persistence.GetKeyStore(); store != nil {
+		if locationData, err := persistence.LoadLocation(store, locationID); err == nil && locationData != nil {
+			if val, ok := locationData.GetMetadata()[METADATA_MESSAGE_DEFAULT_TTL]; ok {
+				ttlStr = val
+			}
+		}
+	}
+	if len(ttlStr) == 0 {
+		return 0
+	}
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil {
+		log.WithError(err).WithField("locationID", locationID).Errorf("Invalid default message TTL, messages will not expire")
+		return 0
+	}
+	return ttl
+}
+
+// GetMessageExpiry the unix millisecond deadline from the message headers, or from the default TTL when the message
+// has none.  seen is when the bridge got the message.  Returns 0 if the message does not expire
+func GetMessageExpiry(header nats.Header, seen time.Time, defaultTTL time.Duration) int64 {
+	if header != nil {
+		if expires := header.Get(HEADER_EXPIRES); len(expires) > 0 {
+			if ms, err := strconv.ParseInt(expires, 10, 64); err == nil {
+				return ms
+			}
+			if deadline, err := time.Parse(time.RFC3339, expires); err == nil {
+				return toUnixMillis(deadline)
+			}
+			log.WithField("expires", expires).Errorf("Invalid %s header, ignoring it", HEADER_EXPIRES)
+		}
+		if ttlStr := header.Get(HEADER_TTL); len(ttlStr) > 0 {
+			if ttl, err := time.ParseDuration(ttlStr); err == nil {
+				return toUnixMillis(seen.Add(ttl))
+			}
+			log.WithField("ttl", ttlStr).Errorf("Invalid %s header, ignoring it", HEADER_TTL)
+		}
+	}
+	if defaultTTL > 0 {
+		return toUnixMillis(seen.Add(defaultTTL))
+	}
+	return 0
+}
+
+// IsExpired true if the message has a deadline and it has passed
+func IsExpired(expires int64, now time.Time) bool {
+	return expires > 0 && toUnixMillis(now) > expires
+}
+
+// DropIfExpired logs and counts the message if it has expired, returns true if it should be dropped
+func DropIfExpired(expires int64, subject string, locationID string, stage string) bool {
+	if !IsExpired(expires, time.Now()) {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"subject":    subject,
+		"locationID": locationID,
+		"stage":      stage,
+	}).Info("Dropping expired message")
+	metrics.IncrementMessageExpired(locationID, stage)
+	return true
+}
+
+func toUnixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
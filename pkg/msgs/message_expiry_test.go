@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/msgs"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func TestGetMessageExpiry(t *testing.T) {
+	seen := time.Unix(1700000000, 0)
+	seenMs := seen.UnixNano() / int64(time.Millisecond)
+	deadline := seen.Add(time.Hour)
+	deadlineMs := deadline.UnixNano() / int64(time.Millisecond)
+
+	tests := []struct {
+		name       string
+		header     nats.Header
+		defaultTTL time.Duration
+		expected   int64
+	}{
+		{"no header no default", nil, 0, 0},
+		{"default ttl", nil, time.Minute, seenMs + 60000},
+		{"unix ms", nats.Header{msgs.HEADER_EXPIRES: []string{strconv.FormatInt(deadlineMs, 10)}}, time.Minute, deadlineMs},
+		{"rfc3339", nats.Header{msgs.HEADER_EXPIRES: []string{deadline.Format(time.RFC3339)}}, 0, deadlineMs},
+		{"ttl", nats.Header{msgs.HEADER_TTL: []string{"30s"}}, time.Minute, seenMs + 30000},
+		{"expires wins over ttl", nats.Header{msgs.HEADER_EXPIRES: []string{strconv.FormatInt(deadlineMs, 10)}, msgs.HEADER_TTL: []string{"30s"}}, 0, deadlineMs},
+		{"invalid falls back to default", nats.Header{msgs.HEADER_TTL: []string{"soon"}}, time.Second, seenMs + 1000},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, msgs.GetMessageExpiry(tc.header, seen, tc.defaultTTL))
+		})
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	now := time.Now()
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	assert.False(t, msgs.IsExpired(0, now), "0 never expires")
+	assert.False(t, msgs.IsExpired(nowMs+1000, now))
+	assert.True(t, msgs.IsExpired(nowMs-1000, now))
+}
+
+func TestGetDefaultTTL(t *testing.T) {
+	oldTTL := pkg.Config.MessageDefaultTTL
+	defer func() { pkg.Config.MessageDefaultTTL = oldTTL }()
+
+	pkg.Config.MessageDefaultTTL = ""
+	assert.Equal(t, time.Duration(0), msgs.GetDefaultTTL("unknown"))
+	pkg.Config.MessageDefaultTTL = "10m"
+	assert.Equal(t, 10*time.Minute, msgs.GetDefaultTTL("unknown"))
+	pkg.Config.MessageDefaultTTL = "bogus"
+	assert.Equal(t, time.Duration(0), msgs.GetDefaultTTL("unknown"))
+}
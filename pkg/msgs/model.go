@@ -17,11 +17,17 @@ const ENVELOPE_VERSION_1 = 1 //EBC AES
 const ENVELOPE_VERSION_2 = 2 // CBC AES
 const ENVELOPE_VERSION_3 = 3 // CBC AES, update version
 const ENVELOPE_VERSION_4 = 4 // v4 is does not encrypt the message, just signs it.  this is for encrypted traffic
+const ENVELOPE_VERSION_5 = 5 // GCM AES-256 with the envelope fields as associated data, RSA-OAEP key wrap, RSA-PSS signature
+const ENVELOPE_VERSION_6 = 6 // GCM AES-256 and HMAC-SHA256 with a per location session key that is only RSA wrapped and signed when it is rekeyed
 const ECHOLET_SUFFIX = "echolet"
 const ECHO_SUBJECT_BASE = "echo"
 const NATSSYNC_MESSAGE_PREFIX = "natssyncmsg"
 const SKIP_ENCRYPTION_FLAG = "noencrypt" // used in third position of a subject (aka, first app usage position) then encryption is skipped.  Handy for SSL or other encrypted messages
 const BLANK_KEY = "this key was intentionally left blank"
+const BRIDGE_SERVER_API_PATH = "/bridge-server/1"
+const CERT_ROTATION_PATH = BRIDGE_SERVER_API_PATH + "/register-certificate"
+const WEBSOCKET_ACKS_PARAM = "acks" // query parameter a websocket client sets to WEBSOCKET_ACKS_EXPLICIT when it acks by delivery ID
+const WEBSOCKET_ACKS_EXPLICIT = "explicit"
 
 type MessageEnvelope struct {
 	EnvelopeVersion int
@@ -31,6 +37,8 @@ type MessageEnvelope struct {
 	Signature       string
 	MsgKey          string
 	KeyID           string
+	// Compression how the message was compressed before it was encrypted, empty for none
+	Compression string `json:",omitempty"`
 }
 
 func MakeReplySubject(replyToLocationID string) string {
@@ -53,6 +61,16 @@ func MakeMessageSubject(locationID string, params string) string {
 	return fmt.Sprintf("%s.%s.%s", NATSSYNC_MESSAGE_PREFIX, locationID, params)
 }
 
+// MakeMessageQueuePath the server path used to post and get messages for a location
+func MakeMessageQueuePath(locationID string) string {
+	return fmt.Sprintf("%s/message-queue/%s", BRIDGE_SERVER_API_PATH, locationID)
+}
+
+// MakeWebSocketPath the server path of the web socket transport for a location
+func MakeWebSocketPath(locationID string) string {
+	return fmt.Sprintf("%s/ws", MakeMessageQueuePath(locationID))
+}
+
 type ParsedSubject struct {
 	OriginalSubject string
 	LocationID      string
@@ -12,10 +12,14 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"github.com/theotw/natssync/pkg/bridgemodel"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -95,31 +99,95 @@ func GetKeyPairLocationData(locationID string, pair *rsa.PrivateKey) (*types.Loc
 }
 
 func LoadPublicKey(locationID string) (*rsa.PublicKey, error) {
+	keys, err := loadLocationKeys(locationID)
+	if err != nil {
+		return nil, err
+	}
+	return keys.PublicKeys[0], nil
+}
+
+// LoadPublicKeys the location's current public key followed by any previous keys it rotated away from that are still
+// accepted
+func LoadPublicKeys(locationID string) ([]*rsa.PublicKey, error) {
+	keys, err := loadLocationKeys(locationID)
+	if err != nil {
+		return nil, err
+	}
+	return keys.PublicKeys, nil
+}
+
+// loadLocationKeys the location's parsed keys, from the keystore's cache if it keeps one
+func loadLocationKeys(locationID string) (*persistence.LocationKeys, error) {
 	t := persistence.GetKeyStore()
+	if cache, ok := t.(persistence.KeyCache); ok {
+		return cache.LoadLocationKeys(locationID)
+	}
 	locationData, err := t.ReadLocation(locationID)
 	if err != nil {
 		return nil, err
 	}
-	data, _ := pem.Decode(locationData.GetPublicKey())
-	var ret *rsa.PublicKey
-	pubKey, err := x509.ParsePKIXPublicKey(data.Bytes)
-	if pubKey != nil && err == nil {
-		ret = pubKey.(*rsa.PublicKey)
+	return persistence.ParseLocationKeys(locationData)
+}
+
+// ParsePublicKey a PEM encoded RSA public key
+func ParsePublicKey(pemKey []byte) (*rsa.PublicKey, error) {
+	return persistence.ParsePublicKey(pemKey)
+}
+
+var senderKeyRefresherLock sync.RWMutex
+var senderKeyRefresher func(senderID string) bool
+
+// SetSenderKeyRefresher sets a func that is called when a signature does not verify with any of the sender's known
+// keys.  It returns true if it stored newer keys for the sender, and the signature is checked once more
+func SetSenderKeyRefresher(refresher func(senderID string) bool) {
+	senderKeyRefresherLock.Lock()
+	defer senderKeyRefresherLock.Unlock()
+	senderKeyRefresher = refresher
+}
+
+// verifySenderSignature runs verify with each of the sender's keys until one passes
+func verifySenderSignature(senderID string, verify func(publicKey *rsa.PublicKey) error) error {
+	err := verifyWithKnownKeys(senderID, verify)
+	if err == nil {
+		return nil
 	}
+	senderKeyRefresherLock.RLock()
+	refresher := senderKeyRefresher
+	senderKeyRefresherLock.RUnlock()
+	if refresher != nil && refresher(senderID) {
+		return verifyWithKnownKeys(senderID, verify)
+	}
+	return err
+}
 
-	return ret, err
+func verifyWithKnownKeys(senderID string, verify func(publicKey *rsa.PublicKey) error) error {
+	publicKeys, err := LoadPublicKeys(senderID)
+	if err != nil {
+		return err
+	}
+	for _, publicKey := range publicKeys {
+		if err = verify(publicKey); err == nil {
+			return nil
+		}
+	}
+	return err
 }
 
 func LoadPrivateKey(keyID string) (*rsa.PrivateKey, error) {
 	t := persistence.GetKeyStore()
+	if cache, ok := t.(persistence.KeyCache); ok {
+		return cache.LoadPrivateKey(keyID)
+	}
 	locationData, err := t.ReadKeyPair(keyID)
 	if err != nil {
 		return nil, err
 	}
 
-	data, _ := pem.Decode(locationData.GetPrivateKey())
-	privateKeyImported, err := x509.ParsePKCS1PrivateKey(data.Bytes)
-	return privateKeyImported, err
+	return parsePrivateKey(locationData.GetPrivateKey())
+}
+
+func parsePrivateKey(pemKey []byte) (*rsa.PrivateKey, error) {
+	return persistence.ParsePrivateKey(pemKey)
 }
 
 func encodePrivateKeyAsBytes(key *rsa.PrivateKey) ([]byte, error) {
@@ -182,16 +250,53 @@ func PutObjectInEnvelope(ob interface{}, senderID string, recipientID string) (*
 	skipEncrpt := false
 	if ok {
 		parsedMsgSubject, _ := ParseSubject(msg.Subject)
-		skipEncrpt = parsedMsgSubject.SkipEncryption
+		skipEncrpt = parsedMsgSubject.SkipEncryption && GetEnvelopePolicy(recipientID).AllowPlaintext
 	}
 	log.Tracef("Puting message in Envelope with Encryption=%v", !skipEncrpt)
 	if skipEncrpt {
 		return PutMessageInEnvelopev4(bits, senderID, recipientID)
 	} else {
-		return PutMessageInEnvelopeV3(bits, senderID, recipientID)
+		return PutMessageInEnvelope(bits, senderID, recipientID)
 	}
 }
 
+// negotiatedEnvelopeVersion set when the version was agreed with the other side, overrides the configured version
+var negotiatedEnvelopeVersion int32
+
+// SetSendEnvelopeVersion overrides the configured send version, 0 goes back to the configured version
+func SetSendEnvelopeVersion(version int) {
+	atomic.StoreInt32(&negotiatedEnvelopeVersion, int32(version))
+}
+
+// GetSendEnvelopeVersion the encrypted envelope version used when sending, set by ENVELOPE_VERSION unless one was negotiated
+func GetSendEnvelopeVersion() int {
+	if negotiated := atomic.LoadInt32(&negotiatedEnvelopeVersion); negotiated != 0 {
+		return int(negotiated)
+	}
+	version, err := strconv.Atoi(pkg.Config.EnvelopeVersion)
+	if err != nil || !isEncryptedSendVersion(version) {
+		log.WithField("envelopeVersion", pkg.Config.EnvelopeVersion).Errorf("Unsupported envelope version, using %d", ENVELOPE_VERSION_3)
+		return ENVELOPE_VERSION_3
+	}
+	return version
+}
+
+// PutMessageInEnvelope encrypts the message using the configured envelope version, moving up to a version the
+// recipient's policy accepts if needed
+func PutMessageInEnvelope(msg []byte, senderID string, recipientID string) (*MessageEnvelope, error) {
+	version := GetSendEnvelopeVersion()
+	if policy := GetEnvelopePolicy(recipientID); policy.Check(version) != nil {
+		version = ChooseEnvelopeVersion(version, policy.AcceptedVersions())
+	}
+	switch version {
+	case ENVELOPE_VERSION_5:
+		return PutMessageInEnvelopeV5(msg, senderID, recipientID)
+	case ENVELOPE_VERSION_6:
+		return PutMessageInEnvelopeV6(msg, senderID, recipientID)
+	}
+	return PutMessageInEnvelopeV3(msg, senderID, recipientID)
+}
+
 func PutMessageInEnvelopeV3(msg []byte, senderID string, recipientID string) (*MessageEnvelope, error) {
 	master, err := LoadPrivateKey("")
 	if err != nil {
@@ -208,6 +313,10 @@ func PutMessageInEnvelopeV3(msg []byte, senderID string, recipientID string) (*M
 		return nil, err
 	}
 
+	msg, ret.Compression = compressForRecipient(msg, recipientID)
+	if len(ret.Compression) > 0 {
+		msg = append(msg, zeroPaddingGuard)
+	}
 	cipherMsg, err := DoAesCBCEncrypt(msg, msgKey)
 	if err != nil {
 		return nil, err
@@ -223,15 +332,63 @@ func PutMessageInEnvelopeV3(msg []byte, senderID string, recipientID string) (*M
 	ret.RecipientID = recipientID
 	ret.Signature = base64.StdEncoding.EncodeToString(sigBits)
 
-	t := persistence.GetKeyStore()
-	locationData, err := t.ReadLocation(recipientID)
+	recipientKeys, err := loadLocationKeys(recipientID)
+	if err != nil {
+		return nil, err
+	}
+	ret.KeyID = recipientKeys.KeyID
+
+	return ret, nil
+}
+
+// PutMessageInEnvelopeV5 encrypts with AES-256-GCM using the envelope fields as associated data, so the
+// sender, recipient and key can not be swapped without failing decryption
+func PutMessageInEnvelopeV5(msg []byte, senderID string, recipientID string) (*MessageEnvelope, error) {
+	master, err := LoadPrivateKey("")
+	if err != nil {
+		return nil, err
+	}
+
+	recipientKeys, err := loadLocationKeys(recipientID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(MessageEnvelope)
+	ret.EnvelopeVersion = ENVELOPE_VERSION_5
+	ret.SenderID = senderID
+	ret.RecipientID = recipientID
+	ret.KeyID = recipientKeys.KeyID
+	msg, ret.Compression = compressForRecipient(msg, recipientID)
+
+	msgKey := make([]byte, 32)
+	if _, err = rand.Read(msgKey); err != nil {
+		return nil, err
+	}
+	ret.MsgKey, err = rsaEncryptOAEP(msgKey, recipientID)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := envelopeAssociatedData(ret)
+	if err != nil {
+		return nil, err
+	}
+	cipherMsg, err := DoAesGCMEncrypt(msg, msgKey, aad)
+	if err != nil {
+		return nil, err
+	}
+	sigBits, err := signDataPSS(envelopeSigningData(aad, cipherMsg), master)
 	if err != nil {
 		return nil, err
 	}
-	ret.KeyID = locationData.KeyID
+
+	ret.Message = base64.StdEncoding.EncodeToString(cipherMsg)
+	ret.Signature = base64.StdEncoding.EncodeToString(sigBits)
 
 	return ret, nil
 }
+
 func PutMessageInEnvelopev4(msg []byte, senderID string, recipientID string) (*MessageEnvelope, error) {
 	master, err := LoadPrivateKey("")
 
@@ -257,11 +414,15 @@ func PutMessageInEnvelopev4(msg []byte, senderID string, recipientID string) (*M
 }
 
 // NewAuthChallengeFromStoredKey Makes a new auth challenge using known stored private location ID
+//
+// Deprecated: legacy challenges can be replayed, use NewAuthChallengeForRequest
 func NewAuthChallengeFromStoredKey() *v1.AuthChallenge {
 	return NewAuthChallenge("")
 }
 
 // NewAuthChallenge Makes a new auth challenge, if KeyID is blank, it uses the current known key ID
+//
+// Deprecated: legacy challenges can be replayed, use NewAuthChallengeForRequest
 func NewAuthChallenge(KeyID string) *v1.AuthChallenge {
 	key, err := LoadPrivateKey(KeyID)
 	if err != nil {
@@ -280,16 +441,15 @@ func NewAuthChallenge(KeyID string) *v1.AuthChallenge {
 	return ret
 }
 
+// ValidateAuthChallenge only checks the signature of the challenge, use an AuthChallengeValidator to also check
+// freshness and replays
 func ValidateAuthChallenge(locationID string, challenge *v1.AuthChallenge) bool {
-	pubKey, err := LoadPublicKey(locationID)
-	if err != nil {
-		log.Errorf("Error loading public key for location %s error: %s", locationID, err.Error())
-		return false
-	}
 	sigBits, _ := base64.StdEncoding.DecodeString(challenge.AuthChellengeB)
 	hash := sha256.Sum256([]byte(challenge.AuthChallengeA))
 
-	err = rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hash[:], sigBits)
+	err := verifySenderSignature(locationID, func(pubKey *rsa.PublicKey) error {
+		return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hash[:], sigBits)
+	})
 	if err != nil {
 		log.Errorf("Signature Verification Failed %s %s", locationID, err.Error())
 		return false
@@ -312,6 +472,14 @@ func PullObjectFromEnvelope(ob interface{}, envelope *MessageEnvelope) error {
 }
 
 func PullMessageFromEnvelope(envelope *MessageEnvelope) ([]byte, error) {
+	if err := checkEnvelopePolicy(envelope); err != nil {
+		return nil, err
+	}
+	if envelope.EnvelopeVersion >= ENVELOPE_VERSION_5 && len(envelope.KeyID) == 0 {
+		return nil, ErrEnvelopeKeyIDRequired
+	}
+	var msg []byte
+	var err error
 	switch envelope.EnvelopeVersion {
 	case ENVELOPE_VERSION_1:
 		return pullMessageFromEnvelopev1(envelope)
@@ -320,11 +488,20 @@ func PullMessageFromEnvelope(envelope *MessageEnvelope) ([]byte, error) {
 		return pullMessageFromEnvelopev2(envelope)
 
 	case ENVELOPE_VERSION_3:
-		return pullMessageFromEnvelopev3(envelope)
+		msg, err = pullMessageFromEnvelopev3(envelope)
 	case ENVELOPE_VERSION_4:
 		return pullMessageFromEnvelopev4(envelope)
+	case ENVELOPE_VERSION_5:
+		msg, err = pullMessageFromEnvelopev5(envelope)
+	case ENVELOPE_VERSION_6:
+		msg, err = pullMessageFromEnvelopev6(envelope)
+	default:
+		return nil, errors.New("invalid envelope")
 	}
-	return nil, errors.New("invalid envelope")
+	if err != nil {
+		return nil, err
+	}
+	return decompress(msg, envelope.Compression)
 }
 
 //ok, Pull From Env 1 and 2 look almost the same, dont try to refactor common, let them live apart.
@@ -344,13 +521,11 @@ func pullMessageFromEnvelopev1(envelope *MessageEnvelope) ([]byte, error) {
 		return nil, err
 	}
 
-	publicKey, err := LoadPublicKey(envelope.SenderID)
-	if err != nil {
-		return nil, err
-	}
 	hash := sha256.Sum256(cipherMsgBits)
 
-	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sigBits)
+	err = verifySenderSignature(envelope.SenderID, func(publicKey *rsa.PublicKey) error {
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sigBits)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -375,13 +550,11 @@ func pullMessageFromEnvelopev2(envelope *MessageEnvelope) ([]byte, error) {
 		return nil, err
 	}
 
-	publicKey, err := LoadPublicKey(envelope.SenderID)
-	if err != nil {
-		return nil, err
-	}
 	hash := sha256.Sum256(cipherMsgBits)
 
-	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sigBits)
+	err = verifySenderSignature(envelope.SenderID, func(publicKey *rsa.PublicKey) error {
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sigBits)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -402,13 +575,11 @@ func pullMessageFromEnvelopev4(envelope *MessageEnvelope) ([]byte, error) {
 		return nil, err
 	}
 
-	publicKey, err := LoadPublicKey(envelope.SenderID)
-	if err != nil {
-		return nil, err
-	}
 	hash := sha256.Sum256(plainBits)
 
-	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sigBits)
+	err = verifySenderSignature(envelope.SenderID, func(publicKey *rsa.PublicKey) error {
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sigBits)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -417,7 +588,97 @@ func pullMessageFromEnvelopev4(envelope *MessageEnvelope) ([]byte, error) {
 }
 
 func pullMessageFromEnvelopev3(envelope *MessageEnvelope) ([]byte, error) {
-	return pullMessageFromEnvelopev2(envelope)
+	msg, err := pullMessageFromEnvelopev2(envelope)
+	if err != nil || len(envelope.Compression) == 0 {
+		return msg, err
+	}
+	if len(msg) == 0 || msg[len(msg)-1] != zeroPaddingGuard {
+		return nil, errors.New("compressed message is missing the padding guard")
+	}
+	return msg[:len(msg)-1], nil
+}
+
+func pullMessageFromEnvelopev5(envelope *MessageEnvelope) ([]byte, error) {
+	cipherMsgBits, err := base64.StdEncoding.DecodeString(envelope.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	sigBits, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := envelopeAssociatedData(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(envelopeSigningData(aad, cipherMsgBits))
+	err = verifySenderSignature(envelope.SenderID, func(publicKey *rsa.PublicKey) error {
+		return rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], sigBits, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgKey, err := rsaDecryptOAEP(envelope.MsgKey, envelope.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return DoAesGCMDecrypt(cipherMsgBits, msgKey, aad)
+}
+
+// envelopeAssociatedData the envelope fields that are authenticated along with the message
+func envelopeAssociatedData(envelope *MessageEnvelope) ([]byte, error) {
+	fields := []string{
+		strconv.Itoa(envelope.EnvelopeVersion),
+		envelope.SenderID,
+		envelope.RecipientID,
+		envelope.KeyID,
+		envelope.MsgKey,
+	}
+	// only added when set so uncompressed envelopes stay readable by older v5 peers
+	if len(envelope.Compression) > 0 {
+		fields = append(fields, envelope.Compression)
+	}
+	return json.Marshal(fields)
+}
+
+// envelopeSigningData length prefixes the associated data so the boundary with the cipher text is unambiguous
+func envelopeSigningData(aad, cipherMsg []byte) []byte {
+	ret := make([]byte, 8, 8+len(aad)+len(cipherMsg))
+	binary.BigEndian.PutUint64(ret, uint64(len(aad)))
+	ret = append(ret, aad...)
+	return append(ret, cipherMsg...)
+}
+
+func signDataPSS(dataToSign []byte, master *rsa.PrivateKey) ([]byte, error) {
+	hash := sha256.Sum256(dataToSign)
+	return rsa.SignPSS(rand.Reader, master, crypto.SHA256, hash[:], nil)
+}
+
+func rsaEncryptOAEP(plain []byte, clientID string) (string, error) {
+	pubKey, err := LoadPublicKey(clientID)
+	if err != nil {
+		return "", err
+	}
+	cipher, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, plain, nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(cipher), nil
+}
+
+func rsaDecryptOAEP(cipherText, keyID string) ([]byte, error) {
+	cipher, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return nil, err
+	}
+	return decryptWithKeyPair(keyID, func(privkey *rsa.PrivateKey) ([]byte, error) {
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, privkey, cipher, nil)
+	})
 }
 
 func rsaEncrypt(plain []byte, clientID string) (string, error) {
@@ -434,14 +695,22 @@ func rsaEncrypt(plain []byte, clientID string) (string, error) {
 }
 
 func rsaDecrypt(cipherText, keyID string) ([]byte, error) {
-	privkey, err := LoadPrivateKey(keyID)
+	cipher, err := base64.StdEncoding.DecodeString(cipherText)
 	if err != nil {
 		return nil, err
 	}
-	cipher, err := base64.StdEncoding.DecodeString(cipherText)
+	return decryptWithKeyPair(keyID, func(privkey *rsa.PrivateKey) ([]byte, error) {
+		return rsa.DecryptPKCS1v15(rand.Reader, privkey, cipher)
+	})
+}
+
+// decryptWithKeyPair decrypts with the key pair the sender named, or the current one if it did not name one.  Only
+// envelopes older than v5 can leave the key out, see PullMessageFromEnvelope.  Other key pairs are not tried, that
+// would let anyone holding the public key of a retired key pair use the decryption as an oracle
+func decryptWithKeyPair(keyID string, decrypt func(privkey *rsa.PrivateKey) ([]byte, error)) ([]byte, error) {
+	privkey, err := LoadPrivateKey(keyID)
 	if err != nil {
 		return nil, err
 	}
-	plain, err := rsa.DecryptPKCS1v15(rand.Reader, privkey, cipher)
-	return plain, err
+	return decrypt(privkey)
 }
@@ -5,11 +5,18 @@
 package msgs
 
 import (
+	"crypto/rsa"
+	"encoding/base64"
 	"fmt"
 	"github.com/theotw/natssync/pkg/bridgemodel"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
 
 	"github.com/theotw/natssync/pkg"
 	"github.com/theotw/natssync/pkg/persistence"
@@ -41,9 +48,9 @@ func TestEncryption(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	writeLocationData, err := types.NewLocationData(pkg.CLOUD_ID, locationData.GetPublicKey(), nil, metadata)
+	writeLocationData, err := types.NewLocationData(pkg.CLOUD_ID, locationData.GetPublicKey(), nil, AdvertiseCompression(metadata))
 	assert.Nil(t, err)
-	writeLocationData.UnsetKeyID()
+	writeLocationData.KeyID = locationData.GetKeyID()
 
 	if err = store.WriteLocation(*writeLocationData); err != nil {
 		t.Fatal(err)
@@ -74,10 +81,23 @@ func TestEncryption(t *testing.T) {
 	t.Run("Test Encrypt", doTest_encrpt)
 	t.Run("Test Envelope", doTestMessageEnvelope)
 	t.Run("Test v4 Envelope ID", doTestMessageEnvelopev4)
+	t.Run("Test v5 Envelope", doTestMessageEnvelopev5)
+	t.Run("Test v5 Envelope Tamper", doTestMessageEnvelopev5Tamper)
+	t.Run("Test Configured Envelope Version", doTestConfiguredEnvelopeVersion)
+	t.Run("Test Envelope Policy Global", doTestEnvelopePolicyGlobal)
+	t.Run("Test Envelope Policy Location", doTestEnvelopePolicyLocation)
 	t.Run("Test Encrypt Enveloper", doTestObjectEnvelopeWithEncrypt)
 	t.Run("Test Plain Text Enveloper", doTestObjectEnvelopeWithoutEncrypt)
+	t.Run("Test Envelope Headers", doTestObjectEnvelopeHeaders)
+	t.Run("Test Envelope Compression", doTestEnvelopeCompression)
+	t.Run("Test Envelope Compression Threshold", doTestEnvelopeCompressionThreshold)
 
 	t.Run("Auth Challenge", doTestAuthChallenge)
+	t.Run("Auth Challenge Replay", doTestAuthChallengeReplay)
+	t.Run("Auth Challenge Clock Skew", doTestAuthChallengeClockSkew)
+	t.Run("Auth Challenge Binding", doTestAuthChallengeBinding)
+	t.Run("Auth Challenge Legacy", doTestAuthChallengeLegacy)
+	t.Run("Cloud Key Rotation", doTestCloudKeyRotation)
 	t.Run("Location ID", doTestLocationID)
 
 }
@@ -127,6 +147,45 @@ func doTestObjectEnvelopeWithoutEncrypt(t *testing.T) {
 	assert.Equal(t, msg.Data, msg2.Data)
 }
 
+func doTestObjectEnvelopeHeaders(t *testing.T) {
+	msg := new(bridgemodel.NatsMessage)
+	msg.Data = []byte("hello")
+	msg.Subject = fmt.Sprintf("%s.1.foo", NATSSYNC_MESSAGE_PREFIX)
+	msg.Reply = "reply"
+	msg.Header = nats.Header{}
+	msg.Header.Set("Trace-Id", "abc")
+	msg.Header.Add("Multi", "1")
+	msg.Header.Add("Multi", "2")
+
+	envelope, err := PutObjectInEnvelope(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	msg2 := new(bridgemodel.NatsMessage)
+	if err = PullObjectFromEnvelope(msg2, envelope); err != nil {
+		t.Fatalf("Error with pull from envelope %s", err)
+	}
+	assert.Equal(t, msg.Header, msg2.Header)
+
+	published := msg2.NewNatsMsg()
+	assert.Equal(t, msg.Subject, published.Subject)
+	assert.Equal(t, msg.Reply, published.Reply)
+	assert.Equal(t, []string{"1", "2"}, published.Header.Values("Multi"))
+
+	// messages from bridges without header support
+	legacy, err := PutMessageInEnvelopeV3([]byte(`{"Subject":"a.b","Reply":"","Data":"aGVsbG8="}`), pkg.CLOUD_ID, pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	msg3 := new(bridgemodel.NatsMessage)
+	if err = PullObjectFromEnvelope(msg3, legacy); err != nil {
+		t.Fatalf("Error with pull from envelope %s", err)
+	}
+	assert.Nil(t, msg3.Header)
+	assert.Equal(t, "hello", string(msg3.Data))
+	assert.Equal(t, 0, len(msg3.NewNatsMsg().Header))
+}
+
 func doTestMessageEnvelope(t *testing.T) {
 	msg := []byte("Hello World")
 	envelope, err := PutMessageInEnvelopeV3(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
@@ -166,6 +225,205 @@ func doTestMessageEnvelopev4(t *testing.T) {
 	assert.Equal(t, msg, msg2)
 }
 
+func doTestMessageEnvelopev5(t *testing.T) {
+	msg := []byte("Hello World")
+	envelope, err := PutMessageInEnvelopeV5(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	assert.Equal(t, ENVELOPE_VERSION_5, envelope.EnvelopeVersion)
+
+	msg2, err := PullMessageFromEnvelope(envelope)
+	if err != nil {
+		t.Fatalf("Error with pull from envelope %s", err)
+	}
+
+	assert.Equal(t, msg, msg2)
+}
+
+func doTestMessageEnvelopev5Tamper(t *testing.T) {
+	msg := []byte("Hello World")
+	tampers := map[string]func(e *MessageEnvelope){
+		"recipient": func(e *MessageEnvelope) { e.RecipientID = "client1" },
+		"sender":    func(e *MessageEnvelope) { e.SenderID = "client1" },
+		"keyID":     func(e *MessageEnvelope) { e.KeyID = "bogus" },
+		"no keyID":  func(e *MessageEnvelope) { e.KeyID = "" },
+		"message": func(e *MessageEnvelope) {
+			bits, _ := base64.StdEncoding.DecodeString(e.Message)
+			bits[len(bits)-1] ^= 0x01
+			e.Message = base64.StdEncoding.EncodeToString(bits)
+		},
+	}
+	for name, tamper := range tampers {
+		t.Run(name, func(t *testing.T) {
+			envelope, err := PutMessageInEnvelopeV5(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+			if err != nil {
+				t.Fatalf("Error with put in envelope %s", err)
+			}
+			tamper(envelope)
+			_, err = PullMessageFromEnvelope(envelope)
+			assert.Error(t, err, "tampered envelope must not open")
+		})
+	}
+}
+
+func doTestEnvelopeCompression(t *testing.T) {
+	oldCompression := pkg.Config.MessageCompression
+	defer func() { pkg.Config.MessageCompression = oldCompression }()
+
+	msg := []byte(strings.Repeat(`{"kind":"Pod","apiVersion":"v1"}`, 100))
+	for _, compression := range SupportedCompression {
+		pkg.Config.MessageCompression = compression
+		for name, put := range map[string]func([]byte, string, string) (*MessageEnvelope, error){"v3": PutMessageInEnvelopeV3, "v5": PutMessageInEnvelopeV5} {
+			t.Run(compression+" "+name, func(t *testing.T) {
+				envelope, err := put(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+				if err != nil {
+					t.Fatalf("Error with put in envelope %s", err)
+				}
+				assert.Equal(t, compression, envelope.Compression)
+				bits, _ := base64.StdEncoding.DecodeString(envelope.Message)
+				assert.Less(t, len(bits), len(msg))
+
+				msg2, err := PullMessageFromEnvelope(envelope)
+				if err != nil {
+					t.Fatalf("Error with pull from envelope %s", err)
+				}
+				assert.Equal(t, msg, msg2)
+			})
+		}
+	}
+
+	// only recipients that listed the compression when they registered get compressed messages
+	pkg.Config.MessageCompression = COMPRESSION_GZIP
+	envelope, err := PutMessageInEnvelopeV5(msg, pkg.CLOUD_ID, "client1")
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	assert.Equal(t, COMPRESSION_NONE, envelope.Compression)
+	assert.Equal(t, COMPRESSION_GZIP, GetConfiguredCompression("client1"))
+
+	// the compression flag is authenticated in v5
+	envelope, err = PutMessageInEnvelopeV5(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	envelope.Compression = COMPRESSION_NONE
+	_, err = PullMessageFromEnvelope(envelope)
+	assert.Error(t, err, "tampered envelope must not open")
+}
+
+func doTestEnvelopeCompressionThreshold(t *testing.T) {
+	oldCompression := pkg.Config.MessageCompression
+	defer func() { pkg.Config.MessageCompression = oldCompression }()
+	pkg.Config.MessageCompression = COMPRESSION_ZSTD
+
+	envelope, err := PutMessageInEnvelopeV3([]byte("Hello World"), pkg.CLOUD_ID, pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	assert.Equal(t, COMPRESSION_NONE, envelope.Compression)
+
+	SetSendCompression(COMPRESSION_DISABLED)
+	defer SetSendCompression(COMPRESSION_NONE)
+	envelope, err = PutMessageInEnvelopeV3([]byte(strings.Repeat("a", 4096)), pkg.CLOUD_ID, pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatalf("Error with put in envelope %s", err)
+	}
+	assert.Equal(t, COMPRESSION_NONE, envelope.Compression)
+}
+
+func doTestConfiguredEnvelopeVersion(t *testing.T) {
+	oldVersion := pkg.Config.EnvelopeVersion
+	defer func() { pkg.Config.EnvelopeVersion = oldVersion }()
+
+	msg := []byte("Hello World")
+	for configured, expected := range map[string]int{"3": ENVELOPE_VERSION_3, "5": ENVELOPE_VERSION_5, "bogus": ENVELOPE_VERSION_3} {
+		pkg.Config.EnvelopeVersion = configured
+		envelope, err := PutMessageInEnvelope(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+		if err != nil {
+			t.Fatalf("Error with put in envelope %s", err)
+		}
+		assert.Equal(t, expected, envelope.EnvelopeVersion)
+
+		msg2, err := PullMessageFromEnvelope(envelope)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, msg2)
+	}
+}
+
+func doTestEnvelopePolicyGlobal(t *testing.T) {
+	oldMin, oldDeny := pkg.Config.EnvelopeMinVersion, pkg.Config.EnvelopeDenyPlaintext
+	defer func() { pkg.Config.EnvelopeMinVersion, pkg.Config.EnvelopeDenyPlaintext = oldMin, oldDeny }()
+
+	msg := []byte("Hello World")
+	v3, err := PutMessageInEnvelopeV3(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	v4, err := PutMessageInEnvelopev4(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+
+	pkg.Config.EnvelopeMinVersion = "5"
+	_, err = PullMessageFromEnvelope(v3)
+	assert.Equal(t, ErrEnvelopeVersionNotAllowed, err)
+	_, err = PullMessageFromEnvelope(v4)
+	assert.Nil(t, err, "plaintext is governed by its own flag")
+
+	pkg.Config.EnvelopeDenyPlaintext = true
+	_, err = PullMessageFromEnvelope(v4)
+	assert.Equal(t, ErrEnvelopePlaintextNotAllowed, err)
+
+	// a sender configured for v3 moves up to what the recipient accepts
+	envelope, err := PutMessageInEnvelope(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ENVELOPE_VERSION_5, envelope.EnvelopeVersion)
+
+	// and noencrypt subjects get encrypted when plaintext is denied
+	natsMsg := new(bridgemodel.NatsMessage)
+	natsMsg.Subject = fmt.Sprintf("%s.1.%s", NATSSYNC_MESSAGE_PREFIX, SKIP_ENCRYPTION_FLAG)
+	envelope, err = PutObjectInEnvelope(natsMsg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.NotEqual(t, BLANK_KEY, envelope.MsgKey)
+
+	assert.Equal(t, []int{ENVELOPE_VERSION_5, ENVELOPE_VERSION_6}, GetGlobalEnvelopePolicy().AcceptedVersions())
+}
+
+func doTestEnvelopePolicyLocation(t *testing.T) {
+	store := persistence.GetKeyStore()
+	original, err := store.ReadLocation(pkg.CLOUD_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := *original
+	defer func() {
+		assert.Nil(t, store.WriteLocation(restore))
+	}()
+
+	tightened := *original
+	tightened.Metadata = map[string]string{
+		METADATA_ENVELOPE_MIN_VERSION:    "5",
+		METADATA_ENVELOPE_DENY_PLAINTEXT: "true",
+	}
+	assert.Nil(t, store.WriteLocation(tightened))
+
+	policy := GetEnvelopePolicy(pkg.CLOUD_ID)
+	assert.Equal(t, ENVELOPE_VERSION_5, policy.MinVersion)
+	assert.False(t, policy.AllowPlaintext)
+
+	msg := []byte("Hello World")
+	v3, err := PutMessageInEnvelopeV3(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	_, err = PullMessageFromEnvelope(v3)
+	assert.Equal(t, ErrEnvelopeVersionNotAllowed, err)
+
+	// location metadata can not loosen the global policy
+	oldMin := pkg.Config.EnvelopeMinVersion
+	defer func() { pkg.Config.EnvelopeMinVersion = oldMin }()
+	pkg.Config.EnvelopeMinVersion = "3"
+	loosened := *original
+	loosened.Metadata = map[string]string{METADATA_ENVELOPE_MIN_VERSION: "1"}
+	assert.Nil(t, store.WriteLocation(loosened))
+	assert.Equal(t, ENVELOPE_VERSION_3, GetEnvelopePolicy(pkg.CLOUD_ID).MinVersion)
+}
+
 func doTest_loadMasterPrivate(t *testing.T) {
 	master, err := LoadPrivateKey("")
 	assert.Nil(t, err)
@@ -216,3 +474,155 @@ func doTestAuthChallenge(t *testing.T) {
 	valid = ValidateAuthChallenge(pkg.CLOUD_ID, challenge)
 	assert.False(t, valid, "Auth Challenge should be false")
 }
+
+func doTestAuthChallengeReplay(t *testing.T) {
+	path := MakeMessageQueuePath(pkg.CLOUD_ID)
+	validator := NewAuthChallengeValidator(time.Minute, NewMemoryNonceCache(), false)
+	challenge := NewAuthChallengeForRequest("", pkg.CLOUD_ID, http.MethodGet, path)
+	if !assert.NotNil(t, challenge) {
+		t.Fatal("Unable to create auth challenge")
+	}
+	assert.Nil(t, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, challenge))
+	assert.Equal(t, ErrAuthChallengeReplayed, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, challenge))
+
+	second := NewAuthChallengeForRequest("", pkg.CLOUD_ID, http.MethodGet, path)
+	assert.Nil(t, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, second), "a new challenge should still be accepted")
+}
+
+func doTestAuthChallengeClockSkew(t *testing.T) {
+	path := MakeMessageQueuePath(pkg.CLOUD_ID)
+	challenge := NewAuthChallengeForRequest("", pkg.CLOUD_ID, http.MethodGet, path)
+	if !assert.NotNil(t, challenge) {
+		t.Fatal("Unable to create auth challenge")
+	}
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   error
+	}{
+		{"server behind", -50 * time.Second, nil},
+		{"server ahead", 50 * time.Second, nil},
+		{"challenge too old", 2 * time.Minute, ErrAuthChallengeExpired},
+		{"challenge from the future", -2 * time.Minute, ErrAuthChallengeExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewAuthChallengeValidator(time.Minute, NewMemoryNonceCache(), false)
+			validator.now = func() time.Time { return time.Now().Add(tt.offset) }
+			assert.Equal(t, tt.want, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, challenge))
+		})
+	}
+
+	// an expired challenge must not be accepted once the nonce has been forgotten either
+	cache := NewMemoryNonceCache()
+	validator := NewAuthChallengeValidator(time.Minute, cache, false)
+	assert.Nil(t, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, challenge))
+	validator.now = func() time.Time { return time.Now().Add(5 * time.Minute) }
+	cache.now = validator.now
+	assert.Equal(t, ErrAuthChallengeExpired, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, challenge))
+}
+
+func doTestAuthChallengeBinding(t *testing.T) {
+	path := MakeMessageQueuePath(pkg.CLOUD_ID)
+	validator := NewAuthChallengeValidator(time.Minute, NewMemoryNonceCache(), false)
+
+	challenge := NewAuthChallengeForRequest("", pkg.CLOUD_ID, http.MethodGet, path)
+	assert.Equal(t, ErrAuthChallengeBindingMismatch, validator.Validate(pkg.CLOUD_ID, http.MethodPost, path, challenge))
+	assert.Equal(t, ErrAuthChallengeBindingMismatch, validator.Validate(pkg.CLOUD_ID, http.MethodGet, CERT_ROTATION_PATH, challenge))
+	assert.Equal(t, ErrAuthChallengeBindingMismatch, validator.Validate("client1", http.MethodGet, path, challenge))
+
+	tampered := NewAuthChallengeForRequest("", pkg.CLOUD_ID, http.MethodGet, path)
+	tampered.AuthChallengeA = strings.Replace(tampered.AuthChallengeA, `"nonce":"`, `"nonce":"x`, 1)
+	assert.Equal(t, ErrAuthChallengeSignature, validator.Validate(pkg.CLOUD_ID, http.MethodGet, path, tampered))
+}
+
+func doTestAuthChallengeLegacy(t *testing.T) {
+	path := MakeMessageQueuePath(pkg.CLOUD_ID)
+	legacy := NewAuthChallenge("")
+
+	strict := NewAuthChallengeValidator(time.Minute, NewMemoryNonceCache(), false)
+	assert.Equal(t, ErrAuthChallengeLegacy, strict.Validate(pkg.CLOUD_ID, http.MethodGet, path, legacy))
+
+	lenient := NewAuthChallengeValidator(time.Minute, NewMemoryNonceCache(), true)
+	assert.Nil(t, lenient.Validate(pkg.CLOUD_ID, http.MethodGet, path, legacy))
+}
+
+func doTestCloudKeyRotation(t *testing.T) {
+	store := persistence.GetKeyStore()
+	cloudLocation, err := store.ReadLocation(pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	oldKey, err := store.ReadKeyPair("")
+	assert.Nil(t, err)
+	msg := []byte("hello from before the rotation")
+	oldEnvelope, err := PutMessageInEnvelopeV5(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	// senders from before v5 may not name the key, those are only opened with the current key
+	unnamedEnvelope, err := PutMessageInEnvelopeV3(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	unnamedEnvelope.KeyID = ""
+	msg2, err := PullMessageFromEnvelope(unnamedEnvelope)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+
+	newKeyID, err := RotateCloudKey()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, store.RemoveKeyPair(newKeyID))
+		assert.Nil(t, store.RemoveCloudMasterData())
+		assert.Nil(t, store.WriteLocation(*cloudLocation))
+		SetSenderKeyRefresher(nil)
+	}()
+
+	// encrypted to the old key and signed by it, both still valid during the overlap
+	msg2, err = PullMessageFromEnvelope(oldEnvelope)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+	_, err = PullMessageFromEnvelope(unnamedEnvelope)
+	assert.Error(t, err, "the older key pairs are not tried")
+
+	// signed by the new key, which the location only learns about through the refresher
+	newEnvelope, err := PutMessageInEnvelopeV5(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	_, err = PullMessageFromEnvelope(newEnvelope)
+	assert.Error(t, err)
+
+	keySet, err := NewCloudKeySet()
+	assert.Nil(t, err)
+	assert.Len(t, keySet.Keys, 2)
+	assert.Equal(t, newKeyID, keySet.Current().KeyID)
+	refreshed := 0
+	SetSenderKeyRefresher(func(senderID string) bool {
+		refreshed++
+		updated := *cloudLocation
+		updated.PublicKey = []byte(keySet.Current().PublicKey)
+		updated.KeyID = keySet.Current().KeyID
+		updated.SetPreviousPublicKeys([][]byte{[]byte(keySet.Keys[1].PublicKey)})
+		assert.Nil(t, store.RemoveCloudMasterData())
+		assert.Nil(t, store.WriteLocation(updated))
+		return true
+	})
+	msg2, err = PullMessageFromEnvelope(newEnvelope)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+	assert.Equal(t, 1, refreshed)
+
+	// old signatures still verify against the previous key
+	oldEnvelope, err = PutMessageInEnvelopev4(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	_, err = PullMessageFromEnvelope(oldEnvelope)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, refreshed)
+
+	// the key set is trusted by anyone that knows one of its keys
+	oldPublicKey, err := ParsePublicKey(oldKey.GetPublicKey())
+	assert.Nil(t, err)
+	assert.Nil(t, keySet.Verify([]*rsa.PublicKey{oldPublicKey}))
+	other, err := GenerateNewKeyPair()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrCloudKeySetUntrusted, keySet.Verify([]*rsa.PublicKey{&other.PublicKey}))
+	otherPEM, err := encodePublicKeyAsBytes(&other.PublicKey)
+	assert.Nil(t, err)
+	keySet.Keys[0].PublicKey = string(otherPEM)
+	assert.Equal(t, ErrCloudKeySetUntrusted, keySet.Verify([]*rsa.PublicKey{oldPublicKey}))
+}
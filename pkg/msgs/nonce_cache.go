@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"sync"
+	"time"
+)
+
+const nonceCachePurgeInterval = 1 * time.Minute
+
+// NonceCache remembers auth challenge nonces that have already been used
+type NonceCache interface {
+	// Add records the nonce until the expiry time. Returns false if the nonce is already known
+	Add(nonce string, expiry time.Time) (bool, error)
+}
+
+// MemoryNonceCache an in process NonceCache.  Only suitable when a single server handles a location's requests
+type MemoryNonceCache struct {
+	lock      sync.Mutex
+	nonces    map[string]time.Time
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+func NewMemoryNonceCache() *MemoryNonceCache {
+	return &MemoryNonceCache{
+		nonces:    make(map[string]time.Time),
+		lastPurge: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (m *MemoryNonceCache) Add(nonce string, expiry time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastPurge) >= nonceCachePurgeInterval {
+		m.purge(now)
+	}
+
+	if existingExpiry, exists := m.nonces[nonce]; exists && existingExpiry.After(now) {
+		return false, nil
+	}
+	m.nonces[nonce] = expiry
+	return true, nil
+}
+
+// Len the number of nonces currently held
+func (m *MemoryNonceCache) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.nonces)
+}
+
+func (m *MemoryNonceCache) purge(now time.Time) {
+	for nonce, expiry := range m.nonces {
+		if !expiry.After(now) {
+			delete(m.nonces, nonce)
+		}
+	}
+	m.lastPurge = now
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryNonceCache(t *testing.T) {
+	now := time.Now()
+	cache := NewMemoryNonceCache()
+	cache.now = func() time.Time { return now }
+
+	fresh, err := cache.Add("a", now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+
+	fresh, err = cache.Add("a", now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, fresh, "a nonce should only be accepted once")
+
+	fresh, err = cache.Add("b", now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+
+	// once expired the nonce is purged and the slot can be reused
+	now = now.Add(2 * nonceCachePurgeInterval)
+	fresh, err = cache.Add("c", now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+	assert.Equal(t, 1, cache.Len())
+
+	fresh, err = cache.Add("a", now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+}
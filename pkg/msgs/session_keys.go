@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+)
+
+const defaultSessionKeyTTL = time.Hour
+const defaultSessionKeyMaxMessages = 100000
+
+// maxReceivedSessions bounds the sessions a receiver remembers, expired sessions are swept out when it fills
+const maxReceivedSessions = 10000
+
+// sessionKeyInfo the HKDF info the encryption and MAC keys are derived with
+const sessionKeyInfo = "natssync session keys"
+
+var (
+	ErrInvalidSessionHeader = errors.New("invalid session key header")
+	ErrSessionMACMismatch   = errors.New("message MAC does not match its session")
+)
+
+// sessionKeys the keys a session key is expanded into
+type sessionKeys struct {
+	encKey []byte
+	macKey []byte
+}
+
+// sendSession a session key used to send to one recipient until it is rekeyed.  Only count changes once it is made
+type sendSession struct {
+	// header the session ID, wrapped session key and the sender's signature over them, sent as the envelope MsgKey
+	header string
+	keys   sessionKeys
+	// keyID the recipient key the session key was wrapped with
+	keyID   string
+	signer  *rsa.PrivateKey
+	created time.Time
+	count   int
+}
+
+type receivedSession struct {
+	keys sessionKeys
+	// verifiedWith the sender key that signed the session, once the sender no longer has it the session is checked again
+	verifiedWith *rsa.PublicKey
+	expires      time.Time
+}
+
+// sessionKeyCache the session keys of the v6 envelopes sent and received by this process.  A receiver that does not
+// know a session, e.g. after a restart or on another server, opens it from the envelope header
+type sessionKeyCache struct {
+	lock     sync.Mutex
+	now      func() time.Time
+	sending  map[string]*sendSession
+	received map[[sha256.Size]byte]receivedSession
+}
+
+func newSessionKeyCache() *sessionKeyCache {
+	return &sessionKeyCache{
+		now:      time.Now,
+		sending:  make(map[string]*sendSession),
+		received: make(map[[sha256.Size]byte]receivedSession),
+	}
+}
+
+var sessions = newSessionKeyCache()
+
+// sessionKeySettings ENVELOPE_SESSION_KEY_TTL and ENVELOPE_SESSION_KEY_MAX_MESSAGES parsed.  They are only parsed
+// again when the config changes, so a bad value is logged once rather than with every message
+type sessionKeySettings struct {
+	ttlValue         string
+	ttl              time.Duration
+	maxMessagesValue string
+	// maxMessages 0 or less only rekeys on the TTL
+	maxMessages int
+}
+
+var sessionKeySettingsLock sync.Mutex
+var parsedSessionKeySettings *sessionKeySettings
+
+func getSessionKeySettings() *sessionKeySettings {
+	sessionKeySettingsLock.Lock()
+	defer sessionKeySettingsLock.Unlock()
+	ttlValue, maxMessagesValue := pkg.Config.EnvelopeSessionKeyTTL, pkg.Config.EnvelopeSessionKeyMaxMessages
+	if ret := parsedSessionKeySettings; ret != nil && ret.ttlValue == ttlValue && ret.maxMessagesValue == maxMessagesValue {
+		return ret
+	}
+
+	ret := &sessionKeySettings{ttlValue: ttlValue, maxMessagesValue: maxMessagesValue}
+	var err error
+	ret.ttl, err = time.ParseDuration(ttlValue)
+	if err != nil || ret.ttl <= 0 {
+		log.WithError(err).Errorf("failed to parse envelope session key ttl, using %v", defaultSessionKeyTTL)
+		ret.ttl = defaultSessionKeyTTL
+	}
+	ret.maxMessages, err = strconv.Atoi(maxMessagesValue)
+	if err != nil {
+		log.WithError(err).Errorf("failed to parse envelope session key max messages, using %d", defaultSessionKeyMaxMessages)
+		ret.maxMessages = defaultSessionKeyMaxMessages
+	}
+	parsedSessionKeySettings = ret
+	return ret
+}
+
+// usable false once the session is due to be rekeyed, or either side's key changed
+func (s *sendSession) usable(now time.Time, master *rsa.PrivateKey, recipientKeyID string) bool {
+	settings := getSessionKeySettings()
+	if now.Sub(s.created) >= settings.ttl {
+		return false
+	}
+	if settings.maxMessages > 0 && s.count >= settings.maxMessages {
+		return false
+	}
+	return s.keyID == recipientKeyID && s.signer.Equal(master)
+}
+
+// sendSession the session to send the next message to the recipient with, making a new one if it is due
+func (c *sessionKeyCache) sendSession(senderID string, recipientID string) (*sendSession, error) {
+	master, err := LoadPrivateKey("")
+	if err != nil {
+		return nil, err
+	}
+	recipientKeys, err := loadLocationKeys(recipientID)
+	if err != nil {
+		return nil, err
+	}
+	key := senderID + "\x00" + recipientID
+	now := c.now()
+
+	c.lock.Lock()
+	session, ok := c.sending[key]
+	if ok && session.usable(now, master, recipientKeys.KeyID) {
+		session.count++
+		c.lock.Unlock()
+		return session, nil
+	}
+	c.lock.Unlock()
+
+	session, err = newSendSession(senderID, recipientID, master, recipientKeys.KeyID, recipientKeys.PublicKeys[0], now)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("locationID", recipientID).WithField("keyID", recipientKeys.KeyID).Debug("New envelope session key")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	session.count = 1
+	c.sending[key] = session
+	return session, nil
+}
+
+func newSendSession(senderID string, recipientID string, master *rsa.PrivateKey, keyID string, recipientKey *rsa.PublicKey, now time.Time) (*sendSession, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipientKey, sessionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	sessionID := bridgemodel.GenerateUUID()
+	wrappedKey := base64.StdEncoding.EncodeToString(wrapped)
+	signingData, err := sessionSigningData(sessionID, senderID, recipientID, keyID, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	sigBits, err := signDataPSS(signingData, master)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := deriveSessionKeys(sessionKey, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &sendSession{
+		header:  strings.Join([]string{sessionID, wrappedKey, base64.StdEncoding.EncodeToString(sigBits)}, "."),
+		keys:    keys,
+		keyID:   keyID,
+		signer:  master,
+		created: now,
+	}, nil
+}
+
+// receivedSession the keys of the envelope's session, opening the session header if it is not known
+func (c *sessionKeyCache) receivedSession(envelope *MessageEnvelope) (sessionKeys, error) {
+	senderKeys, err := loadLocationKeys(envelope.SenderID)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	key := sha256.Sum256([]byte(envelope.SenderID + "\x00" + envelope.RecipientID + "\x00" + envelope.KeyID + "\x00" + envelope.MsgKey))
+	now := c.now()
+	c.lock.Lock()
+	session, ok := c.received[key]
+	c.lock.Unlock()
+	if ok && now.Before(session.expires) && isTrusted(session.verifiedWith, senderKeys.PublicKeys) {
+		return session.keys, nil
+	}
+
+	session, err = openSession(envelope)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	session.expires = now.Add(getSessionKeySettings().ttl)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.received) >= maxReceivedSessions {
+		for k, v := range c.received {
+			if !now.Before(v.expires) {
+				delete(c.received, k)
+			}
+		}
+		if len(c.received) >= maxReceivedSessions {
+			c.received = make(map[[sha256.Size]byte]receivedSession)
+		}
+	}
+	c.received[key] = session
+	return session.keys, nil
+}
+
+// openSession checks the sender signed the session header and unwraps the session key
+func openSession(envelope *MessageEnvelope) (receivedSession, error) {
+	var ret receivedSession
+	parts := strings.Split(envelope.MsgKey, ".")
+	if len(parts) != 3 {
+		return ret, ErrInvalidSessionHeader
+	}
+	sessionID, wrappedKey := parts[0], parts[1]
+	sigBits, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ret, ErrInvalidSessionHeader
+	}
+	signingData, err := sessionSigningData(sessionID, envelope.SenderID, envelope.RecipientID, envelope.KeyID, wrappedKey)
+	if err != nil {
+		return ret, err
+	}
+
+	hash := sha256.Sum256(signingData)
+	err = verifySenderSignature(envelope.SenderID, func(publicKey *rsa.PublicKey) error {
+		err := rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], sigBits, nil)
+		if err == nil {
+			ret.verifiedWith = publicKey
+		}
+		return err
+	})
+	if err != nil {
+		return ret, err
+	}
+
+	sessionKey, err := rsaDecryptOAEP(wrappedKey, envelope.KeyID)
+	if err != nil {
+		return ret, err
+	}
+	ret.keys, err = deriveSessionKeys(sessionKey, sessionID)
+	return ret, err
+}
+
+// sessionSigningData the session fields the sender signs, binding the session key to both sides and the recipient key
+func sessionSigningData(sessionID, senderID, recipientID, keyID, wrappedKey string) ([]byte, error) {
+	return json.Marshal([]string{strconv.Itoa(ENVELOPE_VERSION_6), sessionID, senderID, recipientID, keyID, wrappedKey})
+}
+
+// deriveSessionKeys separate encryption and MAC keys from the session key
+func deriveSessionKeys(sessionKey []byte, sessionID string) (sessionKeys, error) {
+	kdf := hkdf.New(sha256.New, sessionKey, []byte(sessionID), []byte(sessionKeyInfo))
+	ret := sessionKeys{encKey: make([]byte, 32), macKey: make([]byte, 32)}
+	if _, err := io.ReadFull(kdf, ret.encKey); err != nil {
+		return ret, err
+	}
+	if _, err := io.ReadFull(kdf, ret.macKey); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+func sessionMAC(keys sessionKeys, aad []byte, cipherMsg []byte) []byte {
+	mac := hmac.New(sha256.New, keys.macKey)
+	mac.Write(envelopeSigningData(aad, cipherMsg))
+	return mac.Sum(nil)
+}
+
+// PutMessageInEnvelopeV6 encrypts with AES-256-GCM like v5, but with a session key shared with the recipient instead
+// of a new RSA wrapped key and signature for every message.  The session key is wrapped and signed once, carried in
+// MsgKey, and each message gets an HMAC-SHA256 in place of the RSA signature
+func PutMessageInEnvelopeV6(msg []byte, senderID string, recipientID string) (*MessageEnvelope, error) {
+	session, err := sessions.sendSession(senderID, recipientID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(MessageEnvelope)
+	ret.EnvelopeVersion = ENVELOPE_VERSION_6
+	ret.SenderID = senderID
+	ret.RecipientID = recipientID
+	ret.KeyID = session.keyID
+	ret.MsgKey = session.header
+	msg, ret.Compression = compressForRecipient(msg, recipientID)
+
+	aad, err := envelopeAssociatedData(ret)
+	if err != nil {
+		return nil, err
+	}
+	cipherMsg, err := DoAesGCMEncrypt(msg, session.keys.encKey, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Message = base64.StdEncoding.EncodeToString(cipherMsg)
+	ret.Signature = base64.StdEncoding.EncodeToString(sessionMAC(session.keys, aad, cipherMsg))
+	return ret, nil
+}
+
+// pullMessageFromEnvelopev6 the MAC is checked before the message is decrypted
+func pullMessageFromEnvelopev6(envelope *MessageEnvelope) ([]byte, error) {
+	cipherMsgBits, err := base64.StdEncoding.DecodeString(envelope.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	macBits, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	aad, err := envelopeAssociatedData(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := sessions.receivedSession(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(sessionMAC(keys, aad, cipherMsgBits), macBits) {
+		return nil, ErrSessionMACMismatch
+	}
+
+	return DoAesGCMDecrypt(cipherMsgBits, keys.encKey, aad)
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+// initSessionTestKeystore a cloud master key pair in a new keystore, with the cloud location so messages can be sent
+// to ourselves
+func initSessionTestKeystore(tb testing.TB) {
+	pkg.Config.KeystoreUrl = "file://" + tb.TempDir()
+	if err := InitCloudKey(); err != nil {
+		tb.Fatal(err)
+	}
+	store := persistence.GetKeyStore()
+	keyPair, err := store.ReadKeyPair("")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cloudLocation, err := types.NewLocationData(pkg.CLOUD_ID, keyPair.GetPublicKey(), nil, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cloudLocation.KeyID = keyPair.GetKeyID()
+	if err = store.WriteLocation(*cloudLocation); err != nil {
+		tb.Fatal(err)
+	}
+	sessions = newSessionKeyCache()
+}
+
+func TestSessionKeys(t *testing.T) {
+	initSessionTestKeystore(t)
+	oldTTL, oldMax := pkg.Config.EnvelopeSessionKeyTTL, pkg.Config.EnvelopeSessionKeyMaxMessages
+	defer func() {
+		pkg.Config.EnvelopeSessionKeyTTL, pkg.Config.EnvelopeSessionKeyMaxMessages = oldTTL, oldMax
+		sessions = newSessionKeyCache()
+	}()
+	pkg.Config.EnvelopeSessionKeyTTL = "1h"
+	pkg.Config.EnvelopeSessionKeyMaxMessages = "3"
+	msg := []byte("Hello World")
+
+	envelope, err := PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ENVELOPE_VERSION_6, envelope.EnvelopeVersion)
+	msg2, err := PullMessageFromEnvelope(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+
+	// the session is reused until it has sent max messages
+	header := envelope.MsgKey
+	for i := 0; i < 2; i++ {
+		envelope, err = PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+		assert.Nil(t, err)
+		assert.Equal(t, header, envelope.MsgKey)
+	}
+	envelope, err = PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.NotEqual(t, header, envelope.MsgKey)
+
+	// or until it is older than the TTL
+	header = envelope.MsgKey
+	now := time.Now()
+	sessions.now = func() time.Time { return now }
+	envelope, err = PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.Equal(t, header, envelope.MsgKey)
+	now = now.Add(time.Hour)
+	envelope, err = PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.NotEqual(t, header, envelope.MsgKey)
+
+	// a receiver that never saw the session, e.g. another server, opens it from the header
+	sessions = newSessionKeyCache()
+	msg2, err = PullMessageFromEnvelope(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+
+	oldVersion := pkg.Config.EnvelopeVersion
+	defer func() { pkg.Config.EnvelopeVersion = oldVersion }()
+	pkg.Config.EnvelopeVersion = "6"
+	envelope, err = PutMessageInEnvelope(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.Equal(t, ENVELOPE_VERSION_6, envelope.EnvelopeVersion)
+}
+
+func TestSessionKeysTamper(t *testing.T) {
+	initSessionTestKeystore(t)
+	defer func() { sessions = newSessionKeyCache() }()
+	msg := []byte("Hello World")
+
+	other, err := PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	sessions = newSessionKeyCache()
+
+	flip := func(val string) string {
+		bits, _ := base64.StdEncoding.DecodeString(val)
+		bits[len(bits)-1] ^= 0x01
+		return base64.StdEncoding.EncodeToString(bits)
+	}
+	tampers := map[string]func(e *MessageEnvelope){
+		"recipient": func(e *MessageEnvelope) { e.RecipientID = "client1" },
+		"sender":    func(e *MessageEnvelope) { e.SenderID = "client1" },
+		"keyID":     func(e *MessageEnvelope) { e.KeyID = "bogus" },
+		"message":   func(e *MessageEnvelope) { e.Message = flip(e.Message) },
+		"mac":       func(e *MessageEnvelope) { e.Signature = flip(e.Signature) },
+		"session":   func(e *MessageEnvelope) { e.MsgKey = other.MsgKey },
+		"header signature": func(e *MessageEnvelope) {
+			parts := strings.Split(e.MsgKey, ".")
+			parts[2] = flip(parts[2])
+			e.MsgKey = strings.Join(parts, ".")
+		},
+		"header": func(e *MessageEnvelope) { e.MsgKey = "bogus" },
+	}
+	for name, tamper := range tampers {
+		t.Run(name, func(t *testing.T) {
+			envelope, err := PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+			if err != nil {
+				t.Fatalf("Error with put in envelope %s", err)
+			}
+			// known to the receiver, so both the cached and the header path are covered
+			_, err = PullMessageFromEnvelope(envelope)
+			assert.Nil(t, err)
+			tamper(envelope)
+			_, err = PullMessageFromEnvelope(envelope)
+			assert.Error(t, err, "tampered envelope must not open")
+		})
+	}
+}
+
+func TestSessionKeysRotation(t *testing.T) {
+	initSessionTestKeystore(t)
+	defer func() { sessions = newSessionKeyCache() }()
+	msg := []byte("Hello World")
+	store := persistence.GetKeyStore()
+
+	envelope, err := PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	_, err = PullMessageFromEnvelope(envelope)
+	assert.Nil(t, err)
+
+	// a new master key makes a new session, which the receiver checks against the sender's new key
+	oldLocation, err := store.ReadLocation(pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	_, err = RotateCloudKey()
+	assert.Nil(t, err)
+	newKeyPair, err := store.ReadKeyPair("")
+	assert.Nil(t, err)
+	rotated, err := PutMessageInEnvelopeV6(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+	assert.Nil(t, err)
+	assert.NotEqual(t, envelope.MsgKey, rotated.MsgKey)
+	_, err = PullMessageFromEnvelope(rotated)
+	assert.Error(t, err)
+
+	updated := *oldLocation
+	updated.PublicKey = newKeyPair.GetPublicKey()
+	updated.SetPreviousPublicKeys([][]byte{oldLocation.GetPublicKey()})
+	assert.Nil(t, store.RemoveCloudMasterData())
+	assert.Nil(t, store.WriteLocation(updated))
+	msg2, err := PullMessageFromEnvelope(rotated)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, msg2)
+
+	// once the old key is retired its sessions are no longer trusted, even the ones already opened
+	updated.SetPreviousPublicKeys(nil)
+	assert.Nil(t, store.RemoveCloudMasterData())
+	assert.Nil(t, store.WriteLocation(updated))
+	_, err = PullMessageFromEnvelope(envelope)
+	assert.Error(t, err)
+}
+
+func benchmarkEnvelope(b *testing.B, put func(msg []byte, senderID string, recipientID string) (*MessageEnvelope, error)) {
+	initSessionTestKeystore(b)
+	defer func() { sessions = newSessionKeyCache() }()
+	msg := bytes.Repeat([]byte("natssync"), 128)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		envelope, err := put(msg, pkg.CLOUD_ID, pkg.CLOUD_ID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = PullMessageFromEnvelope(envelope); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnvelopeV3(b *testing.B) {
+	benchmarkEnvelope(b, PutMessageInEnvelopeV3)
+}
+
+func BenchmarkEnvelopeV6(b *testing.B) {
+	benchmarkEnvelope(b, PutMessageInEnvelopeV6)
+}
+
+func TestSessionKeySettings(t *testing.T) {
+	oldTTL, oldMax := pkg.Config.EnvelopeSessionKeyTTL, pkg.Config.EnvelopeSessionKeyMaxMessages
+	defer func() {
+		pkg.Config.EnvelopeSessionKeyTTL, pkg.Config.EnvelopeSessionKeyMaxMessages = oldTTL, oldMax
+	}()
+	hooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	defer log.StandardLogger().ReplaceHooks(hooks)
+	hook := logtest.NewGlobal()
+
+	// bad values are logged once, not for every message
+	pkg.Config.EnvelopeSessionKeyTTL = "bogus"
+	pkg.Config.EnvelopeSessionKeyMaxMessages = "many"
+	for i := 0; i < 3; i++ {
+		settings := getSessionKeySettings()
+		assert.Equal(t, defaultSessionKeyTTL, settings.ttl)
+		assert.Equal(t, defaultSessionKeyMaxMessages, settings.maxMessages)
+	}
+	errors := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.ErrorLevel {
+			errors++
+		}
+	}
+	assert.Equal(t, 2, errors)
+
+	// a config change is picked up
+	pkg.Config.EnvelopeSessionKeyTTL = "5m"
+	pkg.Config.EnvelopeSessionKeyMaxMessages = "10"
+	settings := getSessionKeySettings()
+	assert.Equal(t, 5*time.Minute, settings.ttl)
+	assert.Equal(t, 10, settings.maxMessages)
+}
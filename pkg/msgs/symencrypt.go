@@ -98,3 +98,36 @@ func DoAesECBDecrypt(src, key []byte) ([]byte, error) {
 	out = unPadTheZeros(out)
 	return out, nil
 }
+
+// DoAesGCMEncrypt encrypts and authenticates src along with the additional data.  The nonce is prepended to the result
+func DoAesGCMEncrypt(src, key, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, src, additionalData), nil
+}
+
+func DoAesGCMDecrypt(src, key, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) < gcm.NonceSize() {
+		return nil, errors.New("cipher text too short")
+	}
+	nonce := src[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, src[gcm.NonceSize():], additionalData)
+}
@@ -57,3 +57,26 @@ func Test_AesCBCEnryption(t *testing.T) {
 		})
 	}
 }
+
+func Test_AesGCMEnryption(t *testing.T) {
+	testData := []string{"hello", "hello world", "super long weird data with \t an                        d stuff     ", "trailing zeros\x00\x00"}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.Nil(t, err)
+	aad := []byte("envelope metadata")
+	for i, plain1 := range testData {
+		name := fmt.Sprintf("Name %d", i)
+		t.Run(name, func(t *testing.T) {
+			cipher, err := msgs.DoAesGCMEncrypt([]byte(plain1), key, aad)
+			assert.Nil(t, err)
+			if err == nil {
+				plain2, err := msgs.DoAesGCMDecrypt(cipher, key, aad)
+				assert.Nil(t, err)
+				assert.Equal(t, plain1, string(plain2))
+
+				_, err = msgs.DoAesGCMDecrypt(cipher, key, []byte("other metadata"))
+				assert.Error(t, err, "changed additional data must fail")
+			}
+		})
+	}
+}
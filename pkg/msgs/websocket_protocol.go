@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+)
+
+// HEADER_AUTH_CHALLENGE carries the base64 JSON auth challenge on the websocket handshake.  The challenge is bound
+// to GET and the MakeWebSocketPath path
+const HEADER_AUTH_CHALLENGE = "X-Natssync-Auth-Challenge"
+
+// WEBSOCKET_PING_PERIOD how often the server pings websocket clients
+const WEBSOCKET_PING_PERIOD = 30 * time.Second
+
+// WEBSOCKET_PONG_WAIT how long either side of a websocket waits to hear from the other before giving up
+const WEBSOCKET_PONG_WAIT = 2 * WEBSOCKET_PING_PERIOD
+
+// WEBSOCKET_WRITE_WAIT how long a websocket write may take
+const WEBSOCKET_WRITE_WAIT = 10 * time.Second
+
+// WEBSOCKET_CONTROL_CERT_ROTATION sent in a WebSocketControlFrame when the location has to rotate its key pair
+// before it reconnects
+const WEBSOCKET_CONTROL_CERT_ROTATION = "cert-rotation"
+
+// WEBSOCKET_CLOSE_CERT_ROTATION the close code that goes with WEBSOCKET_CONTROL_CERT_ROTATION
+const WEBSOCKET_CLOSE_CERT_ROTATION = 4000 + 495
+
+// WEBSOCKET_CONTROL_CLOUD_KEYS sent in a WebSocketControlFrame when the cloud master key changed, the location should
+// fetch CLOUD_KEYS_PATH
+const WEBSOCKET_CONTROL_CLOUD_KEYS = "cloud-keys"
+
+// EncodeAuthChallengeHeader the HEADER_AUTH_CHALLENGE value for the challenge
+func EncodeAuthChallengeHeader(challenge *v1.AuthChallenge) (string, error) {
+	bits, err := json.Marshal(challenge)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bits), nil
+}
+
+// DecodeAuthChallengeHeader reads a HEADER_AUTH_CHALLENGE value
+func DecodeAuthChallengeHeader(header string) (*v1.AuthChallenge, error) {
+	bits, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(v1.AuthChallenge)
+	if err = json.Unmarshal(bits, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
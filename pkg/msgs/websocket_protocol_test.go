@@ -0,0 +1,29 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package msgs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/theotw/natssync/pkg/bridgemodel/generated/v1"
+)
+
+func TestAuthChallengeHeader(t *testing.T) {
+	challenge := &v1.AuthChallenge{Version: AUTH_CHALLENGE_VERSION_2, AuthChallengeA: `{"nonce":"abc"}`, AuthChellengeB: "c2ln"}
+	header, err := EncodeAuthChallengeHeader(challenge)
+	assert.Nil(t, err)
+	assert.NotContains(t, header, "\n")
+
+	challenge2, err := DecodeAuthChallengeHeader(header)
+	assert.Nil(t, err)
+	assert.Equal(t, challenge, challenge2)
+
+	for _, bad := range []string{"", "not base64!", "bm90IGpzb24="} {
+		_, err = DecodeAuthChallengeHeader(bad)
+		assert.Error(t, err, bad)
+	}
+}
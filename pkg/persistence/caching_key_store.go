@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package persistence
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/bridgemodel"
+	"github.com/theotw/natssync/pkg/metrics"
+	"github.com/theotw/natssync/pkg/natsmodel"
+	"github.com/theotw/natssync/pkg/persistence/natskv"
+	"github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+const defaultKeystoreCacheTTL = 5 * time.Minute
+
+// the kind label of the keystore cache metrics
+const (
+	cacheKindPublic   = "public"
+	cacheKindPrivate  = "private"
+	cacheKindLocation = "location"
+)
+
+// LocationKeys the parsed public keys of a location, its current key first followed by the previous keys it rotated
+// away from that are still accepted
+type LocationKeys struct {
+	KeyID      string
+	PublicKeys []*rsa.PublicKey
+}
+
+// KeyCache is implemented by keystores that keep the parsed keys, so messages do not read and parse them every time
+type KeyCache interface {
+	LoadLocationKeys(locationID string) (*LocationKeys, error)
+	// LoadPrivateKey an empty keyID is the latest key pair
+	LoadPrivateKey(keyID string) (*rsa.PrivateKey, error)
+	// LoadLocation the location record for reading, it is shared and must not be changed
+	LoadLocation(locationID string) (*types.LocationData, error)
+	// Invalidate drops the location's record, its public keys and the private keys of its key pairs
+	Invalidate(locationID string)
+}
+
+type cachedLocationKeys struct {
+	keys    *LocationKeys
+	expires time.Time
+}
+
+type cachedLocation struct {
+	locationData *types.LocationData
+	expires      time.Time
+}
+
+type cachedPrivateKey struct {
+	locationID string
+	key        *rsa.PrivateKey
+	expires    time.Time
+}
+
+// CachingKeyStore keeps the location records and parsed keys read through it for the TTL.  Writes through it drop what they change, and
+// changes made by other servers are dropped when their lifecycle events come in, see Subscribe, or when a
+// ChangeNotifier keystore reports them
+type CachingKeyStore struct {
+	store LocationKeyStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	lock        sync.Mutex
+	locations   map[string]cachedLocation
+	publicKeys  map[string]cachedLocationKeys
+	privateKeys map[string]cachedPrivateKey
+	// generation changes on every invalidation, a read that started before one is not cached
+	generation uint64
+}
+
+func NewCachingKeyStore(store LocationKeyStore, ttl time.Duration) *CachingKeyStore {
+	return &CachingKeyStore{
+		store:       store,
+		ttl:         ttl,
+		now:         time.Now,
+		locations:   make(map[string]cachedLocation),
+		publicKeys:  make(map[string]cachedLocationKeys),
+		privateKeys: make(map[string]cachedPrivateKey),
+	}
+}
+
+// wrapWithKeyCache caches the keystore's parsed keys for KEYSTORE_CACHE_TTL, 0 turns the cache off
+func wrapWithKeyCache(store LocationKeyStore) LocationKeyStore {
+	ttl := defaultKeystoreCacheTTL
+	if len(pkg.Config.KeystoreCacheTTL) > 0 {
+		var err error
+		if ttl, err = time.ParseDuration(pkg.Config.KeystoreCacheTTL); err != nil {
+			log.WithError(err).Errorf("failed to parse keystore cache ttl, using %v", defaultKeystoreCacheTTL)
+			ttl = defaultKeystoreCacheTTL
+		}
+	}
+	if ttl <= 0 {
+		return store
+	}
+	ret := NewCachingKeyStore(store, ttl)
+	if notifier, ok := store.(ChangeNotifier); ok {
+		notifier.OnChange(ret.onKeystoreChange)
+	}
+	if nc := natsmodel.GetNatsConnection(); nc != nil {
+		if err := ret.Subscribe(nc); err != nil {
+			log.WithError(err).Errorf("Unable to subscribe to lifecycle events, keys are only refreshed every %v", ttl)
+		}
+	}
+	log.Infof("caching keystore keys for %v", ttl)
+	return ret
+}
+
+// Subscribe drops what is cached for the locations named by the registration lifecycle and key rotation events
+func (c *CachingKeyStore) Subscribe(nc *nats.Conn) error {
+	handler := func(msg *nats.Msg) {
+		if len(msg.Data) == 0 {
+			log.Debugf("Got a %s message with no location", msg.Subject)
+			return
+		}
+		c.Invalidate(string(msg.Data))
+	}
+	for _, subject := range []string{bridgemodel.REGISTRATION_LIFECYCLE_ADDED, bridgemodel.REGISTRATION_LIFECYCLE_REMOVED, bridgemodel.REGISTRATION_LIFECYCLE_KEY_ROTATED, bridgemodel.REGISTRATION_LIFECYCLE_UPDATED} {
+		if _, err := nc.Subscribe(subject, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CachingKeyStore) Invalidate(locationID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	delete(c.locations, locationID)
+	delete(c.publicKeys, locationID)
+	for keyID, entry := range c.privateKeys {
+		if entry.locationID == locationID {
+			delete(c.privateKeys, keyID)
+		}
+	}
+}
+
+func (c *CachingKeyStore) invalidateLocation(locationID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	delete(c.locations, locationID)
+	delete(c.publicKeys, locationID)
+}
+
+// onKeystoreChange drops what is cached for a location or key pair the keystore reports changed
+func (c *CachingKeyStore) onKeystoreChange(kind string, id string, removed bool) {
+	switch kind {
+	case natskv.KIND_LOCATION:
+		c.Invalidate(id)
+	case natskv.KIND_KEY_PAIR:
+		c.invalidatePrivateKeys()
+	}
+}
+
+// invalidatePrivateKeys drops every private key, a new or removed key pair can change which one is the latest
+func (c *CachingKeyStore) invalidatePrivateKeys() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.privateKeys = make(map[string]cachedPrivateKey)
+}
+
+func (c *CachingKeyStore) LoadLocationKeys(locationID string) (*LocationKeys, error) {
+	now := c.now()
+	c.lock.Lock()
+	entry, ok := c.publicKeys[locationID]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		metrics.IncrementKeystoreCacheHit(cacheKindPublic)
+		return entry.keys, nil
+	}
+	metrics.IncrementKeystoreCacheMiss(cacheKindPublic)
+
+	locationData, err := c.store.ReadLocation(locationID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseLocationKeys(locationData)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation == c.generation {
+		c.publicKeys[locationID] = cachedLocationKeys{keys: keys, expires: now.Add(c.ttl)}
+	}
+	return keys, nil
+}
+
+func (c *CachingKeyStore) LoadLocation(locationID string) (*types.LocationData, error) {
+	now := c.now()
+	c.lock.Lock()
+	entry, ok := c.locations[locationID]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		metrics.IncrementKeystoreCacheHit(cacheKindLocation)
+		return entry.locationData, nil
+	}
+	metrics.IncrementKeystoreCacheMiss(cacheKindLocation)
+
+	locationData, err := c.store.ReadLocation(locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation == c.generation {
+		c.locations[locationID] = cachedLocation{locationData: locationData, expires: now.Add(c.ttl)}
+	}
+	return locationData, nil
+}
+
+func (c *CachingKeyStore) LoadPrivateKey(keyID string) (*rsa.PrivateKey, error) {
+	now := c.now()
+	c.lock.Lock()
+	entry, ok := c.privateKeys[keyID]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		metrics.IncrementKeystoreCacheHit(cacheKindPrivate)
+		return entry.key, nil
+	}
+	metrics.IncrementKeystoreCacheMiss(cacheKindPrivate)
+
+	locationData, err := c.store.ReadKeyPair(keyID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(locationData.GetPrivateKey())
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation == c.generation {
+		cached := cachedPrivateKey{locationID: locationData.GetLocationID(), key: key, expires: now.Add(c.ttl)}
+		c.privateKeys[keyID] = cached
+		c.privateKeys[locationData.GetKeyID()] = cached
+	}
+	return key, nil
+}
+
+// ParseLocationKeys the location's current and previous public keys
+func ParseLocationKeys(locationData *types.LocationData) (*LocationKeys, error) {
+	pemKeys := append([][]byte{locationData.GetPublicKey()}, locationData.GetPreviousPublicKeys()...)
+	ret := &LocationKeys{KeyID: locationData.GetKeyID(), PublicKeys: make([]*rsa.PublicKey, 0, len(pemKeys))}
+	for _, pemKey := range pemKeys {
+		publicKey, err := ParsePublicKey(pemKey)
+		if err != nil {
+			return nil, err
+		}
+		ret.PublicKeys = append(ret.PublicKeys, publicKey)
+	}
+	return ret, nil
+}
+
+// ParsePublicKey a PEM encoded RSA public key
+func ParsePublicKey(pemKey []byte) (*rsa.PublicKey, error) {
+	data, _ := pem.Decode(pemKey)
+	if data == nil {
+		return nil, errors.New("invalid public key")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(data.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return ret, nil
+}
+
+// ParsePrivateKey a PEM encoded PKCS1 RSA private key
+func ParsePrivateKey(pemKey []byte) (*rsa.PrivateKey, error) {
+	data, _ := pem.Decode(pemKey)
+	if data == nil {
+		return nil, errors.New("invalid private key")
+	}
+	return x509.ParsePKCS1PrivateKey(data.Bytes)
+}
+
+func (c *CachingKeyStore) ReadKeyPair(keyID string) (*types.LocationData, error) {
+	return c.store.ReadKeyPair(keyID)
+}
+
+func (c *CachingKeyStore) WriteKeyPair(locationData *types.LocationData) error {
+	defer c.invalidatePrivateKeys()
+	return c.store.WriteKeyPair(locationData)
+}
+
+func (c *CachingKeyStore) RemoveKeyPair(keyID string) error {
+	defer c.invalidatePrivateKeys()
+	return c.store.RemoveKeyPair(keyID)
+}
+
+func (c *CachingKeyStore) LoadLocationID(keyID string) string {
+	return c.store.LoadLocationID(keyID)
+}
+
+func (c *CachingKeyStore) WriteLocation(locationData types.LocationData) error {
+	defer c.invalidateLocation(locationData.GetLocationID())
+	return c.store.WriteLocation(locationData)
+}
+
+func (c *CachingKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	defer c.invalidateLocation(locationData.GetLocationID())
+	return c.store.UpdateLocation(locationData)
+}
+
+func (c *CachingKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	return c.store.ReadLocation(locationID)
+}
+
+func (c *CachingKeyStore) RemoveLocation(locationID string) error {
+	defer c.invalidateLocation(locationID)
+	return c.store.RemoveLocation(locationID)
+}
+
+func (c *CachingKeyStore) RemoveCloudMasterData() error {
+	defer c.Invalidate(pkg.CLOUD_ID)
+	return c.store.RemoveCloudMasterData()
+}
+
+func (c *CachingKeyStore) ListKnownClients() ([]string, error) {
+	return c.store.ListKnownClients()
+}
+
+func (c *CachingKeyStore) GetExistingKeys() ([]*utils.UUIDv1, error) {
+	cleanup, ok := c.store.(CleanupKeysInterface)
+	if !ok {
+		return nil, fmt.Errorf("keystore can not list its keys")
+	}
+	return cleanup.GetExistingKeys()
+}
+
+func (c *CachingKeyStore) GetLatestKeyID() (string, error) {
+	cleanup, ok := c.store.(CleanupKeysInterface)
+	if !ok {
+		return "", fmt.Errorf("keystore can not list its keys")
+	}
+	return cleanup.GetLatestKeyID()
+}
+
+func (c *CachingKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	return ListLocations(c.store, query)
+}
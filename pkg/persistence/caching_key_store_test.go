@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package persistence
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence/natskv"
+	"github.com/theotw/natssync/pkg/types"
+)
+
+func newTestKeyPair(t *testing.T, locationID string) (*types.LocationData, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	publicBits, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBits})
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	locationData, err := types.NewLocationData(locationID, publicKey, privateKey, nil)
+	assert.Nil(t, err)
+	return locationData, key
+}
+
+func TestCachingKeyStorePublicKeys(t *testing.T) {
+	inner, cleanup := newTestFileKeyStore(t)
+	defer cleanup()
+	store := NewCachingKeyStore(inner, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	first, firstKey := newTestKeyPair(t, "loc1")
+	assert.Nil(t, store.WriteLocation(*first))
+	keys, err := store.LoadLocationKeys("loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, first.KeyID, keys.KeyID)
+	assert.True(t, firstKey.PublicKey.Equal(keys.PublicKeys[0]))
+
+	// changed behind the cache's back, the cached key is used until it is invalidated
+	second, secondKey := newTestKeyPair(t, "loc1")
+	second.SetPreviousPublicKeys([][]byte{first.PublicKey})
+	assert.Nil(t, inner.WriteLocation(*second))
+	keys, err = store.LoadLocationKeys("loc1")
+	assert.Nil(t, err)
+	assert.True(t, firstKey.PublicKey.Equal(keys.PublicKeys[0]))
+
+	store.Invalidate("loc1")
+	keys, err = store.LoadLocationKeys("loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, second.KeyID, keys.KeyID)
+	assert.Len(t, keys.PublicKeys, 2)
+	assert.True(t, secondKey.PublicKey.Equal(keys.PublicKeys[0]))
+	assert.True(t, firstKey.PublicKey.Equal(keys.PublicKeys[1]))
+
+	// or until the TTL runs out
+	assert.Nil(t, inner.WriteLocation(*first))
+	now = now.Add(time.Minute)
+	keys, err = store.LoadLocationKeys("loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, first.KeyID, keys.KeyID)
+
+	// writes through the cache drop the location
+	assert.Nil(t, store.WriteLocation(*second))
+	keys, err = store.LoadLocationKeys("loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, second.KeyID, keys.KeyID)
+
+	assert.Nil(t, store.RemoveLocation("loc1"))
+	_, err = store.LoadLocationKeys("loc1")
+	assert.Error(t, err)
+}
+
+func TestCachingKeyStorePrivateKeys(t *testing.T) {
+	inner, cleanup := newTestFileKeyStore(t)
+	defer cleanup()
+	store := NewCachingKeyStore(inner, time.Minute)
+
+	first, firstKey := newTestKeyPair(t, pkg.CLOUD_ID)
+	assert.Nil(t, store.WriteKeyPair(first))
+	key, err := store.LoadPrivateKey("")
+	assert.Nil(t, err)
+	assert.True(t, firstKey.Equal(key))
+	key, err = store.LoadPrivateKey(first.KeyID)
+	assert.Nil(t, err)
+	assert.True(t, firstKey.Equal(key))
+
+	// a rotation on another server, seen once its event comes in
+	second, secondKey := newTestKeyPair(t, pkg.CLOUD_ID)
+	assert.Nil(t, inner.WriteKeyPair(second))
+	key, err = store.LoadPrivateKey("")
+	assert.Nil(t, err)
+	assert.True(t, firstKey.Equal(key))
+	store.Invalidate("loc1")
+	key, err = store.LoadPrivateKey("")
+	assert.Nil(t, err)
+	assert.True(t, firstKey.Equal(key))
+	store.Invalidate(pkg.CLOUD_ID)
+	key, err = store.LoadPrivateKey("")
+	assert.Nil(t, err)
+	assert.True(t, secondKey.Equal(key))
+
+	// the older key pair is still there for messages that name it
+	key, err = store.LoadPrivateKey(first.KeyID)
+	assert.Nil(t, err)
+	assert.True(t, firstKey.Equal(key))
+
+	assert.Nil(t, store.RemoveKeyPair(second.KeyID))
+	key, err = store.LoadPrivateKey("")
+	assert.Nil(t, err)
+	assert.True(t, firstKey.Equal(key))
+}
+
+func TestCachingKeyStoreLocations(t *testing.T) {
+	inner, cleanup := newTestFileKeyStore(t)
+	defer cleanup()
+	store := NewCachingKeyStore(inner, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	first, _ := newTestKeyPair(t, "loc1")
+	first.SetMetadata(map[string]string{"region": "east"})
+	assert.Nil(t, store.WriteLocation(*first))
+	locationData, err := LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "east", locationData.GetMetadata()["region"])
+
+	// changed behind the cache's back, the cached record is used until it is invalidated
+	second := *first
+	second.SetMetadata(map[string]string{"region": "west"})
+	assert.Nil(t, inner.WriteLocation(second))
+	locationData, err = LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "east", locationData.GetMetadata()["region"])
+	// reads for an update always go to the keystore
+	locationData, err = store.ReadLocation("loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "west", locationData.GetMetadata()["region"])
+
+	store.Invalidate("loc1")
+	locationData, err = LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "west", locationData.GetMetadata()["region"])
+
+	// or until the TTL runs out
+	assert.Nil(t, inner.WriteLocation(*first))
+	now = now.Add(time.Minute)
+	locationData, err = LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "east", locationData.GetMetadata()["region"])
+
+	// updates through the cache drop the location
+	locationData, err = store.ReadLocation("loc1")
+	assert.Nil(t, err)
+	locationData.SetMetadata(map[string]string{"region": "north"})
+	assert.Nil(t, store.UpdateLocation(locationData))
+	locationData, err = LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "north", locationData.GetMetadata()["region"])
+
+	assert.Nil(t, store.RemoveLocation("loc1"))
+	_, err = LoadLocation(store, "loc1")
+	assert.Error(t, err)
+}
+
+// notifyingKeyStore a keystore that reports changes the way the NATS KV keystore does
+type notifyingKeyStore struct {
+	LocationKeyStore
+	handlers []natskv.ChangeHandler
+}
+
+func (n *notifyingKeyStore) OnChange(handler natskv.ChangeHandler) {
+	n.handlers = append(n.handlers, handler)
+}
+
+func (n *notifyingKeyStore) changed(kind string, id string) {
+	for _, handler := range n.handlers {
+		handler(kind, id, false)
+	}
+}
+
+func TestCachingKeyStoreChangeNotifier(t *testing.T) {
+	inner, cleanup := newTestFileKeyStore(t)
+	defer cleanup()
+	notifier := &notifyingKeyStore{LocationKeyStore: inner}
+	saved := pkg.Config
+	defer func() { pkg.Config = saved }()
+	pkg.Config.KeystoreCacheTTL = "1m"
+	store, ok := wrapWithKeyCache(notifier).(*CachingKeyStore)
+	if !assert.True(t, ok) || !assert.Len(t, notifier.handlers, 1) {
+		return
+	}
+
+	first, _ := newTestKeyPair(t, "loc1")
+	first.SetMetadata(map[string]string{"region": "east"})
+	assert.Nil(t, store.WriteLocation(*first))
+	locationData, err := LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "east", locationData.GetMetadata()["region"])
+
+	// another server changed the location, the keystore reports it before the TTL runs out
+	second := *first
+	second.SetMetadata(map[string]string{"region": "west"})
+	assert.Nil(t, inner.WriteLocation(second))
+	notifier.changed(natskv.KIND_LOCATION, "loc1")
+	locationData, err = LoadLocation(store, "loc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "west", locationData.GetMetadata()["region"])
+}
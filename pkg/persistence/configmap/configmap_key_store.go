@@ -13,6 +13,7 @@ import (
 	"github.com/theotw/natssync/pkg"
 	"github.com/theotw/natssync/pkg/types"
 	"github.com/theotw/natssync/pkg/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sTypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
@@ -26,6 +27,8 @@ import (
 const (
 	locationDataKeyFileSuffix = "_locationData.json"
 	serviceKeyFileNameSuffix  = "_serviceKeyData.json"
+	// updateRetries times an update is tried again when another key of the configmap changed under it
+	updateRetries = 5
 )
 
 type ConfigmapKeyStore struct {
@@ -33,6 +36,9 @@ type ConfigmapKeyStore struct {
 	cleanupTTL      time.Duration
 
 	configmapName string
+	// client set by NewConfigmapKeyStoreWithClient, otherwise a client is made from the pod's service account
+	client    kubernetes.Interface
+	namespace string
 }
 
 func (c *ConfigmapKeyStore) GetExistingKeys() ([]*utils.UUIDv1, error) {
@@ -74,9 +80,15 @@ func NewKeyMetadata(key string, createdTime int64, uuid *utils.UUIDv1) *KeyMetad
 func NewConfigmapKeyStore() (*ConfigmapKeyStore, error) {
 	ret := new(ConfigmapKeyStore)
 	ret.configmapName = pkg.Config.ConfigmapName
+	ret.namespace = pkg.Config.PodNamespace
 	return ret, nil
 }
 
+// NewConfigmapKeyStoreWithClient a keystore in the configmap name of the namespace, which must already exist
+func NewConfigmapKeyStoreWithClient(client kubernetes.Interface, namespace string, name string) *ConfigmapKeyStore {
+	return &ConfigmapKeyStore{client: client, namespace: namespace, configmapName: name}
+}
+
 func (c *ConfigmapKeyStore) WriteKeyPair(locationData *types.LocationData) error {
 
 	locationDataBytes, err := json.Marshal(locationData)
@@ -233,6 +245,55 @@ func (c *ConfigmapKeyStore) WriteLocation(locationData types.LocationData) error
 	return c.addConfigmapKeyPair(locationFile, data)
 }
 
+// UpdateLocation checks the revision in the configmap it read and updates it with that resourceVersion, so a change
+// made in between fails the update.  Changes to other keys are not a conflict, the update is tried again
+func (c *ConfigmapKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	k8sClient, err := c.getK8sClientset()
+	if err != nil {
+		return err
+	}
+	configMaps := k8sClient.CoreV1().ConfigMaps(c.namespace)
+	locationFile := c.makeLocationDataFileName(locationData.GetLocationID())
+	updated := *locationData
+	updated.Revision++
+	data, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < updateRetries; i++ {
+		configMap, err := configMaps.Get(context.TODO(), c.configmapName, metav1.GetOptions{})
+		if err != nil {
+			log.WithError(err).Errorf("failed to get configmap %s", c.configmapName)
+			return err
+		}
+		key, stored := "", &types.LocationData{}
+		for k, val := range configMap.Data {
+			if strings.EqualFold(k, locationFile) {
+				key = k
+				if err = json.Unmarshal([]byte(val), stored); err != nil {
+					return err
+				}
+			}
+		}
+		if len(key) == 0 || stored.Revision != locationData.Revision {
+			return types.ErrRevisionConflict
+		}
+
+		configMap.Data[key] = string(data)
+		_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		if err == nil {
+			locationData.Revision = updated.Revision
+			return nil
+		}
+		if !apierrors.IsConflict(err) {
+			log.Errorf("Unable to update configmap.\n%s", err.Error())
+			return err
+		}
+	}
+	return types.ErrRevisionConflict
+}
+
 func (c *ConfigmapKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
 	locationFile := c.makeLocationDataFileName(locationID)
 	locationDataBytes, err := c.readFile(locationFile)
@@ -291,6 +352,27 @@ func (c *ConfigmapKeyStore) ListKnownClients() ([]string, error) {
 	return ret, nil
 }
 
+// ListLocations all the locations are in the one configmap, so they are read with a single request
+func (c *ConfigmapKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	configMapData, err := c.getConfigMapData()
+	if err != nil {
+		return nil, err
+	}
+
+	locations := make([]types.LocationData, 0)
+	for key, val := range configMapData {
+		if strings.HasSuffix(key, locationDataKeyFileSuffix) {
+			var locationData types.LocationData
+			if err = json.Unmarshal([]byte(val), &locationData); err != nil {
+				log.WithError(err).WithField("key", key).Error("Unable to read location data from configmap")
+				continue
+			}
+			locations = append(locations, locationData)
+		}
+	}
+	return types.ApplyLocationQuery(locations, query)
+}
+
 func (c *ConfigmapKeyStore) removeConfigmapKey(key string) error {
 	// Note: "/data" is not a file/dir. This is specific to k8s configmaps.
 	escapedKeyBytes, err := json.Marshal(fmt.Sprintf("/data/%s", key))
@@ -304,7 +386,7 @@ func (c *ConfigmapKeyStore) removeConfigmapKey(key string) error {
 	}
 
 	payloadBytes := []byte(fmt.Sprintf("[{\"op\": \"remove\", \"path\": %s}]", string(escapedKeyBytes)))
-	_, err = k8sClient.CoreV1().ConfigMaps(pkg.Config.PodNamespace).Patch(context.TODO(), c.configmapName, k8sTypes.JSONPatchType, payloadBytes, metav1.PatchOptions{})
+	_, err = k8sClient.CoreV1().ConfigMaps(c.namespace).Patch(context.TODO(), c.configmapName, k8sTypes.JSONPatchType, payloadBytes, metav1.PatchOptions{})
 	if err != nil {
 		log.Errorf("Unable to remove configmap key.\n%s", err.Error())
 		return err
@@ -333,7 +415,7 @@ func (c *ConfigmapKeyStore) addConfigmapKeyPair(key string, value []byte) error
 	payloadString := fmt.Sprintf("{\"data\": {%s: %s}}", string(escapedKeyBytes), string(escapedValueBytes))
 	payloadBytes := []byte(payloadString)
 
-	_, err = k8sClient.CoreV1().ConfigMaps(pkg.Config.PodNamespace).Patch(context.TODO(), c.configmapName, k8sTypes.MergePatchType, payloadBytes, metav1.PatchOptions{})
+	_, err = k8sClient.CoreV1().ConfigMaps(c.namespace).Patch(context.TODO(), c.configmapName, k8sTypes.MergePatchType, payloadBytes, metav1.PatchOptions{})
 	if err != nil {
 		log.Errorf("Unable to patch configmap.\n%s", err.Error())
 		return err
@@ -369,7 +451,10 @@ func (c *ConfigmapKeyStore) makeServiceKeyFileName(keyID string) string {
 	return fmt.Sprintf("%s%s%s", keyID, c.getTimestampSuffix(), serviceKeyFileNameSuffix)
 }
 
-func (c *ConfigmapKeyStore) getK8sClientset() (*kubernetes.Clientset, error) {
+func (c *ConfigmapKeyStore) getK8sClientset() (kubernetes.Interface, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
 	// Use the k8s service account attached to this pod
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -392,7 +477,7 @@ func (c *ConfigmapKeyStore) getConfigMapData() (map[string]string, error) {
 		return nil, err
 	}
 
-	configMap, err := clientset.CoreV1().ConfigMaps(pkg.Config.PodNamespace).Get(context.TODO(), c.configmapName, metav1.GetOptions{})
+	configMap, err := clientset.CoreV1().ConfigMaps(c.namespace).Get(context.TODO(), c.configmapName, metav1.GetOptions{})
 	if err != nil {
 		log.WithError(err).Errorf("failed to get configmap %s", c.configmapName)
 		return nil, err
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package configmap_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+
+	"github.com/theotw/natssync/pkg/persistence/configmap"
+	"github.com/theotw/natssync/pkg/persistence/keystoretest"
+	types "github.com/theotw/natssync/pkg/types"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+const (
+	testNamespace = "natssync-test"
+	testConfigmap = "natssync-keystore"
+)
+
+func newTestStore() (*fake.Clientset, *configmap.ConfigmapKeyStore) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: testConfigmap, Namespace: testNamespace},
+	})
+	return client, configmap.NewConfigmapKeyStoreWithClient(client, testNamespace, testConfigmap)
+}
+
+func TestConfigmapKeyStoreUpdateLocation(t *testing.T) {
+	_, store := newTestStore()
+	keystoretest.TestUpdateLocation(t, store)
+}
+
+func TestConfigmapKeyStoreUpdateConflict(t *testing.T) {
+	client, store := newTestStore()
+	assert.Nil(t, store.WriteLocation(types.LocationData{LocationID: "foo", PublicKey: []byte("first")}))
+	locationData, err := store.ReadLocation("foo")
+	assert.Nil(t, err)
+
+	// another key of the configmap changed first, the update reads it again and retries
+	conflicts := 0
+	client.PrependReactor("update", "configmaps", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, k8sErrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, testConfigmap, fmt.Errorf("changed"))
+	})
+	locationData.PublicKey = []byte("second")
+	assert.Nil(t, store.UpdateLocation(locationData))
+	assert.Equal(t, 1, conflicts)
+	assert.Equal(t, int64(1), locationData.Revision)
+
+	configMap, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), testConfigmap, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, configMap.Data["foo_locationData.json"], `"revision":1`)
+
+	// an update that always loses gives up with a conflict
+	client.PrependReactor("update", "configmaps", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8sErrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, testConfigmap, fmt.Errorf("changed"))
+	})
+	locationData.PublicKey = []byte("third")
+	assert.Equal(t, types.ErrRevisionConflict, store.UpdateLocation(locationData))
+	stored, err := store.ReadLocation("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(stored.GetPublicKey()))
+}
+
+func TestConfigmapKeyStore(t *testing.T) {
+	_, store := newTestStore()
+	keystoretest.TestKeyStore(t, store)
+}
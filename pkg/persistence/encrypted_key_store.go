@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package persistence
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence/kek"
+	"github.com/theotw/natssync/pkg/persistence/natskv"
+	"github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+// ENCRYPTED_PRIVATE_KEY_PEM_TYPE the PEM type of a private key encrypted by an EncryptedKeyStore
+const ENCRYPTED_PRIVATE_KEY_PEM_TYPE = "NATSSYNC ENCRYPTED PRIVATE KEY"
+
+// kekPEMHeader names the KEK that encrypted the private key
+const kekPEMHeader = "KEK"
+
+var ErrUnknownKEK = errors.New("private key was encrypted with a KEK that is not configured")
+
+// EncryptedKeyStore encrypts the private keys of the records it writes to the wrapped keystore and decrypts them
+// again when they are read.  Records written before it was turned on are read as they are until
+// MigrateKeyEncryption encrypts them
+type EncryptedKeyStore struct {
+	store LocationKeyStore
+	kek   kek.KeyEncrypter
+	// previous KEKs that are only used to decrypt, MigrateKeyEncryption moves their records to kek
+	previous []kek.KeyEncrypter
+}
+
+func NewEncryptedKeyStore(store LocationKeyStore, current kek.KeyEncrypter, previous ...kek.KeyEncrypter) *EncryptedKeyStore {
+	return &EncryptedKeyStore{store: store, kek: current, previous: previous}
+}
+
+// newKeyEncrypter the KEK from KEYSTORE_KEK_FILE, KEYSTORE_KEK_PASSPHRASE or KEYSTORE_KEK_KMS, nil if none is set
+func newKeyEncrypter(fileName, passphrase, kmsURL string) (kek.KeyEncrypter, error) {
+	set := 0
+	for _, val := range []string{fileName, passphrase, kmsURL} {
+		if len(val) > 0 {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return nil, fmt.Errorf("only one of the KEK file, passphrase or KMS can be set")
+	case len(fileName) > 0:
+		return kek.NewFileKeyEncrypter(fileName)
+	case len(passphrase) > 0:
+		return kek.NewPassphraseKeyEncrypter(passphrase)
+	case len(kmsURL) > 0:
+		return kek.OpenKMS(kmsURL)
+	}
+	return nil, nil
+}
+
+// wrapWithKeyEncryption wraps the keystore in an EncryptedKeyStore if a KEK is configured
+func wrapWithKeyEncryption(store LocationKeyStore) (LocationKeyStore, error) {
+	current, err := newKeyEncrypter(pkg.Config.KeystoreKEKFile, pkg.Config.KeystoreKEKPassphrase, pkg.Config.KeystoreKEKKMS)
+	if err != nil || current == nil {
+		return store, err
+	}
+	previous, err := newKeyEncrypter(pkg.Config.KeystoreKEKPreviousFile, pkg.Config.KeystoreKEKPreviousPassphrase, "")
+	if err != nil {
+		return nil, err
+	}
+	var ret *EncryptedKeyStore
+	if previous != nil {
+		ret = NewEncryptedKeyStore(store, current, previous)
+	} else {
+		ret = NewEncryptedKeyStore(store, current)
+	}
+	log.WithField("kek", current.ID()).Info("Encrypting keystore private keys")
+
+	if pkg.Config.KeystoreKEKMigrate {
+		count, err := MigrateKeyEncryption(ret)
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("count", count).Info("Encrypted the keystore private keys")
+	}
+	return ret, nil
+}
+
+// associatedData binds the cipher text to the key pair, so it can not be moved to another record
+func associatedData(locationData *types.LocationData) []byte {
+	return []byte(locationData.KeyID)
+}
+
+// encryptedKEK the ID of the KEK the private key was encrypted with, empty if it is not encrypted
+func encryptedKEK(privateKey []byte) string {
+	block, _ := pem.Decode(privateKey)
+	if block == nil || block.Type != ENCRYPTED_PRIVATE_KEY_PEM_TYPE {
+		return ""
+	}
+	return block.Headers[kekPEMHeader]
+}
+
+// encrypt a copy of the record with its private key encrypted, the caller's record is left alone
+func (e *EncryptedKeyStore) encrypt(locationData *types.LocationData) (*types.LocationData, error) {
+	ret := *locationData
+	if len(ret.PrivateKey) == 0 || len(encryptedKEK(ret.PrivateKey)) > 0 {
+		return &ret, nil
+	}
+	cipherText, err := e.kek.Encrypt(ret.PrivateKey, associatedData(&ret))
+	if err != nil {
+		return nil, err
+	}
+	ret.PrivateKey = pem.EncodeToMemory(&pem.Block{
+		Type:    ENCRYPTED_PRIVATE_KEY_PEM_TYPE,
+		Headers: map[string]string{kekPEMHeader: e.kek.ID()},
+		Bytes:   cipherText,
+	})
+	return &ret, nil
+}
+
+// decrypt the record's private key in place, records that are not encrypted are left as they are
+func (e *EncryptedKeyStore) decrypt(locationData *types.LocationData) error {
+	if locationData == nil || len(encryptedKEK(locationData.PrivateKey)) == 0 {
+		return nil
+	}
+	block, _ := pem.Decode(locationData.PrivateKey)
+	kekID := block.Headers[kekPEMHeader]
+	for _, keyEncrypter := range append([]kek.KeyEncrypter{e.kek}, e.previous...) {
+		if keyEncrypter.ID() != kekID {
+			continue
+		}
+		plain, err := keyEncrypter.Decrypt(block.Bytes, associatedData(locationData))
+		if err != nil {
+			continue
+		}
+		locationData.PrivateKey = plain
+		return nil
+	}
+	log.WithField("kek", kekID).WithField("keyID", locationData.KeyID).Error("Unable to decrypt the private key")
+	return ErrUnknownKEK
+}
+
+func (e *EncryptedKeyStore) ReadKeyPair(keyID string) (*types.LocationData, error) {
+	locationData, err := e.store.ReadKeyPair(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.decrypt(locationData); err != nil {
+		return nil, err
+	}
+	return locationData, nil
+}
+
+func (e *EncryptedKeyStore) WriteKeyPair(locationData *types.LocationData) error {
+	encrypted, err := e.encrypt(locationData)
+	if err != nil {
+		return err
+	}
+	return e.store.WriteKeyPair(encrypted)
+}
+
+func (e *EncryptedKeyStore) RemoveKeyPair(keyID string) error {
+	return e.store.RemoveKeyPair(keyID)
+}
+
+func (e *EncryptedKeyStore) LoadLocationID(keyID string) string {
+	return e.store.LoadLocationID(keyID)
+}
+
+func (e *EncryptedKeyStore) WriteLocation(locationData types.LocationData) error {
+	encrypted, err := e.encrypt(&locationData)
+	if err != nil {
+		return err
+	}
+	return e.store.WriteLocation(*encrypted)
+}
+
+func (e *EncryptedKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	encrypted, err := e.encrypt(locationData)
+	if err != nil {
+		return err
+	}
+	if err = e.store.UpdateLocation(encrypted); err != nil {
+		return err
+	}
+	locationData.Revision = encrypted.Revision
+	return nil
+}
+
+func (e *EncryptedKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	locationData, err := e.store.ReadLocation(locationID)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.decrypt(locationData); err != nil {
+		return nil, err
+	}
+	return locationData, nil
+}
+
+func (e *EncryptedKeyStore) RemoveLocation(locationID string) error {
+	return e.store.RemoveLocation(locationID)
+}
+
+func (e *EncryptedKeyStore) RemoveCloudMasterData() error {
+	return e.store.RemoveCloudMasterData()
+}
+
+func (e *EncryptedKeyStore) ListKnownClients() ([]string, error) {
+	return e.store.ListKnownClients()
+}
+
+func (e *EncryptedKeyStore) GetExistingKeys() ([]*utils.UUIDv1, error) {
+	cleanup, ok := e.store.(CleanupKeysInterface)
+	if !ok {
+		return nil, fmt.Errorf("keystore can not list its keys")
+	}
+	return cleanup.GetExistingKeys()
+}
+
+func (e *EncryptedKeyStore) GetLatestKeyID() (string, error) {
+	cleanup, ok := e.store.(CleanupKeysInterface)
+	if !ok {
+		return "", fmt.Errorf("keystore can not list its keys")
+	}
+	return cleanup.GetLatestKeyID()
+}
+
+// OnChange registers the handler with the wrapped keystore, if it reports changes
+func (e *EncryptedKeyStore) OnChange(handler natskv.ChangeHandler) {
+	if notifier, ok := e.store.(ChangeNotifier); ok {
+		notifier.OnChange(handler)
+	}
+}
+
+func (e *EncryptedKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	page, err := ListLocations(e.store, query)
+	if err != nil {
+		return nil, err
+	}
+	for i := range page.Locations {
+		if err = e.decrypt(&page.Locations[i]); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// maxMigrateAttempts how many times a location is migrated again when another writer changed it first
+const maxMigrateAttempts = 5
+
+// MigrateKeyEncryption encrypts every private key in the keystore that is not encrypted with the current KEK,
+// returns how many records it rewrote.  Records are rewritten in place, never removed, so a failed write leaves the
+// old record readable.  It is safe to run again and from several servers at once, key pairs do not change once they
+// are written and locations are updated on their revision, a location another server changed first is read again
+func MigrateKeyEncryption(e *EncryptedKeyStore) (int, error) {
+	count := 0
+	needsMigration := func(locationData *types.LocationData) bool {
+		return len(locationData.PrivateKey) > 0 && encryptedKEK(locationData.PrivateKey) != e.kek.ID()
+	}
+
+	if cleanup, ok := e.store.(CleanupKeysInterface); ok {
+		keyIDs, err := cleanup.GetExistingKeys()
+		if err != nil {
+			return count, err
+		}
+		for _, keyID := range keyIDs {
+			if keyID == nil {
+				continue
+			}
+			locationData, err := e.store.ReadKeyPair(keyID.String())
+			if err != nil {
+				return count, err
+			}
+			if !needsMigration(locationData) {
+				continue
+			}
+			if err = e.decrypt(locationData); err != nil {
+				return count, err
+			}
+			encrypted, err := e.encrypt(locationData)
+			if err != nil {
+				return count, err
+			}
+			if err = e.store.WriteKeyPair(encrypted); err != nil {
+				return count, err
+			}
+			count++
+		}
+	} else {
+		log.Warn("Keystore can not list its key pairs, only locations were migrated")
+	}
+
+	locationIDs, err := e.store.ListKnownClients()
+	if err != nil {
+		return count, err
+	}
+	for _, locationID := range locationIDs {
+		migrated, err := e.migrateLocation(locationID, needsMigration)
+		if err != nil {
+			return count, err
+		}
+		if migrated {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// migrateLocation re-encrypts the location if it needs it, returns false if it did not
+func (e *EncryptedKeyStore) migrateLocation(locationID string, needsMigration func(*types.LocationData) bool) (bool, error) {
+	for attempt := 0; attempt < maxMigrateAttempts; attempt++ {
+		locationData, err := e.store.ReadLocation(locationID)
+		if err != nil {
+			return false, err
+		}
+		if !needsMigration(locationData) {
+			return false, nil
+		}
+		if err = e.decrypt(locationData); err != nil {
+			return false, err
+		}
+		encrypted, err := e.encrypt(locationData)
+		if err != nil {
+			return false, err
+		}
+		err = e.store.UpdateLocation(encrypted)
+		if errors.Is(err, types.ErrRevisionConflict) {
+			log.WithField("locationID", locationID).Debug("Location changed while it was being migrated, trying again")
+			continue
+		}
+		return err == nil, err
+	}
+	return false, types.ErrRevisionConflict
+}
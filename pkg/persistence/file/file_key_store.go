@@ -11,6 +11,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -30,6 +31,8 @@ type FileKeyStore struct {
 	cleanupTTL      time.Duration
 
 	basePath string
+	// locationLock keeps an update's read and write of a location together
+	locationLock sync.Mutex
 }
 
 func NewFileKeyStore(basePath string) (*FileKeyStore, error) {
@@ -150,7 +153,12 @@ func (t *FileKeyStore) LoadLocationID(keyID string) string {
 }
 
 func (t *FileKeyStore) WriteLocation(locationData types.LocationData) error {
+	t.locationLock.Lock()
+	defer t.locationLock.Unlock()
+	return t.writeLocation(&locationData)
+}
 
+func (t *FileKeyStore) writeLocation(locationData *types.LocationData) error {
 	locationFile := t.makeLocationDataFileName(locationData.GetLocationID())
 
 	data, err := json.Marshal(locationData)
@@ -160,6 +168,31 @@ func (t *FileKeyStore) WriteLocation(locationData types.LocationData) error {
 	return t.writeFile(locationFile, data)
 }
 
+// UpdateLocation the revision is checked under a lock held by this process, the file store is not shared between
+// replicas
+func (t *FileKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	t.locationLock.Lock()
+	defer t.locationLock.Unlock()
+
+	stored, err := t.ReadLocation(locationData.GetLocationID())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return types.ErrRevisionConflict
+		}
+		return err
+	}
+	if stored.Revision != locationData.Revision {
+		return types.ErrRevisionConflict
+	}
+	updated := *locationData
+	updated.Revision++
+	if err = t.writeLocation(&updated); err != nil {
+		return err
+	}
+	locationData.Revision = updated.Revision
+	return nil
+}
+
 func (t *FileKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
 	locationFile := t.makeLocationDataFileName(locationID)
 	locationDataBytes, err := t.readFile(locationFile)
@@ -184,6 +217,8 @@ func (t *FileKeyStore) removeLocationData(locationID string, allowCloudMaster bo
 		return err
 	}
 
+	t.locationLock.Lock()
+	defer t.locationLock.Unlock()
 	filename := t.makeLocationDataFileName(locationID)
 	if err = t.removeFile(filename); err != nil {
 		return err
@@ -218,17 +253,30 @@ func (t *FileKeyStore) ListKnownClients() ([]string, error) {
 	return ret, nil
 }
 
+// writeFile writes a temp file and renames it over the old one, so a crash leaves either the old or the new file
 func (t *FileKeyStore) writeFile(fileName string, buf []byte) error {
 	pathToFile := path.Join(t.basePath, fileName)
 	log.Tracef("Writing to file %s", pathToFile)
-	keyFile, err := os.Create(pathToFile)
+	keyFile, err := ioutil.TempFile(t.basePath, fileName+".tmp")
 	if err != nil {
 		log.Errorf("Unable to open key file %s \n", err.Error())
 		return err
 	}
+	defer os.Remove(keyFile.Name())
 
-	defer keyFile.Close()
 	_, err = keyFile.Write(buf)
+	if err == nil {
+		err = keyFile.Sync()
+	}
+	if closeErr := keyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(keyFile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(keyFile.Name(), pathToFile)
+	}
 	if err != nil {
 		log.Errorf("Unable to write key file %s \n", err.Error())
 		return err
@@ -14,7 +14,9 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/persistence"
 	"github.com/theotw/natssync/pkg/persistence/file"
+	"github.com/theotw/natssync/pkg/persistence/keystoretest"
 	types "github.com/theotw/natssync/pkg/types"
 	_ "github.com/theotw/natssync/tests/unit"
 )
@@ -47,7 +49,9 @@ func TestFileKeyStore(t *testing.T) {
 		{"Remove Keypair", testFileKeystoreRemoveKeyPair},
 		{"Write Location", testFileKeyStoreWriteLocation},
 		{"Read Location", testFileKeyStoreReadLocation},
+		{"Update Location", func(t *testing.T, keystore *file.FileKeyStore) { keystoretest.TestUpdateLocation(t, keystore) }},
 		{"List Clients", testFileKeyStoreListKnownClients},
+		{"List Locations", testFileKeyStoreListLocations},
 		{"Remove Location", testFileKeystoreRemoveLocation},
 		{"Remove Cloud Master Data", testFileKeystoreRemoveCloudMasterData},
 	}
@@ -113,7 +117,6 @@ func testFileKeyStoreReadLocation(t *testing.T, keystore *file.FileKeyStore) {
 	assert.Error(t, err)
 	assert.Nil(t, locationData)
 }
-
 func testFileKeyStoreListKnownClients(t *testing.T, keystore *file.FileKeyStore) {
 	expectedClients := []string{"foo"}
 	clients, err := keystore.ListKnownClients()
@@ -121,6 +124,27 @@ func testFileKeyStoreListKnownClients(t *testing.T, keystore *file.FileKeyStore)
 	assert.Equal(t, expectedClients, clients)
 }
 
+func testFileKeyStoreListLocations(t *testing.T, keystore *file.FileKeyStore) {
+	selector, err := types.ParseSelector("foo=bar")
+	assert.Nil(t, err)
+	query, err := types.NewLocationQuery(selector, types.LOCATION_SORT_CREATED, true, 10, "")
+	assert.Nil(t, err)
+	page, err := persistence.ListLocations(keystore, query)
+	assert.Nil(t, err)
+	if assert.Len(t, page.Locations, 1) {
+		assert.Equal(t, "foo", page.Locations[0].GetLocationID())
+	}
+	assert.Empty(t, page.NextCursor)
+
+	selector, err = types.ParseSelector("foo notin (bar)")
+	assert.Nil(t, err)
+	query, err = types.NewLocationQuery(selector, "", false, 0, "")
+	assert.Nil(t, err)
+	page, err = persistence.ListLocations(keystore, query)
+	assert.Nil(t, err)
+	assert.Empty(t, page.Locations)
+}
+
 func testFileKeystoreRemoveLocation(t *testing.T, keystore *file.FileKeyStore) {
 	err := keystore.RemoveLocation("foo")
 	assert.Nil(t, err)
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package kek key encryption keys that protect the private keys a keystore holds
+package kek
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const kekSize = 32
+
+// scrypt cost parameters for passphrase KEKs
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+// passphraseIDSalt the fixed salt of the key the passphrase ID is a fingerprint of, it is never used to encrypt
+const passphraseIDSalt = "natssync kek id"
+
+var ErrInvalidCipherText = errors.New("invalid encrypted key")
+
+// KeyEncrypter encrypts private key material with a key encryption key.  The associated data is authenticated but
+// not encrypted, it binds the cipher text to the record it is stored in.  KMS plugins implement it so the KEK never
+// leaves the KMS
+type KeyEncrypter interface {
+	// ID names the KEK, it is stored with every cipher text so the right KEK can be found to decrypt it
+	ID() string
+	Encrypt(plain []byte, associatedData []byte) ([]byte, error)
+	Decrypt(cipherText []byte, associatedData []byte) ([]byte, error)
+}
+
+// KMSOpener opens a KMS from the rest of its KEYSTORE_KEK_KMS URL after the scheme
+type KMSOpener func(uri string) (KeyEncrypter, error)
+
+var kmsLock sync.Mutex
+var kmsOpeners = map[string]KMSOpener{
+	LOCAL_KMS_SCHEME: openLocalKMS,
+}
+
+// RegisterKMS makes a KMS available to KEYSTORE_KEK_KMS URLs with the scheme
+func RegisterKMS(scheme string, opener KMSOpener) {
+	kmsLock.Lock()
+	defer kmsLock.Unlock()
+	kmsOpeners[scheme] = opener
+}
+
+// OpenKMS the KMS for a scheme://uri URL
+func OpenKMS(kmsURL string) (KeyEncrypter, error) {
+	parts := strings.SplitN(kmsURL, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid KMS URL, expected scheme://")
+	}
+	kmsLock.Lock()
+	opener, ok := kmsOpeners[parts[0]]
+	kmsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported KMS %s", parts[0])
+	}
+	return opener(parts[1])
+}
+
+// aesKeyEncrypter AES-256-GCM with a fixed KEK, the cipher text is the nonce followed by the sealed data
+type aesKeyEncrypter struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newAESKeyEncrypter(id string, kek []byte) (*aesKeyEncrypter, error) {
+	if len(kek) != kekSize {
+		return nil, fmt.Errorf("the KEK must be %d bytes", kekSize)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesKeyEncrypter{id: id, aead: aead}, nil
+}
+
+// NewFileKeyEncrypter a KEK read from a file, holding 32 raw bytes or their base64 or hex encoding
+func NewFileKeyEncrypter(fileName string) (KeyEncrypter, error) {
+	bits, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := decodeKEK(bits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KEK in %s: %v", fileName, err)
+	}
+	// the ID tells KEKs apart without giving anything about them away
+	fingerprint := sha256.Sum256(kek)
+	return newAESKeyEncrypter("file:"+hex.EncodeToString(fingerprint[:8]), kek)
+}
+
+func decodeKEK(bits []byte) ([]byte, error) {
+	if len(bits) == kekSize {
+		return bits, nil
+	}
+	text := strings.TrimSpace(string(bits))
+	if kek, err := base64.StdEncoding.DecodeString(text); err == nil && len(kek) == kekSize {
+		return kek, nil
+	}
+	if kek, err := hex.DecodeString(text); err == nil && len(kek) == kekSize {
+		return kek, nil
+	}
+	return nil, fmt.Errorf("expected %d bytes, raw, base64 or hex", kekSize)
+}
+
+func (e *aesKeyEncrypter) ID() string {
+	return e.id
+}
+
+func (e *aesKeyEncrypter) Encrypt(plain []byte, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plain)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plain, associatedData), nil
+}
+
+func (e *aesKeyEncrypter) Decrypt(cipherText []byte, associatedData []byte) ([]byte, error) {
+	if len(cipherText) < e.aead.NonceSize() {
+		return nil, ErrInvalidCipherText
+	}
+	nonce := cipherText[:e.aead.NonceSize()]
+	plain, err := e.aead.Open(nil, nonce, cipherText[e.aead.NonceSize():], associatedData)
+	if err != nil {
+		return nil, ErrInvalidCipherText
+	}
+	return plain, nil
+}
+
+// passphraseKeyEncrypter derives the KEK from a passphrase with scrypt.  Each process picks a random salt for what
+// it writes, the salt is stored in front of the cipher text and the keys derived for each salt are remembered
+type passphraseKeyEncrypter struct {
+	id         string
+	passphrase []byte
+	salt       []byte
+
+	lock    sync.Mutex
+	derived map[string]*aesKeyEncrypter
+}
+
+// NewPassphraseKeyEncrypter a KEK derived from a passphrase
+func NewPassphraseKeyEncrypter(passphrase string) (KeyEncrypter, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("the KEK passphrase is empty")
+	}
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	// the ID tells passphrases apart, so a new one can be rotated to, without making them any easier to guess
+	idKey, err := scrypt.Key([]byte(passphrase), []byte(passphraseIDSalt), scryptN, scryptR, scryptP, kekSize)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(idKey)
+	return &passphraseKeyEncrypter{
+		id:         "passphrase:" + hex.EncodeToString(fingerprint[:8]),
+		passphrase: []byte(passphrase),
+		salt:       salt,
+		derived:    make(map[string]*aesKeyEncrypter),
+	}, nil
+}
+
+func (e *passphraseKeyEncrypter) ID() string {
+	return e.id
+}
+
+func (e *passphraseKeyEncrypter) keyForSalt(salt []byte) (*aesKeyEncrypter, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if ret, ok := e.derived[string(salt)]; ok {
+		return ret, nil
+	}
+	kek, err := scrypt.Key(e.passphrase, salt, scryptN, scryptR, scryptP, kekSize)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := newAESKeyEncrypter(e.ID(), kek)
+	if err != nil {
+		return nil, err
+	}
+	e.derived[string(salt)] = ret
+	return ret, nil
+}
+
+func (e *passphraseKeyEncrypter) Encrypt(plain []byte, associatedData []byte) ([]byte, error) {
+	key, err := e.keyForSalt(e.salt)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := key.Encrypt(plain, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, e.salt...), cipherText...), nil
+}
+
+func (e *passphraseKeyEncrypter) Decrypt(cipherText []byte, associatedData []byte) ([]byte, error) {
+	if len(cipherText) < scryptSaltLen {
+		return nil, ErrInvalidCipherText
+	}
+	key, err := e.keyForSalt(cipherText[:scryptSaltLen])
+	if err != nil {
+		return nil, err
+	}
+	return key.Decrypt(cipherText[scryptSaltLen:], associatedData)
+}
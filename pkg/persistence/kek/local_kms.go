@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package kek
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// LOCAL_KMS_SCHEME an in process stand in for a KMS, localkms://name.  Its KEKs only live as long as the process so
+// it is for tests and trying things out, not production
+const LOCAL_KMS_SCHEME = "localkms"
+
+var localKMSLock sync.Mutex
+var localKMSKeys = make(map[string]*aesKeyEncrypter)
+
+// openLocalKMS every open of the same name in a process gets the same KEK
+func openLocalKMS(name string) (KeyEncrypter, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("the local KMS needs a key name, localkms://name")
+	}
+	localKMSLock.Lock()
+	defer localKMSLock.Unlock()
+	if ret, ok := localKMSKeys[name]; ok {
+		return ret, nil
+	}
+	kek := make([]byte, kekSize)
+	if _, err := rand.Read(kek); err != nil {
+		return nil, err
+	}
+	ret, err := newAESKeyEncrypter(LOCAL_KMS_SCHEME+":"+name, kek)
+	if err != nil {
+		return nil, err
+	}
+	localKMSKeys[name] = ret
+	return ret, nil
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+// Package keystoretest the conformance tests every keystore backend runs
+package keystoretest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+// KeyStore the methods of persistence.LocationKeyStore.  They are repeated here because persistence imports every
+// backend, so the backends could not use this package in their own tests
+type KeyStore interface {
+	ReadKeyPair(KeyID string) (*types.LocationData, error)
+	WriteKeyPair(locationData *types.LocationData) error
+	RemoveKeyPair(KeyID string) error
+	LoadLocationID(KeyID string) string
+	WriteLocation(locationData types.LocationData) error
+	UpdateLocation(locationData *types.LocationData) error
+	ReadLocation(locationID string) (*types.LocationData, error)
+	RemoveLocation(locationID string) error
+	RemoveCloudMasterData() error
+	ListKnownClients() ([]string, error)
+}
+
+// keyLister persistence.CleanupKeysInterface, checked when the keystore has it
+type keyLister interface {
+	GetExistingKeys() ([]*utils.UUIDv1, error)
+	GetLatestKeyID() (string, error)
+}
+
+// locationLister persistence.LocationLister, checked when the keystore has it
+type locationLister interface {
+	ListLocations(query *types.LocationQuery) (*types.LocationPage, error)
+}
+
+// TestKeyStore the behavior every keystore has to share, run against an empty keystore
+func TestKeyStore(t *testing.T, store KeyStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store KeyStore)
+	}{
+		{"Write Keypair", testWriteKeyPair},
+		{"Read Keypair", testReadKeyPair},
+		{"Get LocationID", testGetLocationID},
+		{"Existing Keys", testExistingKeys},
+		{"Remove Keypair", testRemoveKeyPair},
+		{"Write Location", testWriteLocation},
+		{"Read Location", testReadLocation},
+		{"Update Location", TestUpdateLocation},
+		{"List Clients", testListKnownClients},
+		{"List Locations", testListLocations},
+		{"Remove Location", testRemoveLocation},
+		{"Remove Cloud Master Data", testRemoveCloudMasterData},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, store)
+		})
+	}
+}
+
+func testWriteKeyPair(t *testing.T, store KeyStore) {
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("id-%d", i)
+		pubkey := fmt.Sprintf("pubkey%d", i)
+		privkey := fmt.Sprintf("privkey%d", i)
+		locationData, err := types.NewLocationData(id, []byte(pubkey), []byte(privkey), nil)
+		assert.Nil(t, err)
+		err = store.WriteKeyPair(locationData)
+		assert.Nil(t, err)
+	}
+}
+
+func testReadKeyPair(t *testing.T, store KeyStore) {
+	locationData, err := store.ReadKeyPair("")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "pubkey2", string(locationData.GetPublicKey()))
+	assert.Equal(t, "privkey2", string(locationData.GetPrivateKey()))
+
+	same, err := store.ReadKeyPair(locationData.KeyID)
+	assert.Nil(t, err)
+	assert.Equal(t, locationData, same)
+}
+
+func testGetLocationID(t *testing.T, store KeyStore) {
+	id := store.LoadLocationID("")
+	assert.Equal(t, "id-2", id)
+}
+
+func testExistingKeys(t *testing.T, store KeyStore) {
+	lister, ok := store.(keyLister)
+	if !ok {
+		t.Skip("the keystore can not list its keys")
+	}
+	keys, err := lister.GetExistingKeys()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+
+	latest, err := lister.GetLatestKeyID()
+	assert.Nil(t, err)
+	locationData, err := store.ReadKeyPair("")
+	if assert.Nil(t, err) {
+		assert.Equal(t, locationData.KeyID, latest)
+	}
+}
+
+func testRemoveKeyPair(t *testing.T, store KeyStore) {
+	err := store.RemoveKeyPair("")
+	assert.Nil(t, err)
+	assert.Equal(t, "id-1", store.LoadLocationID(""))
+}
+
+func testWriteLocation(t *testing.T, store KeyStore) {
+	locationData := types.LocationData{
+		LocationID: "foo",
+		PublicKey:  []byte("This is definitely a key"),
+		Metadata:   map[string]string{"foo": "bar", "old": "gone"},
+	}
+	err := store.WriteLocation(locationData)
+	assert.Nil(t, err)
+
+	// writing again replaces the location and its metadata
+	locationData.PublicKey = []byte("This is definitely a new key")
+	locationData.Metadata = map[string]string{"foo": "bar"}
+	err = store.WriteLocation(locationData)
+	assert.Nil(t, err)
+}
+
+func testReadLocation(t *testing.T, store KeyStore) {
+	locationData, err := store.ReadLocation("foo")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "This is definitely a new key", string(locationData.GetPublicKey()))
+		assert.Equal(t, map[string]string{"foo": "bar"}, locationData.GetMetadata())
+	}
+	locationData, err = store.ReadLocation("foo2")
+	assert.Error(t, err)
+	assert.Nil(t, locationData)
+}
+
+func testListKnownClients(t *testing.T, store KeyStore) {
+	clients, err := store.ListKnownClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, clients)
+}
+
+func testListLocations(t *testing.T, store KeyStore) {
+	lister, ok := store.(locationLister)
+	if !ok {
+		t.Skip("the keystore does not list locations itself")
+	}
+	selector, err := types.ParseSelector("foo=bar")
+	assert.Nil(t, err)
+	query, err := types.NewLocationQuery(selector, types.LOCATION_SORT_CREATED, true, 10, "")
+	assert.Nil(t, err)
+	page, err := lister.ListLocations(query)
+	if assert.Nil(t, err) && assert.Len(t, page.Locations, 1) {
+		assert.Equal(t, "foo", page.Locations[0].GetLocationID())
+		assert.Empty(t, page.NextCursor)
+	}
+
+	selector, err = types.ParseSelector("foo notin (bar)")
+	assert.Nil(t, err)
+	query, err = types.NewLocationQuery(selector, "", false, 0, "")
+	assert.Nil(t, err)
+	page, err = lister.ListLocations(query)
+	if assert.Nil(t, err) {
+		assert.Empty(t, page.Locations)
+	}
+}
+
+func testRemoveLocation(t *testing.T, store KeyStore) {
+	err := store.RemoveLocation("foo")
+	assert.Nil(t, err)
+	err = store.RemoveLocation("foo")
+	assert.Error(t, err)
+	err = store.RemoveLocation(pkg.CLOUD_ID)
+	assert.Error(t, err)
+	_, err = store.ReadLocation("foo")
+	assert.Error(t, err)
+}
+
+func testRemoveCloudMasterData(t *testing.T, store KeyStore) {
+	locationData := types.LocationData{
+		LocationID: pkg.CLOUD_ID,
+		PublicKey:  []byte("somekey"),
+	}
+	err := store.WriteLocation(locationData)
+	assert.Nil(t, err)
+	err = store.RemoveCloudMasterData()
+	assert.Nil(t, err)
+
+	lData, err := store.ReadLocation(pkg.CLOUD_ID)
+	assert.Error(t, err)
+	assert.Nil(t, lData)
+}
+
+// TestUpdateLocation an update of a revision that was already replaced must fail with types.ErrRevisionConflict and
+// leave the stored location alone.  The location it uses is removed again
+func TestUpdateLocation(t *testing.T, store KeyStore) {
+	const locationID = "update-test"
+	assert.Nil(t, store.WriteLocation(types.LocationData{
+		LocationID: locationID,
+		PublicKey:  []byte("This is definitely a key"),
+		Metadata:   map[string]string{"foo": "bar"},
+	}))
+	defer func() {
+		assert.Nil(t, store.RemoveLocation(locationID))
+	}()
+
+	locationData, err := store.ReadLocation(locationID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	stale := *locationData
+	locationData.SetForcedKeypairRotation()
+	assert.Nil(t, store.UpdateLocation(locationData))
+	assert.Equal(t, stale.Revision+1, locationData.Revision)
+
+	// an update of the revision that was replaced is refused
+	stale.SetMetadata(map[string]string{"foo": "baz"})
+	assert.Equal(t, types.ErrRevisionConflict, store.UpdateLocation(&stale))
+	stored, err := store.ReadLocation(locationID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, locationData.Revision, stored.Revision)
+	assert.True(t, stored.GetForceKeypairRotation())
+	assert.Equal(t, map[string]string{"foo": "bar"}, stored.GetMetadata())
+
+	// the next revision goes through
+	stored.SetMetadata(map[string]string{"foo": "baz"})
+	assert.Nil(t, store.UpdateLocation(stored))
+	assert.Equal(t, locationData.Revision+1, stored.Revision)
+
+	assert.Equal(t, types.ErrRevisionConflict, store.UpdateLocation(&types.LocationData{LocationID: locationID + "2"}))
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
@@ -78,8 +79,9 @@ func (m *MongoKeyStore) WriteKeyPair(locationData *types.LocationData) error {
 		"keyID":      locationData.KeyID,
 	}).Tracef("Saving key pair")
 
+	// replaced if it is already there, so a key pair can be rewritten without removing it first
 	collection := m.getKeyPairCollection()
-	_, err := collection.InsertOne(context.TODO(), locationData)
+	_, err := collection.ReplaceOne(context.TODO(), bson.M{"keyID": locationData.KeyID}, locationData, options.Replace().SetUpsert(true))
 	return err
 }
 
@@ -196,6 +198,30 @@ func (m *MongoKeyStore) WriteLocation(data types.LocationData) error {
 	return err
 }
 
+// UpdateLocation replaces the document only if it still has the revision, documents written before revisions were
+// added have none and match revision 0
+func (m *MongoKeyStore) UpdateLocation(data *types.LocationData) error {
+	log.Tracef("Mongo update location '%s' revision %d", data.GetLocationID(), data.Revision)
+
+	var revision interface{} = data.Revision
+	if data.Revision == 0 {
+		revision = bson.M{"$in": bson.A{0, nil}}
+	}
+	filter := bson.M{"locationID": data.GetLocationID(), "revision": revision}
+	updated := *data
+	updated.Revision++
+	result, err := m.getLocationsCollection().ReplaceOne(context.TODO(), filter, updated)
+	if err != nil {
+		log.WithError(err).Errorf("Error updating mongo record %s", data.GetLocationID())
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return types.ErrRevisionConflict
+	}
+	data.Revision = updated.Revision
+	return nil
+}
+
 func (m *MongoKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
 	log.Tracef("Mongo get public key for '%s'", locationID)
 	collection := m.getLocationsCollection()
@@ -259,6 +285,143 @@ func (m *MongoKeyStore) ListKnownClients() ([]string, error) {
 	return locationIDs, nil
 }
 
+// ListLocations filters, sorts and pages in the query, so only the page is read
+func (m *MongoKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	filter, err := newLocationFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	direction := 1
+	if query.Descending {
+		direction = -1
+	}
+	sortFields := bson.D{bson.E{Key: "locationID", Value: direction}}
+	if query.SortBy != types.LOCATION_SORT_ID {
+		sortFields = bson.D{bson.E{Key: query.SortBy, Value: direction}, bson.E{Key: "locationID", Value: direction}}
+	}
+	findOptions := options.Find().SetSort(sortFields)
+	if query.Limit > 0 {
+		// one more than the limit says if there is a next page
+		findOptions.SetLimit(int64(query.Limit + 1))
+	}
+
+	cur, err := m.getLocationsCollection().Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := cur.Close(context.TODO()); err != nil {
+			log.Errorf("Error closing cursor: %s", err)
+		}
+	}()
+	locations := make([]types.LocationData, 0)
+	if err = cur.All(context.TODO(), &locations); err != nil {
+		return nil, err
+	}
+	return types.NewLocationPage(locations, query), nil
+}
+
+// newLocationFilter the selector and cursor of the query.  A selector key is a dotted path under metadata, unless the
+// key has a dot in it.  Mongo would read that path as nested documents, so those keys are read with $getField, which
+// needs MongoDB 5.0 or later
+func newLocationFilter(query *types.LocationQuery) (bson.M, error) {
+	matches := bson.A{}
+	exprs := bson.A{}
+	for _, req := range query.Selector {
+		if strings.Contains(req.Key, ".") {
+			cond, err := newMetadataExpr(req)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, cond)
+			continue
+		}
+		cond, err := newMetadataMatch(req)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, bson.M{"metadata." + req.Key: cond})
+	}
+	ret := bson.M{}
+	if len(matches) > 0 {
+		ret["$and"] = matches
+	}
+	if len(exprs) > 0 {
+		ret["$expr"] = bson.M{"$and": exprs}
+	}
+
+	cursor, err := query.ParseCursor()
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		after := "$gt"
+		if query.Descending {
+			after = "$lt"
+		}
+		if query.SortBy == types.LOCATION_SORT_ID {
+			ret["locationID"] = bson.M{after: cursor.LocationID}
+		} else {
+			sortValue := types.SortValueTime(cursor.SortValue)
+			var equal interface{} = sortValue
+			if sortValue.IsZero() {
+				// records from before the field was added do not have it, they sort with the zero time
+				equal = bson.M{"$in": bson.A{sortValue, nil}}
+			}
+			or := bson.A{
+				bson.M{query.SortBy: bson.M{after: sortValue}},
+				bson.M{query.SortBy: equal, "locationID": bson.M{after: cursor.LocationID}},
+			}
+			if query.Descending && !sortValue.IsZero() {
+				or = append(or, bson.M{query.SortBy: nil})
+			}
+			ret["$or"] = or
+		}
+	}
+	return ret, nil
+}
+
+// newMetadataMatch the query operator of a requirement on a metadata field.  $ne and $nin match documents without the
+// field, the same as the selector
+func newMetadataMatch(req types.SelectorRequirement) (bson.M, error) {
+	switch req.Operator {
+	case types.SELECTOR_EQUALS:
+		return bson.M{"$eq": req.Values[0]}, nil
+	case types.SELECTOR_NOT_EQUALS:
+		return bson.M{"$ne": req.Values[0]}, nil
+	case types.SELECTOR_IN:
+		return bson.M{"$in": req.Values}, nil
+	case types.SELECTOR_NOT_IN:
+		return bson.M{"$nin": req.Values}, nil
+	case types.SELECTOR_EXISTS:
+		return bson.M{"$exists": true}, nil
+	case types.SELECTOR_DOES_NOT_EXIST:
+		return bson.M{"$exists": false}, nil
+	}
+	return nil, fmt.Errorf("unsupported selector operator %s", req.Operator)
+}
+
+// newMetadataExpr the aggregation expression of a requirement on a metadata key with a dot in it
+func newMetadataExpr(req types.SelectorRequirement) (bson.M, error) {
+	field := bson.M{"$getField": bson.M{"field": bson.M{"$literal": req.Key}, "input": "$metadata"}}
+	exists := bson.M{"$ne": bson.A{bson.M{"$type": field}, "missing"}}
+	switch req.Operator {
+	case types.SELECTOR_EQUALS:
+		return bson.M{"$eq": bson.A{field, req.Values[0]}}, nil
+	case types.SELECTOR_NOT_EQUALS:
+		return bson.M{"$ne": bson.A{field, req.Values[0]}}, nil
+	case types.SELECTOR_IN:
+		return bson.M{"$in": bson.A{field, req.Values}}, nil
+	case types.SELECTOR_NOT_IN:
+		return bson.M{"$not": bson.A{bson.M{"$in": bson.A{field, req.Values}}}}, nil
+	case types.SELECTOR_EXISTS:
+		return exists, nil
+	case types.SELECTOR_DOES_NOT_EXIST:
+		return bson.M{"$not": bson.A{exists}}, nil
+	}
+	return nil, fmt.Errorf("unsupported selector operator %s", req.Operator)
+}
+
 func NewMongoKeyStore(mongoUri string) (*MongoKeyStore, error) {
 	mongoUrl := fmt.Sprintf("mongodb://%s", mongoUri)
 	log.Tracef("Connecting to mongo at %s", mongoUrl)
@@ -273,3 +436,16 @@ func NewMongoKeyStore(mongoUri string) (*MongoKeyStore, error) {
 	err := keyStore.Init()
 	return &keyStore, err
 }
+
+// NewMongoKeyStoreWithClient a keystore in databaseName using a client that is already connected
+func NewMongoKeyStoreWithClient(client *mongo.Client, databaseName string) (*MongoKeyStore, error) {
+	keyStore := MongoKeyStore{
+		conn:                    client,
+		databaseName:            databaseName,
+		keyPairCollectionName:   "keypair",
+		locationsCollectionName: "locations",
+	}
+
+	err := keyStore.initCollections()
+	return &keyStore, err
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package mongo_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"github.com/theotw/natssync/pkg/persistence/keystoretest"
+	"github.com/theotw/natssync/pkg/persistence/mongo"
+	types "github.com/theotw/natssync/pkg/types"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func locationResponse(t *testing.T, locationData types.LocationData) bson.D {
+	bits, err := bson.Marshal(locationData)
+	assert.Nil(t, err)
+	var doc bson.D
+	assert.Nil(t, bson.Unmarshal(bits, &doc))
+	return mtest.CreateCursorResponse(0, "natssync.locations", mtest.FirstBatch, doc)
+}
+
+func updateResponse(matched int) bson.D {
+	return bson.D{{Key: "ok", Value: 1}, {Key: "n", Value: matched}, {Key: "nModified", Value: matched}}
+}
+
+// TestMongoKeyStoreUpdateLocation mongo answers with what the conformance test expects, the test checks the updates
+// the keystore sends are conditional on the revision
+func TestMongoKeyStoreUpdateLocation(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("update location", func(mt *mtest.T) {
+		// the two indexes
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+		store, err := mongo.NewMongoKeyStoreWithClient(mt.Client, "natssync")
+		assert.Nil(mt, err)
+
+		written := types.LocationData{
+			LocationID: "update-test",
+			PublicKey:  []byte("This is definitely a key"),
+			Metadata:   map[string]string{"foo": "bar"},
+		}
+		updated := written
+		updated.ForceKeypairRotation = true
+		updated.Revision = 1
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(),   // write
+			locationResponse(mt.T, written), // read
+			updateResponse(1),               // update
+			updateResponse(0),               // stale update
+			locationResponse(mt.T, updated), // read
+			updateResponse(1),               // next update
+			updateResponse(0),               // update of a location that is not there
+			mtest.CreateSuccessResponse(),   // remove
+		)
+		mt.ClearEvents()
+		keystoretest.TestUpdateLocation(mt.T, store)
+
+		// a location without a revision was written before revisions were added and matches revision 0
+		unrevisioned := bson.D{{Key: "$in", Value: bson.A{int32(0), nil}}}
+		expected := []interface{}{unrevisioned, unrevisioned, int64(1), unrevisioned}
+		for event := mt.GetStartedEvent(); event != nil; event = mt.GetStartedEvent() {
+			if event.CommandName != "update" {
+				continue
+			}
+			update := event.Command.Lookup("updates").Array().Index(0).Value().Document()
+			filter := update.Lookup("q").Document()
+			replacement := update.Lookup("u").Document()
+			if !assert.NotEmpty(mt, expected, "unexpected update %v", update) {
+				break
+			}
+			switch revision := expected[0].(type) {
+			case bson.D:
+				var in bson.D
+				assert.Nil(mt, filter.Lookup("revision").Unmarshal(&in))
+				assert.Equal(mt, revision, in)
+				assert.Equal(mt, int64(1), replacement.Lookup("revision").Int64())
+			case int64:
+				assert.Equal(mt, revision, filter.Lookup("revision").Int64())
+				assert.Equal(mt, revision+1, replacement.Lookup("revision").Int64())
+			}
+			expected = expected[1:]
+		}
+		assert.Empty(mt, expected)
+	})
+}
+
+// TestMongoKeyStoreListLocationsFilter keys without a dot are matched on their metadata path, keys with a dot need
+// $getField
+func TestMongoKeyStoreListLocationsFilter(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("list locations", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+		store, err := mongo.NewMongoKeyStoreWithClient(mt.Client, "natssync")
+		assert.Nil(mt, err)
+
+		selector, err := types.ParseSelector("region=east,tier notin (test),owner,natssync.compression=gzip")
+		assert.Nil(mt, err)
+		query, err := types.NewLocationQuery(selector, types.LOCATION_SORT_ID, false, 0, "")
+		assert.Nil(mt, err)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "natssync.locations", mtest.FirstBatch))
+		mt.ClearEvents()
+		_, err = store.ListLocations(query)
+		assert.Nil(mt, err)
+
+		event := mt.GetStartedEvent()
+		if !assert.NotNil(mt, event) || !assert.Equal(mt, "find", event.CommandName) {
+			return
+		}
+		var filter struct {
+			And  []bson.M `bson:"$and"`
+			Expr bson.M   `bson:"$expr"`
+		}
+		assert.Nil(mt, event.Command.Lookup("filter").Unmarshal(&filter))
+		assert.Equal(mt, []bson.M{
+			{"metadata.region": bson.M{"$eq": "east"}},
+			{"metadata.tier": bson.M{"$nin": bson.A{"test"}}},
+			{"metadata.owner": bson.M{"$exists": true}},
+		}, filter.And)
+		assert.Contains(mt, fmt.Sprint(filter.Expr), "$getField")
+		assert.Contains(mt, fmt.Sprint(filter.Expr), "natssync.compression")
+	})
+}
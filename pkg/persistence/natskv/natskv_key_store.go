@@ -0,0 +1,426 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package natskv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+const (
+	KIND_LOCATION = "location"
+	KIND_KEY_PAIR = "keypair"
+
+	defaultBucket = "natssync_keystore"
+	// maxWriteAttempts how many times a write is retried when another writer changed the key first
+	maxWriteAttempts = 5
+	// syncTimeout how long to wait for the watcher to deliver what is already in the bucket
+	syncTimeout = 30 * time.Second
+
+	// encodedIDPrefix marks an ID that was base64 encoded because it is not a valid KV key token
+	encodedIDPrefix = "="
+)
+
+var validID = regexp.MustCompile(`^[-/_.a-zA-Z0-9]+$`)
+
+// ChangeHandler is called for every location or key pair that is written or removed, by this process or any other
+// using the bucket
+type ChangeHandler func(kind string, id string, removed bool)
+
+// indexEntry the latest revision of a key, removed entries are kept so older revisions are not brought back
+type indexEntry struct {
+	revision     uint64
+	removed      bool
+	locationData *types.LocationData
+}
+
+// NatsKVKeyStore keeps the locations and key pairs in a JetStream key value bucket.  Every store watches the bucket,
+// so changes made by other cloud server replicas show up as soon as NATS delivers them
+type NatsKVKeyStore struct {
+	kv      nats.KeyValue
+	watcher nats.KeyWatcher
+
+	lock     sync.RWMutex
+	index    map[string]*indexEntry
+	handlers []ChangeHandler
+}
+
+// NewNatsKVKeyStore binds to the bucket, creating it if it does not exist yet.  A bucket that already exists is used
+// as it is, so it can be created up front with the replicas and storage the deployment needs
+func NewNatsKVKeyStore(nc *nats.Conn, bucket string) (*NatsKVKeyStore, error) {
+	if nc == nil {
+		return nil, fmt.Errorf("the NATS KV keystore needs a NATS connection")
+	}
+	if len(bucket) == 0 {
+		bucket = defaultBucket
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "NATSSync locations and key pairs",
+			Storage:     nats.FileStorage,
+		})
+	}
+	if err != nil {
+		log.WithError(err).WithField("bucket", bucket).Error("Unable to open the keystore bucket")
+		return nil, err
+	}
+	return newNatsKVKeyStore(kv)
+}
+
+func newNatsKVKeyStore(kv nats.KeyValue) (*NatsKVKeyStore, error) {
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	ret := &NatsKVKeyStore{
+		kv:      kv,
+		watcher: watcher,
+		index:   make(map[string]*indexEntry),
+	}
+
+	// the watcher sends everything already in the bucket followed by a nil entry
+	timeout := time.After(syncTimeout)
+	for synced := false; !synced; {
+		select {
+		case entry := <-watcher.Updates():
+			if entry == nil {
+				synced = true
+			} else {
+				ret.applyEntry(entry)
+			}
+		case <-timeout:
+			_ = watcher.Stop()
+			return nil, fmt.Errorf("timed out reading the keystore bucket %s", kv.Bucket())
+		}
+	}
+	go ret.watch()
+	return ret, nil
+}
+
+func (s *NatsKVKeyStore) watch() {
+	for entry := range s.watcher.Updates() {
+		if entry != nil {
+			s.applyEntry(entry)
+		}
+	}
+	log.WithField("bucket", s.kv.Bucket()).Debug("Keystore watcher stopped")
+}
+
+// Close stops watching the bucket
+func (s *NatsKVKeyStore) Close() error {
+	return s.watcher.Stop()
+}
+
+// OnChange registers a handler for the changes the watcher sees
+func (s *NatsKVKeyStore) OnChange(handler ChangeHandler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+func (s *NatsKVKeyStore) applyEntry(entry nats.KeyValueEntry) {
+	if entry.Operation() != nats.KeyValuePut {
+		s.apply(entry.Key(), entry.Revision(), nil, true)
+		return
+	}
+	locationData := &types.LocationData{}
+	if err := json.Unmarshal(entry.Value(), locationData); err != nil {
+		log.WithError(err).WithField("key", entry.Key()).Error("Unable to read keystore entry")
+		return
+	}
+	s.apply(entry.Key(), entry.Revision(), locationData, false)
+}
+
+// apply updates the index unless it already holds a newer revision.  The change handlers are called when an entry
+// is written or goes away, not again when the watcher delivers the delete marker of a removal this store made
+func (s *NatsKVKeyStore) apply(key string, revision uint64, locationData *types.LocationData, removed bool) {
+	s.lock.Lock()
+	current, ok := s.index[key]
+	if ok && (revision < current.revision || (revision == current.revision && !removed)) {
+		s.lock.Unlock()
+		return
+	}
+	s.index[key] = &indexEntry{revision: revision, removed: removed, locationData: locationData}
+	handlers := s.handlers
+	s.lock.Unlock()
+	if ok && current.removed && removed {
+		return
+	}
+
+	kind, id, err := parseKey(key)
+	if err != nil {
+		log.WithError(err).WithField("key", key).Warn("Unexpected key in the keystore bucket")
+		return
+	}
+	for _, handler := range handlers {
+		handler(kind, id, removed)
+	}
+}
+
+// makeKey the KV key for a location or key pair, IDs that are not valid key tokens are encoded
+func makeKey(kind string, id string) string {
+	if !validID.MatchString(id) || strings.HasPrefix(id, encodedIDPrefix) || strings.HasPrefix(id, ".") ||
+		strings.HasSuffix(id, ".") || strings.Contains(id, "..") {
+		id = encodedIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(id))
+	}
+	return kind + "." + id
+}
+
+func parseKey(key string) (string, string, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid keystore key")
+	}
+	id := parts[1]
+	if strings.HasPrefix(id, encodedIDPrefix) {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(id, encodedIDPrefix))
+		if err != nil {
+			return "", "", err
+		}
+		id = string(decoded)
+	}
+	return parts[0], id, nil
+}
+
+// write creates the key or updates the revision that was read, if another writer got there first the write is tried
+// again against the new revision
+func (s *NatsKVKeyStore) write(kind string, id string, locationData *types.LocationData) error {
+	bits, err := json.Marshal(locationData)
+	if err != nil {
+		return err
+	}
+	key := makeKey(kind, id)
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		var revision uint64
+		entry, err := s.kv.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+			revision, err = s.kv.Create(key, bits)
+		case err != nil:
+			return err
+		default:
+			revision, err = s.kv.Update(key, bits, entry.Revision())
+		}
+		if errors.Is(err, nats.ErrKeyExists) {
+			log.WithField("key", key).Debug("Keystore entry changed while it was being written, trying again")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stored := *locationData
+		s.apply(key, revision, &stored, false)
+		return nil
+	}
+	return fmt.Errorf("keystore entry %s kept changing while it was being written", key)
+}
+
+// update replaces the entry only if it still holds the location revision, the bucket revision it was read at makes
+// the check and the write one step.  The revision is read from the bucket, the index may not have seen the latest
+func (s *NatsKVKeyStore) update(kind string, id string, locationData *types.LocationData) error {
+	key := makeKey(kind, id)
+	entry, err := s.kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return types.ErrRevisionConflict
+	}
+	if err != nil {
+		return err
+	}
+	stored := &types.LocationData{}
+	if err = json.Unmarshal(entry.Value(), stored); err != nil {
+		return err
+	}
+	if stored.Revision != locationData.Revision {
+		return types.ErrRevisionConflict
+	}
+
+	updated := *locationData
+	updated.Revision++
+	bits, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	revision, err := s.kv.Update(key, bits, entry.Revision())
+	if errors.Is(err, nats.ErrKeyExists) {
+		return types.ErrRevisionConflict
+	}
+	if err != nil {
+		return err
+	}
+	s.apply(key, revision, &updated, false)
+	locationData.Revision = updated.Revision
+	return nil
+}
+
+func (s *NatsKVKeyStore) read(kind string, id string) (*types.LocationData, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entry, ok := s.index[makeKey(kind, id)]
+	if !ok || entry.removed {
+		return nil, fmt.Errorf("%s %s not found", kind, id)
+	}
+	ret := *entry.locationData
+	return &ret, nil
+}
+
+func (s *NatsKVKeyStore) remove(kind string, id string) error {
+	key := makeKey(kind, id)
+	s.lock.RLock()
+	entry, ok := s.index[key]
+	s.lock.RUnlock()
+	if !ok || entry.removed {
+		return fmt.Errorf("%s %s not found", kind, id)
+	}
+	if err := s.kv.Delete(key); err != nil {
+		return err
+	}
+	s.apply(key, entry.revision, nil, true)
+	return nil
+}
+
+// list the current entries of a kind
+func (s *NatsKVKeyStore) list(kind string) []*types.LocationData {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make([]*types.LocationData, 0)
+	prefix := kind + "."
+	for key, entry := range s.index {
+		if entry.removed || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		locationData := *entry.locationData
+		ret = append(ret, &locationData)
+	}
+	return ret
+}
+
+func (s *NatsKVKeyStore) GetExistingKeys() ([]*utils.UUIDv1, error) {
+	keyPairs := s.list(KIND_KEY_PAIR)
+	keys := make([]*utils.UUIDv1, 0, len(keyPairs))
+	for _, keyPair := range keyPairs {
+		key, err := utils.ParseUUIDv1(keyPair.KeyID)
+		if err != nil {
+			log.WithError(err).WithField("keyID", keyPair.KeyID).Error("failed to parse keyID")
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *NatsKVKeyStore) GetLatestKeyID() (string, error) {
+	keys, err := s.GetExistingKeys()
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("existing keys not found")
+	}
+	latest := keys[0]
+	for _, key := range keys {
+		if key.GetCreationTime().After(latest.GetCreationTime()) {
+			latest = key
+		}
+	}
+	return latest.String(), nil
+}
+
+func (s *NatsKVKeyStore) WriteKeyPair(locationData *types.LocationData) error {
+	return s.write(KIND_KEY_PAIR, locationData.KeyID, locationData)
+}
+
+func (s *NatsKVKeyStore) ReadKeyPair(keyID string) (*types.LocationData, error) {
+	if keyID == "" {
+		var err error
+		if keyID, err = s.GetLatestKeyID(); err != nil {
+			return nil, err
+		}
+	}
+	return s.read(KIND_KEY_PAIR, keyID)
+}
+
+func (s *NatsKVKeyStore) RemoveKeyPair(keyID string) error {
+	if keyID == "" {
+		var err error
+		if keyID, err = s.GetLatestKeyID(); err != nil {
+			return err
+		}
+	}
+	return s.remove(KIND_KEY_PAIR, keyID)
+}
+
+func (s *NatsKVKeyStore) LoadLocationID(keyID string) string {
+	locationData, err := s.ReadKeyPair(keyID)
+	if err != nil {
+		log.WithError(err).Error("failed to read key pair")
+		return ""
+	}
+	return locationData.GetLocationID()
+}
+
+func (s *NatsKVKeyStore) WriteLocation(locationData types.LocationData) error {
+	return s.write(KIND_LOCATION, locationData.GetLocationID(), &locationData)
+}
+
+func (s *NatsKVKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	return s.update(KIND_LOCATION, locationData.GetLocationID(), locationData)
+}
+
+func (s *NatsKVKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	return s.read(KIND_LOCATION, locationID)
+}
+
+func (s *NatsKVKeyStore) removeLocationData(locationID string, allowCloudMaster bool) error {
+	if locationID == pkg.CLOUD_ID && !allowCloudMaster {
+		log.Errorf("Removing default cloud location ID")
+		return fmt.Errorf("unable to remove cloud master location")
+	}
+	return s.remove(KIND_LOCATION, locationID)
+}
+
+func (s *NatsKVKeyStore) RemoveLocation(locationID string) error {
+	return s.removeLocationData(locationID, false)
+}
+
+func (s *NatsKVKeyStore) RemoveCloudMasterData() error {
+	return s.removeLocationData(pkg.CLOUD_ID, true)
+}
+
+func (s *NatsKVKeyStore) ListKnownClients() ([]string, error) {
+	locations := s.list(KIND_LOCATION)
+	ret := make([]string, 0, len(locations))
+	for _, locationData := range locations {
+		ret = append(ret, locationData.GetLocationID())
+	}
+	return ret, nil
+}
+
+func (s *NatsKVKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	locations := s.list(KIND_LOCATION)
+	ret := make([]types.LocationData, 0, len(locations))
+	for _, locationData := range locations {
+		ret = append(ret, *locationData)
+	}
+	return types.ApplyLocationQuery(ret, query)
+}
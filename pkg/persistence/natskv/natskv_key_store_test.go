@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package natskv
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/persistence/keystoretest"
+	types "github.com/theotw/natssync/pkg/types"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	// cleanups run last in first out, so the stores opened afterwards stop before the server goes away
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func openTestStore(t *testing.T, ns *server.Server, bucket string) *NatsKVKeyStore {
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	store, err := NewNatsKVKeyStore(nc, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestNatsKVKeyStore(t *testing.T) {
+	ns := runJetStreamServer(t)
+	keystoretest.TestKeyStore(t, openTestStore(t, ns, ""))
+}
+
+func TestNatsKVKeyStoreReplicas(t *testing.T) {
+	ns := runJetStreamServer(t)
+	first := openTestStore(t, ns, "replicas")
+	assert.Nil(t, first.WriteLocation(types.LocationData{LocationID: "before", PublicKey: []byte("before")}))
+
+	// a store opened later reads what is already there
+	second := openTestStore(t, ns, "replicas")
+	locationData, err := second.ReadLocation("before")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "before", string(locationData.GetPublicKey()))
+	}
+
+	changes := make(chan string, 10)
+	second.OnChange(func(kind string, id string, removed bool) {
+		changes <- fmt.Sprintf("%s %s %v", kind, id, removed)
+	})
+
+	// registrations and removals on one replica show up on the other
+	assert.Nil(t, first.WriteLocation(types.LocationData{LocationID: "Not A Key/Token", PublicKey: []byte("after")}))
+	assert.Equal(t, "location Not A Key/Token false", nextChange(t, changes))
+	locationData, err = second.ReadLocation("Not A Key/Token")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "after", string(locationData.GetPublicKey()))
+	}
+
+	assert.Nil(t, first.RemoveLocation("before"))
+	assert.Equal(t, "location before true", nextChange(t, changes))
+	_, err = second.ReadLocation("before")
+	assert.Error(t, err)
+
+	clients, err := second.ListKnownClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Not A Key/Token"}, clients)
+}
+
+func nextChange(t *testing.T, changes chan string) string {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change was seen")
+	}
+	return ""
+}
+
+func TestNatsKVKeyStoreConcurrentWrites(t *testing.T) {
+	ns := runJetStreamServer(t)
+	stores := []*NatsKVKeyStore{openTestStore(t, ns, "concurrent"), openTestStore(t, ns, "concurrent")}
+
+	// every write lands even though they race on the same key, the losers retry against the new revision
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- stores[i%2].WriteLocation(types.LocationData{LocationID: "shared", PublicKey: []byte(fmt.Sprintf("key%d", i))})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	entry, err := stores[0].kv.Get(makeKey(KIND_LOCATION, "shared"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(4), entry.Revision())
+	}
+}
+
+func TestNatsKVKeyStoreKeys(t *testing.T) {
+	for _, id := range []string{"foo", "a.b", "with space", "=foo", ".foo", "foo.", "a..b", "*", ">"} {
+		key := makeKey(KIND_LOCATION, id)
+		assert.Regexp(t, `^location\.[-/_=.a-zA-Z0-9]+$`, key)
+		kind, parsedID, err := parseKey(key)
+		assert.Nil(t, err)
+		assert.Equal(t, KIND_LOCATION, kind)
+		assert.Equal(t, id, parsedID)
+	}
+}
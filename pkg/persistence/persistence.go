@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"github.com/theotw/natssync/pkg/persistence/configmap"
 	"net/url"
+	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/natsmodel"
 	"github.com/theotw/natssync/pkg/persistence/file"
 	"github.com/theotw/natssync/pkg/persistence/mongo"
+	"github.com/theotw/natssync/pkg/persistence/natskv"
+	"github.com/theotw/natssync/pkg/persistence/secret"
+	"github.com/theotw/natssync/pkg/persistence/sqldb"
 	types "github.com/theotw/natssync/pkg/types"
 )
 
@@ -19,6 +24,14 @@ const (
 	fileKeyStoreTypePrefix      = "file://"
 	mongoKeyStoreTypePrefix     = "mongodb://"
 	configmapKeyStoreTypePrefix = "configmap://"
+	// secretKeyStoreTypePrefix secret://name, name labels the secrets and defaults to natssync
+	secretKeyStoreTypePrefix = "secret://"
+	// natsKVKeyStoreTypePrefix natskv://bucket, a JetStream KV bucket on the NATS server the app is connected to
+	natsKVKeyStoreTypePrefix = "natskv://"
+	// sqliteKeyStoreTypePrefix sqlite://path, a single SQLite file
+	sqliteKeyStoreTypePrefix = "sqlite://"
+	// postgresKeyStoreTypePrefix the whole postgres:// URL is handed to the driver
+	postgresKeyStoreTypePrefix = "postgres://"
 )
 
 type LocationKeyStore interface {
@@ -30,14 +43,94 @@ type LocationKeyStore interface {
 	// LoadLocationID if keyID is empty load the location from latest key
 	LoadLocationID(KeyID string) string
 	WriteLocation(locationData types.LocationData) error
+	// UpdateLocation replaces the location only if its stored revision is still locationData.Revision, otherwise it
+	// returns types.ErrRevisionConflict.  On success locationData.Revision is set to the new revision
+	UpdateLocation(locationData *types.LocationData) error
 	ReadLocation(locationID string) (*types.LocationData, error)
 	RemoveLocation(locationID string) error
 	RemoveCloudMasterData() error
 	ListKnownClients() ([]string, error)
 }
 
+// LocationLister implemented by keystores that can filter, sort and page locations natively
+type LocationLister interface {
+	ListLocations(query *types.LocationQuery) (*types.LocationPage, error)
+}
+
+// ChangeNotifier implemented by keystores that see the changes other servers make, the key cache drops what they change
+type ChangeNotifier interface {
+	OnChange(handler natskv.ChangeHandler)
+}
+
 var keystore LocationKeyStore
 
+// ListLocations the page of locations for the query.  Keystores that are not a LocationLister have every location
+// read and the query applied in memory
+func ListLocations(store LocationKeyStore, query *types.LocationQuery) (*types.LocationPage, error) {
+	if lister, ok := store.(LocationLister); ok {
+		return lister.ListLocations(query)
+	}
+	clients, err := store.ListKnownClients()
+	if err != nil {
+		return nil, err
+	}
+	locations := make([]types.LocationData, 0, len(clients))
+	for _, client := range clients {
+		locationData, err := store.ReadLocation(client)
+		if err != nil {
+			log.WithError(err).WithField("locationID", client).Error("Unable to read location info")
+			continue
+		}
+		locations = append(locations, *locationData)
+	}
+	return types.ApplyLocationQuery(locations, query)
+}
+
+// LoadLocation the location from the keystore's cache if it keeps one.  It is only for reading, a location that is
+// going to be updated has to be read with ReadLocation
+func LoadLocation(store LocationKeyStore, locationID string) (*types.LocationData, error) {
+	if cache, ok := store.(KeyCache); ok {
+		return cache.LoadLocation(locationID)
+	}
+	return store.ReadLocation(locationID)
+}
+
+// ListKeyPairs every key pair of this side, newest first.  Keystores that can not list their keys return just the
+// latest
+func ListKeyPairs(store LocationKeyStore) ([]*types.LocationData, error) {
+	lister, ok := store.(CleanupKeysInterface)
+	if !ok {
+		latest, err := store.ReadKeyPair("")
+		if err != nil {
+			return nil, err
+		}
+		return []*types.LocationData{latest}, nil
+	}
+	keyIDs, err := lister.GetExistingKeys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keyIDs, func(i, j int) bool {
+		if keyIDs[i] == nil || keyIDs[j] == nil {
+			return keyIDs[j] == nil && keyIDs[i] != nil
+		}
+		return keyIDs[i].GetCreationTime().After(keyIDs[j].GetCreationTime())
+	})
+	ret := make([]*types.LocationData, 0, len(keyIDs))
+	for _, keyID := range keyIDs {
+		if keyID == nil {
+			continue
+		}
+		locationData, err := store.ReadKeyPair(keyID.String())
+		if err != nil {
+			log.WithError(err).WithField("keyID", keyID.String()).Error("Unable to read key pair")
+			continue
+		}
+		ret = append(ret, locationData)
+	}
+	return ret, nil
+}
+
 func GetKeyStore() LocationKeyStore {
 	return keystore
 }
@@ -84,24 +177,59 @@ func CreateLocationKeyStore(keystoreUrl string) (LocationKeyStore, error) {
 	switch keystoreType {
 	case fileKeyStoreTypePrefix:
 		fileKeyStore, err := file.NewFileKeyStore(keystoreUri)
-		if err == nil {
-			newReaper(fileKeyStore).RunCleanupJob(context.TODO())
+		if err != nil {
+			return nil, err
 		}
-		return fileKeyStore, err
+		newReaper(fileKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(fileKeyStore)
 
 	case mongoKeyStoreTypePrefix:
 		mongoKeyStore, err := mongo.NewMongoKeyStore(keystoreUri)
-		if err == nil {
-			newReaper(mongoKeyStore).RunCleanupJob(context.TODO())
+		if err != nil {
+			return nil, err
 		}
-		return mongoKeyStore, err
+		newReaper(mongoKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(mongoKeyStore)
 
 	case configmapKeyStoreTypePrefix:
 		configmapKeyStore, err := configmap.NewConfigmapKeyStore()
-		if err == nil {
-			newReaper(configmapKeyStore).RunCleanupJob(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		newReaper(configmapKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(configmapKeyStore)
+
+	case secretKeyStoreTypePrefix:
+		secretKeyStore, err := secret.NewSecretKeyStore(keystoreUri)
+		if err != nil {
+			return nil, err
 		}
-		return configmapKeyStore, err
+		newReaper(secretKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(secretKeyStore)
+
+	case natsKVKeyStoreTypePrefix:
+		natsKVKeyStore, err := natskv.NewNatsKVKeyStore(natsmodel.GetNatsConnection(), keystoreUri)
+		if err != nil {
+			return nil, err
+		}
+		newReaper(natsKVKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(natsKVKeyStore)
+
+	case sqliteKeyStoreTypePrefix:
+		sqliteKeyStore, err := sqldb.NewSQLiteKeyStore(keystoreUri)
+		if err != nil {
+			return nil, err
+		}
+		newReaper(sqliteKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(sqliteKeyStore)
+
+	case postgresKeyStoreTypePrefix:
+		postgresKeyStore, err := sqldb.NewPostgresKeyStore(keystoreUrl)
+		if err != nil {
+			return nil, err
+		}
+		newReaper(postgresKeyStore).RunCleanupJob(context.TODO())
+		return wrapWithKeyEncryption(postgresKeyStore)
 	}
 
 	return nil, fmt.Errorf("unsupported keystore types %s", keystoreType)
@@ -123,5 +251,9 @@ func InitLocationKeyStore() error {
 	}
 
 	keystore, err = CreateLocationKeyStore(keystoreUrl)
-	return err
+	if err != nil {
+		return err
+	}
+	keystore = wrapWithKeyCache(keystore)
+	return nil
 }
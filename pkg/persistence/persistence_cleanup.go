@@ -6,12 +6,14 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/theotw/natssync/pkg"
 	"github.com/theotw/natssync/pkg/utils"
 )
 
 const (
 	cleanupInterval = 1 * time.Hour
-	cleanupTTL      = 5 * time.Minute
+	// cleanupTTL how long a key pair stays usable after a newer one replaces it, overridden by KEY_OVERLAP
+	cleanupTTL = 24 * time.Hour
 )
 
 type CleanupKeysInterface interface {
@@ -27,7 +29,15 @@ type reaper struct {
 }
 
 func newReaper(store CleanupKeysInterface) *reaper {
-	return newReaperDetailed(store, cleanupInterval, cleanupTTL)
+	ttl := cleanupTTL
+	if len(pkg.Config.KeyOverlap) > 0 {
+		if overlap, err := time.ParseDuration(pkg.Config.KeyOverlap); err != nil || overlap < 0 {
+			log.WithError(err).Errorf("failed to parse key overlap, using %v", cleanupTTL)
+		} else {
+			ttl = overlap
+		}
+	}
+	return newReaperDetailed(store, cleanupInterval, ttl)
 }
 
 func newReaperDetailed(
@@ -82,13 +92,18 @@ func (r *reaper) cleanupOldKeys() {
 	}
 
 	for _, key := range existingKeys {
+		if key == nil || latestKey == nil {
+			continue
+		}
 
 		// do not delete the latest key or any key created after the latest key
 		if key.String() == latestKeyID || key.GetCreationTime().After(latestKey.GetCreationTime()) {
 			continue
 		}
 
-		if time.Now().Sub(key.GetCreationTime()) >= r.cleanupTTL {
+		// a key stays usable for the TTL after the next key replaced it, so messages and peers still using it have
+		// time to move to the new key
+		if time.Now().Sub(replacedAt(key, existingKeys)) >= r.cleanupTTL {
 			if err = r.store.RemoveKeyPair(key.String()); err != nil {
 				log.WithError(err).WithField("keyID", key).Error("failed to delete expired key pair")
 			} else {
@@ -97,3 +112,17 @@ func (r *reaper) cleanupOldKeys() {
 		}
 	}
 }
+
+// replacedAt when the next newer key was created
+func replacedAt(key *utils.UUIDv1, keys []*utils.UUIDv1) time.Time {
+	var ret time.Time
+	for _, other := range keys {
+		if other == nil || !other.GetCreationTime().After(key.GetCreationTime()) {
+			continue
+		}
+		if ret.IsZero() || other.GetCreationTime().Before(ret) {
+			ret = other.GetCreationTime()
+		}
+	}
+	return ret
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package persistence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+type memoryKeys struct {
+	keys []*utils.UUIDv1
+}
+
+func (m *memoryKeys) add(t *testing.T) string {
+	key, err := utils.NewUUIDv1()
+	assert.Nil(t, err)
+	m.keys = append(m.keys, key)
+	return key.String()
+}
+
+func (m *memoryKeys) GetExistingKeys() ([]*utils.UUIDv1, error) {
+	return m.keys, nil
+}
+
+func (m *memoryKeys) GetLatestKeyID() (string, error) {
+	return m.keys[len(m.keys)-1].String(), nil
+}
+
+func (m *memoryKeys) RemoveKeyPair(keyID string) error {
+	for i, key := range m.keys {
+		if key.String() == keyID {
+			m.keys = append(m.keys[:i:i], m.keys[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryKeys) keyIDs() []string {
+	ret := make([]string, 0, len(m.keys))
+	for _, key := range m.keys {
+		ret = append(ret, key.String())
+	}
+	return ret
+}
+
+func TestReaperKeepsReplacedKeysForTheOverlap(t *testing.T) {
+	store := new(memoryKeys)
+	oldest := store.add(t)
+	time.Sleep(200 * time.Millisecond)
+	previous := store.add(t)
+	latest := store.add(t)
+
+	// the oldest key is older than the TTL, but it was only just replaced
+	r := newReaperDetailed(store, time.Hour, 100*time.Millisecond)
+	r.cleanupOldKeys()
+	assert.Equal(t, []string{oldest, previous, latest}, store.keyIDs())
+
+	time.Sleep(150 * time.Millisecond)
+	r.cleanupOldKeys()
+	assert.Equal(t, []string{latest}, store.keyIDs())
+}
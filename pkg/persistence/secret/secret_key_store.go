@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package secret
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+const (
+	// LABEL_KEYSTORE the keystore a secret belongs to, so several keystores can share a namespace
+	LABEL_KEYSTORE = "natssync.io/keystore"
+	// LABEL_KIND KIND_LOCATION or KIND_KEY_PAIR
+	LABEL_KIND = "natssync.io/kind"
+	// ANNOTATION_ID the location or key ID, secret names can not hold every ID
+	ANNOTATION_ID = "natssync.io/id"
+
+	KIND_LOCATION = "location"
+	KIND_KEY_PAIR = "keypair"
+
+	// DATA_KEY the secret data key holding the JSON location data
+	DATA_KEY = "locationData.json"
+
+	defaultKeystoreName = "natssync"
+	// maxWriteAttempts how many times a write is retried when another writer changed the secret first
+	maxWriteAttempts = 5
+)
+
+// dnsName what can be used as is in a secret name
+var dnsName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// SecretKeyStore keeps each location and key pair in its own Secret.  The secrets are labeled with the keystore
+// name and their kind so they can be listed with a label selector
+type SecretKeyStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewSecretKeyStore a keystore in the pod's namespace using the pod's service account, the secrets are labeled with
+// name
+func NewSecretKeyStore(name string) (*SecretKeyStore, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.WithError(err).Error("Unable to initialize Kubernetes client config")
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.WithError(err).Error("Unable to initialize Kubernetes client")
+		return nil, err
+	}
+	return NewSecretKeyStoreWithClient(client, pkg.Config.PodNamespace, name), nil
+}
+
+func NewSecretKeyStoreWithClient(client kubernetes.Interface, namespace string, name string) *SecretKeyStore {
+	if len(name) == 0 {
+		name = defaultKeystoreName
+	}
+	return &SecretKeyStore{client: client, namespace: namespace, name: name}
+}
+
+func (s *SecretKeyStore) secrets() typedcorev1.SecretInterface {
+	return s.client.CoreV1().Secrets(s.namespace)
+}
+
+// secretName the secret for a location or key pair.  IDs that are not valid in a name are hashed
+func (s *SecretKeyStore) secretName(kind string, id string) string {
+	lowerID := strings.ToLower(id)
+	if lowerID != id || !dnsName.MatchString(id) || len(id) > 200 {
+		hash := sha256.Sum256([]byte(id))
+		lowerID = "h" + hex.EncodeToString(hash[:16])
+	}
+	return fmt.Sprintf("%s-%s-%s", s.name, kind, lowerID)
+}
+
+func (s *SecretKeyStore) selector(kind string) string {
+	return labels.SelectorFromSet(labels.Set{LABEL_KEYSTORE: s.name, LABEL_KIND: kind}).String()
+}
+
+// write creates or replaces the secret.  Replacing is done with the resourceVersion that was read, so if another
+// writer got there first the update fails with a conflict and is tried again
+func (s *SecretKeyStore) write(kind string, id string, locationData *types.LocationData) error {
+	bits, err := json.Marshal(locationData)
+	if err != nil {
+		return err
+	}
+	name := s.secretName(kind, id)
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		existing, err := s.secrets().Get(context.TODO(), name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   s.namespace,
+					Labels:      map[string]string{LABEL_KEYSTORE: s.name, LABEL_KIND: kind},
+					Annotations: map[string]string{ANNOTATION_ID: id},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{DATA_KEY: bits},
+			}
+			_, err = s.secrets().Create(context.TODO(), secret, metav1.CreateOptions{})
+			if k8sErrors.IsAlreadyExists(err) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		existing.Data = map[string][]byte{DATA_KEY: bits}
+		_, err = s.secrets().Update(context.TODO(), existing, metav1.UpdateOptions{})
+		if k8sErrors.IsConflict(err) {
+			log.WithField("secret", name).Debug("Secret changed while it was being written, trying again")
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("secret %s kept changing while it was being written", name)
+}
+
+func (s *SecretKeyStore) read(kind string, id string) (*types.LocationData, error) {
+	secret, err := s.secrets().Get(context.TODO(), s.secretName(kind, id), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return decodeSecret(secret)
+}
+
+func decodeSecret(secret *corev1.Secret) (*types.LocationData, error) {
+	locationData := &types.LocationData{}
+	if err := json.Unmarshal(secret.Data[DATA_KEY], locationData); err != nil {
+		return nil, err
+	}
+	return locationData, nil
+}
+
+func (s *SecretKeyStore) remove(kind string, id string) error {
+	return s.secrets().Delete(context.TODO(), s.secretName(kind, id), metav1.DeleteOptions{})
+}
+
+func (s *SecretKeyStore) list(kind string) ([]corev1.Secret, error) {
+	secretList, err := s.secrets().List(context.TODO(), metav1.ListOptions{LabelSelector: s.selector(kind)})
+	if err != nil {
+		return nil, err
+	}
+	return secretList.Items, nil
+}
+
+func (s *SecretKeyStore) GetExistingKeys() ([]*utils.UUIDv1, error) {
+	secrets, err := s.list(KIND_KEY_PAIR)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*utils.UUIDv1, 0, len(secrets))
+	for _, secret := range secrets {
+		key, err := utils.ParseUUIDv1(secret.Annotations[ANNOTATION_ID])
+		if err != nil {
+			log.WithError(err).WithField("secret", secret.Name).Error("failed to parse keyID from secret")
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *SecretKeyStore) GetLatestKeyID() (string, error) {
+	keys, err := s.GetExistingKeys()
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("existing keys not found")
+	}
+	latest := keys[0]
+	for _, key := range keys {
+		if key.GetCreationTime().After(latest.GetCreationTime()) {
+			latest = key
+		}
+	}
+	return latest.String(), nil
+}
+
+func (s *SecretKeyStore) WriteKeyPair(locationData *types.LocationData) error {
+	return s.write(KIND_KEY_PAIR, locationData.KeyID, locationData)
+}
+
+func (s *SecretKeyStore) ReadKeyPair(keyID string) (*types.LocationData, error) {
+	if keyID == "" {
+		var err error
+		if keyID, err = s.GetLatestKeyID(); err != nil {
+			return nil, err
+		}
+	}
+	return s.read(KIND_KEY_PAIR, keyID)
+}
+
+func (s *SecretKeyStore) RemoveKeyPair(keyID string) error {
+	if keyID == "" {
+		var err error
+		if keyID, err = s.GetLatestKeyID(); err != nil {
+			return err
+		}
+	}
+	return s.remove(KIND_KEY_PAIR, keyID)
+}
+
+func (s *SecretKeyStore) LoadLocationID(keyID string) string {
+	locationData, err := s.ReadKeyPair(keyID)
+	if err != nil {
+		log.WithError(err).Error("failed to read key pair")
+		return ""
+	}
+	return locationData.GetLocationID()
+}
+
+func (s *SecretKeyStore) WriteLocation(locationData types.LocationData) error {
+	return s.write(KIND_LOCATION, locationData.GetLocationID(), &locationData)
+}
+
+// UpdateLocation the secret only holds the location, so the update is made with the resourceVersion the revision was
+// read at and any change in between is a conflict
+func (s *SecretKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	existing, err := s.secrets().Get(context.TODO(), s.secretName(KIND_LOCATION, locationData.GetLocationID()), metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return types.ErrRevisionConflict
+	}
+	if err != nil {
+		return err
+	}
+	stored, err := decodeSecret(existing)
+	if err != nil {
+		return err
+	}
+	if stored.Revision != locationData.Revision {
+		return types.ErrRevisionConflict
+	}
+
+	updated := *locationData
+	updated.Revision++
+	bits, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	existing.Data = map[string][]byte{DATA_KEY: bits}
+	_, err = s.secrets().Update(context.TODO(), existing, metav1.UpdateOptions{})
+	if k8sErrors.IsConflict(err) || k8sErrors.IsNotFound(err) {
+		return types.ErrRevisionConflict
+	}
+	if err != nil {
+		return err
+	}
+	locationData.Revision = updated.Revision
+	return nil
+}
+
+func (s *SecretKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	return s.read(KIND_LOCATION, locationID)
+}
+
+func (s *SecretKeyStore) removeLocationData(locationID string, allowCloudMaster bool) error {
+	if locationID == pkg.CLOUD_ID && !allowCloudMaster {
+		log.Errorf("Removing default cloud location ID")
+		return fmt.Errorf("unable to remove cloud master location")
+	}
+	return s.remove(KIND_LOCATION, locationID)
+}
+
+func (s *SecretKeyStore) RemoveLocation(locationID string) error {
+	return s.removeLocationData(locationID, false)
+}
+
+func (s *SecretKeyStore) RemoveCloudMasterData() error {
+	return s.removeLocationData(pkg.CLOUD_ID, true)
+}
+
+func (s *SecretKeyStore) ListKnownClients() ([]string, error) {
+	secrets, err := s.list(KIND_LOCATION)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		ret = append(ret, secret.Annotations[ANNOTATION_ID])
+	}
+	return ret, nil
+}
+
+// ListLocations all the locations are read with a single list request
+func (s *SecretKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	secrets, err := s.list(KIND_LOCATION)
+	if err != nil {
+		return nil, err
+	}
+	locations := make([]types.LocationData, 0, len(secrets))
+	for i := range secrets {
+		locationData, err := decodeSecret(&secrets[i])
+		if err != nil {
+			log.WithError(err).WithField("secret", secrets[i].Name).Error("Unable to read location data from secret")
+			continue
+		}
+		locations = append(locations, *locationData)
+	}
+	return types.ApplyLocationQuery(locations, query)
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package secret_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+
+	"github.com/theotw/natssync/pkg/persistence/keystoretest"
+	"github.com/theotw/natssync/pkg/persistence/secret"
+	types "github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+const testNamespace = "natssync-test"
+
+func TestSecretKeyStore(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := secret.NewSecretKeyStoreWithClient(client, testNamespace, "")
+	// another keystore in the same namespace must not show up in this one
+	other := secret.NewSecretKeyStoreWithClient(client, testNamespace, "other")
+	otherData, err := types.NewLocationData("other", []byte("otherkey"), nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, other.WriteKeyPair(otherData))
+	assert.Nil(t, other.WriteLocation(*otherData))
+
+	keystoretest.TestKeyStore(t, store)
+}
+
+func TestSecretKeyStoreIDsThatAreNotNames(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := secret.NewSecretKeyStoreWithClient(client, testNamespace, "")
+
+	for _, id := range []string{"Upper_Case", "upper_case", "with.dots"} {
+		err := store.WriteLocation(types.LocationData{LocationID: id, PublicKey: []byte(id)})
+		assert.Nil(t, err)
+	}
+	for _, id := range []string{"Upper_Case", "upper_case", "with.dots"} {
+		locationData, err := store.ReadLocation(id)
+		if assert.Nil(t, err) {
+			assert.Equal(t, id, string(locationData.GetPublicKey()))
+		}
+	}
+	clients, err := store.ListKnownClients()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"Upper_Case", "upper_case", "with.dots"}, clients)
+}
+
+func TestSecretKeyStoreWriteConflict(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := secret.NewSecretKeyStoreWithClient(client, testNamespace, "")
+	assert.Nil(t, store.WriteLocation(types.LocationData{LocationID: "foo", PublicKey: []byte("first")}))
+
+	// the first update loses to another writer, the write reads the secret again and retries
+	conflicts := 0
+	client.PrependReactor("update", "secrets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, k8sErrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "natssync-location-foo", fmt.Errorf("changed"))
+	})
+	assert.Nil(t, store.WriteLocation(types.LocationData{LocationID: "foo", PublicKey: []byte("second")}))
+	assert.Equal(t, 1, conflicts)
+
+	locationData, err := store.ReadLocation("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(locationData.GetPublicKey()))
+
+	// a writer that always loses gives up
+	client.PrependReactor("update", "secrets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8sErrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "natssync-location-foo", fmt.Errorf("changed"))
+	})
+	assert.Error(t, store.WriteLocation(types.LocationData{LocationID: "foo", PublicKey: []byte("third")}))
+}
+
+func TestSecretKeyStoreLabels(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := secret.NewSecretKeyStoreWithClient(client, testNamespace, "")
+	keyID, err := utils.NewUUIDv1()
+	assert.Nil(t, err)
+	assert.Nil(t, store.WriteKeyPair(&types.LocationData{KeyID: keyID.String(), LocationID: "foo"}))
+
+	secrets, err := client.CoreV1().Secrets(testNamespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: secret.LABEL_KIND + "=" + secret.KIND_KEY_PAIR,
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, secrets.Items, 1) {
+		item := secrets.Items[0]
+		assert.Equal(t, "natssync", item.Labels[secret.LABEL_KEYSTORE])
+		assert.Equal(t, keyID.String(), item.Annotations[secret.ANNOTATION_ID])
+		assert.NotEmpty(t, item.Data[secret.DATA_KEY])
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dialect the differences between the databases the SQL keystore runs on
+type dialect struct {
+	name   string
+	driver string
+	// blobType the column type for JSON and key bytes
+	blobType string
+	// lockMigrations stops two servers starting at the same time from both migrating, empty if a write lock on the
+	// database already does that
+	lockMigrations string
+	// numberedParams the driver wants $1, $2 rather than ?
+	numberedParams bool
+}
+
+var sqliteDialect = dialect{
+	name:     "sqlite",
+	driver:   "sqlite",
+	blobType: "BLOB",
+}
+
+var postgresDialect = dialect{
+	name:           "postgres",
+	driver:         "postgres",
+	blobType:       "BYTEA",
+	lockMigrations: "SELECT pg_advisory_xact_lock(7460513982)",
+	numberedParams: true,
+}
+
+// rebind the query's ? parameters in the dialect's form
+func (d dialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// migrations the schema, one list of statements per version.  Released versions are never changed, changes to the
+// schema are added as a new version.  {blob} is replaced with the dialect's blob type
+var migrations = [][]string{
+	// 1: locations, their metadata and the key pairs.  The sort columns hold types.LocationQuery sort values so
+	// cursors can be compared in SQL
+	{
+		`CREATE TABLE locations (
+			location_id TEXT PRIMARY KEY,
+			created BIGINT NOT NULL,
+			last_keypair_rotation BIGINT NOT NULL,
+			last_seen BIGINT NOT NULL,
+			data {blob} NOT NULL
+		)`,
+		`CREATE INDEX locations_created ON locations (created, location_id)`,
+		`CREATE INDEX locations_last_keypair_rotation ON locations (last_keypair_rotation, location_id)`,
+		`CREATE INDEX locations_last_seen ON locations (last_seen, location_id)`,
+		`CREATE TABLE location_metadata (
+			location_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (location_id, name)
+		)`,
+		`CREATE INDEX location_metadata_name_value ON location_metadata (name, value)`,
+		`CREATE TABLE key_pairs (
+			key_id TEXT PRIMARY KEY,
+			location_id TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			data {blob} NOT NULL
+		)`,
+		`CREATE INDEX key_pairs_created ON key_pairs (created)`,
+	},
+	// 2: the location revision, so an update can check it is replacing the revision it read
+	{
+		`ALTER TABLE locations ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+	},
+}
+
+// migrate brings the schema up to the latest version, each version is applied in its own transaction
+func migrate(db *sql.DB, d dialect) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	for version := 1; version <= len(migrations); version++ {
+		if err := migrateTo(db, d, version); err != nil {
+			log.WithError(err).WithField("version", version).Error("Unable to migrate the keystore schema")
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateTo(db *sql.DB, d dialect, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if len(d.lockMigrations) > 0 {
+		if _, err = tx.Exec(d.lockMigrations); err != nil {
+			return err
+		}
+	}
+	var applied int
+	err = tx.QueryRow(d.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied)
+	if err != nil || applied > 0 {
+		return err
+	}
+	for _, statement := range migrations[version-1] {
+		if _, err = tx.Exec(strings.ReplaceAll(statement, "{blob}", d.blobType)); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+		return err
+	}
+	log.WithField("version", version).Info("Migrated the keystore schema")
+	return tx.Commit()
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+
+	"github.com/theotw/natssync/pkg"
+	"github.com/theotw/natssync/pkg/types"
+	"github.com/theotw/natssync/pkg/utils"
+)
+
+// sortColumns the locations column for each types.LocationQuery sort
+var sortColumns = map[string]string{
+	types.LOCATION_SORT_ID:            "location_id",
+	types.LOCATION_SORT_CREATED:       "created",
+	types.LOCATION_SORT_LAST_ROTATION: "last_keypair_rotation",
+	types.LOCATION_SORT_LAST_SEEN:     "last_seen",
+}
+
+// SQLKeyStore keeps the locations and key pairs in SQLite or PostgreSQL.  Each location is a row holding its JSON,
+// with its sort times and metadata in indexed columns so queries are answered by the database
+type SQLKeyStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// NewSQLiteKeyStore a keystore in a single SQLite file, created if it does not exist.  The driver is pure Go, so it
+// works in the CGO_ENABLED=0 builds
+func NewSQLiteKeyStore(fileName string) (*SQLKeyStore, error) {
+	dsn := fileName
+	if !strings.Contains(dsn, "?") {
+		// wait on another process' write lock rather than failing straight away
+		dsn += "?_pragma=busy_timeout(5000)"
+	}
+	db, err := sql.Open(sqliteDialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer, one connection keeps the writes of this process in line
+	db.SetMaxOpenConns(1)
+	return newSQLKeyStore(db, sqliteDialect)
+}
+
+// NewPostgresKeyStore a keystore in the PostgreSQL database of a postgres:// URL
+func NewPostgresKeyStore(url string) (*SQLKeyStore, error) {
+	db, err := sql.Open(postgresDialect.driver, url)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLKeyStore(db, postgresDialect)
+}
+
+func newSQLKeyStore(db *sql.DB, d dialect) (*SQLKeyStore, error) {
+	if err := db.Ping(); err != nil {
+		log.WithError(err).WithField("database", d.name).Error("Unable to connect to the keystore database")
+		_ = db.Close()
+		return nil, err
+	}
+	if err := migrate(db, d); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SQLKeyStore{db: db, dialect: d}, nil
+}
+
+func (s *SQLKeyStore) Close() error {
+	return s.db.Close()
+}
+
+// sortValue the time as a types.LocationQuery sort value
+func sortValue(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+// inTx runs fn in a transaction, committing if it returns nil
+func (s *SQLKeyStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLKeyStore) WriteKeyPair(locationData *types.LocationData) error {
+	keyID, err := utils.ParseUUIDv1(locationData.KeyID)
+	if err != nil {
+		return err
+	}
+	bits, err := json.Marshal(locationData)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.dialect.rebind(`INSERT INTO key_pairs (key_id, location_id, created, data) VALUES (?, ?, ?, ?)
+			ON CONFLICT (key_id) DO UPDATE SET location_id = excluded.location_id, created = excluded.created, data = excluded.data`),
+			locationData.KeyID, locationData.GetLocationID(), keyID.GetCreationTime().UnixNano(), bits)
+		return err
+	})
+}
+
+func (s *SQLKeyStore) GetExistingKeys() ([]*utils.UUIDv1, error) {
+	rows, err := s.db.Query(`SELECT key_id FROM key_pairs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]*utils.UUIDv1, 0)
+	for rows.Next() {
+		var keyID string
+		if err = rows.Scan(&keyID); err != nil {
+			return nil, err
+		}
+		key, err := utils.ParseUUIDv1(keyID)
+		if err != nil {
+			log.WithError(err).WithField("keyID", keyID).Error("failed to parse keyID")
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLKeyStore) GetLatestKeyID() (string, error) {
+	var keyID string
+	err := s.db.QueryRow(`SELECT key_id FROM key_pairs ORDER BY created DESC LIMIT 1`).Scan(&keyID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("existing keys not found")
+	}
+	return keyID, err
+}
+
+func (s *SQLKeyStore) ReadKeyPair(keyID string) (*types.LocationData, error) {
+	if keyID == "" {
+		var err error
+		if keyID, err = s.GetLatestKeyID(); err != nil {
+			return nil, err
+		}
+	}
+	var bits []byte
+	if err := s.db.QueryRow(s.dialect.rebind(`SELECT data FROM key_pairs WHERE key_id = ?`), keyID).Scan(&bits); err != nil {
+		return nil, err
+	}
+	locationData := &types.LocationData{}
+	if err := json.Unmarshal(bits, locationData); err != nil {
+		return nil, err
+	}
+	return locationData, nil
+}
+
+func (s *SQLKeyStore) RemoveKeyPair(keyID string) error {
+	if keyID == "" {
+		var err error
+		if keyID, err = s.GetLatestKeyID(); err != nil {
+			return err
+		}
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		return expectOneRow(tx.Exec(s.dialect.rebind(`DELETE FROM key_pairs WHERE key_id = ?`), keyID))
+	})
+}
+
+func (s *SQLKeyStore) LoadLocationID(keyID string) string {
+	locationData, err := s.ReadKeyPair(keyID)
+	if err != nil {
+		log.WithError(err).Error("failed to read key pair")
+		return ""
+	}
+	return locationData.GetLocationID()
+}
+
+// WriteLocation replaces the location row and its metadata rows together
+func (s *SQLKeyStore) WriteLocation(locationData types.LocationData) error {
+	bits, err := json.Marshal(&locationData)
+	if err != nil {
+		return err
+	}
+	locationID := locationData.GetLocationID()
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.dialect.rebind(`INSERT INTO locations (location_id, created, last_keypair_rotation, last_seen, data, revision) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (location_id) DO UPDATE SET created = excluded.created,
+				last_keypair_rotation = excluded.last_keypair_rotation, last_seen = excluded.last_seen, data = excluded.data,
+				revision = excluded.revision`),
+			locationID, sortValue(locationData.GetCreated()), sortValue(locationData.GetLastKeyPairRotation()),
+			sortValue(locationData.GetLastSeen()), bits, locationData.Revision)
+		if err != nil {
+			return err
+		}
+		return s.writeMetadata(tx, locationID, locationData.GetMetadata())
+	})
+}
+
+// UpdateLocation the row is only updated where it still has the revision, the database makes the check and the
+// write one step
+func (s *SQLKeyStore) UpdateLocation(locationData *types.LocationData) error {
+	updated := *locationData
+	updated.Revision++
+	bits, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	locationID := locationData.GetLocationID()
+	err = s.inTx(func(tx *sql.Tx) error {
+		err := expectOneRow(tx.Exec(s.dialect.rebind(`UPDATE locations SET created = ?, last_keypair_rotation = ?, last_seen = ?, data = ?, revision = ?
+			WHERE location_id = ? AND revision = ?`),
+			sortValue(updated.GetCreated()), sortValue(updated.GetLastKeyPairRotation()), sortValue(updated.GetLastSeen()),
+			bits, updated.Revision, locationID, locationData.Revision))
+		if err == sql.ErrNoRows {
+			return types.ErrRevisionConflict
+		}
+		if err != nil {
+			return err
+		}
+		return s.writeMetadata(tx, locationID, updated.GetMetadata())
+	})
+	if err != nil {
+		return err
+	}
+	locationData.Revision = updated.Revision
+	return nil
+}
+
+// writeMetadata replaces the metadata rows of the location
+func (s *SQLKeyStore) writeMetadata(tx *sql.Tx, locationID string, metadata map[string]string) error {
+	if _, err := tx.Exec(s.dialect.rebind(`DELETE FROM location_metadata WHERE location_id = ?`), locationID); err != nil {
+		return err
+	}
+	for name, value := range metadata {
+		_, err := tx.Exec(s.dialect.rebind(`INSERT INTO location_metadata (location_id, name, value) VALUES (?, ?, ?)`),
+			locationID, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLKeyStore) ReadLocation(locationID string) (*types.LocationData, error) {
+	var bits []byte
+	if err := s.db.QueryRow(s.dialect.rebind(`SELECT data FROM locations WHERE location_id = ?`), locationID).Scan(&bits); err != nil {
+		return nil, err
+	}
+	locationData := &types.LocationData{}
+	if err := json.Unmarshal(bits, locationData); err != nil {
+		return nil, err
+	}
+	return locationData, nil
+}
+
+func (s *SQLKeyStore) removeLocationData(locationID string, allowCloudMaster bool) error {
+	if locationID == pkg.CLOUD_ID && !allowCloudMaster {
+		log.Errorf("Removing default cloud location ID")
+		return fmt.Errorf("unable to remove cloud master location")
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(s.dialect.rebind(`DELETE FROM location_metadata WHERE location_id = ?`), locationID); err != nil {
+			return err
+		}
+		return expectOneRow(tx.Exec(s.dialect.rebind(`DELETE FROM locations WHERE location_id = ?`), locationID))
+	})
+}
+
+func (s *SQLKeyStore) RemoveLocation(locationID string) error {
+	return s.removeLocationData(locationID, false)
+}
+
+func (s *SQLKeyStore) RemoveCloudMasterData() error {
+	return s.removeLocationData(pkg.CLOUD_ID, true)
+}
+
+// expectOneRow the error of a statement, sql.ErrNoRows if it did not change a row
+func expectOneRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLKeyStore) ListKnownClients() ([]string, error) {
+	rows, err := s.db.Query(`SELECT location_id FROM locations ORDER BY location_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]string, 0)
+	for rows.Next() {
+		var locationID string
+		if err = rows.Scan(&locationID); err != nil {
+			return nil, err
+		}
+		ret = append(ret, locationID)
+	}
+	return ret, rows.Err()
+}
+
+// ListLocations filters, sorts and pages in the query, so only the page is read
+func (s *SQLKeyStore) ListLocations(query *types.LocationQuery) (*types.LocationPage, error) {
+	where, args, err := newLocationFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	direction := "ASC"
+	if query.Descending {
+		direction = "DESC"
+	}
+	order := "location_id " + direction
+	if query.SortBy != types.LOCATION_SORT_ID {
+		order = sortColumns[query.SortBy] + " " + direction + ", " + order
+	}
+	statement := "SELECT data FROM locations l"
+	if len(where) > 0 {
+		statement += " WHERE " + strings.Join(where, " AND ")
+	}
+	statement += " ORDER BY " + order
+	if query.Limit > 0 {
+		// one more than the limit says if there is a next page
+		statement += fmt.Sprintf(" LIMIT %d", query.Limit+1)
+	}
+
+	rows, err := s.db.Query(s.dialect.rebind(statement), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	locations := make([]types.LocationData, 0)
+	for rows.Next() {
+		var bits []byte
+		if err = rows.Scan(&bits); err != nil {
+			return nil, err
+		}
+		var locationData types.LocationData
+		if err = json.Unmarshal(bits, &locationData); err != nil {
+			return nil, err
+		}
+		locations = append(locations, locationData)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return types.NewLocationPage(locations, query), nil
+}
+
+// newLocationFilter the conditions for the selector and cursor of the query, each selector requirement is a sub
+// query on the metadata table.  != and notin match locations without the key, as types.Selector does
+func newLocationFilter(query *types.LocationQuery) ([]string, []interface{}, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	const hasMetadata = "EXISTS (SELECT 1 FROM location_metadata m WHERE m.location_id = l.location_id AND m.name = ?"
+	for _, req := range query.Selector {
+		args = append(args, req.Key)
+		switch req.Operator {
+		case types.SELECTOR_EQUALS:
+			where = append(where, hasMetadata+" AND m.value = ?)")
+			args = append(args, req.Values[0])
+		case types.SELECTOR_NOT_EQUALS:
+			where = append(where, "NOT "+hasMetadata+" AND m.value = ?)")
+			args = append(args, req.Values[0])
+		case types.SELECTOR_IN, types.SELECTOR_NOT_IN:
+			cond := hasMetadata + " AND m.value IN (?" + strings.Repeat(", ?", len(req.Values)-1) + "))"
+			if req.Operator == types.SELECTOR_NOT_IN {
+				cond = "NOT " + cond
+			}
+			where = append(where, cond)
+			for _, val := range req.Values {
+				args = append(args, val)
+			}
+		case types.SELECTOR_EXISTS:
+			where = append(where, hasMetadata+")")
+		case types.SELECTOR_DOES_NOT_EXIST:
+			where = append(where, "NOT "+hasMetadata+")")
+		default:
+			return nil, nil, fmt.Errorf("unsupported selector operator %s", req.Operator)
+		}
+	}
+
+	cursor, err := query.ParseCursor()
+	if err != nil {
+		return nil, nil, err
+	}
+	if cursor != nil {
+		after := ">"
+		if query.Descending {
+			after = "<"
+		}
+		if query.SortBy == types.LOCATION_SORT_ID {
+			where = append(where, "location_id "+after+" ?")
+			args = append(args, cursor.LocationID)
+		} else {
+			column := sortColumns[query.SortBy]
+			where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND location_id %[2]s ?))", column, after))
+			args = append(args, cursor.SortValue, cursor.SortValue, cursor.LocationID)
+		}
+	}
+	return where, args, nil
+}
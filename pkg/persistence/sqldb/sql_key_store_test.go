@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) The One True Way 2023. Apache License 2.0. The authors accept no liability, 0 nada for the use of this software.  It is offered "As IS"  Have fun with it!!
+ */
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theotw/natssync/pkg/persistence/keystoretest"
+	types "github.com/theotw/natssync/pkg/types"
+	_ "github.com/theotw/natssync/tests/unit"
+)
+
+func openTestStore(t *testing.T, fileName string) *SQLKeyStore {
+	store, err := NewSQLiteKeyStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestSQLiteKeyStore(t *testing.T) {
+	keystoretest.TestKeyStore(t, openTestStore(t, filepath.Join(t.TempDir(), "keystore.db")))
+}
+
+// TestSQLKeyStoreLocationMetadata the metadata rows follow the location they belong to
+func TestSQLKeyStoreLocationMetadata(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "keystore.db"))
+	locationData := types.LocationData{
+		LocationID: "foo",
+		Metadata:   map[string]string{"foo": "bar", "old": "gone"},
+	}
+	assert.Nil(t, store.WriteLocation(locationData))
+
+	// writing again replaces the metadata rows
+	locationData.Metadata = map[string]string{"foo": "bar"}
+	assert.Nil(t, store.WriteLocation(locationData))
+	var count int
+	assert.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM location_metadata WHERE name = 'old'`).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	assert.Nil(t, store.RemoveLocation("foo"))
+	assert.Equal(t, sql.ErrNoRows, store.RemoveLocation("foo"))
+	assert.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM location_metadata`).Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+// TestSQLKeyStoreListLocations the SQL query has to give the same pages as filtering in memory
+func TestSQLKeyStoreListLocations(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "keystore.db"))
+	base := time.Now()
+	locations := make([]types.LocationData, 0)
+	for i := 0; i < 12; i++ {
+		locationData := types.LocationData{
+			LocationID: fmt.Sprintf("loc-%02d", i),
+			Created:    base.Add(time.Duration(i%4) * time.Minute),
+			Metadata:   map[string]string{"site": fmt.Sprintf("site%d", i%3)},
+		}
+		if i%2 == 0 {
+			locationData.LastSeen = base.Add(time.Duration(i) * time.Second)
+			locationData.Metadata["edge"] = "true"
+		}
+		assert.Nil(t, store.WriteLocation(locationData))
+		// the JSON round trip drops the monotonic clock, compare against what comes back
+		stored, err := store.ReadLocation(locationData.LocationID)
+		assert.Nil(t, err)
+		locations = append(locations, *stored)
+	}
+
+	for _, selectorText := range []string{"", "site=site1", "site!=site1", "site in (site0,site2)", "site notin (site0)", "edge", "!edge", "edge,site=site0"} {
+		for _, sortBy := range []string{types.LOCATION_SORT_ID, types.LOCATION_SORT_CREATED, types.LOCATION_SORT_LAST_SEEN} {
+			for _, descending := range []bool{false, true} {
+				name := fmt.Sprintf("%q %s %v", selectorText, sortBy, descending)
+				selector, err := types.ParseSelector(selectorText)
+				assert.Nil(t, err, name)
+				query, err := types.NewLocationQuery(selector, sortBy, descending, 3, "")
+				assert.Nil(t, err, name)
+
+				for page := 0; page < 10; page++ {
+					expected, err := types.ApplyLocationQuery(locations, query)
+					assert.Nil(t, err, name)
+					actual, err := store.ListLocations(query)
+					if !assert.Nil(t, err, name) {
+						break
+					}
+					assert.Equal(t, locationIDs(expected.Locations), locationIDs(actual.Locations), name)
+					assert.Equal(t, expected.NextCursor, actual.NextCursor, name)
+					if len(actual.NextCursor) == 0 {
+						break
+					}
+					query.Cursor = actual.NextCursor
+				}
+			}
+		}
+	}
+}
+
+func locationIDs(locations []types.LocationData) []string {
+	ret := make([]string, 0, len(locations))
+	for _, locationData := range locations {
+		ret = append(ret, locationData.GetLocationID())
+	}
+	return ret
+}
+
+func TestSQLKeyStoreMigrations(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keystore.db")
+	store := openTestStore(t, fileName)
+	assert.Nil(t, store.WriteLocation(types.LocationData{LocationID: "foo"}))
+	assert.Nil(t, store.Close())
+
+	// opening it again finds the schema up to date and the data still there
+	store = openTestStore(t, fileName)
+	var versions int
+	assert.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&versions))
+	assert.Equal(t, len(migrations), versions)
+	clients, err := store.ListKnownClients()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, clients)
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT data FROM locations WHERE location_id = ? AND created > ?`
+	assert.Equal(t, query, sqliteDialect.rebind(query))
+	assert.Equal(t, `SELECT data FROM locations WHERE location_id = $1 AND created > $2`, postgresDialect.rebind(query))
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"errors"
 	"time"
 
 	"github.com/theotw/natssync/pkg/utils"
@@ -16,8 +17,18 @@ type LocationData struct {
 	LastModified         time.Time         `json:"lastModified" bson:"lastModified"`
 	LastKeypairRotation  time.Time         `json:"lastKeypairRotation" bson:"lastKeypairRotation"`
 	ForceKeypairRotation bool              `json:"forceKeypairRotation" bson:"forceKeypairRotation"`
+	LastSeen             time.Time         `json:"lastSeen" bson:"lastSeen"`
+	// Certificate the PEM client certificate the cloud server issued for the key pair, if it runs a client CA
+	Certificate []byte `json:"certificate,omitempty" bson:"certificate,omitempty"`
+	// PreviousPublicKeys PEM keys the location rotated away from that are still accepted for signatures
+	PreviousPublicKeys [][]byte `json:"previousPublicKeys,omitempty" bson:"previousPublicKeys,omitempty"`
+	// Revision counts the updates to a location, an update only replaces the revision it read
+	Revision int64 `json:"revision" bson:"revision"`
 }
 
+// ErrRevisionConflict the location was changed or removed since the revision being updated was read
+var ErrRevisionConflict = errors.New("the location was changed by another writer")
+
 func NewLocationData(
 	locationID string,
 	publicKey []byte,
@@ -75,6 +86,16 @@ func (l *LocationData) GetLastModified() time.Time {
 	return l.LastModified
 }
 
+// UpdateLastSeen the location made an authenticated request, this does not change LastModified
+func (l *LocationData) UpdateLastSeen() *LocationData {
+	l.LastSeen = time.Now()
+	return l
+}
+
+func (l *LocationData) GetLastSeen() time.Time {
+	return l.LastSeen
+}
+
 func (l *LocationData) UpdateCreated() *LocationData {
 	now := time.Now()
 	l.Created = now
@@ -115,6 +136,24 @@ func (l *LocationData) SetKeyPair(publicKey, privateKey []byte) *LocationData {
 	return l.UpdateLastModified().UpdateLastKeyPairRotation()
 }
 
+func (l *LocationData) GetCertificate() []byte {
+	return l.Certificate
+}
+
+func (l *LocationData) SetCertificate(certificate []byte) *LocationData {
+	l.Certificate = certificate
+	return l.UpdateLastModified()
+}
+
+func (l *LocationData) GetPreviousPublicKeys() [][]byte {
+	return l.PreviousPublicKeys
+}
+
+func (l *LocationData) SetPreviousPublicKeys(publicKeys [][]byte) *LocationData {
+	l.PreviousPublicKeys = publicKeys
+	return l.UpdateLastModified()
+}
+
 func (l *LocationData) GetMetadata() map[string]string {
 	return l.Metadata
 }
@@ -140,3 +179,7 @@ func (l *LocationData) UnsetKeyID() *LocationData {
 	l.KeyID = ""
 	return l
 }
+
+func (l *LocationData) GetRevision() int64 {
+	return l.Revision
+}
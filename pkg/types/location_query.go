@@ -0,0 +1,172 @@
+package types
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// fields locations can be sorted by, the names are the json and bson field names
+const (
+	LOCATION_SORT_ID            = "locationID"
+	LOCATION_SORT_CREATED       = "created"
+	LOCATION_SORT_LAST_ROTATION = "lastKeypairRotation"
+	LOCATION_SORT_LAST_SEEN     = "lastSeen"
+)
+
+// LocationQuery which locations to list and in what order.  Locations with the same sort value are ordered by ID
+type LocationQuery struct {
+	Selector   Selector
+	SortBy     string
+	Descending bool
+	// Limit the most locations in a page, 0 for all of them
+	Limit int
+	// Cursor the NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// LocationPage a page of locations, NextCursor is empty on the last page
+type LocationPage struct {
+	Locations  []LocationData
+	NextCursor string
+}
+
+// LocationCursor where a page ended, the sort value and ID of its last location
+type LocationCursor struct {
+	SortBy     string `json:"s"`
+	SortValue  int64  `json:"v,omitempty"`
+	LocationID string `json:"id"`
+}
+
+// NewLocationQuery checks the sort field and cursor
+func NewLocationQuery(selector Selector, sortBy string, descending bool, limit int, cursor string) (*LocationQuery, error) {
+	if len(sortBy) == 0 {
+		sortBy = LOCATION_SORT_ID
+	}
+	switch sortBy {
+	case LOCATION_SORT_ID, LOCATION_SORT_CREATED, LOCATION_SORT_LAST_ROTATION, LOCATION_SORT_LAST_SEEN:
+	default:
+		return nil, fmt.Errorf("unable to sort locations by %s", sortBy)
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("invalid limit %d", limit)
+	}
+	ret := &LocationQuery{Selector: selector, SortBy: sortBy, Descending: descending, Limit: limit, Cursor: cursor}
+	if _, err := ret.ParseCursor(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SortTime the value of a time sort field, the zero time when sorting by ID
+func (q *LocationQuery) SortTime(location *LocationData) time.Time {
+	switch q.SortBy {
+	case LOCATION_SORT_CREATED:
+		return location.GetCreated()
+	case LOCATION_SORT_LAST_ROTATION:
+		return location.GetLastKeyPairRotation()
+	case LOCATION_SORT_LAST_SEEN:
+		return location.GetLastSeen()
+	}
+	return time.Time{}
+}
+
+// SortValue the sort time as unix nanoseconds, locations that never had it set sort before all others
+func (q *LocationQuery) SortValue(location *LocationData) int64 {
+	t := q.SortTime(location)
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+// SortValueTime the time of a SortValue
+func SortValueTime(val int64) time.Time {
+	if val == math.MinInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, val)
+}
+
+// ParseCursor the cursor of the query, nil for the first page
+func (q *LocationQuery) ParseCursor() (*LocationCursor, error) {
+	if len(q.Cursor) == 0 {
+		return nil, nil
+	}
+	bits, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	ret := new(LocationCursor)
+	if err = json.Unmarshal(bits, ret); err != nil || ret.SortBy != q.SortBy {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return ret, nil
+}
+
+// NewCursor the cursor of a page that ends with the location
+func (q *LocationQuery) NewCursor(last *LocationData) string {
+	cursor := LocationCursor{SortBy: q.SortBy, LocationID: last.GetLocationID()}
+	if q.SortBy != LOCATION_SORT_ID {
+		cursor.SortValue = q.SortValue(last)
+	}
+	bits, _ := json.Marshal(&cursor)
+	return base64.RawURLEncoding.EncodeToString(bits)
+}
+
+// less true if a sorts before b
+func (q *LocationQuery) less(a, b *LocationData) bool {
+	ta, tb := q.SortValue(a), q.SortValue(b)
+	if ta != tb {
+		return (ta < tb) != q.Descending
+	}
+	return (a.GetLocationID() < b.GetLocationID()) != q.Descending
+}
+
+// afterCursor true if the location sorts after the cursor
+func (q *LocationQuery) afterCursor(location *LocationData, cursor *LocationCursor) bool {
+	if cursor == nil {
+		return true
+	}
+	var t int64
+	if q.SortBy != LOCATION_SORT_ID {
+		t = q.SortValue(location)
+	}
+	if t != cursor.SortValue {
+		return (t > cursor.SortValue) != q.Descending
+	}
+	if location.GetLocationID() == cursor.LocationID {
+		return false
+	}
+	return (location.GetLocationID() > cursor.LocationID) != q.Descending
+}
+
+// ApplyLocationQuery filters, sorts and pages locations in memory, for keystores that can not query natively
+func ApplyLocationQuery(locations []LocationData, query *LocationQuery) (*LocationPage, error) {
+	cursor, err := query.ParseCursor()
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]LocationData, 0)
+	for i := range locations {
+		if query.Selector.Matches(locations[i].GetMetadata()) && query.afterCursor(&locations[i], cursor) {
+			matched = append(matched, locations[i])
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return query.less(&matched[i], &matched[j]) })
+	return NewLocationPage(matched, query), nil
+}
+
+// NewLocationPage the page from sorted locations that are after the cursor, there is a next page if there are
+// more than the limit
+func NewLocationPage(locations []LocationData, query *LocationQuery) *LocationPage {
+	ret := &LocationPage{Locations: locations}
+	if query.Limit > 0 && len(locations) > query.Limit {
+		ret.Locations = locations[:query.Limit]
+		ret.NextCursor = query.NewCursor(&ret.Locations[query.Limit-1])
+	}
+	return ret
+}
@@ -0,0 +1,89 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLocations() []LocationData {
+	start := time.Now()
+	ret := make([]LocationData, 0)
+	for i := 0; i < 10; i++ {
+		region := "east"
+		if i%2 == 1 {
+			region = "west"
+		}
+		ret = append(ret, LocationData{
+			LocationID: fmt.Sprintf("loc%d", i),
+			Metadata:   map[string]string{"region": region},
+			// pairs of locations share a created time, so the ID breaks the tie
+			Created: start.Add(time.Duration(i/2) * time.Minute),
+		})
+	}
+	// the rest were never seen
+	ret[3].LastSeen = start
+	return ret
+}
+
+// allPages follows the cursors and returns the location IDs in order
+func allPages(t *testing.T, locations []LocationData, selector string, sortBy string, descending bool, limit int) []string {
+	parsed, err := ParseSelector(selector)
+	assert.Nil(t, err)
+	var ret []string
+	cursor := ""
+	for pages := 0; pages < 20; pages++ {
+		query, err := NewLocationQuery(parsed, sortBy, descending, limit, cursor)
+		assert.Nil(t, err)
+		page, err := ApplyLocationQuery(locations, query)
+		assert.Nil(t, err)
+		assert.True(t, limit == 0 || len(page.Locations) <= limit)
+		for _, location := range page.Locations {
+			ret = append(ret, location.LocationID)
+		}
+		if len(page.NextCursor) == 0 {
+			return ret
+		}
+		cursor = page.NextCursor
+	}
+	t.Fatal("too many pages")
+	return nil
+}
+
+func TestApplyLocationQuery(t *testing.T) {
+	locations := newTestLocations()
+
+	all := allPages(t, locations, "", "", false, 0)
+	assert.Equal(t, []string{"loc0", "loc1", "loc2", "loc3", "loc4", "loc5", "loc6", "loc7", "loc8", "loc9"}, all)
+	for _, limit := range []int{1, 3, 10} {
+		assert.Equal(t, all, allPages(t, locations, "", "", false, limit), limit)
+	}
+
+	assert.Equal(t, []string{"loc9", "loc7", "loc5", "loc3", "loc1"}, allPages(t, locations, "region=west", LOCATION_SORT_ID, true, 2))
+	assert.Equal(t, []string{"loc9", "loc8", "loc7", "loc6", "loc5", "loc4"}, allPages(t, locations, "", LOCATION_SORT_CREATED, true, 4)[:6])
+	assert.Equal(t, []string{"loc0", "loc2", "loc4", "loc6", "loc8"}, allPages(t, locations, "region in (east)", LOCATION_SORT_CREATED, false, 2))
+
+	// locations that were never seen sort first
+	lastSeen := allPages(t, locations, "", LOCATION_SORT_LAST_SEEN, false, 3)
+	assert.Len(t, lastSeen, 10)
+	assert.Equal(t, "loc3", lastSeen[9])
+}
+
+func TestNewLocationQueryInvalid(t *testing.T) {
+	_, err := NewLocationQuery(nil, "bogus", false, 0, "")
+	assert.Error(t, err)
+	_, err = NewLocationQuery(nil, "", false, -1, "")
+	assert.Error(t, err)
+	_, err = NewLocationQuery(nil, "", false, 0, "not a cursor")
+	assert.Error(t, err)
+
+	// a cursor is only good for the sort it came from
+	query, err := NewLocationQuery(nil, LOCATION_SORT_CREATED, false, 1, "")
+	assert.Nil(t, err)
+	page, err := ApplyLocationQuery(newTestLocations(), query)
+	assert.Nil(t, err)
+	_, err = NewLocationQuery(nil, LOCATION_SORT_ID, false, 1, page.NextCursor)
+	assert.Error(t, err)
+}
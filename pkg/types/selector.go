@@ -0,0 +1,141 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// selector operators, the same as Kubernetes label selectors
+const (
+	SELECTOR_EQUALS         = "="
+	SELECTOR_NOT_EQUALS     = "!="
+	SELECTOR_IN             = "in"
+	SELECTOR_NOT_IN         = "notin"
+	SELECTOR_EXISTS         = "exists"
+	SELECTOR_DOES_NOT_EXIST = "!"
+)
+
+var selectorKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+var selectorSetPattern = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// SelectorRequirement one comma separated part of a selector
+type SelectorRequirement struct {
+	Key      string
+	Operator string
+	// Values one value for = and !=, the set for in and notin
+	Values []string
+}
+
+// Selector metadata matches when it matches every requirement
+type Selector []SelectorRequirement
+
+// ParseSelector parses a Kubernetes style selector over metadata, for example
+// "region=east,tier!=test,env in (prod,staging),owner,!deprecated".  An empty selector matches everything
+func ParseSelector(selector string) (Selector, error) {
+	ret := make(Selector, 0)
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		req, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *req)
+	}
+	return ret, nil
+}
+
+// splitSelector splits on the commas that are not inside an in or notin set
+func splitSelector(selector string) []string {
+	var ret []string
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				ret = append(ret, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(ret, selector[start:])
+}
+
+func parseRequirement(part string) (*SelectorRequirement, error) {
+	ret := new(SelectorRequirement)
+	if match := selectorSetPattern.FindStringSubmatch(part); match != nil {
+		ret.Key = match[1]
+		ret.Operator = match[2]
+		for _, val := range strings.Split(match[3], ",") {
+			ret.Values = append(ret.Values, strings.TrimSpace(val))
+		}
+		sort.Strings(ret.Values)
+	} else if strings.HasPrefix(part, "!") && !strings.Contains(part, "=") {
+		ret.Key = strings.TrimSpace(part[1:])
+		ret.Operator = SELECTOR_DOES_NOT_EXIST
+	} else if i := strings.Index(part, "!="); i >= 0 {
+		ret.Key = strings.TrimSpace(part[:i])
+		ret.Operator = SELECTOR_NOT_EQUALS
+		ret.Values = []string{strings.TrimSpace(part[i+2:])}
+	} else if i := strings.Index(part, "="); i >= 0 {
+		ret.Key = strings.TrimSpace(part[:i])
+		ret.Operator = SELECTOR_EQUALS
+		ret.Values = []string{strings.TrimSpace(strings.TrimPrefix(part[i+1:], "="))}
+	} else {
+		ret.Key = part
+		ret.Operator = SELECTOR_EXISTS
+	}
+	if !selectorKeyPattern.MatchString(ret.Key) {
+		return nil, fmt.Errorf("invalid selector key in '%s'", part)
+	}
+	for _, val := range ret.Values {
+		if strings.ContainsAny(val, "=!() ") {
+			return nil, fmt.Errorf("invalid selector value in '%s'", part)
+		}
+	}
+	return ret, nil
+}
+
+// Matches true if the metadata matches every requirement
+func (s Selector) Matches(metadata map[string]string) bool {
+	for i := range s {
+		if !s[i].Matches(metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches != and notin match metadata that does not have the key, as they do in Kubernetes
+func (r *SelectorRequirement) Matches(metadata map[string]string) bool {
+	val, ok := metadata[r.Key]
+	switch r.Operator {
+	case SELECTOR_EQUALS:
+		return ok && val == r.Values[0]
+	case SELECTOR_NOT_EQUALS:
+		return !ok || val != r.Values[0]
+	case SELECTOR_IN:
+		return ok && r.hasValue(val)
+	case SELECTOR_NOT_IN:
+		return !ok || !r.hasValue(val)
+	case SELECTOR_EXISTS:
+		return ok
+	case SELECTOR_DOES_NOT_EXIST:
+		return !ok
+	}
+	return false
+}
+
+func (r *SelectorRequirement) hasValue(val string) bool {
+	i := sort.SearchStrings(r.Values, val)
+	return i < len(r.Values) && r.Values[i] == val
+}
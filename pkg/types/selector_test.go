@@ -0,0 +1,53 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("region=east, tier!=test,env in (prod, staging),owner,!deprecated,zone==a")
+	assert.Nil(t, err)
+	assert.Equal(t, Selector{
+		{Key: "region", Operator: SELECTOR_EQUALS, Values: []string{"east"}},
+		{Key: "tier", Operator: SELECTOR_NOT_EQUALS, Values: []string{"test"}},
+		{Key: "env", Operator: SELECTOR_IN, Values: []string{"prod", "staging"}},
+		{Key: "owner", Operator: SELECTOR_EXISTS},
+		{Key: "deprecated", Operator: SELECTOR_DOES_NOT_EXIST},
+		{Key: "zone", Operator: SELECTOR_EQUALS, Values: []string{"a"}},
+	}, selector)
+
+	selector, err = ParseSelector("")
+	assert.Nil(t, err)
+	assert.Empty(t, selector)
+
+	for _, bad := range []string{"=east", "region=a=b", "env in (a b)", "bad key=a", "!"} {
+		_, err = ParseSelector(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	metadata := map[string]string{"region": "east", "env": "prod", "natssync.compression": "zstd"}
+	for selector, expected := range map[string]bool{
+		"":                          true,
+		"region=east":               true,
+		"region=west":               false,
+		"region!=west":              true,
+		"missing!=west":             true,
+		"env in (prod,staging)":     true,
+		"env notin (prod,staging)":  false,
+		"missing notin (prod)":      true,
+		"missing in (prod)":         false,
+		"region":                    true,
+		"!region":                   false,
+		"!missing":                  true,
+		"natssync.compression=zstd": true,
+		"region=east,env=test":      false,
+	} {
+		parsed, err := ParseSelector(selector)
+		assert.Nil(t, err, selector)
+		assert.Equal(t, expected, parsed.Matches(metadata), selector)
+	}
+}